@@ -6,6 +6,7 @@ toolchain go1.24.5
 
 require (
 	fyne.io/fyne/v2 v2.4.5
+	github.com/fsnotify/fsnotify v1.6.0
 	github.com/luoxk/wzlib v0.0.0-00010101000000-000000000000
 )
 
@@ -13,7 +14,6 @@ require (
 	fyne.io/systray v1.10.1-0.20231115130155-104f5ef7839e // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fredbi/uri v1.0.0 // indirect
-	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/fyne-io/gl-js v0.0.0-20220119005834-d2da28d9ccfe // indirect
 	github.com/fyne-io/glfw-js v0.0.0-20220120001248-ee7290d23504 // indirect
 	github.com/fyne-io/image v0.0.0-20220602074514-4956b0afb3d2 // indirect
@@ -0,0 +1,136 @@
+// Command wzpack unpacks a WZ file to a folder tree that can be kept under
+// version control and repacks it.
+//
+//	wzpack unpack Mob.wz Mob                    # whole file
+//	wzpack unpack -img 100.img Mob.wz 100.img   # one image
+//	wzpack repack Mob Mob.wz                    # rebuild the whole file
+//	wzpack repack -into Mob.wz 100.img          # replace or add one image
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luoxk/wzlib"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "unpack":
+		err = unpack(os.Args[2:])
+	case "repack":
+		err = repack(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "wzpack:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  wzpack unpack [-version N] [-key BMS|KMS|GMS] [-img path] file.wz dir
+  wzpack repack dir file.wz
+  wzpack repack -into file.wz [-dir path] [-backup] imagedir`)
+	os.Exit(2)
+}
+
+func unpack(args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	version := fs.Int("version", 0, "client version, guessed from the header when 0")
+	key := fs.String("key", "", "key type, detected when empty")
+	img := fs.String("img", "", "unpack only the image at this path in the file")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		usage()
+	}
+
+	var opts []wzlib.Option
+	if *version > 0 {
+		opts = append(opts, wzlib.WithVersion(*version))
+	}
+	if *key != "" {
+		t, ok := map[string]wzlib.WzCryptoKeyType{"BMS": wzlib.BMS, "KMS": wzlib.KMS, "GMS": wzlib.GMS}[strings.ToUpper(*key)]
+		if !ok {
+			return fmt.Errorf("unknown key %q", *key)
+		}
+		opts = append(opts, wzlib.WithKey(t))
+	}
+	ws, err := wzlib.NewWzStructure(opts...)
+	if err != nil {
+		return err
+	}
+	if err := ws.LoadWzFile(fs.Arg(0)); err != nil {
+		return err
+	}
+	defer ws.Close()
+
+	if *img == "" {
+		return ws.WzFiles[0].Unpack(fs.Arg(1))
+	}
+	n := ws.WzNode.GetNode(*img)
+	if n == nil {
+		return fmt.Errorf("%s not found in %s", *img, fs.Arg(0))
+	}
+	return wzlib.UnpackImage(n, fs.Arg(1))
+}
+
+func repack(args []string) error {
+	fs := flag.NewFlagSet("repack", flag.ExitOnError)
+	into := fs.String("into", "", "add the image folder to this existing file instead of building a new one")
+	dir := fs.String("dir", "", "directory in the file that receives the image, the root when empty")
+	backup := fs.Bool("backup", false, "keep the original file as file.wz.bak")
+	fs.Parse(args)
+
+	if *into == "" {
+		if fs.NArg() != 2 {
+			usage()
+		}
+		return wzlib.Repack(fs.Arg(0), fs.Arg(1), wzlib.RepackOptions{})
+	}
+	if fs.NArg() != 1 {
+		usage()
+	}
+	node, err := wzlib.RepackImage(filepath.Clean(fs.Arg(0)))
+	if err != nil {
+		return err
+	}
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(*into); err != nil {
+		return err
+	}
+	defer ws.Close()
+	parent := ws.WzNode
+	if *dir != "" {
+		if parent = ws.WzNode.GetNode(*dir); parent == nil {
+			return fmt.Errorf("%s not found in %s", *dir, *into)
+		}
+	}
+
+	tx, err := ws.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if old := parent.FindChild(node.Text); old != nil {
+		if err := tx.Remove(old); err != nil {
+			return err
+		}
+	}
+	if err := tx.Add(parent, node); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return ws.WzFiles[0].Save(wzlib.SaveOptions{Backup: *backup})
+}
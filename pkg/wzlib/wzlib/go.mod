@@ -2,12 +2,4 @@ module github.com/luoxk/wzlib
 
 go 1.23.3
 
-require (
-	github.com/fastgox/utils/logger v0.0.0-20250816153919-a87da17c3389
-	golang.org/x/text v0.21.0
-)
-
-require (
-	github.com/fastgox/utils v0.0.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-)
+require golang.org/x/text v0.21.0
@@ -1,12 +1,41 @@
 package wzlib
 
 import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
 	"testing"
-
-	"github.com/fastgox/utils/logger"
 )
 
-func TestLogger(t *testing.T) {
-	logger.InitDefault()
-	logger.Info("Hello, World!")
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), false)
+	l.Debug("hidden")
+	l.Warn("checksum mismatch", "path", "Mob.wz/100.img", "odd")
+	l.Info("done")
+
+	want := "WARN checksum mismatch path=Mob.wz/100.img !BADKEY=odd\nINFO done\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	NewStdLogger(log.New(&buf, "", 0), true).Debug("shown", "n", 1)
+	if buf.String() != "DEBUG shown n=1\n" {
+		t.Fatalf("debug: got %q", buf.String())
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.NewTextHandler(&buf, nil))
+	l.Error("read failed", "file", "Mob.wz")
+	if out := buf.String(); !strings.Contains(out, "level=ERROR") ||
+		!strings.Contains(out, "component=wzlib") || !strings.Contains(out, "file=Mob.wz") {
+		t.Fatalf("unexpected record %q", out)
+	}
+
+	var ws *WzStructure
+	ws.logger().Error("dropped")
 }
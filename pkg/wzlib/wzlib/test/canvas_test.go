@@ -0,0 +1,181 @@
+package test
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+func testPixels(w, h int) []byte {
+	bgra := make([]byte, w*h*4)
+	for i := range bgra {
+		bgra[i] = byte(i*7 + i/5)
+	}
+	return bgra
+}
+
+// bgraToNRGBA 是 form 2 的期望输出
+func bgraToNRGBA(bgra []byte) []byte {
+	out := make([]byte, len(bgra))
+	for i := 0; i < len(bgra); i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = bgra[i+2], bgra[i+1], bgra[i], bgra[i+3]
+	}
+	return out
+}
+
+func canvasFixture(t *testing.T, key *wzlib.WzCryptoKey, canvases ...wzProp) *wzlib.WzStructure {
+	t.Helper()
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzSource("Map.wz", wzlib.NewBytesSource(buildWzWithKey(key, fixtureImg("0.img", canvases...)))); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func canvasAt(t *testing.T, ws *wzlib.WzStructure, path string) *wzlib.WzPng {
+	t.Helper()
+	n := ws.WzNode.GetNode(path)
+	if n == nil {
+		t.Fatalf("%s not found", path)
+	}
+	return n.Value.(*wzlib.WzPng)
+}
+
+func TestCanvasDecode(t *testing.T) {
+	bgra := testPixels(40, 24)
+	for _, tc := range []struct {
+		name string
+		key  *wzlib.WzCryptoKey
+	}{
+		{"bms", nil},
+		{"gms", wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ws := canvasFixture(t, tc.key,
+				wzProp{"plain", &fixtureCanvas{width: 40, height: 24, bgra: bgra}},
+				wzProp{"blocks", &fixtureCanvas{width: 40, height: 24, bgra: bgra, blocks: 100}},
+			)
+			for _, name := range []string{"plain", "blocks"} {
+				png := canvasAt(t, ws, "0.img/"+name)
+				raw, err := png.GetRawData()
+				if err != nil {
+					t.Fatalf("%s: GetRawData: %v", name, err)
+				}
+				if !bytes.Equal(raw, bgra) {
+					t.Fatalf("%s: raw data differs", name)
+				}
+				img, err := png.ExtractImage()
+				if err != nil {
+					t.Fatalf("%s: ExtractImage: %v", name, err)
+				}
+				if got := img.(*image.NRGBA).Pix; !bytes.Equal(got, bgraToNRGBA(bgra)) {
+					t.Fatalf("%s: pixels differ", name)
+				}
+			}
+		})
+	}
+}
+
+func TestCanvasForms(t *testing.T) {
+	raw565 := testPixels(8, 4)[:8*4*2]
+	dxt := testPixels(8, 8)[:8*8]
+	ws := canvasFixture(t, nil,
+		wzProp{"4444", &fixtureCanvas{width: 8, height: 4, form: 1, bgra: raw565}},
+		wzProp{"1555", &fixtureCanvas{width: 8, height: 4, form: 257, bgra: raw565}},
+		wzProp{"565", &fixtureCanvas{width: 8, height: 4, form: 513, bgra: raw565}},
+		wzProp{"dxt3", &fixtureCanvas{width: 8, height: 8, form: 1026, bgra: dxt}},
+		wzProp{"dxt5", &fixtureCanvas{width: 8, height: 8, form: 2050, bgra: dxt}},
+	)
+	for _, tc := range []struct {
+		name string
+		want []byte
+	}{
+		{"4444", wzlib.GetPixelDataBGRA4444(raw565, 8, 4)},
+		{"1555", wzlib.GetPixelDataARGB1555(raw565, 8, 4)},
+		{"565", wzlib.ConvertRGB565ToRGBA(raw565, 8, 4)},
+		{"dxt3", wzlib.GetPixelDataDXT3(dxt, 8, 8)},
+		{"dxt5", wzlib.GetPixelDataDXT5(dxt, 8, 8)},
+	} {
+		img, err := canvasAt(t, ws, "0.img/"+tc.name).ExtractImage()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(img.(*image.NRGBA).Pix, tc.want) {
+			t.Errorf("%s: pixels differ from the reference converter", tc.name)
+		}
+	}
+}
+
+func TestCanvasExtractInto(t *testing.T) {
+	small := testPixels(4, 4)
+	large := testPixels(16, 8)
+	ws := canvasFixture(t, nil,
+		wzProp{"small", &fixtureCanvas{width: 4, height: 4, bgra: small}},
+		wzProp{"large", &fixtureCanvas{width: 16, height: 8, bgra: large}},
+	)
+
+	dst, err := canvasAt(t, ws, "0.img/large").ExtractImageInto(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &dst.Pix[0]
+	got, err := canvasAt(t, ws, "0.img/small").ExtractImageInto(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &got.Pix[0] != buf {
+		t.Error("ExtractImageInto did not reuse a large enough buffer")
+	}
+	if got.Bounds() != image.Rect(0, 0, 4, 4) || got.Stride != 16 {
+		t.Errorf("bounds = %v, stride = %d", got.Bounds(), got.Stride)
+	}
+	if !bytes.Equal(got.Pix, bgraToNRGBA(small)) {
+		t.Error("pixels differ after reuse")
+	}
+
+	// 缓冲区不够大时重新分配
+	got, err = canvasAt(t, ws, "0.img/large").ExtractImageInto(image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	if err != nil || !bytes.Equal(got.Pix, bgraToNRGBA(large)) {
+		t.Fatalf("reallocated decode = %v", err)
+	}
+
+	var pool wzlib.ImagePool
+	for i := 0; i < 3; i++ {
+		img, err := pool.Extract(canvasAt(t, ws, "0.img/large"))
+		if err != nil || !bytes.Equal(img.Pix, bgraToNRGBA(large)) {
+			t.Fatalf("pooled decode = %v", err)
+		}
+		pool.Put(img)
+	}
+}
+
+func BenchmarkExtractCanvas(b *testing.B) {
+	ws := &wzlib.WzStructure{}
+	data := buildWz(fixtureImg("0.img", wzProp{"c", &fixtureCanvas{width: 256, height: 256, bgra: testPixels(256, 256)}}))
+	if err := ws.LoadWzSource("Map.wz", wzlib.NewBytesSource(data)); err != nil {
+		b.Fatal(err)
+	}
+	png := ws.WzNode.GetNode("0.img/c").Value.(*wzlib.WzPng)
+
+	b.Run("New", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := png.ExtractImage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Pool", func(b *testing.B) {
+		var pool wzlib.ImagePool
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			img, err := pool.Extract(png)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(img)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// writeClient 在临时目录中按相对路径写入文件，返回该目录
+func writeClient(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// checkParents 确认提取后整棵树的 ParentNode 与 Nodes 一致
+func checkParents(t *testing.T, root *wzlib.WzNode) {
+	t.Helper()
+	err := root.Walk(wzlib.WalkOptions{Extract: true}, func(n *wzlib.WzNode, depth int) error {
+		if depth == 0 && n.ParentNode != nil {
+			t.Errorf("root %s has parent %s", n.Text, n.ParentNode.Text)
+		}
+		for _, child := range n.Children() {
+			if child.ParentNode != n {
+				t.Errorf("%s: parent is %v", child.GetFullPath(), child.ParentNode)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mountClient(t *testing.T, dir string) *wzlib.WzStructure {
+	t.Helper()
+	ws := newStructure(t)
+	if err := ws.MountClient(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func TestMountClassicClient(t *testing.T) {
+	dir := writeClient(t, map[string][]byte{
+		"Mob.wz":  buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Mob2.wz": buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})),
+		"Map.wz":  buildWz(fixtureDirEntry("Map", fixtureDirEntry("Map0", fixtureImg("000010000.img", wzProp{"value", int32(10000)})))),
+		"List.wz": []byte("not a package file"),
+		"Mob.old": []byte("stale copy, not a category"),
+	})
+	if layout, _, err := wzlib.DetectClientLayout(dir); err != nil || layout != wzlib.LayoutClassic {
+		t.Fatalf("DetectClientLayout = %v, %v", layout, err)
+	}
+
+	ws := mountClient(t, dir)
+	if names := childNames(ws.WzNode); names != "Map Mob" {
+		t.Fatalf("categories = %q, want \"Map Mob\"", names)
+	}
+	for path, want := range map[string]int32{
+		"Mob/100.img/value":                100,
+		"Mob/200.img/value":                200,
+		"Map/Map/Map0/000010000.img/value": 10000,
+	} {
+		if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %d", path, n, want)
+		}
+	}
+	if got, want := ws.WzNode.GetNode("Mob/200.img").GetFullPath(), filepath.Base(dir)+"/Mob/200.img"; got != want {
+		t.Errorf("GetFullPath = %q, want %q", got, want)
+	}
+	checkParents(t, ws.WzNode)
+
+	if err := ws.MountClient(dir); !errors.Is(err, wzlib.ErrAlreadyLoaded) {
+		t.Fatalf("second mount: err = %v, want ErrAlreadyLoaded", err)
+	}
+}
+
+func TestMountDataClient(t *testing.T) {
+	dir := writeClient(t, map[string][]byte{
+		"Data/Mob/Mob.wz":     buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Data/Mob/Mob_000.wz": buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})),
+		"Data/Mob/Mob.ini":    []byte("LastWzIndex|0\n"),
+		"Data/Map/Map.wz":     buildWz(fixtureDirEntry("Map"), fixtureImg("info.img", wzProp{"value", int32(1)})),
+		"Data/Map/Map/Map.wz": buildWz(fixtureDirEntry("Map0", fixtureImg("000010000.img", wzProp{"value", int32(10000)}))),
+	})
+	layout, dataDir, err := wzlib.DetectClientLayout(dir)
+	if err != nil || layout != wzlib.LayoutData || dataDir != filepath.Join(dir, "Data") {
+		t.Fatalf("DetectClientLayout = %v, %q, %v", layout, dataDir, err)
+	}
+
+	ws := mountClient(t, dir)
+	for path, want := range map[string]int32{
+		"Mob/100.img/value":                100,
+		"Mob/200.img/value":                200,
+		"Map/info.img/value":               1,
+		"Map/Map/Map0/000010000.img/value": 10000,
+	} {
+		if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %d", path, n, want)
+		}
+	}
+	checkParents(t, ws.WzNode)
+}
+
+// Data 目录下的分类文件经 LoadFile 加载，重新挂载时同样从索引缓存恢复
+func TestMountDataClientIndexCache(t *testing.T) {
+	dir := writeClient(t, map[string][]byte{
+		"Data/Mob/Mob.wz":     buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Data/Mob/Mob_000.wz": buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})),
+		"Data/Mob/Mob.ini":    []byte("LastWzIndex|0\n"),
+		"Data/Map/Map.wz":     buildWz(fixtureDirEntry("Map")),
+		"Data/Map/Map/Map.wz": buildWz(fixtureDirEntry("Map0", fixtureImg("000010000.img", wzProp{"value", int32(10000)}))),
+	})
+	metrics := wzlib.NewExpvarMetrics("wzlib_test_data_client")
+	vars := metrics.Map()
+	cache := wzlib.NewIndexCache(t.TempDir())
+
+	var misses int64
+	for i := 0; i < 2; i++ {
+		ws := newStructure(t, wzlib.WithMetrics(metrics), wzlib.WithIndexCache(cache))
+		if err := ws.MountClient(dir); err != nil {
+			t.Fatal(err)
+		}
+		for path, want := range map[string]int32{
+			"Mob/100.img/value":                100,
+			"Mob/200.img/value":                200,
+			"Map/Map/Map0/000010000.img/value": 10000,
+		} {
+			if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+				t.Errorf("mount %d: %s = %v, want %d", i, path, n, want)
+			}
+		}
+		checkParents(t, ws.WzNode)
+		if i == 0 {
+			misses = expvarInt(vars, "cache_misses", wzlib.CacheIndex)
+			if misses != int64(len(ws.WzFiles)) || misses == 0 {
+				t.Fatalf("first mount: %d index misses for %d files", misses, len(ws.WzFiles))
+			}
+			if err := ws.SaveIndexCache(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ws.Close()
+	}
+	if got := expvarInt(vars, "cache_misses", wzlib.CacheIndex); got != misses {
+		t.Errorf("second mount missed the index cache: misses = %d, want %d", got, misses)
+	}
+	if got := expvarInt(vars, "cache_hits", wzlib.CacheIndex); got != misses {
+		t.Errorf("index hits = %d, want %d", got, misses)
+	}
+}
+
+func TestMountClientErrors(t *testing.T) {
+	if _, _, err := wzlib.DetectClientLayout(t.TempDir()); !errors.Is(err, wzlib.ErrUnknownLayout) {
+		t.Fatalf("empty dir: err = %v, want ErrUnknownLayout", err)
+	}
+
+	// 目录区被截断的文件使整个挂载失败，已打开的文件全部关闭
+	good := buildWz(fixtureImg("100.img", wzProp{"value", int32(100)}))
+	dir := writeClient(t, map[string][]byte{
+		"Etc.wz": good,
+		"Mob.wz": good[:fixtureHeaderSize+4],
+	})
+	ws := newStructure(t)
+	if err := ws.MountClient(dir); err == nil {
+		t.Fatal("mounting a truncated file succeeded")
+	}
+	if ws.WzNode != nil || len(ws.WzFiles) != 0 {
+		t.Fatalf("failed mount left root %v and %d files", ws.WzNode, len(ws.WzFiles))
+	}
+}
+
+// childNames 以空格连接 n 的子节点名称
+func childNames(n *wzlib.WzNode) string {
+	var names []string
+	for _, c := range n.Children() {
+		names = append(names, c.Text)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestMountBaseClient(t *testing.T) {
+	dir := writeClient(t, map[string][]byte{
+		"Base.wz": buildWz(
+			fixtureDirEntry("Map"), fixtureDirEntry("Mob"), fixtureDirEntry("Mob2"), fixtureDirEntry("Sound"),
+			fixtureImg("smap.img", wzProp{"value", int32(1)}),
+		),
+		"Mob.wz":    buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Mob2.wz":   buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})),
+		"Mob001.wz": buildWz(fixtureImg("8800000.img", wzProp{"value", int32(8800000)})),
+		"Map.wz":    buildWz(fixtureDirEntry("Map", fixtureDirEntry("Map0", fixtureImg("000010000.img", wzProp{"value", int32(10000)})))),
+		"Etc.wz":    buildWz(fixtureImg("Commodity.img", wzProp{"value", int32(0)})),
+		"Mob.old":   []byte("stale copy"),
+		"Mob.xml":   []byte("<xml/>"),
+	})
+	if layout, _, err := wzlib.DetectClientLayout(dir); err != nil || layout != wzlib.LayoutBase {
+		t.Fatalf("DetectClientLayout = %v, %v", layout, err)
+	}
+
+	// 第二次挂载从索引缓存恢复，分类列表应保持不变
+	cache := wzlib.NewIndexCache(t.TempDir())
+	for i := 0; i < 2; i++ {
+		ws := newStructure(t, wzlib.WithIndexCache(cache))
+		if err := ws.MountClient(dir); err != nil {
+			t.Fatal(err)
+		}
+		if !ws.HasBaseWz {
+			t.Error("HasBaseWz not set")
+		}
+		// 不在 Base.wz 中的 Etc.wz 不加载，Mob2 合并进 Mob，Sound 没有文件保持为空
+		if names := childNames(ws.WzNode); names != "smap.img Map Mob Sound" {
+			t.Fatalf("mount %d: root = %q", i, names)
+		}
+		for path, want := range map[string]int32{
+			"smap.img/value":                   1,
+			"Mob/100.img/value":                100,
+			"Mob/200.img/value":                200,
+			"Mob/8800000.img/value":            8800000,
+			"Map/Map/Map0/000010000.img/value": 10000,
+		} {
+			if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+				t.Errorf("mount %d: %s = %v, want %d", i, path, n, want)
+			}
+		}
+		checkParents(t, ws.WzNode)
+		if err := ws.SaveIndexCache(); err != nil {
+			t.Fatal(err)
+		}
+		ws.Close()
+	}
+}
+
+func TestMountDataBaseClient(t *testing.T) {
+	dir := writeClient(t, map[string][]byte{
+		"Data/Base/Base.wz":   buildWz(fixtureDirEntry("Map"), fixtureDirEntry("Mob"), fixtureImg("smap.img", wzProp{"value", int32(1)})),
+		"Data/Mob/Mob.wz":     buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Data/Mob/Mob_000.wz": buildWz(fixtureImg("8800000.img", wzProp{"value", int32(8800000)})),
+		"Data/Map/Map.wz":     buildWz(fixtureDirEntry("Map")),
+		"Data/Map/Map/Map.wz": buildWz(fixtureDirEntry("Map0", fixtureImg("000010000.img", wzProp{"value", int32(10000)}))),
+	})
+
+	ws := mountClient(t, dir)
+	if names := childNames(ws.WzNode); names != "smap.img Map Mob" {
+		t.Fatalf("root = %q", names)
+	}
+	for path, want := range map[string]int32{
+		"smap.img/value":                   1,
+		"Mob/8800000.img/value":            8800000,
+		"Map/Map/Map0/000010000.img/value": 10000,
+	} {
+		if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %d", path, n, want)
+		}
+	}
+	checkParents(t, ws.WzNode)
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// trackingSource 记录 Close 调用次数
+type trackingSource struct {
+	wzlib.WzSource
+	closes int
+}
+
+func (s *trackingSource) Close() error {
+	s.closes++
+	return s.WzSource.Close()
+}
+
+func TestStructureClose(t *testing.T) {
+	src := &trackingSource{WzSource: wzlib.NewBytesSource(sampleFixture())}
+	cache := wzlib.NewImageCache(0, 0)
+	ws := &wzlib.WzStructure{ImageCache: cache}
+	if err := ws.LoadWzSource("Mob.wz", src); err != nil {
+		t.Fatal(err)
+	}
+	info := ws.WzNode.GetNode("100.img/info")
+	canvas := ws.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng)
+
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.Close(); err != nil || src.closes != 1 {
+		t.Fatalf("second Close = %v, source closed %d times", err, src.closes)
+	}
+	if !ws.WzFiles[0].Closed() {
+		t.Fatal("Closed() = false")
+	}
+	if cache.Len() != 0 {
+		t.Fatalf("cache still holds %d images of the closed file", cache.Len())
+	}
+
+	// 已提取的节点仍可使用
+	if n := info.FindChild("name"); n == nil || n.Value != "snail" {
+		t.Fatalf("info/name after Close = %v", n)
+	}
+	// 需要读取文件的操作返回 ErrClosed
+	if _, err := canvas.ExtractImage(); !errors.Is(err, wzlib.ErrClosed) {
+		t.Fatalf("ExtractImage err = %v, want ErrClosed", err)
+	}
+	img := ws.WzNode.FindChild("200.img").Value.(*wzlib.WzImage)
+	if err := img.TryExtract(); !errors.Is(err, wzlib.ErrClosed) {
+		t.Fatalf("TryExtract err = %v, want ErrClosed", err)
+	}
+	if n := ws.WzNode.GetNode("200.img/info/level"); n != nil {
+		t.Fatalf("GetNode after Close = %v", n)
+	}
+}
+
+func TestCloseMergedFiles(t *testing.T) {
+	open := func(name string, data []byte) (*wzlib.WzStructure, *trackingSource) {
+		src := &trackingSource{WzSource: wzlib.NewBytesSource(data)}
+		ws := &wzlib.WzStructure{}
+		if err := ws.LoadWzSource(name, src); err != nil {
+			t.Fatal(err)
+		}
+		ws.WzFiles[0].Node = ws.WzNode
+		return ws, src
+	}
+	entry, entrySrc := open("Map.wz", buildWz(fixtureImg("0.img", wzProp{"v", int32(0)})))
+	extra, extraSrc := open("Map_000.wz", buildWz(fixtureImg("1.img", wzProp{"v", int32(1)})))
+	entry.WzFiles[0].MergeWzFile(extra.WzFiles[0])
+
+	if n := entry.WzNode.GetNode("1.img/v"); n == nil || n.Value != int32(1) {
+		t.Fatalf("merged 1.img/v = %v", n)
+	}
+	if err := entry.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if entrySrc.closes != 1 || extraSrc.closes != 1 {
+		t.Fatalf("closes = %d, %d; want 1, 1", entrySrc.closes, extraSrc.closes)
+	}
+}
+
+func TestLoadFailureDropsFile(t *testing.T) {
+	data := sampleFixture()
+	path := writeFixture(t, "Mob.wz", data[:fixtureHeaderSize+12])
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(ws.WzFiles) != 0 {
+		t.Fatalf("failed load left %d files in the structure", len(ws.WzFiles))
+	}
+
+	// LoadFile（data 目录的挂载也经过它）同样不留下失败的文件
+	if _, err := ws.LoadFile(path, wzlib.NewWzNode("Mob"), false, false); err == nil {
+		t.Fatal("LoadFile: expected error")
+	}
+	if len(ws.WzFiles) != 0 {
+		t.Fatalf("failed LoadFile left %d files in the structure", len(ws.WzFiles))
+	}
+}
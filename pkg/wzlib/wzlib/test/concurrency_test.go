@@ -0,0 +1,115 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// 用 go test -race 运行时可以发现提取过程中的数据竞争。
+
+func concurrentFixture() []byte {
+	pixels := make([]byte, 8*8*4)
+	for i := range pixels {
+		pixels[i] = byte(i)
+	}
+	var entries []fixtureEntry
+	for i := 0; i < 16; i++ {
+		entries = append(entries, fixtureImg(fmt.Sprintf("%d.img", i),
+			// 较长的字符串迫使密钥流在读取时扩展
+			wzProp{"name", strings.Repeat(fmt.Sprintf("mob%d-", i), 40)},
+			wzProp{"level", int32(i)},
+			wzProp{"frames", []wzProp{
+				{"0", &fixtureCanvas{width: 8, height: 8, bgra: pixels}},
+				{"1", &fixtureCanvas{width: 8, height: 8, bgra: pixels}},
+			}},
+		))
+	}
+	// 使用独立的密钥实例写入，避免预先扩展 GmsCryptoKey
+	return buildWzWithKey(wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b}), entries...)
+}
+
+func TestConcurrentExtract(t *testing.T) {
+	data := concurrentFixture()
+	ws := loadFixture(t, data)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 16; i++ {
+				name := fmt.Sprintf("%d.img", (i+g)%16)
+				img := ws.WzNode.FindChild(name).Value.(*wzlib.WzImage)
+				if err := img.TryExtract(); err != nil {
+					t.Error(err)
+					return
+				}
+				n := ws.WzNode.GetNode(name + "/level")
+				if n == nil || n.Value != int32((i+g)%16) {
+					t.Errorf("%s/level = %v", name, n)
+					return
+				}
+				if n := ws.WzNode.GetNode(name + "/name"); n == nil || !strings.HasPrefix(n.Value.(string), "mob") {
+					t.Errorf("%s/name = %v", name, n)
+					return
+				}
+				png := ws.WzNode.GetNode(name + "/frames/0").Value.(*wzlib.WzPng)
+				if _, err := png.ExtractImage(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 16; i++ {
+		img := ws.WzNode.FindChild(fmt.Sprintf("%d.img", i)).Value.(*wzlib.WzImage)
+		if !img.IsExtracted() {
+			t.Errorf("%d.img not extracted", i)
+		}
+		if got := len(img.Node.Nodes); got != 3 {
+			t.Errorf("%d.img has %d children, want 3", i, got)
+		}
+	}
+}
+
+func TestConcurrentSoundCopy(t *testing.T) {
+	data := concurrentFixture()
+	ws := loadFixture(t, data)
+	img := ws.WzNode.FindChild("3.img").Value.(*wzlib.WzImage)
+	want := data[img.Offset : img.Offset+int64(img.Size)]
+
+	// 将 img 的原始数据当作 MP3 读取，验证各个读取方互不影响读取位置
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 32; i++ {
+				off := (g*7 + i) % (img.Size / 2)
+				sound := &wzlib.WzSound{
+					Offset:     uint32(off),
+					DataLength: img.Size / 2,
+					MediaType:  &wzlib.AMMediaType{MajorType: "Stream", SubType: "MPEG1Audio"},
+					WzImage:    img,
+				}
+				got, err := sound.ExtractSound()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, want[off:off+img.Size/2]) {
+					t.Errorf("sound at %d returned wrong bytes", off)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
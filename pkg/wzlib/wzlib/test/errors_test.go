@@ -0,0 +1,143 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+func loadFixture(t *testing.T, data []byte) *wzlib.WzStructure {
+	t.Helper()
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatalf("load fixture: %v", err)
+	}
+	return ws
+}
+
+func TestFixtureLoads(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	node := ws.WzNode.GetNode("100.img/info/name")
+	if node == nil || node.Value != "snail" {
+		t.Fatalf("100.img/info/name = %v", node)
+	}
+	if n := ws.WzNode.GetNode("Sub/Deep/400.img/value"); n == nil || n.Value != "deep" {
+		t.Fatalf("Sub/Deep/400.img/value = %v", n)
+	}
+}
+
+// 只有一个 img 的文件，img 数据紧跟在顶层目录表之后
+func TestDirEndPosition(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", buildWz(fixtureImg("1.img", wzProp{"v", int32(1)})))
+	cache := wzlib.NewIndexCache(t.TempDir())
+	for i, load := range []func(ws *wzlib.WzStructure) error{
+		func(ws *wzlib.WzStructure) error { return ws.LoadWzFile(path) },
+		func(ws *wzlib.WzStructure) error { return ws.LoadWzFile(path) }, // 从索引缓存恢复
+		func(ws *wzlib.WzStructure) error {
+			_, err := ws.LoadFile(path, wzlib.NewWzNode("Mob"), false, false)
+			return err
+		},
+	} {
+		ws := &wzlib.WzStructure{IndexCache: cache}
+		if err := load(ws); err != nil {
+			t.Fatal(err)
+		}
+		wf := ws.WzFiles[0]
+		img := wf.Node.FindChild("1.img").Value.(*wzlib.WzImage)
+		if end := wf.Header.DirEndPosition; end <= wf.Header.DataStartPosition || end != img.Offset {
+			t.Errorf("load %d: DirEndPosition = %d, want %d", i, end, img.Offset)
+		}
+		if err := ws.SaveIndexCache(); err != nil {
+			t.Fatal(err)
+		}
+		ws.Close()
+	}
+}
+
+func TestErrorBadSignature(t *testing.T) {
+	data := sampleFixture()
+	copy(data, "XXXX")
+	_, err := wzlib.NewWzFile(writeFixture(t, "Bad.wz", data))
+	if !errors.Is(err, wzlib.ErrBadSignature) {
+		t.Fatalf("err = %v, want ErrBadSignature", err)
+	}
+	_, err = wzlib.NewWzFileFromSource("Bad.wz", wzlib.NewBytesSource(data))
+	if !errors.Is(err, wzlib.ErrBadSignature) {
+		t.Fatalf("err = %v, want ErrBadSignature", err)
+	}
+	var sigErr *wzlib.SignatureError
+	if !errors.As(err, &sigErr) || string(sigErr.Signature) != "XXXX" {
+		t.Fatalf("errors.As SignatureError failed: %v", err)
+	}
+}
+
+func TestErrorNoKeyMatched(t *testing.T) {
+	ws := &wzlib.WzStructure{}
+	err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(buildWz(fixtureImg("bad name!", wzProp{"x", int32(1)}))))
+	if !errors.Is(err, wzlib.ErrNoKeyMatched) {
+		t.Fatalf("err = %v, want ErrNoKeyMatched", err)
+	}
+}
+
+func TestErrorTruncatedDirectory(t *testing.T) {
+	data := sampleFixture()
+	ws := &wzlib.WzStructure{}
+	err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data[:fixtureHeaderSize+12]))
+	if !errors.Is(err, wzlib.ErrTruncated) {
+		t.Fatalf("err = %v, want ErrTruncated", err)
+	}
+	var wzErr *wzlib.WzError
+	if !errors.As(err, &wzErr) || wzErr.Offset < fixtureHeaderSize {
+		t.Fatalf("missing location: %v", err)
+	}
+}
+
+func TestErrorChecksumMismatch(t *testing.T) {
+	data := sampleFixture()
+	ws := loadFixture(t, data)
+	img := ws.WzNode.FindChild("200.img").Value.(*wzlib.WzImage)
+	data[img.Offset+int64(img.Size)-1] ^= 0xFF
+
+	err := img.TryExtract()
+	var sumErr *wzlib.ChecksumError
+	if !errors.Is(err, wzlib.ErrChecksumMismatch) || !errors.As(err, &sumErr) {
+		t.Fatalf("err = %v, want ChecksumError", err)
+	}
+	if sumErr.Expected != img.Checksum {
+		t.Errorf("Expected = %d, want %d", sumErr.Expected, img.Checksum)
+	}
+	var wzErr *wzlib.WzError
+	if !errors.As(err, &wzErr) || wzErr.Path != "Mob.wz/200.img" || wzErr.Offset != img.Offset {
+		t.Fatalf("location = %+v", wzErr)
+	}
+}
+
+func TestErrorUnknownFlag(t *testing.T) {
+	ws := loadFixture(t, buildWz(fixtureImg("1.img",
+		wzProp{"ok", int32(1)},
+		wzProp{"info", []wzProp{{"broken", rawProp{0x42}}}},
+	)))
+	err := ws.WzNode.FindChild("1.img").Value.(*wzlib.WzImage).TryExtract()
+	var flagErr *wzlib.UnknownFlagError
+	if !errors.Is(err, wzlib.ErrUnknownFlag) || !errors.As(err, &flagErr) || flagErr.Flag != 0x42 {
+		t.Fatalf("err = %v, want UnknownFlagError 0x42", err)
+	}
+	var wzErr *wzlib.WzError
+	if !errors.As(err, &wzErr) || wzErr.Path != "Mob.wz/1.img/info/broken" {
+		t.Fatalf("location = %+v", wzErr)
+	}
+}
+
+func TestErrorUnknownTag(t *testing.T) {
+	w := &fixtureWriter{}
+	w.object("Mystery", func(*fixtureWriter) {})
+	body := w.Bytes()
+	raw := append([]byte{0x09, byte(len(body)), 0, 0, 0}, body...)
+	ws := loadFixture(t, buildWz(fixtureImg("1.img", wzProp{"odd", rawProp(raw)})))
+	err := ws.WzNode.FindChild("1.img").Value.(*wzlib.WzImage).TryExtract()
+	var tagErr *wzlib.UnknownTagError
+	if !errors.Is(err, wzlib.ErrUnknownTag) || !errors.As(err, &tagErr) || tagErr.Tag != "Mystery" {
+		t.Fatalf("err = %v, want UnknownTagError", err)
+	}
+}
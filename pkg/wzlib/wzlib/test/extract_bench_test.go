@@ -0,0 +1,77 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+var (
+	benchFixtureOnce sync.Once
+	benchFixtureData []byte
+)
+
+// benchFixture 生成一个较大的 WZ：200 个 img，每个含大量字符串、数值与画布。
+func benchFixture() []byte {
+	benchFixtureOnce.Do(func() {
+		pixels := make([]byte, 32*32*4)
+		for i := range pixels {
+			pixels[i] = byte(i * 13)
+		}
+		var images []fixtureEntry
+		for i := 0; i < 200; i++ {
+			var props []wzProp
+			for j := 0; j < 50; j++ {
+				props = append(props, wzProp{fmt.Sprintf("%d", j), []wzProp{
+					{"name", fmt.Sprintf("string entry %d of image %d", j, i)},
+					{"desc", "#cA somewhat longer description text that String.wz is full of.#k"},
+					{"value", int32(i * j)},
+					{"ratio", float32(j) / 4},
+				}})
+			}
+			props = append(props, wzProp{"icon", &fixtureCanvas{width: 32, height: 32, bgra: pixels}})
+			images = append(images, fixtureImg(fmt.Sprintf("%07d.img", i), props...))
+		}
+		benchFixtureData = buildWzWithKey(wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b}), images...)
+	})
+	return benchFixtureData
+}
+
+// extractAll 提取全部 img 并解码所有画布
+func extractAll(b *testing.B, ws *wzlib.WzStructure) {
+	for _, child := range ws.WzNode.Nodes {
+		img := child.Value.(*wzlib.WzImage)
+		if err := img.TryExtract(); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := img.Node.FindChild("icon").Value.(*wzlib.WzPng).GetRawData(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkExtractAll(b *testing.B, load func(ws *wzlib.WzStructure, path string) error) {
+	data := benchFixture()
+	path := writeFixture(b, "String.wz", data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ws := &wzlib.WzStructure{}
+		if err := load(ws, path); err != nil {
+			b.Fatal(err)
+		}
+		extractAll(b, ws)
+		ws.Close()
+	}
+}
+
+func BenchmarkExtractAllFile(b *testing.B) {
+	benchmarkExtractAll(b, (*wzlib.WzStructure).LoadWzFile)
+}
+
+func BenchmarkExtractAllMmap(b *testing.B) {
+	benchmarkExtractAll(b, (*wzlib.WzStructure).LoadWzFileMmap)
+}
@@ -0,0 +1,459 @@
+package test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// 测试用的 WZ 文件构造器：生成小型 WZ 文件（默认 BMS 即不加密），不依赖本地游戏数据。
+
+const fixtureHeaderSize = 0x3C
+
+// fixtureEntry 是目录中的一项：子目录（isDir）或 img。
+type fixtureEntry struct {
+	name    string
+	isDir   bool
+	entries []fixtureEntry // 子目录内容
+	props   []wzProp       // img 内容
+}
+
+// wzProp 是 img 中的一个属性，value 的类型决定编码方式：
+// nil、int16、int32、int64、float32、float64、string、[]wzProp（子 Property）、
+// image.Point（向量）、*fixtureCanvas、*fixtureSound、fixtureUOL、fixtureUTF16，rawProp 原样写入类型字节之后的内容。
+type wzProp struct {
+	name  string
+	value any
+}
+
+type fixtureCanvas struct {
+	width, height int
+	form          int    // 像素格式，0 表示 2（BGRA8888）
+	bgra          []byte // 解压后的原始像素，form 2 时每像素 4 字节 BGRA
+	props         []wzProp
+	blocks        int // 大于 0 时按分块加密格式写入，每块最多 blocks 字节
+}
+
+type fixtureUOL string
+
+// fixtureUTF16 是按 UTF-16LE 编码写入的字符串属性
+type fixtureUTF16 string
+
+// fixtureSound 是 Sound_DX8 音频，format 为 WAVEFORMATEX
+type fixtureSound struct {
+	ms      int
+	format  []byte
+	encrypt bool // 用密钥加密 format
+	data    []byte
+}
+
+// mp3Format 返回 MPEGLAYER3WAVEFORMAT 格式头
+func mp3Format() []byte {
+	var b bytes.Buffer
+	for _, v := range []any{uint16(0x55), uint16(2), uint32(44100), uint32(16000), uint16(1), uint16(0), uint16(12),
+		uint16(1), uint32(2), uint16(522), uint16(1), uint16(1393)} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+type rawProp []byte
+
+func fixtureDirEntry(name string, entries ...fixtureEntry) fixtureEntry {
+	return fixtureEntry{name: name, isDir: true, entries: entries}
+}
+
+func fixtureImg(name string, props ...wzProp) fixtureEntry {
+	return fixtureEntry{name: name, props: props}
+}
+
+// fixtureVersion returns the version and hash the ordinal detector will settle on.
+func fixtureVersion() (encVer int, hash uint32) {
+	enc := func(v int) int {
+		sum := wzlib.CalcHashVersion(v)
+		return 0xff ^ ((sum >> 24) & 0xFF) ^ ((sum >> 16) & 0xFF) ^ ((sum >> 8) & 0xFF) ^ (sum & 0xFF)
+	}
+	encVer = enc(83)
+	for v := 0; ; v++ {
+		if enc(v) == encVer {
+			return encVer, uint32(wzlib.CalcHashVersion(v))
+		}
+	}
+}
+
+type fixtureWriter struct {
+	bytes.Buffer
+	key *wzlib.WzCryptoKey // 字符串加密密钥，nil 表示不加密
+}
+
+func (w *fixtureWriter) compressedInt(v int32) {
+	if v > -128 && v <= 127 {
+		w.WriteByte(byte(int8(v)))
+		return
+	}
+	w.WriteByte(0x80)
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *fixtureWriter) compressedLong(v int64) {
+	if v > -128 && v <= 127 {
+		w.WriteByte(byte(int8(v)))
+		return
+	}
+	w.WriteByte(0x80)
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *fixtureWriter) str(s string) {
+	if len(s) == 0 {
+		w.WriteByte(0)
+		return
+	}
+	if len(s) < 128 {
+		w.WriteByte(byte(int8(-len(s))))
+	} else {
+		w.WriteByte(0x80)
+		binary.Write(w, binary.LittleEndian, int32(len(s)))
+	}
+	mask := byte(0xAA)
+	for i := 0; i < len(s); i++ {
+		b := s[i] ^ mask
+		if w.key != nil {
+			k, _ := w.key.GetKey(i)
+			b ^= k
+		}
+		w.WriteByte(b)
+		mask++
+	}
+}
+
+// wstr 按 UTF-16LE 写入字符串：正的长度按字符数计，127 及以上写 127 再跟 int32 长度，
+// 每个字符异或从 0xAAAA 递增的掩码，密钥按字节加密
+func (w *fixtureWriter) wstr(s string) {
+	var units []uint16
+	for _, r := range s {
+		if r > 0xFFFF {
+			r -= 0x10000
+			units = append(units, uint16(0xD800+r>>10), uint16(0xDC00+r&0x3FF))
+		} else {
+			units = append(units, uint16(r))
+		}
+	}
+	if len(units) < 127 {
+		w.WriteByte(byte(len(units)))
+	} else {
+		w.WriteByte(127)
+		binary.Write(w, binary.LittleEndian, int32(len(units)))
+	}
+	mask := uint16(0xAAAA)
+	for i, u := range units {
+		u ^= mask
+		b := []byte{byte(u), byte(u >> 8)}
+		if w.key != nil {
+			for j := range b {
+				k, _ := w.key.GetKey(i*2 + j)
+				b[j] ^= k
+			}
+		}
+		w.Write(b)
+		mask++
+	}
+}
+
+func (w *fixtureWriter) object(tag string, body func(*fixtureWriter)) {
+	w.WriteByte(0x73)
+	w.str(tag)
+	body(w)
+}
+
+func (w *fixtureWriter) properties(props []wzProp) {
+	w.Write([]byte{0, 0})
+	w.compressedInt(int32(len(props)))
+	for _, p := range props {
+		w.WriteByte(0x00)
+		w.str(p.name)
+		w.value(p.value)
+	}
+}
+
+func (w *fixtureWriter) value(v any) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0x00)
+	case int16:
+		w.WriteByte(0x02)
+		binary.Write(w, binary.LittleEndian, v)
+	case int32:
+		w.WriteByte(0x03)
+		w.compressedInt(v)
+	case int64:
+		w.WriteByte(0x14)
+		w.compressedLong(v)
+	case float32:
+		w.WriteByte(0x04)
+		if v == float32(int8(v)) && v != -128 {
+			w.WriteByte(byte(int8(v)))
+		} else {
+			w.WriteByte(0x80)
+			binary.Write(w, binary.LittleEndian, math.Float32bits(v))
+		}
+	case float64:
+		w.WriteByte(0x05)
+		binary.Write(w, binary.LittleEndian, v)
+	case string:
+		w.WriteByte(0x08)
+		w.WriteByte(0x00)
+		w.str(v)
+	case fixtureUTF16:
+		w.WriteByte(0x08)
+		w.WriteByte(0x00)
+		w.wstr(string(v))
+	case rawProp:
+		w.Write(v)
+	default:
+		sub := &fixtureWriter{key: w.key}
+		sub.subObject(v)
+		w.WriteByte(0x09)
+		binary.Write(w, binary.LittleEndian, int32(sub.Len()))
+		w.Write(sub.Bytes())
+	}
+}
+
+func (w *fixtureWriter) subObject(v any) {
+	switch v := v.(type) {
+	case []wzProp:
+		w.object("Property", func(w *fixtureWriter) { w.properties(v) })
+	case image.Point:
+		w.object("Shape2D#Vector2D", func(w *fixtureWriter) {
+			w.compressedInt(int32(v.X))
+			w.compressedInt(int32(v.Y))
+		})
+	case fixtureUOL:
+		w.object("UOL", func(w *fixtureWriter) {
+			w.WriteByte(0)
+			w.WriteByte(0x00)
+			w.str(string(v))
+		})
+	case *fixtureSound:
+		w.object("Sound_DX8", func(w *fixtureWriter) {
+			w.WriteByte(0)
+			w.compressedInt(int32(len(v.data)))
+			w.compressedInt(int32(v.ms))
+			w.WriteByte(0x02)
+			w.Write([]byte{0x83, 0xEB, 0x36, 0xE4, 0x4F, 0x52, 0xCE, 0x11, 0x9F, 0x53, 0x00, 0x20, 0xAF, 0x0B, 0xA7, 0x70})
+			w.Write([]byte{0x8B, 0xEB, 0x36, 0xE4, 0x4F, 0x52, 0xCE, 0x11, 0x9F, 0x53, 0x00, 0x20, 0xAF, 0x0B, 0xA7, 0x70})
+			w.Write([]byte{0x00, 0x01})
+			w.Write([]byte{0x81, 0x9F, 0x58, 0x05, 0x56, 0xC3, 0xCE, 0x11, 0xBF, 0x01, 0x00, 0xAA, 0x00, 0x55, 0x59, 0x5A})
+			format := append([]byte(nil), v.format...)
+			if v.encrypt && w.key != nil {
+				w.key.Decrypt(format, 0, len(format))
+			}
+			w.WriteByte(byte(len(format)))
+			w.Write(format)
+			w.Write(v.data)
+		})
+	case *fixtureCanvas:
+		w.object("Canvas", func(w *fixtureWriter) {
+			w.WriteByte(0)
+			if len(v.props) > 0 {
+				w.WriteByte(1)
+				w.properties(v.props)
+			} else {
+				w.WriteByte(0)
+			}
+			form := v.form
+			if form == 0 {
+				form = 2
+			}
+			w.compressedInt(int32(v.width))
+			w.compressedInt(int32(v.height))
+			w.compressedInt(int32(form - form&0xFF))
+			w.WriteByte(byte(form & 0xFF))
+			w.Write([]byte{0, 0, 0, 0})
+			var z bytes.Buffer
+			zw := zlib.NewWriter(&z)
+			zw.Write(v.bgra)
+			zw.Close()
+			payload := z.Bytes()
+			if v.blocks > 0 {
+				payload = encryptBlocks(w.key, payload, v.blocks)
+			}
+			binary.Write(w, binary.LittleEndian, int32(len(payload)+1))
+			w.WriteByte(0)
+			w.Write(payload)
+		})
+	default:
+		panic("fixture: unsupported property value")
+	}
+}
+
+// encryptBlocks 将 zlib 数据切成块，每块前写 int32 长度并从密钥流开头加密
+func encryptBlocks(key *wzlib.WzCryptoKey, data []byte, blockSize int) []byte {
+	var out bytes.Buffer
+	for len(data) > 0 {
+		n := min(blockSize, len(data))
+		block := append([]byte(nil), data[:n]...)
+		if key != nil {
+			key.Decrypt(block, 0, n)
+		}
+		binary.Write(&out, binary.LittleEndian, int32(n))
+		out.Write(block)
+		data = data[n:]
+	}
+	return out.Bytes()
+}
+
+func encodeFixtureImage(key *wzlib.WzCryptoKey, props []wzProp) []byte {
+	w := &fixtureWriter{key: key}
+	w.object("Property", func(w *fixtureWriter) { w.properties(props) })
+	return w.Bytes()
+}
+
+// buildWz 生成包含给定目录树的完整 WZ 文件内容。
+func buildWz(entries ...fixtureEntry) []byte {
+	return buildWzWithKey(nil, entries...)
+}
+
+// buildWzWithKey 与 buildWz 相同，但用 key 加密所有字符串。
+func buildWzWithKey(key *wzlib.WzCryptoKey, entries ...fixtureEntry) []byte {
+	encVer, hash := fixtureVersion()
+	return buildWzVersion(key, encVer, hash, entries...)
+}
+
+// buildWzVersion 用给定的加密版本号与哈希版本生成 WZ 文件，用于测试版本检测。
+func buildWzVersion(key *wzlib.WzCryptoKey, encVer int, hash uint32, entries ...fixtureEntry) []byte {
+
+	type pending struct {
+		hashPos int // 在 dir 区域内的位置
+		dir     *fixtureEntry
+		img     int // 在 images 中的下标
+	}
+	dirArea := fixtureWriter{key: key}
+	var images [][]byte
+	var fixups []pending
+	dirStart := map[*fixtureEntry]int{}
+
+	var writeDir func(entries []fixtureEntry)
+	writeDir = func(entries []fixtureEntry) {
+		dirArea.compressedInt(int32(len(entries)))
+		var subdirs []*fixtureEntry
+		for i := range entries {
+			e := &entries[i]
+			if e.isDir {
+				dirArea.WriteByte(0x03)
+				dirArea.str(e.name)
+				dirArea.compressedInt(0)
+				dirArea.compressedInt(0)
+				fixups = append(fixups, pending{hashPos: dirArea.Len(), dir: e, img: -1})
+				subdirs = append(subdirs, e)
+			} else {
+				data := encodeFixtureImage(key, e.props)
+				sum := 0
+				for _, b := range data {
+					sum += int(b)
+				}
+				dirArea.WriteByte(0x04)
+				dirArea.str(e.name)
+				dirArea.compressedInt(int32(len(data)))
+				dirArea.compressedInt(int32(sum))
+				fixups = append(fixups, pending{hashPos: dirArea.Len(), img: len(images)})
+				images = append(images, data)
+			}
+			dirArea.Write([]byte{0, 0, 0, 0})
+		}
+		for _, d := range subdirs {
+			dirStart[d] = dirArea.Len()
+			writeDir(d.entries)
+		}
+	}
+	writeDir(entries)
+
+	dataStart := fixtureHeaderSize + 2
+	imgStart := make([]int, len(images))
+	pos := dataStart + dirArea.Len()
+	for i, data := range images {
+		imgStart[i] = pos
+		pos += len(data)
+	}
+
+	dir := dirArea.Bytes()
+	for _, f := range fixups {
+		target := 0
+		if f.dir != nil {
+			target = dataStart + dirStart[f.dir]
+		} else {
+			target = imgStart[f.img]
+		}
+		filePos := uint32(dataStart + f.hashPos)
+		off := (filePos - 0x3C) ^ 0xFFFFFFFF
+		off *= hash
+		off -= 0x581C3F6D
+		off = bits.RotateLeft32(off, int(off&0x1F))
+		binary.LittleEndian.PutUint32(dir[f.hashPos:], off^(uint32(target)-0x78))
+	}
+
+	var out fixtureWriter
+	out.WriteString("PKG1")
+	binary.Write(&out, binary.LittleEndian, int64(pos-fixtureHeaderSize))
+	binary.Write(&out, binary.LittleEndian, int32(fixtureHeaderSize))
+	copyright := make([]byte, fixtureHeaderSize-out.Len())
+	copy(copyright, "Package file v1.0 Copyright 2002 Wizet, ZMS")
+	out.Write(copyright)
+	binary.Write(&out, binary.LittleEndian, int16(encVer))
+	out.Write(dir)
+	for _, data := range images {
+		out.Write(data)
+	}
+	return out.Bytes()
+}
+
+// writeFixture 将 WZ 内容写入临时目录并返回文件路径。
+func writeFixture(t testing.TB, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sampleFixture 是大多数测试共用的目录树。
+func sampleFixture() []byte {
+	pixels := make([]byte, 4*4*4)
+	for i := range pixels {
+		pixels[i] = byte(i * 3)
+	}
+	return buildWz(
+		fixtureImg("100.img",
+			wzProp{"info", []wzProp{
+				{"name", "snail"},
+				{"level", int32(1)},
+				{"speed", int16(-30)},
+				{"exp", int64(1 << 40)},
+				{"rate", float32(0.5)},
+				{"ratio", float64(1.25)},
+				{"empty", nil},
+			}},
+			wzProp{"stand", []wzProp{
+				{"0", &fixtureCanvas{width: 4, height: 4, bgra: pixels, props: []wzProp{
+					{"origin", image.Pt(2, 4)},
+					{"delay", int32(120)},
+				}}},
+				{"1", fixtureUOL("0")},
+			}},
+		),
+		fixtureImg("200.img", wzProp{"info", []wzProp{{"level", int32(2)}}}),
+		fixtureDirEntry("Sub",
+			fixtureImg("300.img", wzProp{"value", int32(300)}),
+			fixtureDirEntry("Deep", fixtureImg("400.img", wzProp{"value", "deep"})),
+		),
+	)
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luoxk/wzlib"
+)
+
+// rangeServer 用 http.ServeContent 提供 data，并统计请求次数与传输字节数。
+func rangeServer(t *testing.T, data []byte) (*httptest.Server, *atomic.Int64, *atomic.Int64) {
+	var requests, sent atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		cw := &countingWriter{ResponseWriter: w, n: &sent}
+		http.ServeContent(cw, r, "Mob.wz", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests, &sent
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+func TestHTTPSourceLoad(t *testing.T) {
+	srv, requests, _ := rangeServer(t, sampleFixture())
+
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzURL(srv.URL + "/data/Mob.wz?rev=1"); err != nil {
+		t.Fatal(err)
+	}
+	if ws.WzNode.Text != "Mob.wz" {
+		t.Errorf("root = %q, want Mob.wz", ws.WzNode.Text)
+	}
+	checkSampleTree(t, ws)
+
+	// 再次读取已缓存的数据不应产生新请求
+	before := requests.Load()
+	checkSampleTree(t, ws)
+	if requests.Load() != before {
+		t.Errorf("cached read issued %d requests", requests.Load()-before)
+	}
+}
+
+func TestHTTPSourcePartialDownload(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	srv, requests, sent := rangeServer(t, data)
+
+	src, err := wzlib.OpenHTTPSource(srv.URL, &wzlib.HTTPSourceOptions{BlockSize: 4096, ReadAhead: 2, CacheBlocks: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if src.Size() != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", src.Size(), len(data))
+	}
+
+	buf := make([]byte, 100)
+	off := int64(len(data)/2 + 4090) // 跨越块边界
+	if _, err := src.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[off:off+100]) {
+		t.Fatal("ReadAt returned wrong bytes")
+	}
+	if got := sent.Load(); got > 4*4096 {
+		t.Errorf("downloaded %d bytes for a 100 byte read", got)
+	}
+
+	// 预取的块命中缓存
+	before := requests.Load()
+	if _, err := src.ReadAt(buf, off+4096); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != before {
+		t.Errorf("read-ahead block was not cached")
+	}
+
+	// 读到文件末尾
+	n, err := src.ReadAt(buf, int64(len(data)-10))
+	if n != 10 || err == nil {
+		t.Errorf("ReadAt at end = %d, %v; want 10, EOF", n, err)
+	}
+
+	// 并发读取同一区域
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := make([]byte, 3000)
+			o := int64(i * 40000)
+			if _, err := src.ReadAt(p, o); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(p, data[o:o+3000]) {
+				t.Errorf("concurrent read at %d returned wrong bytes", o)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestHTTPSourceNoRangeSupport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(sampleFixture())
+	}))
+	defer srv.Close()
+
+	_, err := wzlib.OpenHTTPSource(srv.URL, nil)
+	if err == nil || !strings.Contains(err.Error(), "range") {
+		t.Fatalf("err = %v, want range support error", err)
+	}
+}
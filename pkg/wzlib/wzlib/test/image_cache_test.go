@@ -0,0 +1,176 @@
+package test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+func cacheFixture(t *testing.T, cache *wzlib.ImageCache) *wzlib.WzStructure {
+	t.Helper()
+	var entries []fixtureEntry
+	for i := 0; i < 6; i++ {
+		entries = append(entries, fixtureImg(fmt.Sprintf("%d.img", i),
+			wzProp{"info", []wzProp{{"level", int32(i)}, {"name", fmt.Sprintf("mob%d", i)}}},
+		))
+	}
+	ws := &wzlib.WzStructure{ImageCache: cache}
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(buildWz(entries...))); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func imageOf(ws *wzlib.WzStructure, name string) *wzlib.WzImage {
+	return ws.WzNode.FindChild(name).Value.(*wzlib.WzImage)
+}
+
+func TestImageUnload(t *testing.T) {
+	ws := cacheFixture(t, nil)
+	img := imageOf(ws, "0.img")
+	info := ws.WzNode.GetNode("0.img/info")
+	if info == nil {
+		t.Fatal("0.img/info not found")
+	}
+
+	img.Unload()
+	if img.IsExtracted() || len(img.Node.Nodes) != 0 {
+		t.Fatal("Unload kept the property tree")
+	}
+	// 卸载前取得的节点仍然可用
+	if n := info.FindChild("level"); n == nil || n.Value != int32(0) {
+		t.Fatalf("detached info/level = %v", n)
+	}
+	if info.GetFullPath() != "Mob.wz/0.img/info" {
+		t.Fatalf("detached path = %q", info.GetFullPath())
+	}
+
+	again := ws.WzNode.GetNode("0.img/info/level")
+	if again == nil || again.Value != int32(0) || !img.IsExtracted() {
+		t.Fatalf("re-extracted level = %v", again)
+	}
+	if again.ParentNode == info {
+		t.Fatal("re-extraction reused the detached nodes")
+	}
+}
+
+func TestImageCacheEvictsByCount(t *testing.T) {
+	cache := wzlib.NewImageCache(2, 0)
+	ws := cacheFixture(t, cache)
+
+	for i := 0; i < 6; i++ {
+		if n := ws.WzNode.GetNode(fmt.Sprintf("%d.img/info/level", i)); n == nil || n.Value != int32(i) {
+			t.Fatalf("%d.img/info/level = %v", i, n)
+		}
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", cache.Len())
+	}
+	for i := 0; i < 4; i++ {
+		if imageOf(ws, fmt.Sprintf("%d.img", i)).IsExtracted() {
+			t.Errorf("%d.img was not evicted", i)
+		}
+	}
+	if !imageOf(ws, "4.img").IsExtracted() || !imageOf(ws, "5.img").IsExtracted() {
+		t.Fatal("most recent images were evicted")
+	}
+
+	// 访问 4.img 使其变为最近使用，5.img 被淘汰
+	ws.WzNode.GetNode("4.img/info")
+	ws.WzNode.GetNode("0.img/info")
+	if imageOf(ws, "5.img").IsExtracted() || !imageOf(ws, "4.img").IsExtracted() {
+		t.Fatal("eviction is not least-recently-used")
+	}
+
+	cache.Clear()
+	if cache.Len() != 0 || cache.Bytes() != 0 || imageOf(ws, "0.img").IsExtracted() {
+		t.Fatal("Clear left images loaded")
+	}
+}
+
+func TestImageCacheEvictsByBytes(t *testing.T) {
+	probe := wzlib.NewImageCache(0, 0)
+	ws := cacheFixture(t, probe)
+	ws.WzNode.GetNode("0.img/info")
+	one := probe.Bytes()
+	if one <= 0 {
+		t.Fatalf("estimated size = %d", one)
+	}
+
+	cache := wzlib.NewImageCache(0, 3*one)
+	ws = cacheFixture(t, cache)
+	for i := 0; i < 6; i++ {
+		ws.WzNode.GetNode(fmt.Sprintf("%d.img/info", i))
+	}
+	if cache.Bytes() > 3*one || cache.Len() != 3 {
+		t.Fatalf("Bytes = %d, Len = %d; want <= %d, 3", cache.Bytes(), cache.Len(), 3*one)
+	}
+}
+
+func TestImageCachePin(t *testing.T) {
+	cache := wzlib.NewImageCache(1, 0)
+	ws := cacheFixture(t, cache)
+	pinned := imageOf(ws, "0.img")
+	cache.Pin(pinned)
+
+	for i := 0; i < 6; i++ {
+		ws.WzNode.GetNode(fmt.Sprintf("%d.img/info", i))
+	}
+	if !pinned.IsExtracted() {
+		t.Fatal("pinned image was evicted")
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("Len = %d, want pinned + most recent", cache.Len())
+	}
+
+	cache.Unpin(pinned)
+	if pinned.IsExtracted() || cache.Len() != 1 {
+		t.Fatal("Unpin did not evict the image")
+	}
+}
+
+func TestImageCacheZeroValue(t *testing.T) {
+	cache := &wzlib.ImageCache{MaxImages: 2}
+	ws := cacheFixture(t, cache)
+	pinned := imageOf(ws, "0.img")
+	cache.Pin(pinned)
+
+	for i := 0; i < 6; i++ {
+		ws.WzNode.GetNode(fmt.Sprintf("%d.img/info", i))
+	}
+	if !pinned.IsExtracted() || cache.Len() != 2 {
+		t.Fatalf("Len = %d, want pinned + most recent", cache.Len())
+	}
+	cache.Unpin(pinned)
+	cache.Clear()
+	if pinned.IsExtracted() || cache.Len() != 0 {
+		t.Fatal("Clear left images loaded")
+	}
+}
+
+func TestImageCacheConcurrent(t *testing.T) {
+	cache := wzlib.NewImageCache(2, 0)
+	ws := cacheFixture(t, cache)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 60; i++ {
+				k := (i*g + i) % 6
+				n := ws.WzNode.GetNode(fmt.Sprintf("%d.img/info/name", k))
+				if n == nil || n.Value != fmt.Sprintf("mob%d", k) {
+					t.Errorf("%d.img/info/name = %v", k, n)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if cache.Len() > 2 {
+		t.Fatalf("Len = %d, want <= 2", cache.Len())
+	}
+}
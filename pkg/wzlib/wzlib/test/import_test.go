@@ -0,0 +1,260 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// pixelsOf 生成 w×h 的 BGRA 像素，seed 区分不同画布
+func pixelsOf(w, h int, seed byte) []byte {
+	pix := make([]byte, w*h*4)
+	for i := range pix {
+		pix[i] = byte(i)*7 + seed
+	}
+	return pix
+}
+
+// importSource 是一个较新客户端的 Mob.wz：用 GMS 密钥加密，含链接画布与音频
+func importSource(t *testing.T) *wzlib.WzStructure {
+	t.Helper()
+	key := wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b})
+	placeholder := func(link string, path string) *fixtureCanvas {
+		return &fixtureCanvas{width: 1, height: 1, bgra: pixelsOf(1, 1, 0), props: []wzProp{
+			{link, path},
+			{"origin", image.Pt(3, 4)},
+		}}
+	}
+	data := buildWzWithKey(key,
+		fixtureImg("100.img",
+			wzProp{"info", []wzProp{{"name", "蜗牛"}, {"level", int32(7)}}},
+			wzProp{"stand", []wzProp{
+				{"0", &fixtureCanvas{width: 4, height: 4, bgra: pixelsOf(4, 4, 1)}},
+				{"1", &fixtureCanvas{width: 4, height: 2, bgra: pixelsOf(4, 2, 2), blocks: 16}},
+				{"2", placeholder("_inlink", "stand/0")},
+				{"3", placeholder("_outlink", "Mob/_Canvas/100.img/stand/3")},
+			}},
+			wzProp{"die", &fixtureSound{ms: 500, format: mp3Format(), encrypt: true, data: []byte("ID3 mp3 payload")}},
+		),
+		fixtureDirEntry("_Canvas", fixtureImg("100.img",
+			wzProp{"stand", []wzProp{{"3", &fixtureCanvas{width: 2, height: 2, bgra: pixelsOf(2, 2, 3)}}}},
+		)),
+	)
+	ws := loadFixture(t, data)
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func rawData(t *testing.T, n *wzlib.WzNode) []byte {
+	t.Helper()
+	if n == nil {
+		t.Fatal("canvas not found")
+	}
+	data, err := n.Value.(*wzlib.WzPng).GetRawData()
+	if err != nil {
+		t.Fatalf("%s: %v", n.GetFullPath(), err)
+	}
+	return data
+}
+
+func TestImportInline(t *testing.T) {
+	src := importSource(t)
+	path := writeFixture(t, "Mob.wz", buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})))
+	dst := &wzlib.WzStructure{}
+	if err := dst.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	tx, err := dst.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := tx.Import(dst.WzNode, src.WzNode.GetNode("100.img"), wzlib.ImportOptions{Name: "9300000.img"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !node.Value.(*wzlib.WzImage).Modified() {
+		t.Error("imported image not marked modified")
+	}
+	if err := dst.WzFiles[0].Save(wzlib.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &wzlib.WzStructure{}
+	if err := reopened.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	root := reopened.WzNode
+	if names := childNames(root); names != "200.img 9300000.img" {
+		t.Fatalf("root = %q", names)
+	}
+	if n := root.GetNode("9300000.img/info/name"); n == nil || n.Value != "蜗牛" {
+		t.Fatalf("info/name = %v", n)
+	}
+	for path, want := range map[string]string{
+		"stand/0": "100.img/stand/0",
+		"stand/1": "100.img/stand/1",
+		"stand/2": "100.img/stand/0",
+		"stand/3": "_Canvas/100.img/stand/3",
+	} {
+		if got := rawData(t, root.GetNode("9300000.img/"+path)); !bytes.Equal(got, rawData(t, src.WzNode.GetNode(want))) {
+			t.Errorf("%s does not match %s", path, want)
+		}
+	}
+	// 内联后链接属性被去掉，其他属性保留
+	if names := childNames(root.GetNode("9300000.img/stand/3")); names != "origin" {
+		t.Errorf("stand/3 children = %q", names)
+	}
+
+	sound, ok := root.GetNode("9300000.img/die").Value.(*wzlib.WzSound)
+	if !ok {
+		t.Fatalf("die = %T", root.GetNode("9300000.img/die").Value)
+	}
+	if sound.SoundType() != wzlib.WzSoundTypeMp3 || sound.Ms != 500 || sound.Frequency() != 44100 {
+		t.Errorf("sound type %v, %d ms, %d Hz", sound.SoundType(), sound.Ms, sound.Frequency())
+	}
+	if got, err := sound.ExtractSound(); err != nil || string(got) != "ID3 mp3 payload" {
+		t.Errorf("sound data = %q, %v", got, err)
+	}
+}
+
+func TestImportRewriteLinks(t *testing.T) {
+	src := importSource(t)
+	dst := loadFixture(t, buildWz(fixtureDirEntry("Mob")))
+	tx, err := dst.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	node, err := tx.Import(dst.WzNode.GetNode("Mob"), src.WzNode.GetNode("100.img"), wzlib.ImportOptions{
+		RewriteOutlink: func(path string) string { return "Mob/_Canvas/9300000.img/stand/3" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := node.GetNode("stand/3/_outlink"); n == nil || n.Value != "Mob/_Canvas/9300000.img/stand/3" {
+		t.Errorf("_outlink = %v", n)
+	}
+	if n := node.GetNode("stand/2/_inlink"); n == nil || n.Value != "stand/0" {
+		t.Errorf("_inlink = %v", n)
+	}
+	// 源树不受影响
+	if n := src.WzNode.GetNode("100.img/stand/3/_outlink"); n == nil || n.Value != "Mob/_Canvas/100.img/stand/3" {
+		t.Errorf("source _outlink = %v", n)
+	}
+}
+
+func TestImportCanvasForms(t *testing.T) {
+	// form 1 (ARGB4444) 的原始数据，每像素 2 字节
+	src := loadFixture(t, buildWz(fixtureImg("100.img",
+		wzProp{"0", &fixtureCanvas{width: 4, height: 4, form: 1, bgra: pixelsOf(4, 2, 5)}},
+	)))
+	defer src.Close()
+	want, err := src.WzNode.GetNode("100.img/0").Value.(*wzlib.WzPng).ExtractImage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]struct {
+		forms    []int
+		wantForm int
+	}{
+		"kept":      {nil, 1},
+		"listed":    {[]int{2, 1}, 1},
+		"converted": {[]int{257, 2}, 2}, // alpha 不止 0 与 255，ARGB1555 放不下
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := writeFixture(t, "Mob.wz", buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})))
+			dst := &wzlib.WzStructure{}
+			if err := dst.LoadWzFile(path); err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+			tx, err := dst.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Import(dst.WzNode, src.WzNode.GetNode("100.img"), wzlib.ImportOptions{CanvasForms: c.forms}); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if err := dst.WzFiles[0].Save(wzlib.SaveOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := &wzlib.WzStructure{}
+			if err := reopened.LoadWzFile(path); err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			png := reopened.WzNode.GetNode("100.img/0").Value.(*wzlib.WzPng)
+			if png.Form != c.wantForm {
+				t.Fatalf("form = %d, want %d", png.Form, c.wantForm)
+			}
+			got, err := png.ExtractImage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.(*image.NRGBA).Pix, want.(*image.NRGBA).Pix) {
+				t.Fatal("pixels changed by the import")
+			}
+		})
+	}
+
+	dst := loadFixture(t, buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})))
+	defer dst.Close()
+	tx, err := dst.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// RGB565 没有 alpha，无法无损表示
+	if _, err := tx.Import(dst.WzNode, src.WzNode.GetNode("100.img"), wzlib.ImportOptions{CanvasForms: []int{513}}); err == nil {
+		t.Fatal("import into an incompatible form succeeded")
+	}
+	if n := dst.WzNode.FindChild("100.img"); n != nil {
+		t.Fatal("failed import added the image")
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	src := importSource(t)
+	broken := loadFixture(t, buildWz(fixtureImg("1.img",
+		wzProp{"0", &fixtureCanvas{width: 1, height: 1, bgra: pixelsOf(1, 1, 0), props: []wzProp{{"_outlink", "Mob/missing.img/0"}}}},
+	)))
+	defer broken.Close()
+	dst := loadFixture(t, buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})))
+	before := dumpTree(t, dst.WzNode)
+	tx, err := dst.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Import(dst.WzNode, broken.WzNode.GetNode("1.img"), wzlib.ImportOptions{}); !errors.Is(err, wzlib.ErrBrokenLink) {
+		t.Errorf("broken link: err = %v, want ErrBrokenLink", err)
+	}
+	if _, err := tx.Import(dst.WzNode.GetNode("200.img"), src.WzNode.GetNode("100.img"), wzlib.ImportOptions{}); !errors.Is(err, wzlib.ErrNotEditable) {
+		t.Errorf("import into an image: err = %v, want ErrNotEditable", err)
+	}
+	if _, err := tx.Import(dst.WzNode, src.WzNode.GetNode("100.img/info"), wzlib.ImportOptions{}); !errors.Is(err, wzlib.ErrNotEditable) {
+		t.Errorf("import of a property: err = %v, want ErrNotEditable", err)
+	}
+	if _, err := tx.Import(dst.WzNode, src.WzNode.GetNode("100.img"), wzlib.ImportOptions{Name: "200.img"}); !errors.Is(err, wzlib.ErrDuplicateName) {
+		t.Errorf("duplicate name: err = %v, want ErrDuplicateName", err)
+	}
+	if after := dumpTree(t, dst.WzNode); after != before {
+		t.Fatalf("tree changed by failed imports:\n%s", after)
+	}
+}
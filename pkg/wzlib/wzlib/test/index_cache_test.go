@@ -0,0 +1,259 @@
+package test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luoxk/wzlib"
+)
+
+// dumpTree 提取全部 img 并按路径列出每个节点的类型和值
+func dumpTree(t *testing.T, n *wzlib.WzNode) string {
+	t.Helper()
+	var sb strings.Builder
+	var walk func(n *wzlib.WzNode)
+	walk = func(n *wzlib.WzNode) {
+		switch v := n.Value.(type) {
+		case *wzlib.WzImage:
+			if err := v.TryExtract(); err != nil {
+				t.Fatalf("%s: %v", n.GetFullPath(), err)
+			}
+			fmt.Fprintf(&sb, "%s img\n", n.GetFullPath())
+		case *wzlib.WzPng:
+			fmt.Fprintf(&sb, "%s %s %dx%d form=%d off=%d len=%d\n", n.GetFullPath(), n.Type, v.Width, v.Height, v.Form, v.Offset, v.DataLength)
+		case *wzlib.WzUol:
+			fmt.Fprintf(&sb, "%s %s %q\n", n.GetFullPath(), n.Type, v.Uol)
+		default:
+			fmt.Fprintf(&sb, "%s %s %T %v\n", n.GetFullPath(), n.Type, v, v)
+		}
+		for _, c := range n.Children() {
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+func TestIndexCacheReopen(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	cache := wzlib.NewIndexCache(t.TempDir())
+	cache.SaveProperties = true
+
+	first := &wzlib.WzStructure{IndexCache: cache}
+	if err := first.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if first.WzNode.GetNode("100.img/info/name") == nil {
+		t.Fatal("100.img/info/name not found")
+	}
+	if err := first.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &wzlib.WzStructure{IndexCache: cache}
+	if err := second.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	// 属性骨架来自缓存，img 无需读取即为已提取
+	if !second.WzNode.FindChild("100.img").Value.(*wzlib.WzImage).IsExtracted() {
+		t.Fatal("100.img was not restored from the index cache")
+	}
+	if second.WzNode.FindChild("200.img").Value.(*wzlib.WzImage).IsExtracted() {
+		t.Fatal("200.img was never extracted but is marked extracted")
+	}
+	if second.Encryption == nil || second.Encryption.EncType != first.Encryption.EncType {
+		t.Fatalf("encryption not restored: %+v", second.Encryption)
+	}
+
+	want := dumpTree(t, first.WzNode)
+	if got := dumpTree(t, second.WzNode); got != want {
+		t.Fatalf("restored tree differs:\n%s\nwant:\n%s", got, want)
+	}
+	img, err := second.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng).ExtractImage()
+	if err != nil || img.Bounds().Dx() != 4 {
+		t.Fatalf("canvas from cached skeleton = %v, %v", img, err)
+	}
+	first.Close()
+}
+
+func TestIndexCacheStale(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	cache := wzlib.NewIndexCache(t.TempDir())
+	cache.SaveProperties = true
+
+	ws := &wzlib.WzStructure{IndexCache: cache}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	ws.WzNode.GetNode("100.img/info")
+	if err := ws.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+
+	// 文件被替换后缓存失效，重新解析目录
+	data := buildWz(fixtureImg("100.img", wzProp{"value", int32(7)}))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	ws = &wzlib.WzStructure{IndexCache: cache}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if n := len(ws.WzNode.Nodes); n != 1 {
+		t.Fatalf("root has %d children, want 1", n)
+	}
+	if n := ws.WzNode.GetNode("100.img/value"); n == nil || n.Value != int32(7) {
+		t.Fatalf("100.img/value = %v", n)
+	}
+}
+
+func TestIndexCacheChangedWhileOpen(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", buildWz(fixtureImg("100.img", wzProp{"value", int32(1)})))
+	cache := wzlib.NewIndexCache(t.TempDir())
+	cache.SaveProperties = true
+
+	ws := &wzlib.WzStructure{IndexCache: cache}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	ws.WzNode.GetNode("100.img/value")
+	if ws.WzFiles[0].Changed() {
+		t.Fatal("Changed before the file was rewritten")
+	}
+
+	// 打开期间文件被改写为同样大小，保存缓存时跳过，不能把旧的属性记到新文件名下
+	if err := os.WriteFile(path, buildWz(fixtureImg("100.img", wzProp{"value", int32(2)})), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !ws.WzFiles[0].Changed() {
+		t.Fatal("Changed = false after the file was rewritten")
+	}
+	if err := ws.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+
+	ws = &wzlib.WzStructure{IndexCache: cache}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if n := ws.WzNode.GetNode("100.img/value"); n == nil || n.Value != int32(2) {
+		t.Fatalf("100.img/value = %v, want 2", n)
+	}
+}
+
+func TestIndexCacheSound(t *testing.T) {
+	path := writeFixture(t, "Sound.wz", buildWz(fixtureImg("Mob.img",
+		wzProp{"plain", &fixtureSound{ms: 500, format: mp3Format(), data: []byte("ID3 plain payload")}},
+		wzProp{"encrypted", &fixtureSound{ms: 700, format: mp3Format(), encrypt: true, data: []byte("ID3 encrypted payload")}},
+	)))
+	cache := wzlib.NewIndexCache(t.TempDir())
+	cache.SaveProperties = true
+
+	first := &wzlib.WzStructure{IndexCache: cache}
+	if err := first.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	first.WzNode.GetNode("Mob.img/plain")
+	if err := first.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &wzlib.WzStructure{IndexCache: cache}
+	if err := second.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if !second.WzNode.FindChild("Mob.img").Value.(*wzlib.WzImage).IsExtracted() {
+		t.Fatal("Mob.img was not restored from the index cache")
+	}
+	for _, name := range []string{"plain", "encrypted"} {
+		want := first.WzNode.GetNode("Mob.img/" + name).Value.(*wzlib.WzSound)
+		got, ok := second.WzNode.GetNode("Mob.img/" + name).Value.(*wzlib.WzSound)
+		if !ok {
+			t.Fatalf("%s restored as %T", name, second.WzNode.GetNode("Mob.img/"+name).Value)
+		}
+		if got.Offset != want.Offset || got.DataLength != want.DataLength || got.Ms != want.Ms ||
+			got.SoundType() != wzlib.WzSoundTypeMp3 || got.Frequency() != want.Frequency() {
+			t.Fatalf("%s = %+v, want %+v", name, got, want)
+		}
+		data, err := got.ExtractSound()
+		if err != nil || string(data) != "ID3 "+name+" payload" {
+			t.Fatalf("%s data = %q, %v", name, data, err)
+		}
+	}
+	first.Close()
+}
+
+func TestIndexCacheSkipsEditedTree(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	cache := wzlib.NewIndexCache(t.TempDir())
+	cache.SaveProperties = true
+
+	first := &wzlib.WzStructure{IndexCache: cache}
+	if err := first.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	tx, err := first.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rename(first.WzNode.GetNode("100.img"), "900.img"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !first.WzFiles[0].Edited() {
+		t.Fatal("rename did not mark the file edited")
+	}
+	// 改名尚未保存，磁盘上的文件没变，不能写入缓存
+	if err := first.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &wzlib.WzStructure{IndexCache: cache}
+	if err := second.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if names := childNames(second.WzNode); !strings.Contains(names, "100.img") || strings.Contains(names, "900.img") {
+		t.Fatalf("reopened root = %q, want the tree on disk", names)
+	}
+	second.Close()
+
+	// 保存后树与磁盘一致，缓存恢复的是改名后的树
+	if err := first.WzFiles[0].Save(wzlib.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if first.WzFiles[0].Edited() {
+		t.Fatal("Save did not clear Edited")
+	}
+	if err := first.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+	third := &wzlib.WzStructure{IndexCache: cache}
+	if err := third.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if n := third.WzNode.GetNode("900.img/info/name"); n == nil {
+		t.Fatalf("900.img/info/name missing after save; root = %q", childNames(third.WzNode))
+	}
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+func TestLazyDirectory(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	sub := ws.WzNode.FindChild("Sub")
+	if sub == nil {
+		t.Fatal("Sub not found")
+	}
+	// 子目录在首次访问前不读取
+	if len(sub.Nodes) != 0 || !sub.HasChildren() {
+		t.Fatalf("Sub read eagerly: %d nodes", len(sub.Nodes))
+	}
+	if n := len(ws.WzFiles[0].Directories); n != 1 {
+		t.Fatalf("%d directories read at load, want 1", n)
+	}
+
+	children := sub.Children()
+	if len(children) != 2 || children[0].Text != "300.img" || children[1].Text != "Deep" {
+		t.Fatalf("Sub children = %v", children)
+	}
+	if n := ws.WzNode.GetNode("Sub/Deep/400.img/value"); n == nil || n.Value != "deep" {
+		t.Fatalf("Sub/Deep/400.img/value = %v", n)
+	}
+	if n := len(ws.WzFiles[0].Directories); n != 2 {
+		t.Fatalf("%d directories after access, want 2", n)
+	}
+}
+
+func TestLazyDirectoryConcurrent(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if n := ws.WzNode.GetNode("Sub/Deep/400.img/value"); n == nil || n.Value != "deep" {
+				t.Errorf("Sub/Deep/400.img/value = %v", n)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(ws.WzNode.FindChild("Sub").Nodes); n != 2 {
+		t.Fatalf("Sub has %d children after concurrent loads, want 2", n)
+	}
+}
+
+func TestLazyDirectoryError(t *testing.T) {
+	data := buildWz(
+		fixtureImg("1.img", wzProp{"v", int32(1)}),
+		fixtureDirEntry("Sub", fixtureImg("broken.img", wzProp{"v", int32(2)})),
+	)
+	// 把子目录中 broken.img 的类型字节改成未知值
+	var name fixtureWriter
+	name.str("broken.img")
+	i := bytes.Index(data, name.Bytes())
+	if i < 1 {
+		t.Fatal("entry name not found in fixture")
+	}
+	data[i-1] = 0x07
+
+	ws := loadFixture(t, data)
+	if n := ws.WzNode.GetNode("1.img/v"); n == nil || n.Value != int32(1) {
+		t.Fatalf("1.img/v = %v", n)
+	}
+	sub := ws.WzNode.FindChild("Sub")
+	err := sub.LoadChildren()
+	if !errors.Is(err, wzlib.ErrUnknownFlag) {
+		t.Fatalf("err = %v, want ErrUnknownFlag", err)
+	}
+	var wzErr *wzlib.WzError
+	if !errors.As(err, &wzErr) || wzErr.Path != "Mob.wz/Sub" {
+		t.Fatalf("location = %+v", wzErr)
+	}
+	if len(sub.Children()) != 0 || ws.WzNode.GetNode("Sub/broken.img") != nil {
+		t.Fatal("failed directory load left children behind")
+	}
+}
@@ -70,21 +70,16 @@ func TestWzLoader(t *testing.T) {
 
 	// 3. 遍历所有 img 下的 node，收集 Canvas 节点
 	var canvasNodes []*wzlib.WzNode
-	var collectCanvas func(n *wzlib.WzNode)
-	collectCanvas = func(n *wzlib.WzNode) {
+	collectCanvas := func(n *wzlib.WzNode, depth int) error {
 		if n.Type == "Canvas" {
 			canvasNodes = append(canvasNodes, n)
-			return
-		}
-		if n.Type == "Property" || n.Type == "" {
-			for _, child := range n.Nodes {
-				collectCanvas(child)
-			}
+			return wzlib.SkipSubtree
 		}
+		return nil
 	}
 	for _, r := range imgResults {
 		if r.Err == nil {
-			collectCanvas(r.Img.Node)
+			r.Img.Node.Walk(wzlib.WalkOptions{}, collectCanvas)
 		}
 	}
 	t.Logf("共找到 Canvas 节点: %d", len(canvasNodes))
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// expvarInt 读取 Map 中的计数，keys 依次进入嵌套的 Map
+func expvarInt(m *expvar.Map, keys ...string) int64 {
+	for _, k := range keys[:len(keys)-1] {
+		m, _ = m.Get(k).(*expvar.Map)
+		if m == nil {
+			return -1
+		}
+	}
+	v, ok := m.Get(keys[len(keys)-1]).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	metrics := wzlib.NewExpvarMetrics("wzlib_test_metrics")
+	if wzlib.NewExpvarMetrics("wzlib_test_metrics") != metrics {
+		t.Fatal("NewExpvarMetrics did not reuse the published metrics")
+	}
+	vars := metrics.Map()
+
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	cache := wzlib.NewIndexCache(t.TempDir())
+	ws := newStructure(t, wzlib.WithMetrics(metrics), wzlib.WithIndexCache(cache))
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	ws.WzNode.GetNode("100.img/info")
+	ws.WzNode.GetNode("100.img/stand")
+	if _, err := ws.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng).ExtractImage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.SaveIndexCache(); err != nil {
+		t.Fatal(err)
+	}
+	ws.Close()
+
+	ws = newStructure(t, wzlib.WithMetrics(metrics), wzlib.WithIndexCache(cache))
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, c := range []struct {
+		keys []string
+		want int64
+	}{
+		{[]string{"images_extracted"}, 1},
+		{[]string{"image_entries"}, 13},
+		{[]string{"canvas_decoded", "2"}, 1},
+		{[]string{"cache_misses", wzlib.CacheImage}, 1},
+		{[]string{"cache_hits", wzlib.CacheImage}, 2},
+		{[]string{"cache_misses", wzlib.CacheIndex}, 1},
+		{[]string{"cache_hits", wzlib.CacheIndex}, 1},
+	} {
+		if got := expvarInt(vars, c.keys...); got != c.want {
+			t.Errorf("%v = %d, want %d", c.keys, got, c.want)
+		}
+	}
+	for _, key := range []string{"image_bytes", "extract_ns", "bytes_read"} {
+		if expvarInt(vars, key) <= 0 {
+			t.Errorf("%s = %d, want > 0", key, expvarInt(vars, key))
+		}
+	}
+	if !json.Valid([]byte(vars.String())) {
+		t.Fatalf("published value is not JSON: %s", vars.String())
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// wideFixture 含一个有 n 个 img 的目录和一个有 n 个子属性的 img
+func wideFixture(tb testing.TB, n int) *wzlib.WzStructure {
+	tb.Helper()
+	var imgs []fixtureEntry
+	var props []wzProp
+	for i := 0; i < n; i++ {
+		imgs = append(imgs, fixtureImg(fmt.Sprintf("%08d.img", i), wzProp{"v", int32(i)}))
+		props = append(props, wzProp{fmt.Sprintf("%08d", i), int32(i)})
+	}
+	data := buildWz(
+		fixtureDirEntry("Map0", imgs...),
+		fixtureImg("Eqp.img", wzProp{"Eqp", []wzProp{{"Weapon", props}}}),
+	)
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzSource("String.wz", wzlib.NewBytesSource(data)); err != nil {
+		tb.Fatal(err)
+	}
+	return ws
+}
+
+func TestNodeIndex(t *testing.T) {
+	ws := wideFixture(t, 100)
+	if n := ws.WzNode.GetNode("Map0/00000042.img/v"); n == nil || n.Value != int32(42) {
+		t.Fatalf("Map0/00000042.img/v = %v", n)
+	}
+	if ws.WzNode.GetNodeFold("map0/00000042.IMG") == nil {
+		t.Fatal("case-insensitive directory lookup failed")
+	}
+
+	root := ws.WzNode.GetNode("Eqp.img/Eqp/Weapon")
+	if c := root.FindChild("00000042"); c == nil || c.Text != "00000042" {
+		t.Fatalf("FindChild = %v", c)
+	}
+
+	// 建立索引后新增的子节点也能找到
+	added := root.AddChild(wzlib.NewWzNode("Weapon"))
+	if root.FindChild("Weapon") != added {
+		t.Fatal("child added after indexing not found")
+	}
+	if root.FindChildFold("WEAPON") != added || root.FindChild("WEAPON") != nil {
+		t.Fatal("case-insensitive lookup mismatch")
+	}
+
+	// 删除
+	if !root.RemoveChild(added) || root.FindChild("Weapon") != nil || added.ParentNode != nil {
+		t.Fatal("removed child still found")
+	}
+	if root.RemoveChild(added) {
+		t.Fatal("RemoveChild of a non-child returned true")
+	}
+	if c := root.FindChild("00000099"); c == nil || c.Text != "00000099" {
+		t.Fatalf("lookup after removal = %v", c)
+	}
+
+	// 改名
+	c := root.FindChild("00000007")
+	c.Rename("Cap")
+	if root.FindChild("Cap") != c || root.FindChild("00000007") != nil {
+		t.Fatal("renamed child not found under its new name")
+	}
+	// 不经 Rename 直接改名也不会返回错误的节点
+	c.Text = "Coat"
+	if root.FindChild("Cap") != nil || root.FindChild("Coat") != c {
+		t.Fatal("stale index after direct rename")
+	}
+
+	// 直接替换 Nodes 时索引随之失效
+	root.Nodes = []*wzlib.WzNode{wzlib.NewWzNode("only")}
+	if root.FindChild("00000042") != nil || root.FindChild("only") == nil {
+		t.Fatal("index survived replacing Nodes")
+	}
+}
+
+func TestGetNodeFold(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	if n := ws.WzNode.GetNodeFold("sub/DEEP/400.IMG/Value"); n == nil || n.Value != "deep" {
+		t.Fatalf("GetNodeFold = %v", n)
+	}
+	if ws.WzNode.GetNode("sub/Deep/400.img/value") != nil {
+		t.Fatal("GetNode matched case-insensitively")
+	}
+}
+
+func TestGetFullPath(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	n := ws.WzNode.GetNode("Sub/Deep/400.img/value")
+	if got := n.GetFullPath(); got != "Mob.wz/Sub/Deep/400.img/value" {
+		t.Fatalf("GetFullPath = %q", got)
+	}
+	if got := ws.WzNode.GetFullPath(); got != "Mob.wz" {
+		t.Fatalf("root GetFullPath = %q", got)
+	}
+	if got := wzlib.NewWzNode("").GetFullPath(); got != "" {
+		t.Fatalf("empty GetFullPath = %q", got)
+	}
+}
+
+func BenchmarkFindChild(b *testing.B) {
+	root := wideFixture(b, 20000).WzNode.GetNode("Eqp.img/Eqp/Weapon")
+	names := make([]string, 256)
+	for i := range names {
+		names[i] = fmt.Sprintf("%08d", i*77)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if root.FindChild(names[i%len(names)]) == nil {
+			b.Fatal("not found")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/luoxk/wzlib"
+)
+
+// characterFixture 模拟 Character.wz：每个 img 含若干动作，每帧带画布、
+// origin 向量与 map 下的 navel/neck 点，键名高度重复
+func characterFixture() []byte {
+	pixels := make([]byte, 2*2*4)
+	var images []fixtureEntry
+	for i := 0; i < 100; i++ {
+		var actions []wzProp
+		for _, action := range []string{"stand1", "walk1", "alert", "swingO1", "jump"} {
+			var frames []wzProp
+			for f := 0; f < 4; f++ {
+				frames = append(frames, wzProp{fmt.Sprint(f), []wzProp{
+					{"body", &fixtureCanvas{width: 2, height: 2, bgra: pixels, props: []wzProp{
+						{"origin", image.Pt(16, 31)},
+						{"map", []wzProp{{"navel", image.Pt(-8, -21)}, {"neck", image.Pt(-4, -32)}}},
+						{"z", "body"},
+						{"group", "skin"},
+					}}},
+					{"delay", int32(180 + f*10)},
+					{"face", int16(1)},
+				}})
+			}
+			actions = append(actions, wzProp{action, frames})
+		}
+		actions = append(actions, wzProp{"info", []wzProp{{"islot", "Bd"}, {"vslot", "Bd"}, {"cash", int32(0)}}})
+		images = append(images, fixtureImg(fmt.Sprintf("%08d.img", 2000+i), actions...))
+	}
+	return buildWz(images...)
+}
+
+// countNodes 提取遇到的每个 img 并统计节点数
+func countNodes(b *testing.B, n *wzlib.WzNode) int {
+	if img, ok := n.Value.(*wzlib.WzImage); ok {
+		if err := img.TryExtract(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	count := 1
+	for _, c := range n.Children() {
+		count += countNodes(b, c)
+	}
+	return count
+}
+
+// BenchmarkNodeMemory 报告全部提取后每个节点占用的堆内存。
+// 设置 WZLIB_CHARACTER_WZ 为 Character.wz 的路径时改用真实数据。
+func BenchmarkNodeMemory(b *testing.B) {
+	path := os.Getenv("WZLIB_CHARACTER_WZ")
+	if path == "" {
+		path = writeFixture(b, "Character.wz", characterFixture())
+	}
+	var perNode float64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		ws := &wzlib.WzStructure{}
+		if err := ws.LoadWzFileMmap(path); err != nil {
+			b.Fatal(err)
+		}
+		nodes := countNodes(b, ws.WzNode)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		perNode = float64(after.HeapAlloc-before.HeapAlloc) / float64(nodes)
+		runtime.KeepAlive(ws)
+		ws.Close()
+	}
+	b.ReportMetric(perNode, "B/node")
+}
+
+func TestInternedNames(t *testing.T) {
+	ws := loadFixture(t, characterFixture())
+	a := ws.WzNode.GetNode("00002000.img/stand1/0/body/origin")
+	b := ws.WzNode.GetNode("00002042.img/walk1/3/body/origin")
+	if a == nil || b == nil {
+		t.Fatal("origin not found")
+	}
+	if unsafe.StringData(a.Text) != unsafe.StringData(b.Text) {
+		t.Error("property names in different images are not shared")
+	}
+	if d := ws.WzNode.GetNode("00002000.img/stand1/1/delay"); d == nil || d.Value != int32(190) {
+		t.Fatalf("delay = %v", d)
+	}
+	if f := ws.WzNode.GetNode("00002000.img/stand1/1/face"); f == nil || f.Value != int16(1) {
+		t.Fatalf("face = %v", f)
+	}
+}
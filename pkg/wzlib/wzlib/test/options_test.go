@@ -0,0 +1,255 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+func newStructure(t *testing.T, opts ...wzlib.Option) *wzlib.WzStructure {
+	t.Helper()
+	ws, err := wzlib.NewWzStructure(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestNewWzStructureInvalid(t *testing.T) {
+	cases := map[string][]wzlib.Option{
+		"unknown key":        {wzlib.WithKey(wzlib.Unknown)},
+		"zero version":       {wzlib.WithVersion(0)},
+		"verify mode":        {wzlib.WithVersionVerify(7)},
+		"nil encoding":       {wzlib.WithTextEncoding(nil)},
+		"nil image cache":    {wzlib.WithImageCache(nil)},
+		"negative limits":    {wzlib.WithLimits(wzlib.Limits{MaxEntries: -1})},
+		"warn without log":   {wzlib.WithChecksum(wzlib.ChecksumWarn)},
+		"unknown checksum":   {wzlib.WithChecksum(9)},
+		"nil logger":         {wzlib.WithLogger(nil)},
+		"invalid after good": {wzlib.WithKey(wzlib.GMS), wzlib.WithVersion(-3)},
+	}
+	for name, opts := range cases {
+		if ws, err := wzlib.NewWzStructure(opts...); err == nil {
+			t.Errorf("%s: got %+v, want an error", name, ws)
+		}
+	}
+
+	ws := newStructure(t, wzlib.WithKey(wzlib.KMS), wzlib.WithVersion(95), wzlib.WithExtFiles(true))
+	if ws.Encryption.EncType != wzlib.KMS || ws.WzVersion != 95 || !ws.AutoDetectExtFiles {
+		t.Fatalf("options not applied: %+v", ws)
+	}
+}
+
+// versionFixture 的头部版本号是 83 的加密形式，但偏移按同样加密形式的 630 计算，
+// 第一个候选版本 83 是错的
+func versionFixture() []byte {
+	encVer, _ := fixtureVersion()
+	return buildWzVersion(nil, encVer, uint32(wzlib.CalcHashVersion(630)),
+		fixtureImg("100.img", wzProp{"value", int32(100)}),
+		fixtureDirEntry("Sub", fixtureImg("200.img", wzProp{"value", int32(200)})),
+	)
+}
+
+func TestVersionDetection(t *testing.T) {
+	data := versionFixture()
+
+	ws := newStructure(t)
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if v := ws.WzFiles[0].Header.VersionDetector.GetWzVersion(); v != 630 {
+		t.Fatalf("detected version %d, want 630", v)
+	}
+	if n := ws.WzNode.GetNode("Sub/200.img/value"); n == nil || n.Value != int32(200) {
+		t.Fatalf("Sub/200.img/value = %v", n)
+	}
+
+	// 快速模式直接采用第一个候选版本
+	ws = newStructure(t, wzlib.WithVersionVerify(wzlib.VersionVerifyFast))
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if v := ws.WzFiles[0].Header.VersionDetector.GetWzVersion(); v != 83 {
+		t.Fatalf("fast mode chose version %d, want 83", v)
+	}
+
+	ws = newStructure(t, wzlib.WithVersion(630))
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n := ws.WzNode.GetNode("100.img/value"); n == nil || n.Value != int32(100) {
+		t.Fatalf("100.img/value = %v", n)
+	}
+
+	for _, v := range []int{83, 100} {
+		ws = newStructure(t, wzlib.WithVersion(v))
+		err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data))
+		if !errors.Is(err, wzlib.ErrNoVersionMatched) {
+			t.Errorf("WithVersion(%d): err = %v, want ErrNoVersionMatched", v, err)
+		}
+		if ws.WzNode != nil {
+			t.Errorf("WithVersion(%d): failed load left a root node", v)
+		}
+	}
+}
+
+func TestChecksumPolicy(t *testing.T) {
+	data := sampleFixture()
+	probe := loadFixture(t, data)
+	img := probe.WzNode.FindChild("200.img").Value.(*wzlib.WzImage)
+	data[img.Offset+int64(img.Size)-1] ^= 0xFF
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	for _, tc := range []struct {
+		policy wzlib.ChecksumPolicy
+		ok     bool
+	}{
+		{wzlib.ChecksumVerify, false},
+		{wzlib.ChecksumWarn, true},
+		{wzlib.ChecksumSkip, true},
+	} {
+		ws := newStructure(t, wzlib.WithChecksum(tc.policy), wzlib.WithLogger(logger))
+		if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+			t.Fatal(err)
+		}
+		err := ws.WzNode.FindChild("200.img").Value.(*wzlib.WzImage).TryExtract()
+		if tc.ok != (err == nil) {
+			t.Errorf("policy %d: err = %v", tc.policy, err)
+		}
+		if !tc.ok && !errors.Is(err, wzlib.ErrChecksumMismatch) {
+			t.Errorf("policy %d: err = %v, want ErrChecksumMismatch", tc.policy, err)
+		}
+	}
+	if n := strings.Count(logs.String(), "level=WARN"); n != 1 {
+		t.Fatalf("logged %d checksum warnings, want 1:\n%s", n, logs.String())
+	}
+}
+
+func TestLimits(t *testing.T) {
+	data := buildWz(fixtureImg("1.img",
+		wzProp{"a", int32(1)}, wzProp{"b", int32(2)}, wzProp{"c", int32(3)},
+		wzProp{"a_rather_long_property_name", "x"},
+	))
+
+	ws := newStructure(t, wzlib.WithLimits(wzlib.Limits{MaxEntries: 3}))
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WzNode.FindChild("1.img").Value.(*wzlib.WzImage).TryExtract(); !errors.Is(err, wzlib.ErrLimitExceeded) {
+		t.Fatalf("MaxEntries: err = %v, want ErrLimitExceeded", err)
+	}
+
+	ws = newStructure(t, wzlib.WithLimits(wzlib.Limits{MaxStringLen: 16}))
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WzNode.FindChild("1.img").Value.(*wzlib.WzImage).TryExtract(); !errors.Is(err, wzlib.ErrLimitExceeded) {
+		t.Fatalf("MaxStringLen: err = %v, want ErrLimitExceeded", err)
+	}
+}
+
+func TestTextEncoding(t *testing.T) {
+	// "蜗牛" 的 GBK 编码，按单字节字符串写入
+	data := buildWz(fixtureImg("100.img", wzProp{"name", "\xce\xcf\xc5\xa3"}))
+
+	ws := newStructure(t, wzlib.WithTextEncoding(simplifiedchinese.GBK))
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(data)); err != nil {
+		t.Fatal(err)
+	}
+	if n := ws.WzNode.GetNode("100.img/name"); n == nil || n.Value != "蜗牛" {
+		t.Fatalf("100.img/name = %v", n)
+	}
+}
+
+func TestUTF16Strings(t *testing.T) {
+	values := map[string]string{
+		"short":  "달팽이 𝄞",
+		"exact":  strings.Repeat("長", 127), // 长度 127 已需要 int32 长度
+		"long":   strings.Repeat("蜗牛", 150),
+		"latin1": "caf\u00e9",
+	}
+	var props []wzProp
+	for name, v := range values {
+		props = append(props, wzProp{name, fixtureUTF16(v)})
+	}
+	// 手工编码的 "가"：1 个字符，0xAC00 ^ 0xAAAA = 0x06AA
+	props = append(props, wzProp{"raw", rawProp{0x08, 0x00, 0x01, 0xAA, 0x06}})
+
+	for name, key := range map[string]*wzlib.WzCryptoKey{
+		"plain":     nil,
+		"encrypted": wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			ws := loadFixture(t, buildWzWithKey(key, fixtureImg("100.img", props...)))
+			defer ws.Close()
+			for name, want := range values {
+				if n := ws.WzNode.GetNode("100.img/" + name); n == nil || n.Value != want {
+					t.Errorf("%s = %v, want %q", name, n, want)
+				}
+			}
+			if key == nil {
+				if n := ws.WzNode.GetNode("100.img/raw"); n == nil || n.Value != "가" {
+					t.Errorf("raw = %v, want %q", n, "가")
+				}
+			}
+		})
+	}
+}
+
+func TestExtFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"Mob.wz":    buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})),
+		"Mob2.wz":   buildWz(fixtureImg("200.img", wzProp{"value", int32(200)})),
+		"Mob001.wz": buildWz(fixtureDirEntry("Boss", fixtureImg("300.img", wzProp{"value", int32(300)}))),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ws := newStructure(t, wzlib.WithExtFiles(true))
+	if err := ws.LoadWzFile(filepath.Join(dir, "Mob.wz")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]int32{"100.img/value": 100, "200.img/value": 200, "Boss/300.img/value": 300} {
+		if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %d", path, n, want)
+		}
+	}
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !ws.WzFiles[0].MergedWzFiles[1].Closed() {
+		t.Fatal("extension file not closed")
+	}
+
+	// 默认不合并扩展文件
+	ws = newStructure(t)
+	if err := ws.LoadWzFile(filepath.Join(dir, "Mob.wz")); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if len(ws.WzNode.Nodes) != 1 {
+		t.Fatalf("root has %d children without WithExtFiles, want 1", len(ws.WzNode.Nodes))
+	}
+}
+
+func TestLoadTwice(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	root := ws.WzNode
+	if err := ws.LoadWzSource("Mob.wz", wzlib.NewBytesSource(sampleFixture())); !errors.Is(err, wzlib.ErrAlreadyLoaded) {
+		t.Fatalf("second load: err = %v, want ErrAlreadyLoaded", err)
+	}
+	if ws.WzNode != root {
+		t.Fatal("second load replaced the root node")
+	}
+}
@@ -0,0 +1,172 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// layerNames 以空格连接层名
+func layerNames(layers []*wzlib.OverlayLayer) string {
+	var names string
+	for i, l := range layers {
+		if i > 0 {
+			names += " "
+		}
+		names += l.Name
+	}
+	return names
+}
+
+func TestOverlay(t *testing.T) {
+	base := loadFixture(t, buildWz(
+		fixtureImg("100.img", wzProp{"value", int32(100)}, wzProp{"name", "snail"},
+			wzProp{"info", []wzProp{{"level", int32(1)}, {"speed", int32(-10)}}},
+			wzProp{"skill", []wzProp{{"0", int32(1)}}}),
+		fixtureImg("200.img", wzProp{"value", int32(200)}),
+		fixtureDirEntry("Sub", fixtureImg("300.img", wzProp{"value", int32(300)})),
+	))
+	mod := loadFixture(t, buildWz(
+		fixtureImg("100.img", wzProp{"value", int32(101)},
+			wzProp{"info", []wzProp{{"level", int32(5)}, {"boss", int32(1)}}},
+			wzProp{"skill", int32(0)}),
+		fixtureDirEntry("Sub", fixtureImg("301.img", wzProp{"value", int32(301)})),
+	))
+	defer base.Close()
+	defer mod.Close()
+
+	o := wzlib.NewOverlay("Mob")
+	if _, err := o.AddLayer("base", 0, base.WzNode, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.AddLayer("mod", 10, mod.WzNode, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.AddLayer("mod", 5, mod.WzNode, ""); err == nil {
+		t.Fatal("duplicate layer name accepted")
+	}
+
+	root := o.Root()
+	if names := childNames(root); names != "100.img 200.img Sub" {
+		t.Fatalf("root = %q", names)
+	}
+	if names := childNames(root.GetNode("Sub")); names != "300.img 301.img" {
+		t.Fatalf("Sub = %q", names)
+	}
+	// 两层的 100.img 合并：mod 只遮盖自己提供的叶子属性，base 独有的属性仍可见
+	if names := childNames(root.GetNode("100.img")); names != "value name info skill" {
+		t.Fatalf("100.img = %q", names)
+	}
+	if names := childNames(root.GetNode("100.img/info")); names != "level speed boss" {
+		t.Fatalf("100.img/info = %q", names)
+	}
+	for path, want := range map[string]any{
+		"100.img/value":      int32(101),
+		"100.img/name":       "snail",
+		"100.img/info/level": int32(5),
+		"100.img/info/speed": int32(-10),
+		"100.img/info/boss":  int32(1),
+		"100.img/skill":      int32(0), // 值遮盖下层同名的属性容器
+	} {
+		if n := root.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %v", path, n, want)
+		}
+	}
+	if n := root.GetNode("100.img/skill/0"); n != nil {
+		t.Errorf("property below a shadowed container visible: %v", n)
+	}
+
+	for path, want := range map[string]string{
+		"":                   "mod",
+		"100.img":            "mod",
+		"100.img/value":      "mod",
+		"100.img/name":       "base",
+		"100.img/info":       "mod",
+		"100.img/info/speed": "base",
+		"200.img/value":      "base",
+		"Sub":                "mod",
+		"Sub/300.img/value":  "base",
+		"Sub/301.img":        "mod",
+	} {
+		l := o.LayerOf(root.GetNode(path))
+		if l == nil || l.Name != want {
+			t.Errorf("LayerOf(%q) = %v, want %s", path, l, want)
+		}
+	}
+	if l := o.LayerOf(wzlib.NewWzNode("other")); l != nil {
+		t.Errorf("LayerOf(foreign node) = %s", l.Name)
+	}
+	if names := layerNames(o.LayersAt("Sub")); names != "mod base" {
+		t.Errorf("LayersAt(Sub) = %q", names)
+	}
+	if names := layerNames(o.LayersAt("200.img")); names != "base" {
+		t.Errorf("LayersAt(200.img) = %q", names)
+	}
+
+	// 合并出的目录挂在虚拟树上，单层提供的节点仍属于原来的层
+	if sub := root.GetNode("Sub"); sub.ParentNode != root {
+		t.Errorf("merged Sub parent = %v", sub.ParentNode)
+	}
+	if img := root.GetNode("200.img"); img.ParentNode != base.WzNode {
+		t.Errorf("200.img parent = %v", img.ParentNode)
+	}
+
+	// 关闭 mod 层后恢复 base 的值，旧树不受影响
+	if err := o.SetEnabled("mod", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := o.Root().GetNode("100.img/value"); n == nil || n.Value != int32(100) {
+		t.Fatalf("with mod disabled: 100.img/value = %v", n)
+	}
+	if n := o.Root().GetNode("100.img/info/boss"); n != nil {
+		t.Fatalf("with mod disabled: 100.img/info/boss = %v", n)
+	}
+	if names := childNames(o.Root().GetNode("Sub")); names != "300.img" {
+		t.Fatalf("with mod disabled: Sub = %q", names)
+	}
+	if n := root.GetNode("100.img/value"); n == nil || n.Value != int32(101) {
+		t.Fatalf("old tree changed: 100.img/value = %v", n)
+	}
+	if err := o.SetEnabled("missing", true); err == nil {
+		t.Fatal("SetEnabled on a missing layer succeeded")
+	}
+}
+
+func TestOverlayMountPath(t *testing.T) {
+	mob := loadFixture(t, buildWz(fixtureImg("100.img", wzProp{"value", int32(100)})))
+	patch := loadFixture(t, buildWz(fixtureImg("100.img", wzProp{"value", int32(101)})))
+	defer mob.Close()
+	defer patch.Close()
+
+	o := wzlib.NewOverlay("client")
+	if _, err := o.AddLayer("base", 0, mob.WzNode, "Mob"); err != nil {
+		t.Fatal(err)
+	}
+	if n := o.Root().GetNode("Mob/100.img/value"); n == nil || n.Value != int32(100) {
+		t.Fatalf("Mob/100.img/value = %v", n)
+	}
+
+	// 同优先级时后加入的层优先
+	if _, err := o.AddLayer("patch", 0, patch.WzNode, "/Mob/"); err != nil {
+		t.Fatal(err)
+	}
+	root := o.Root()
+	if names := childNames(root); names != "Mob" {
+		t.Fatalf("root = %q", names)
+	}
+	if n := root.GetNode("Mob/100.img/value"); n == nil || n.Value != int32(101) {
+		t.Fatalf("Mob/100.img/value = %v", n)
+	}
+	if l := o.LayerOf(root.GetNode("Mob/100.img")); l == nil || l.Name != "patch" {
+		t.Errorf("LayerOf(Mob/100.img) = %v", l)
+	}
+	if names := layerNames(o.LayersAt("Mob/100.img")); names != "patch base" {
+		t.Errorf("LayersAt(Mob/100.img) = %q", names)
+	}
+	if names := layerNames(o.LayersAt("")); names != "patch base" {
+		t.Errorf("LayersAt(root) = %q", names)
+	}
+	if names := layerNames(o.LayersAt("Map")); names != "" {
+		t.Errorf("LayersAt(Map) = %q", names)
+	}
+}
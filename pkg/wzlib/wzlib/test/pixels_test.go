@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+type pixelConverter struct {
+	name    string
+	rawSize func(w, h int) int
+	current func(raw []byte, w, h int) []byte
+	ref     func(pix, raw []byte, w, h int)
+}
+
+var pixelConverters = []pixelConverter{
+	{"BGRA4444", func(w, h int) int { return w * h * 2 }, wzlib.GetPixelDataBGRA4444,
+		func(pix, raw []byte, w, h int) { refDecodeBGRA4444(pix, raw, w*h) }},
+	{"ARGB1555", func(w, h int) int { return w * h * 2 }, wzlib.GetPixelDataARGB1555,
+		func(pix, raw []byte, w, h int) { refDecodeARGB1555(pix, raw, w*h) }},
+	{"RGB565", func(w, h int) int { return w * h * 2 }, wzlib.ConvertRGB565ToRGBA,
+		func(pix, raw []byte, w, h int) { refDecodeRGB565(pix, raw, w*h) }},
+	{"DXT3", func(w, h int) int { return w * h }, wzlib.GetPixelDataDXT3, refDecodeDXT3},
+	{"DXT5", func(w, h int) int { return w * h }, wzlib.GetPixelDataDXT5, refDecodeDXT5},
+}
+
+func randomRaw(n int, seed int64) []byte {
+	raw := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(raw)
+	return raw
+}
+
+func TestPixelConvertersMatchReference(t *testing.T) {
+	// 保证即使在单核机器上也会走并发解码的分支
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	for _, c := range pixelConverters {
+		// 1024x1024 超过并发阈值，覆盖多段并发解码
+		for _, size := range [][2]int{{4, 4}, {64, 32}, {100, 60}, {1024, 1024}} {
+			w, h := size[0], size[1]
+			raw := randomRaw(c.rawSize(w, h), int64(w*h))
+			want := make([]byte, w*h*4)
+			c.ref(want, raw, w, h)
+			if got := c.current(raw, w, h); !bytes.Equal(got, want) {
+				t.Errorf("%s %dx%d differs from the reference implementation", c.name, w, h)
+			}
+		}
+	}
+}
+
+func TestDXTPartialBlocks(t *testing.T) {
+	// 宽高不是 4 的倍数时只写出画布内的像素，不越界
+	raw := randomRaw(8*8, 1)
+	for _, decode := range []func([]byte, int, int) []byte{wzlib.GetPixelDataDXT3, wzlib.GetPixelDataDXT5} {
+		full := decode(raw, 8, 8)
+		part := decode(raw, 7, 6)
+		if len(part) != 7*6*4 {
+			t.Fatalf("len = %d", len(part))
+		}
+		// 第一个块与完整画布中的同一块一致
+		for y := 0; y < 4; y++ {
+			if !bytes.Equal(part[y*7*4:y*7*4+16], full[y*8*4:y*8*4+16]) {
+				t.Fatalf("row %d of the first block differs", y)
+			}
+		}
+	}
+}
+
+func BenchmarkPixelConverters(b *testing.B) {
+	const w, h = 1024, 1024
+	for _, c := range pixelConverters {
+		raw := randomRaw(c.rawSize(w, h), 42)
+		want := make([]byte, w*h*4)
+		c.ref(want, raw, w, h)
+		if !bytes.Equal(c.current(raw, w, h), want) {
+			b.Fatalf("%s differs from the reference implementation", c.name)
+		}
+		// 两者都为每次调用分配输出，与 GetPixelData* 的用法一致
+		b.Run(fmt.Sprintf("%s/Reference", c.name), func(b *testing.B) {
+			b.SetBytes(w * h * 4)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.ref(make([]byte, w*h*4), raw, w, h)
+			}
+		})
+		b.Run(fmt.Sprintf("%s/Current", c.name), func(b *testing.B) {
+			b.SetBytes(w * h * 4)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.current(raw, w, h)
+			}
+		})
+	}
+}
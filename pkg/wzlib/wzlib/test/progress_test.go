@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+func TestExtractAllProgress(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	var progress wzlib.ProgressCounter
+	ws := &wzlib.WzStructure{Progress: &progress}
+	if err := ws.LoadWzFileContext(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	if err := ws.WzNode.ExtractAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"100.img", "200.img", "Sub/300.img", "Sub/Deep/400.img"} {
+		if !ws.WzNode.GetNode(name).Value.(*wzlib.WzImage).IsExtracted() {
+			t.Errorf("%s was not extracted", name)
+		}
+	}
+	// 6 个目录项加 17 个属性
+	if n := progress.Entries(); n != 23 {
+		t.Errorf("reported %d entries, want 23", n)
+	}
+	if progress.Bytes() <= 0 {
+		t.Errorf("reported %d bytes", progress.Bytes())
+	}
+}
+
+func TestLoadCanceled(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFileContext(ctx, path); !errors.Is(err, context.Canceled) {
+		t.Fatalf("LoadWzFileContext = %v, want context.Canceled", err)
+	}
+	if len(ws.WzFiles) != 0 {
+		t.Fatalf("cancelled load kept %d files open", len(ws.WzFiles))
+	}
+}
+
+func TestExtractAllCanceled(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 第一个 img 提取完成后取消，之后的 img 不再提取
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ws.Progress = wzlib.ProgressFunc(func(entries int, bytes int64) { cancel() })
+
+	err := ws.WzNode.ExtractAll(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ExtractAll = %v, want context.Canceled", err)
+	}
+	if !ws.WzNode.GetNode("100.img").Value.(*wzlib.WzImage).IsExtracted() {
+		t.Error("100.img should have been extracted before the cancel")
+	}
+	sub := ws.WzNode.FindChild("Sub")
+	if img := ws.WzNode.FindChild("200.img").Value.(*wzlib.WzImage); img.IsExtracted() {
+		t.Error("200.img was extracted after the cancel")
+	}
+
+	// 取消后可以重新提取
+	if err := ws.WzNode.ExtractAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := sub.GetNode("Deep/400.img/value"); n == nil || n.Value != "deep" {
+		t.Fatalf("Sub/Deep/400.img/value = %v", n)
+	}
+}
+
+func TestTryExtractContextCanceled(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	img := ws.WzNode.FindChild("100.img").Value.(*wzlib.WzImage)
+	if err := img.TryExtractContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("TryExtractContext = %v, want context.Canceled", err)
+	}
+	if img.IsExtracted() {
+		t.Fatal("cancelled extraction marked the image extracted")
+	}
+	if err := img.TryExtract(); err != nil {
+		t.Fatal(err)
+	}
+}
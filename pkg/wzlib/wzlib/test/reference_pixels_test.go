@@ -0,0 +1,110 @@
+package test
+
+import (
+	"encoding/binary"
+
+	"github.com/luoxk/wzlib"
+)
+
+// 优化前的像素转换实现，基准测试用它校验新实现的输出逐字节一致。
+
+func refDecodeRGB565(out, rgb565 []byte, count int) {
+	for i := 0; i < count; i++ {
+		val := binary.LittleEndian.Uint16(rgb565[i*2:])
+
+		rgba := wzlib.RGB565ToRGBA(val)
+
+		j := i * 4
+		out[j+0] = rgba[2] // B
+		out[j+1] = rgba[1] // G
+		out[j+2] = rgba[0] // R
+		out[j+3] = rgba[3] // A
+	}
+}
+
+func refDecodeBGRA4444(pixelBuffer, rawData []byte, count int) {
+	for i := 0; i < count; i++ {
+		lo := rawData[i*2]
+		hi := rawData[i*2+1]
+		pixelBuffer[i*4+0] = (hi&0x0F)<<4 | (hi & 0x0F) // R
+		pixelBuffer[i*4+1] = (lo & 0xF0) | (lo&0xF0)>>4 // G
+		pixelBuffer[i*4+2] = (lo&0x0F)<<4 | (lo & 0x0F) // B
+		pixelBuffer[i*4+3] = (hi & 0xF0) | (hi&0xF0)>>4 // A
+	}
+}
+
+func refDecodeDXT3(pixel, raw []byte, width, height int) {
+	var colorTable [4][4]byte // RGBA
+	var colorIdx [16]int
+	var alphaTable [16]byte
+
+	for y := 0; y < height; y += 4 {
+		for x := 0; x < width; x += 4 {
+			offset := x*4 + y*width
+
+			wzlib.ExpandAlphaTableDXT3(alphaTable[:], raw, offset)
+
+			c0 := binary.LittleEndian.Uint16(raw[offset+8:])
+			c1 := binary.LittleEndian.Uint16(raw[offset+10:])
+			wzlib.ExpandColorTable(&colorTable, c0, c1)
+
+			wzlib.ExpandColorIndexTable(colorIdx[:], raw, offset+12)
+
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					idx := j*4 + i
+					wzlib.SetPixel(
+						pixel,
+						x+i, y+j, width,
+						colorTable[colorIdx[idx]],
+						alphaTable[idx],
+					)
+				}
+			}
+		}
+	}
+}
+
+func refDecodeDXT5(pixel, raw []byte, width, height int) {
+	var colorTable [4][4]byte
+	var colorIdx [16]int
+	var alphaTable [8]byte
+	var alphaIdx [16]int
+
+	for y := 0; y < height; y += 4 {
+		for x := 0; x < width; x += 4 {
+			offset := x*4 + y*width
+
+			a0 := raw[offset]
+			a1 := raw[offset+1]
+			wzlib.ExpandAlphaTableDXT5(alphaTable[:], a0, a1)
+			wzlib.ExpandAlphaIndexTableDXT5(alphaIdx[:], raw, offset+2)
+
+			c0 := binary.LittleEndian.Uint16(raw[offset+8:])
+			c1 := binary.LittleEndian.Uint16(raw[offset+10:])
+			wzlib.ExpandColorTable(&colorTable, c0, c1)
+
+			wzlib.ExpandColorIndexTable(colorIdx[:], raw, offset+12)
+
+			for j := 0; j < 4; j++ {
+				for i := 0; i < 4; i++ {
+					idx := j*4 + i
+					wzlib.SetPixel(
+						pixel,
+						x+i, y+j, width,
+						colorTable[colorIdx[idx]],
+						alphaTable[alphaIdx[idx]],
+					)
+				}
+			}
+		}
+	}
+}
+
+func refDecodeARGB1555(out, raw []byte, count int) {
+	for i := 0; i < count; i++ {
+		val := binary.LittleEndian.Uint16(raw[i*2:])
+		rgba := wzlib.ARGB1555ToRGBA(val)
+		copy(out[i*4:], rgba[:])
+	}
+}
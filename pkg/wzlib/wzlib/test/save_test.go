@@ -0,0 +1,184 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// imageBytes 返回 img 在文件中的原始数据
+func imageBytes(t *testing.T, img *wzlib.WzImage) []byte {
+	t.Helper()
+	data := make([]byte, img.Size)
+	if _, err := img.WzFile.ReadAt(data, img.Offset); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSaveIncremental(t *testing.T) {
+	original := sampleFixture()
+	path := writeFixture(t, "Mob.wz", original)
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	wf := ws.WzFiles[0]
+
+	canvas := ws.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng)
+	pixels, err := canvas.GetRawData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untouched := imageBytes(t, ws.WzNode.GetNode("Sub/300.img").Value.(*wzlib.WzImage))
+
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	editAll(t, ws, tx)
+	if err := wf.Save(wzlib.SaveOptions{}); !errors.Is(err, wzlib.ErrTxActive) {
+		t.Fatalf("Save during a transaction: err = %v, want ErrTxActive", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Save(wzlib.SaveOptions{Backup: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if bak, err := os.ReadFile(path + ".bak"); err != nil || !bytes.Equal(bak, original) {
+		t.Fatalf("backup differs from the original file (err = %v)", err)
+	}
+	if wf.Changed() {
+		t.Error("saved file reported as changed on disk")
+	}
+	img := ws.WzNode.GetNode("100.img").Value.(*wzlib.WzImage)
+	if img.Modified() {
+		t.Error("100.img still marked modified after Save")
+	}
+	// 只改名的 img 原样复制
+	renamed := ws.WzNode.GetNode("Sub/301.img").Value.(*wzlib.WzImage)
+	if got := imageBytes(t, renamed); !bytes.Equal(got, untouched) {
+		t.Error("unmodified image was re-encoded")
+	}
+	// 已提取的画布指向新文件中的数据
+	if got, err := canvas.GetRawData(); err != nil || !bytes.Equal(got, pixels) {
+		t.Fatalf("canvas after Save: err = %v, equal = %v", err, bytes.Equal(got, pixels))
+	}
+
+	reopened := &wzlib.WzStructure{}
+	if err := reopened.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got, want := dumpTree(t, reopened.WzNode), dumpTree(t, ws.WzNode); got != want {
+		t.Fatalf("reopened tree:\n%s\nwant:\n%s", got, want)
+	}
+	if n := reopened.WzNode.GetNode("100.img/info/level"); n == nil || n.Value != int32(99) {
+		t.Fatalf("100.img/info/level = %v, want 99", n)
+	}
+	got, err := reopened.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng).GetRawData()
+	if err != nil || !bytes.Equal(got, pixels) {
+		t.Fatalf("reopened canvas: err = %v, equal = %v", err, bytes.Equal(got, pixels))
+	}
+}
+
+func TestSaveStrings(t *testing.T) {
+	for name, key := range map[string]*wzlib.WzCryptoKey{
+		"plain":     nil,
+		"encrypted": wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b}),
+	} {
+		t.Run(name, func(t *testing.T) { testSaveStrings(t, key) })
+	}
+}
+
+func testSaveStrings(t *testing.T, key *wzlib.WzCryptoKey) {
+	path := writeFixture(t, "String.wz", buildWzWithKey(key, fixtureImg("Mob.img", wzProp{"100", []wzProp{{"name", "snail"}}})))
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	values := map[string]string{
+		"name":  "蜗牛",
+		"long":  strings.Repeat("長", 200),
+		"ascii": strings.Repeat("x", 300),
+	}
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := ws.WzNode.GetNode("Mob.img/100")
+	for name, v := range values {
+		n := parent.FindChild(name)
+		if n == nil {
+			n = wzlib.NewWzNode(name)
+			if err := tx.Add(parent, n); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Set(n, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 重复的字符串写成引用
+	if err := tx.Add(parent, wzlib.NewWzNode("蜗牛")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WzFiles[0].Save(wzlib.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("backup written without Backup: %v", err)
+	}
+
+	reopened := &wzlib.WzStructure{}
+	if err := reopened.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for name, want := range values {
+		if n := reopened.WzNode.GetNode("Mob.img/100/" + name); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %q", name, n, want)
+		}
+	}
+	if reopened.WzNode.GetNode("Mob.img/100/蜗牛") == nil {
+		t.Error("property with a unicode name missing")
+	}
+}
+
+func TestSaveUnsupportedSource(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	if err := ws.WzFiles[0].Save(wzlib.SaveOptions{}); err == nil {
+		t.Fatal("Save of an in-memory file succeeded")
+	}
+}
+
+func TestSaveUnwritableNode(t *testing.T) {
+	original := sampleFixture()
+	path := writeFixture(t, "Mob.wz", original)
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// 绕过事务挂上的无值节点既不是目录也不是 img，保存时报错而不是静默丢弃
+	ws.WzNode.AddChild(wzlib.NewWzNode("NewDir"))
+	if err := ws.WzFiles[0].Save(wzlib.SaveOptions{}); err == nil || !strings.Contains(err.Error(), "NewDir") {
+		t.Fatalf("Save err = %v, want an error naming NewDir", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, original) {
+		t.Fatalf("file changed by a failed save: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	"archive/zip"
+	"bytes"
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/luoxk/wzlib"
+)
+
+//go:embed testdata/Mob.wz
+var testdataFS embed.FS
+
+// checkSampleTree 校验 sampleFixture 的内容是否正确读出。
+func checkSampleTree(t *testing.T, ws *wzlib.WzStructure) {
+	t.Helper()
+	if n := ws.WzNode.GetNode("100.img/info/level"); n == nil || n.Value != int32(1) {
+		t.Fatalf("100.img/info/level = %v", n)
+	}
+	if n := ws.WzNode.GetNode("Sub/300.img/value"); n == nil || n.Value != int32(300) {
+		t.Fatalf("Sub/300.img/value = %v", n)
+	}
+	canvas := ws.WzNode.GetNode("100.img/stand/0")
+	if canvas == nil || canvas.Type != "Canvas" {
+		t.Fatalf("100.img/stand/0 = %v", canvas)
+	}
+	if _, err := canvas.Value.(*wzlib.WzPng).ExtractImage(); err != nil {
+		t.Fatalf("ExtractImage: %v", err)
+	}
+}
+
+func loadSource(t *testing.T, src wzlib.WzSource, err error) *wzlib.WzStructure {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { src.Close() })
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzSource("Mob.wz", src); err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func TestSourceBytes(t *testing.T) {
+	checkSampleTree(t, loadSource(t, wzlib.NewBytesSource(sampleFixture()), nil))
+}
+
+func TestSourceEmbedFS(t *testing.T) {
+	src, err := wzlib.OpenFSSource(testdataFS, "testdata/Mob.wz")
+	checkSampleTree(t, loadSource(t, src, err))
+}
+
+func TestSourceMapFS(t *testing.T) {
+	fsys := fstest.MapFS{"data/Mob.wz": &fstest.MapFile{Data: sampleFixture()}}
+	src, err := wzlib.OpenFSSource(fsys, "data/Mob.wz")
+	checkSampleTree(t, loadSource(t, src, err))
+}
+
+func TestSourceMmap(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", sampleFixture())
+	src, err := wzlib.OpenMmapSource(path)
+	checkSampleTree(t, loadSource(t, src, err))
+
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFileMmap(path); err != nil {
+		t.Fatal(err)
+	}
+	canvas := ws.WzNode.GetNode("100.img/stand/0").Value.(*wzlib.WzPng)
+	want, err := canvas.GetRawData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关闭后不能再访问映射内存
+	if err := ws.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := canvas.GetRawData(); !errors.Is(err, wzlib.ErrClosed) {
+		t.Fatalf("GetRawData after Close = %v, want ErrClosed", err)
+	}
+	if len(want) != 4*4*4 {
+		t.Fatalf("raw data length = %d", len(want))
+	}
+}
+
+func TestSourceZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, m := range []struct {
+		name   string
+		method uint16
+	}{
+		{"stored/Mob.wz", zip.Store},
+		{"deflated/Mob.wz", zip.Deflate},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: m.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(sampleFixture())
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	for _, name := range []string{"stored/Mob.wz", "deflated/Mob.wz"} {
+		t.Run(name, func(t *testing.T) {
+			src, err := wzlib.OpenZipSource(bytes.NewReader(archive), int64(len(archive)), name)
+			checkSampleTree(t, loadSource(t, src, err))
+		})
+	}
+
+	zipPath := filepath.Join(t.TempDir(), "client.zip")
+	if err := os.WriteFile(zipPath, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err := wzlib.OpenZipFileSource(zipPath, "stored/Mob.wz")
+	checkSampleTree(t, loadSource(t, src, err))
+
+	_, err = wzlib.OpenZipSource(bytes.NewReader(archive), int64(len(archive)), "missing.wz")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("err = %v, want fs.ErrNotExist", err)
+	}
+}
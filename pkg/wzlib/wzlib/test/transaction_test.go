@@ -0,0 +1,275 @@
+package test
+
+import (
+	"errors"
+	"image"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// editAll 在 tx 中对样例树做各类修改
+func editAll(t *testing.T, ws *wzlib.WzStructure, tx *wzlib.Transaction) {
+	t.Helper()
+	root := ws.WzNode
+	steps := []error{
+		tx.Set(root.GetNode("100.img/info/level"), int32(99)),
+		tx.Set(root.GetNode("100.img/info/empty"), image.Pt(1, 2)),
+		tx.Remove(root.GetNode("100.img/info/speed")),
+		tx.Rename(root.GetNode("100.img/info/name"), "label"),
+		tx.Add(root.GetNode("200.img"), wzlib.NewWzNode("added")),
+		tx.Rename(root.GetNode("Sub/300.img"), "301.img"),
+		tx.Remove(root.GetNode("Sub/Deep")),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	before := dumpTree(t, ws.WzNode)
+
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	editAll(t, ws, tx)
+	if n := ws.WzNode.GetNode("100.img/info/level"); n.Value != int32(99) {
+		t.Fatalf("edit not visible inside the transaction: %v", n.Value)
+	}
+	if _, err := ws.Begin(); !errors.Is(err, wzlib.ErrTxActive) {
+		t.Fatalf("second Begin: err = %v, want ErrTxActive", err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if after := dumpTree(t, ws.WzNode); after != before {
+		t.Fatalf("tree after rollback:\n%s\nwant:\n%s", after, before)
+	}
+	if img := ws.WzNode.GetNode("Sub/300.img").Value.(*wzlib.WzImage); img.Name != "300.img" {
+		t.Errorf("image name after rollback = %q", img.Name)
+	}
+	for _, name := range []string{"100.img", "200.img"} {
+		if ws.WzNode.GetNode(name).Value.(*wzlib.WzImage).Modified() {
+			t.Errorf("%s still marked modified", name)
+		}
+	}
+	if err := tx.Commit(); !errors.Is(err, wzlib.ErrTxDone) {
+		t.Fatalf("Commit after Rollback: err = %v, want ErrTxDone", err)
+	}
+}
+
+func TestTransactionCommit(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	editAll(t, ws, tx)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set(ws.WzNode.GetNode("100.img/info/level"), int32(1)); !errors.Is(err, wzlib.ErrTxDone) {
+		t.Fatalf("Set after Commit: err = %v, want ErrTxDone", err)
+	}
+
+	img := ws.WzNode.GetNode("100.img").Value.(*wzlib.WzImage)
+	if !img.Modified() {
+		t.Fatal("100.img not marked modified")
+	}
+	// 修改过的 img 不会被卸载
+	img.Unload()
+	for path, want := range map[string]any{
+		"100.img/info/level": int32(99),
+		"100.img/info/empty": image.Pt(1, 2),
+		"100.img/info/label": "snail",
+	} {
+		if n := ws.WzNode.GetNode(path); n == nil || n.Value != want {
+			t.Errorf("%s = %v, want %v", path, n, want)
+		}
+	}
+	if n := ws.WzNode.GetNode("100.img/info/empty"); n.Type != "Shape2D#Vector2D" {
+		t.Errorf("empty has type %q", n.Type)
+	}
+	for _, path := range []string{"100.img/info/speed", "100.img/info/name", "Sub/300.img", "Sub/Deep"} {
+		if ws.WzNode.GetNode(path) != nil {
+			t.Errorf("%s still present", path)
+		}
+	}
+	if ws.WzNode.GetNode("200.img/added") == nil || ws.WzNode.GetNode("Sub/301.img/value") == nil {
+		t.Error("added or renamed node missing")
+	}
+	// 只改了目录的 img 不算修改
+	if ws.WzNode.GetNode("Sub/301.img").Value.(*wzlib.WzImage).Modified() {
+		t.Error("renamed image marked modified")
+	}
+
+	if _, err := ws.Begin(); err != nil {
+		t.Fatalf("Begin after Commit: %v", err)
+	}
+}
+
+func TestTransactionSavepoints(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	level := ws.WzNode.GetNode("100.img/info/level")
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.Set(level, int32(10)); err != nil {
+		t.Fatal(err)
+	}
+	sp := tx.Savepoint()
+	if err := tx.Set(level, int32(20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.RollbackTo(sp); err != nil {
+		t.Fatal(err)
+	}
+	if level.Value != int32(10) {
+		t.Fatalf("after RollbackTo: level = %v, want 10", level.Value)
+	}
+
+	// 内层失败只撤销内层的修改，外层失败撤销整个 Do
+	boom := errors.New("boom")
+	err = tx.Do(func(tx *wzlib.Transaction) error {
+		if err := tx.Set(level, int32(30)); err != nil {
+			return err
+		}
+		err := tx.Do(func(tx *wzlib.Transaction) error {
+			if err := tx.Set(level, int32(40)); err != nil {
+				return err
+			}
+			return boom
+		})
+		if !errors.Is(err, boom) {
+			t.Errorf("inner Do: err = %v, want boom", err)
+		}
+		if level.Value != int32(30) {
+			t.Errorf("after failed inner Do: level = %v, want 30", level.Value)
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("Do: err = %v, want boom", err)
+	}
+	if level.Value != int32(10) {
+		t.Fatalf("after failed outer Do: level = %v, want 10", level.Value)
+	}
+	if err := tx.RollbackTo(sp + 5); err == nil {
+		t.Fatal("RollbackTo with an invalid savepoint succeeded")
+	}
+}
+
+func TestTransactionErrors(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	before := dumpTree(t, ws.WzNode)
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	prop := wzlib.NewWzNode("prop")
+	prop.Value = int32(1)
+	dup := wzlib.NewWzNode("level")
+	badType := wzlib.NewWzNode("x")
+	badType.Value = int32(1)
+	badType.Type = "Canvas"
+	for name, c := range map[string]struct {
+		err  error
+		want error
+	}{
+		"set directory":   {tx.Set(ws.WzNode.GetNode("Sub"), int32(1)), wzlib.ErrNotEditable},
+		"set image":       {tx.Set(ws.WzNode.GetNode("200.img"), int32(1)), wzlib.ErrNotEditable},
+		"set container":   {tx.Set(ws.WzNode.GetNode("100.img/info"), int32(1)), wzlib.ErrNotEditable},
+		"set bad value":   {tx.Set(ws.WzNode.GetNode("100.img/info/level"), struct{}{}), wzlib.ErrNotEditable},
+		"add to leaf":     {tx.Add(ws.WzNode.GetNode("100.img/info/level"), wzlib.NewWzNode("x")), wzlib.ErrNotEditable},
+		"add prop to dir": {tx.Add(ws.WzNode.GetNode("Sub"), prop), wzlib.ErrNotEditable},
+		"add duplicate":   {tx.Add(ws.WzNode.GetNode("100.img/info"), dup), wzlib.ErrDuplicateName},
+		"add bad type":    {tx.Add(ws.WzNode.GetNode("100.img/info"), badType), wzlib.ErrNotEditable},
+		"add valueless":   {tx.Add(ws.WzNode, wzlib.NewWzNode("NewDir")), wzlib.ErrNotEditable},
+		"add attached":    {tx.Add(ws.WzNode.GetNode("200.img"), ws.WzNode.GetNode("100.img/info")), wzlib.ErrNotEditable},
+		"rename clash":    {tx.Rename(ws.WzNode.GetNode("100.img/info/name"), "level"), wzlib.ErrDuplicateName},
+		"remove root":     {tx.Remove(ws.WzNode), wzlib.ErrNotEditable},
+		"foreign node":    {tx.Remove(wzlib.NewWzNode("x")), wzlib.ErrNotEditable},
+	} {
+		if !errors.Is(c.err, c.want) {
+			t.Errorf("%s: err = %v, want %v", name, c.err, c.want)
+		}
+	}
+	// 被拒绝的修改不改变树，也不标记 img
+	if after := dumpTree(t, ws.WzNode); after != before {
+		t.Fatalf("tree changed by rejected edits:\n%s", after)
+	}
+	if ws.WzNode.GetNode("100.img").Value.(*wzlib.WzImage).Modified() {
+		t.Fatal("rejected edits marked 100.img modified")
+	}
+}
+
+func TestTransactionImageCache(t *testing.T) {
+	ws := cacheFixture(t, wzlib.NewImageCache(1, 0))
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set(ws.WzNode.GetNode("0.img/info/level"), int32(42)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// 提取别的 img 会淘汰 0.img，但修改不能丢
+	for _, name := range []string{"1.img", "2.img", "3.img"} {
+		if ws.WzNode.GetNode(name+"/info/level") == nil {
+			t.Fatalf("%s not extracted", name)
+		}
+	}
+	if n := ws.WzNode.GetNode("0.img/info/level"); n == nil || n.Value != int32(42) {
+		t.Fatalf("0.img/info/level = %v, want 42", n)
+	}
+}
+
+func TestTransactionEvictedNode(t *testing.T) {
+	ws := cacheFixture(t, wzlib.NewImageCache(1, 0))
+	level := ws.WzNode.GetNode("0.img/info/level")
+	info := ws.WzNode.GetNode("0.img/info")
+	// 提取 1.img 淘汰 0.img，之前取得的节点已不在树中
+	ws.WzNode.GetNode("1.img/info")
+	img := ws.WzNode.FindChild("0.img").Value.(*wzlib.WzImage)
+	if img.IsExtracted() {
+		t.Fatal("0.img was not evicted")
+	}
+
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	added := wzlib.NewWzNode("added")
+	added.Value = int32(1)
+	for name, err := range map[string]error{
+		"set":    tx.Set(level, int32(42)),
+		"add":    tx.Add(info, added),
+		"remove": tx.Remove(level),
+		"rename": tx.Rename(level, "lv"),
+	} {
+		if !errors.Is(err, wzlib.ErrNotEditable) {
+			t.Errorf("%s on an evicted node: err = %v, want ErrNotEditable", name, err)
+		}
+	}
+	if img.Modified() {
+		t.Fatal("rejected edits marked 0.img modified")
+	}
+
+	// 重新取得的节点可以修改
+	if err := tx.Set(ws.WzNode.GetNode("0.img/info/level"), int32(42)); err != nil {
+		t.Fatal(err)
+	}
+}
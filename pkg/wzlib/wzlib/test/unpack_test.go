@@ -0,0 +1,301 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// pcmFormat 返回单声道 16 位 PCM 的 WAVEFORMATEX
+func pcmFormat() []byte {
+	var b bytes.Buffer
+	for _, v := range []any{uint16(1), uint16(1), uint32(22050), uint32(44100), uint16(2), uint16(16), uint16(0)} {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	return b.Bytes()
+}
+
+// unpackFixture 覆盖 image.txt 中的每种类型，用 GMS 密钥加密
+func unpackFixture() []byte {
+	key := wzlib.NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b})
+	return buildWzWithKey(key,
+		fixtureImg("100.img",
+			wzProp{"info", []wzProp{
+				{"name", "蜗牛 \"snail\""},
+				{"level", int32(7)},
+				{"speed", int16(-30)},
+				{"exp", int64(1 << 40)},
+				{"rate", float32(0.1)},
+				{"ratio", float64(1.0 / 3)},
+				{"empty", nil},
+				{"two words", "a\tb"},
+			}},
+			wzProp{"stand", []wzProp{
+				{"0", &fixtureCanvas{width: 4, height: 4, bgra: pixelsOf(4, 4, 1), props: []wzProp{
+					{"origin", image.Pt(2, -4)},
+					{"delay", int32(120)},
+				}}},
+				{"1", &fixtureCanvas{width: 2, height: 2, form: 1, bgra: pixelsOf(2, 2, 5)[:8]}},
+				{"2", fixtureUOL("0")},
+			}},
+			wzProp{"die", &fixtureSound{ms: 500, format: mp3Format(), encrypt: true, data: []byte("ID3 mp3 payload")}},
+			wzProp{"hit", &fixtureSound{ms: 100, format: pcmFormat(), data: []byte{1, 0, 2, 0, 3, 0}}},
+		),
+		fixtureDirEntry("Sub",
+			fixtureImg("300.img", wzProp{"a/b", int32(300)}),
+			fixtureDirEntry("Deep", fixtureImg("400.img", wzProp{"value", "deep"})),
+		),
+		fixtureImg("200.img", wzProp{"info", []wzProp{{"level", int32(2)}}}),
+	)
+}
+
+// valueTree 列出节点的路径、类型与值，画布与音频列出解码后的内容，不含文件中的位置
+func valueTree(t *testing.T, n *wzlib.WzNode) string {
+	t.Helper()
+	var sb strings.Builder
+	var walk func(n *wzlib.WzNode, path string)
+	walk = func(n *wzlib.WzNode, path string) {
+		for _, c := range n.Children() {
+			p := path + "/" + c.Text
+			switch v := c.Value.(type) {
+			case *wzlib.WzImage:
+				if err := v.TryExtract(); err != nil {
+					t.Fatalf("%s: %v", p, err)
+				}
+				fmt.Fprintf(&sb, "%s img\n", p)
+			case *wzlib.WzDirectory:
+				fmt.Fprintf(&sb, "%s dir\n", p)
+			case *wzlib.WzPng:
+				fmt.Fprintf(&sb, "%s %dx%d form=%d %x\n", p, v.Width, v.Height, v.Form, rawData(t, c))
+			case *wzlib.WzSound:
+				data := make([]byte, v.DataLength)
+				if err := v.CopyTo(data, 0); err != nil {
+					t.Fatalf("%s: %v", p, err)
+				}
+				fmt.Fprintf(&sb, "%s sound %d ms %d Hz %v %q\n", p, v.Ms, v.Frequency(), v.SoundType(), data)
+			case *wzlib.WzUol:
+				fmt.Fprintf(&sb, "%s %s %q\n", p, c.Type, v.Uol)
+			default:
+				fmt.Fprintf(&sb, "%s %s %T %v\n", p, c.Type, v, v)
+			}
+			walk(c, p)
+		}
+	}
+	walk(n, "")
+	return sb.String()
+}
+
+// readTree 读出文件夹中所有文件的内容，键为相对路径
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestUnpackRepack(t *testing.T) {
+	src := loadFixture(t, unpackFixture())
+	defer src.Close()
+	dir := filepath.Join(t.TempDir(), "Mob")
+	if err := src.WzFiles[0].Unpack(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readTree(t, dir)
+	for _, want := range []string{"dir.txt", "100.img/stand/0.png", "100.img/die.mp3", "100.img/hit.wav", "Sub/300.img/image.txt", "Sub/Deep/dir.txt"} {
+		if _, ok := files[want]; !ok {
+			t.Errorf("%s not written", want)
+		}
+	}
+	if !strings.HasPrefix(files["dir.txt"], "version ") || !strings.Contains(files["dir.txt"], "key GMS\nimage 100.img\nimage 200.img\ndir Sub\n") {
+		t.Errorf("dir.txt:\n%s", files["dir.txt"])
+	}
+	for _, want := range []string{
+		"info property\n",
+		`  name string "蜗牛 \"snail\""` + "\n",
+		"  level int 7\n",
+		"  rate float 0.1\n",
+		"  empty null\n",
+		`  "two words" string "a\tb"` + "\n",
+		`  0 canvas "stand/0.png" form=2` + "\n    origin vector 2,-4\n",
+		`  2 uol "0"` + "\n",
+		`die sound "die.mp3" ms=500 format=5500`,
+	} {
+		if !strings.Contains(files["100.img/image.txt"], want) {
+			t.Errorf("image.txt lacks %q:\n%s", want, files["100.img/image.txt"])
+		}
+	}
+	if text := files["Sub/300.img/image.txt"]; text != "a/b int 300\n" {
+		t.Errorf("300.img/image.txt = %q", text)
+	}
+
+	out := filepath.Join(t.TempDir(), "Mob.wz")
+	if err := wzlib.Repack(dir, out, wzlib.RepackOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	repacked := &wzlib.WzStructure{}
+	if err := repacked.LoadWzFile(out); err != nil {
+		t.Fatal(err)
+	}
+	defer repacked.Close()
+	if repacked.Encryption.EncType != wzlib.GMS {
+		t.Errorf("repacked key = %v, want GMS", repacked.Encryption.EncType)
+	}
+	if got, want := valueTree(t, repacked.WzNode), valueTree(t, src.WzNode); got != want {
+		t.Fatalf("repacked tree:\n%s\nwant:\n%s", got, want)
+	}
+
+	// 再次解包得到相同的文件
+	again := filepath.Join(t.TempDir(), "Mob")
+	if err := repacked.WzFiles[0].Unpack(again); err != nil {
+		t.Fatal(err)
+	}
+	second := readTree(t, again)
+	if len(second) != len(files) {
+		t.Errorf("second unpack has %d files, first %d", len(second), len(files))
+	}
+	for name, data := range files {
+		if second[name] != data {
+			t.Errorf("%s differs between unpacks", name)
+		}
+	}
+}
+
+func TestRepackImage(t *testing.T) {
+	path := writeFixture(t, "Mob.wz", unpackFixture())
+	ws := &wzlib.WzStructure{}
+	if err := ws.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	dir := filepath.Join(t.TempDir(), "100.img")
+	if err := wzlib.UnpackImage(ws.WzNode.GetNode("100.img"), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// 改一个值，换掉一张图；stand/1 的新像素无法用 ARGB4444 表示
+	text, err := os.ReadFile(filepath.Join(dir, "image.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text = bytes.Replace(text, []byte("level int 7"), []byte("level int 8"), 1)
+	if err := os.WriteFile(filepath.Join(dir, "image.txt"), text, 0644); err != nil {
+		t.Fatal(err)
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range canvas.Pix {
+		canvas.Pix[i] = byte(i*37 + 1)
+	}
+	for _, name := range []string{"stand/0.png", "stand/1.png"} {
+		var buf bytes.Buffer
+		png.Encode(&buf, canvas)
+		if err := os.WriteFile(filepath.Join(dir, name), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	node, err := wzlib.RepackImage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Text != "100.img" {
+		t.Errorf("image name = %q", node.Text)
+	}
+	// 保存前画布从内存解码
+	if img, err := node.GetNode("stand/0").Value.(*wzlib.WzPng).ExtractImage(); err != nil || img.At(2, 1) != canvas.At(2, 1) {
+		t.Fatalf("canvas before save: %v", err)
+	}
+
+	tx, err := ws.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Remove(ws.WzNode.GetNode("100.img")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Add(ws.WzNode, node); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.WzFiles[0].Save(wzlib.SaveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := &wzlib.WzStructure{}
+	if err := reopened.LoadWzFile(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	root := reopened.WzNode
+	if n := root.GetNode("100.img/info/level"); n == nil || n.Value != int32(8) {
+		t.Errorf("info/level = %v, want 8", n)
+	}
+	for _, name := range []string{"stand/0", "stand/1"} {
+		p := root.GetNode("100.img/" + name).Value.(*wzlib.WzPng)
+		img, err := p.ExtractImage()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if p.Form != 2 || img.Bounds() != canvas.Rect {
+			t.Errorf("%s: form %d, bounds %v", name, p.Form, img.Bounds())
+		}
+		for y := range 2 {
+			for x := range 3 {
+				if got, want := color.NRGBAModel.Convert(img.At(x, y)), canvas.At(x, y); got != want {
+					t.Fatalf("%s (%d,%d) = %v, want %v", name, x, y, got, want)
+				}
+			}
+		}
+	}
+	if got, want := valueTree(t, root.GetNode("100.img/hit")), valueTree(t, ws.WzNode.GetNode("100.img/hit")); got != want {
+		t.Errorf("hit = %q, want %q", got, want)
+	}
+	if n := root.GetNode("100.img/stand/0/origin"); n == nil || n.Value != image.Pt(2, -4) {
+		t.Errorf("stand/0/origin = %v", n)
+	}
+}
+
+func TestUnpackErrors(t *testing.T) {
+	ws := loadFixture(t, unpackFixture())
+	defer ws.Close()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "keep.txt"), nil, 0644)
+	if err := ws.WzFiles[0].Unpack(dir); err == nil {
+		t.Error("Unpack into a non-empty folder succeeded")
+	}
+
+	img := filepath.Join(t.TempDir(), "1.img")
+	os.Mkdir(img, 0755)
+	os.WriteFile(filepath.Join(img, "image.txt"), []byte("a int 1\na int 2\n"), 0644)
+	if _, err := wzlib.RepackImage(img); !errors.Is(err, wzlib.ErrDuplicateName) || !strings.Contains(err.Error(), "image.txt:2") {
+		t.Errorf("duplicate name: err = %v", err)
+	}
+	os.WriteFile(filepath.Join(img, "image.txt"), []byte("a canvas \"../x.png\" form=2\n"), 0644)
+	if _, err := wzlib.RepackImage(img); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("canvas outside the folder: err = %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/luoxk/wzlib"
+)
+
+// walkTrace 以 "深度:名称" 的形式记录访问顺序
+func walkTrace(t *testing.T, root *wzlib.WzNode, opts wzlib.WalkOptions, fn wzlib.WalkFunc) string {
+	t.Helper()
+	var trace []string
+	err := root.Walk(opts, func(n *wzlib.WzNode, depth int) error {
+		trace = append(trace, fmt.Sprintf("%d:%s", depth, n.Text))
+		if fn != nil {
+			return fn(n, depth)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(trace, " ")
+}
+
+func TestWalk(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	defer ws.Close()
+
+	got := walkTrace(t, ws.WzNode, wzlib.WalkOptions{Extract: true}, nil)
+	want := "0:Mob.wz " +
+		"1:100.img 2:info 3:name 3:level 3:speed 3:exp 3:rate 3:ratio 3:empty 2:stand 3:0 4:origin 4:delay 3:1 " +
+		"1:200.img 2:info 3:level " +
+		"1:Sub 2:300.img 3:value 2:Deep 3:400.img 4:value"
+	if got != want {
+		t.Fatalf("walk order:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWalkWithoutExtract(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	defer ws.Close()
+	ws.WzNode.GetNode("200.img/info")
+
+	// 只进入已提取的 img，目录仍然按需读取
+	got := walkTrace(t, ws.WzNode, wzlib.WalkOptions{}, nil)
+	want := "0:Mob.wz 1:100.img 1:200.img 2:info 3:level 1:Sub 2:300.img 2:Deep 3:400.img"
+	if got != want {
+		t.Fatalf("walk order:\n%s\nwant:\n%s", got, want)
+	}
+	if ws.WzNode.FindChild("100.img").Value.(*wzlib.WzImage).IsExtracted() {
+		t.Fatal("Walk without Extract extracted 100.img")
+	}
+}
+
+func TestWalkSignals(t *testing.T) {
+	ws := loadFixture(t, sampleFixture())
+	defer ws.Close()
+	opts := wzlib.WalkOptions{Extract: true}
+
+	got := walkTrace(t, ws.WzNode, opts, func(n *wzlib.WzNode, depth int) error {
+		if strings.HasSuffix(n.Text, ".img") || n.Text == "Deep" {
+			return wzlib.SkipSubtree
+		}
+		return nil
+	})
+	if want := "0:Mob.wz 1:100.img 1:200.img 1:Sub 2:300.img 2:Deep"; got != want {
+		t.Fatalf("SkipSubtree: %s, want %s", got, want)
+	}
+
+	got = walkTrace(t, ws.WzNode, opts, func(n *wzlib.WzNode, depth int) error {
+		if n.Text == "200.img" {
+			return wzlib.StopWalk
+		}
+		if depth == 1 {
+			return wzlib.SkipSubtree
+		}
+		return nil
+	})
+	if want := "0:Mob.wz 1:100.img 1:200.img"; got != want {
+		t.Fatalf("StopWalk: %s, want %s", got, want)
+	}
+
+	got = walkTrace(t, ws.WzNode, wzlib.WalkOptions{MaxDepth: 2}, nil)
+	if want := "0:Mob.wz 1:100.img 1:200.img 1:Sub 2:300.img 2:Deep"; got != want {
+		t.Fatalf("MaxDepth: %s, want %s", got, want)
+	}
+
+	errBoom := errors.New("boom")
+	err := ws.WzNode.Walk(opts, func(n *wzlib.WzNode, depth int) error {
+		if n.Text == "stand" {
+			return errBoom
+		}
+		return nil
+	})
+	if err != errBoom {
+		t.Fatalf("Walk = %v, want %v", err, errBoom)
+	}
+}
+
+func TestWalkImages(t *testing.T) {
+	ws := wideFixture(t, 64)
+	defer ws.Close()
+
+	var want []string
+	ws.WzNode.Walk(wzlib.WalkOptions{}, func(n *wzlib.WzNode, depth int) error {
+		if _, ok := n.Value.(*wzlib.WzImage); ok {
+			want = append(want, n.GetFullPath())
+		}
+		return nil
+	})
+
+	// 结果按遍历顺序排列，与调度无关
+	for i := 0; i < 5; i++ {
+		got, err := wzlib.WalkImages(context.Background(), ws.WzNode, 8, func(n *wzlib.WzNode) (string, error) {
+			if !n.Value.(*wzlib.WzImage).IsExtracted() {
+				return "", fmt.Errorf("%s not extracted", n.Text)
+			}
+			return n.GetFullPath(), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("results out of order:\n%v\nwant:\n%v", got, want)
+		}
+	}
+}
+
+func TestWalkImagesError(t *testing.T) {
+	ws := wideFixture(t, 64)
+	defer ws.Close()
+
+	// 多个 img 出错时总是返回遍历顺序中最靠前的错误
+	for i := 0; i < 5; i++ {
+		_, err := wzlib.WalkImages(context.Background(), ws.WzNode, 8, func(n *wzlib.WzNode) (int, error) {
+			if n.Text == "00000010.img" || n.Text == "00000040.img" {
+				return 0, errors.New(n.Text)
+			}
+			return 0, nil
+		})
+		if err == nil || err.Error() != "00000010.img" {
+			t.Fatalf("WalkImages = %v, want 00000010.img", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := wzlib.WalkImages(ctx, ws.WzNode, 8, func(n *wzlib.WzNode) (int, error) {
+		return 0, nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WalkImages with cancelled ctx = %v", err)
+	}
+}
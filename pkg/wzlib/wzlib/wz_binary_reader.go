@@ -1,10 +1,15 @@
 package wzlib
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
+	"math"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/text/encoding"
 )
 
 type Decrypter interface {
@@ -14,11 +19,15 @@ type Decrypter interface {
 type WzBinaryReader struct {
 	BaseStream io.ReadSeeker
 	ReaderAt   io.ReaderAt // 可选，只有底层支持才设置
-	file       *os.File
-}
+	buf        [8]byte
+
+	names   *stringTable    // 非 nil 时属性名与对象类型名经由它驻留
+	scratch []byte          // 驻留字符串时的解码缓冲区
+	ctx     context.Context // 非 nil 时提取 img 的过程中检查取消
+	entries int             // 已提取的属性数，用于报告进度
 
-func (r *WzBinaryReader) File() *os.File {
-	return r.file
+	text      encoding.Encoding // 非 nil 时用它解码非 Unicode 字符串中的非 ASCII 字节
+	maxString int               // 字符串的最大字节数，0 表示不限
 }
 
 func NewWzBinaryReader(stream io.ReadSeeker) *WzBinaryReader {
@@ -27,14 +36,10 @@ func NewWzBinaryReader(stream io.ReadSeeker) *WzBinaryReader {
 		ra = r
 	}
 
-	wzb := &WzBinaryReader{
+	return &WzBinaryReader{
 		BaseStream: stream,
 		ReaderAt:   ra,
 	}
-	if file, ok := stream.(*os.File); ok {
-		wzb.file = file
-	}
-	return wzb
 }
 
 func (r *WzBinaryReader) PartialStream() *PartialStream {
@@ -47,119 +52,141 @@ func (r *WzBinaryReader) PartialStream() *PartialStream {
 	return nil
 }
 
+// read 读取 n (<= 8) 个字节到内部缓冲区，避免 binary.Read 的反射与分配
+func (r *WzBinaryReader) read(n int) ([]byte, error) {
+	b := r.buf[:n]
+	if _, err := io.ReadFull(r.BaseStream, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func (r *WzBinaryReader) ReadCompressedSingle() (float32, error) {
-	var fl int8
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &fl)
+	fl, err := r.ReadSByte()
 	if err != nil {
 		return 0, err
 	}
 
 	if fl == -128 {
-		var val float32
-		if err := binary.Read(r.BaseStream, binary.LittleEndian, &val); err != nil {
+		b, err := r.read(4)
+		if err != nil {
 			return 0, err
 		}
-		return val, nil
+		return math.Float32frombits(binary.LittleEndian.Uint32(b)), nil
 	}
 
 	return float32(fl), nil
 }
 
 func (r *WzBinaryReader) ReadDouble() (float64, error) {
-	var val float64
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	b, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
 }
 
 func (r *WzBinaryReader) ReadByte() (byte, error) {
-
-	var b [1]byte
-	_, err := r.BaseStream.Read(b[:])
-	return b[0], err
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
 }
+
 func (r *WzBinaryReader) ReadSByte() (int8, error) {
-	var val int8
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	b, err := r.ReadByte()
+	return int8(b), err
 }
 
 func (r *WzBinaryReader) ReadInt16() (int16, error) {
-
-	var val int16
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	v, err := r.ReadUInt16()
+	return int16(v), err
 }
-func (r *WzBinaryReader) ReadUInt16() (uint16, error) {
 
-	var val uint16
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+func (r *WzBinaryReader) ReadUInt16() (uint16, error) {
+	b, err := r.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
 }
 
 func (r *WzBinaryReader) ReadInt32() (int32, error) {
-
-	var val int32
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	v, err := r.ReadUInt32()
+	return int32(v), err
 }
 
 func (r *WzBinaryReader) ReadUInt32() (uint32, error) {
-
-	var val uint32
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	b, err := r.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
 }
 
 func (r *WzBinaryReader) ReadInt64() (int64, error) {
-
-	var val int64
-	err := binary.Read(r.BaseStream, binary.LittleEndian, &val)
-	return val, err
+	b, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
 }
 
 func (r *WzBinaryReader) ReadCompressedInt32() (int32, error) {
-
-	var b [1]byte
-	_, err := r.BaseStream.Read(b[:])
+	b, err := r.ReadSByte()
 	if err != nil {
 		return 0, err
 	}
 
-	if b[0] == 0x80 {
-		var val int32
-		err = binary.Read(r.BaseStream, binary.LittleEndian, &val)
-		return val, err
+	if b == -128 {
+		return r.ReadInt32()
 	}
 
-	return int32(int8(b[0])), nil
+	return int32(b), nil
 }
 
 func (r *WzBinaryReader) ReadCompressedInt64() (int64, error) {
-
-	var b [1]byte
-	_, err := r.BaseStream.Read(b[:])
+	b, err := r.ReadSByte()
 	if err != nil {
 		return 0, err
 	}
 
-	if b[0] == 0x80 {
-		var val int64
-		err = binary.Read(r.BaseStream, binary.LittleEndian, &val)
-		return val, err
+	if b == -128 {
+		return r.ReadInt64()
 	}
 
-	return int64(int8(b[0])), nil
+	return int64(b), nil
+}
+
+// view 将接下来的 n 字节交给 fn。底层为 MmapSource 时 b 直接指向映射内存，
+// 只在 fn 内有效且不可修改
+func (r *WzBinaryReader) view(n int, fn func(b []byte) error) error {
+	if ps := r.PartialStream(); ps != nil {
+		return ps.view(int64(n), fn)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.BaseStream, buf); err != nil {
+		return err
+	}
+	return fn(buf)
 }
+
 func (r *WzBinaryReader) ReadString(decrypter Decrypter) (string, error) {
+	return r.readString(decrypter, false)
+}
 
-	/*currentPos, err := r.BaseStream.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return "", err
-	}*/
+// readString 读取字符串；intern 为 true 且设置了 names 时返回驻留的字符串，
+// 命中时不为结果分配内存
+func (r *WzBinaryReader) readString(decrypter Decrypter, intern bool) (string, error) {
+	intern = intern && r.names != nil
 
 	var size int8
 	var err error
-	size, _ = r.ReadSByte()
+	size, err = r.ReadSByte()
+	if err != nil {
+		return "", err
+	}
 	if size < 0 { // ASCII/cp1252 字符串
 		var usize int
 		if size == -128 {
@@ -171,9 +198,23 @@ func (r *WzBinaryReader) ReadString(decrypter Decrypter) (string, error) {
 		} else {
 			usize = -int(size)
 		}
+		if err := r.checkStringLen(usize); err != nil {
+			return "", err
+		}
 
-		buffer := make([]byte, usize)
-		_, err = r.BaseStream.Read(buffer)
+		var buffer []byte
+		if intern {
+			if cap(r.scratch) < usize {
+				r.scratch = make([]byte, usize)
+			}
+			buffer = r.scratch[:usize]
+		} else {
+			buffer = make([]byte, usize)
+		}
+		err = r.view(usize, func(b []byte) error {
+			copy(buffer, b)
+			return nil
+		})
 		if err != nil {
 			return "", err
 		}
@@ -184,28 +225,77 @@ func (r *WzBinaryReader) ReadString(decrypter Decrypter) (string, error) {
 			buffer[i] ^= mask
 			mask++
 		}
+		if r.text != nil && !isASCII(buffer) {
+			if decoded, err := r.text.NewDecoder().Bytes(buffer); err == nil {
+				buffer = decoded
+			}
+		}
 
-		return string(buffer), nil
-	} else if size > 0 { // UTF-16LE 字符串
-		buffer := make([]byte, int(size)*2)
-		_, err = r.BaseStream.Read(buffer)
+		if intern {
+			return r.names.intern(buffer), nil
+		}
+		// buffer 之后不再修改，直接转为字符串
+		return unsafe.String(unsafe.SliceData(buffer), len(buffer)), nil
+	} else if size > 0 { // UTF-16LE 字符串，长度 127 表示后面跟 int32 长度
+		usize := int(size)
+		if size == 127 {
+			size32, err := r.ReadInt32()
+			if err != nil {
+				return "", err
+			}
+			usize = int(size32)
+		}
+		if err := r.checkStringLen(usize * 2); err != nil {
+			return "", err
+		}
+		buffer := make([]byte, usize*2)
+		err = r.view(len(buffer), func(b []byte) error {
+			copy(buffer, b)
+			return nil
+		})
 		if err != nil {
 			return "", err
 		}
 
-		decrypter.Decrypt(buffer, 0, int(size)*2)
-		runes := make([]rune, size)
-		for i := 0; i < int(size); i++ {
-			runes[i] = rune(buffer[i*2]) | rune(buffer[i*2+1])<<8
-			runes[i] ^= 0xAAAA
+		decrypter.Decrypt(buffer, 0, usize*2)
+		chars := make([]uint16, usize)
+		mask := uint16(0xAAAA)
+		for i := range chars {
+			chars[i] = binary.LittleEndian.Uint16(buffer[i*2:]) ^ mask
+			mask++
 		}
+		runes := utf16.Decode(chars)
 
-		return string(runes), nil
+		s := string(runes)
+		if intern {
+			return r.names.intern(unsafe.Slice(unsafe.StringData(s), len(s))), nil
+		}
+		return s, nil
 	}
 
 	return "", nil
 }
 
+// checkStringLen 在字符串长度超出 maxString 时返回错误
+func (r *WzBinaryReader) checkStringLen(n int) error {
+	if n < 0 {
+		return fmt.Errorf("invalid string length %d", n)
+	}
+	if r.maxString > 0 && n > r.maxString {
+		return fmt.Errorf("%w: string of %d bytes, max %d", ErrLimitExceeded, n, r.maxString)
+	}
+	return nil
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *WzBinaryReader) SkipBytes(count int64) error {
 
 	_, err := r.BaseStream.Seek(count, io.SeekCurrent)
@@ -213,7 +303,10 @@ func (r *WzBinaryReader) SkipBytes(count int64) error {
 }
 
 func (r *WzBinaryReader) ReadStringAt(offset int64, decrypter Decrypter) (string, error) {
+	return r.readStringAt(offset, decrypter, false)
+}
 
+func (r *WzBinaryReader) readStringAt(offset int64, decrypter Decrypter, intern bool) (string, error) {
 	currentPos, err := r.BaseStream.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return "", err
@@ -224,7 +317,7 @@ func (r *WzBinaryReader) ReadStringAt(offset int64, decrypter Decrypter) (string
 		return "", err
 	}
 
-	result, err := r.ReadString(decrypter)
+	result, err := r.readString(decrypter, intern)
 	if err != nil {
 		return "", err
 	}
@@ -242,20 +335,28 @@ func (r *WzBinaryReader) ReadImageObjectTypeName(decrypter Decrypter) (string, e
 
 	switch flag {
 	case 0x73:
-		return r.ReadString(decrypter)
+		return r.readString(decrypter, true)
 	case 0x1B:
 		offset, err := r.ReadInt32()
 		if err != nil {
 			return "", err
 		}
-		return r.ReadStringAt(int64(offset), decrypter)
+		return r.readStringAt(int64(offset), decrypter, true)
 	default:
-		return "", fmt.Errorf("unexpected flag '%x' when reading string", flag)
+		return "", &UnknownFlagError{Flag: flag, Context: "object type name"}
 	}
 }
 
 func (r *WzBinaryReader) ReadImageString(decrypter Decrypter) (string, error) {
+	return r.readImageString(decrypter, false)
+}
+
+// readImageName 读取属性名，设置了 names 时驻留
+func (r *WzBinaryReader) readImageName(decrypter Decrypter) (string, error) {
+	return r.readImageString(decrypter, true)
+}
 
+func (r *WzBinaryReader) readImageString(decrypter Decrypter, intern bool) (string, error) {
 	flag, err := r.ReadByte()
 	if err != nil {
 		return "", err
@@ -263,13 +364,13 @@ func (r *WzBinaryReader) ReadImageString(decrypter Decrypter) (string, error) {
 
 	switch flag {
 	case 0x00:
-		return r.ReadString(decrypter)
+		return r.readString(decrypter, intern)
 	case 0x01:
 		offset, err := r.ReadInt32()
 		if err != nil {
 			return "", err
 		}
-		return r.ReadStringAt(int64(offset), decrypter)
+		return r.readStringAt(int64(offset), decrypter, intern)
 	case 0x04:
 		err := r.SkipBytes(8)
 		if err != nil {
@@ -277,7 +378,7 @@ func (r *WzBinaryReader) ReadImageString(decrypter Decrypter) (string, error) {
 		}
 		return "", nil
 	default:
-		return "", fmt.Errorf("unexpected flag '%x' when reading string", flag)
+		return "", &UnknownFlagError{Flag: flag, Context: "string"}
 	}
 }
 
@@ -290,6 +391,18 @@ func (r *WzBinaryReader) Read(p []byte) (n int, err error) {
 }
 
 func (r *WzBinaryReader) Pos() int64 {
+	if ps := r.PartialStream(); ps != nil {
+		return ps.position
+	}
 	now, _ := r.BaseStream.Seek(0, io.SeekCurrent)
 	return now
 }
+
+// AbsPos returns the current position as an absolute offset in the WZ file.
+func (r *WzBinaryReader) AbsPos() int64 {
+	pos := r.Pos()
+	if ps := r.PartialStream(); ps != nil {
+		return ps.Offset + pos
+	}
+	return pos
+}
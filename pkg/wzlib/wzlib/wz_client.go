@@ -0,0 +1,346 @@
+package wzlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ClientLayout 描述客户端目录中 WZ 文件的组织方式
+type ClientLayout int
+
+const (
+	LayoutUnknown ClientLayout = iota
+	LayoutClassic              // 目录下直接是 Mob.wz、Map.wz 等，扩展文件为 Mob2.wz 或 Mob001.wz
+	LayoutBase                 // 同 LayoutClassic，但以 Base.wz 为清单，只加载其中列出的分类
+	LayoutData                 // 64 位客户端：Data/<分类>/<分类>.wz、<分类>_NNN.wz 与 <分类>.ini，有 Data/Base 时同样以其为清单
+)
+
+func (l ClientLayout) String() string {
+	switch l {
+	case LayoutClassic:
+		return "classic"
+	case LayoutBase:
+		return "base"
+	case LayoutData:
+		return "data"
+	}
+	return "unknown"
+}
+
+// DetectClientLayout reports how the WZ files under dir are organized and
+// the directory that holds them: dir itself, or its Data subdirectory for
+// a 64-bit client. dir may also be the Data directory itself.
+func DetectClientLayout(dir string) (ClientLayout, string, error) {
+	data := filepath.Join(dir, "Data")
+	if len(dataCategories(data)) > 0 {
+		return LayoutData, data, nil
+	}
+	if len(dataCategories(dir)) > 0 {
+		return LayoutData, dir, nil
+	}
+	files, err := classicCategories(dir)
+	if err != nil {
+		return LayoutUnknown, "", err
+	}
+	if len(files) == 0 {
+		return LayoutUnknown, "", fmt.Errorf("%w: %s", ErrUnknownLayout, dir)
+	}
+	for _, name := range files {
+		if strings.EqualFold(name, "Base.wz") {
+			return LayoutBase, dir, nil
+		}
+	}
+	return LayoutClassic, dir, nil
+}
+
+// MountClient loads every WZ file of the client installed in dir under one
+// root node named after dir. Each category (Mob, Map, ...) becomes a child
+// of the root holding the file's entries, so Mob/100100.img resolves from
+// ws.WzNode; extension files are merged into their category. The layout is
+// detected with DetectClientLayout.
+//
+// When the client has a Base.wz it is used as the manifest: its entries
+// become the root's children, and each empty directory in it is a category
+// filled from the sibling <Name>.wz (or Data/<Name> folder). Files that
+// Base.wz does not list are not loaded.
+//
+// Like LoadWzFile, MountClient fails with ErrAlreadyLoaded when the
+// structure already has a root.
+func (ws *WzStructure) MountClient(dir string) error {
+	return ws.MountClientContext(context.Background(), dir)
+}
+
+// MountClientContext is like MountClient but stops when ctx is cancelled.
+// On error every file opened by the mount is closed again.
+func (ws *WzStructure) MountClientContext(ctx context.Context, dir string) (err error) {
+	if ws.WzNode != nil {
+		return ErrAlreadyLoaded
+	}
+	layout, dataDir, err := DetectClientLayout(dir)
+	if err != nil {
+		return err
+	}
+
+	opened := len(ws.WzFiles)
+	defer func() {
+		if err != nil {
+			for _, wf := range ws.WzFiles[opened:] {
+				wf.Close()
+			}
+			ws.WzFiles = ws.WzFiles[:opened]
+		}
+	}()
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root := NewWzNode(filepath.Base(abs))
+	switch {
+	case layout == LayoutData && isFile(filepath.Join(dataDir, "Base", "Base.wz")):
+		err = ws.mountDataBase(ctx, dataDir, root)
+	case layout == LayoutData:
+		err = ws.mountData(ctx, dataDir, root)
+	case layout == LayoutBase:
+		err = ws.mountBase(ctx, dataDir, root)
+	default:
+		err = ws.mountClassic(ctx, dataDir, root)
+	}
+	if err != nil {
+		return err
+	}
+	ws.logger().Info("mounted client", "dir", dir, "layout", layout.String(), "files", len(ws.WzFiles)-opened)
+	ws.WzNode = root
+	return nil
+}
+
+// mountClassic 为 dir 下的每个 <分类>.wz 建立一个子节点，扩展文件合并到对应分类
+func (ws *WzStructure) mountClassic(ctx context.Context, dir string, root *WzNode) error {
+	names, err := classicCategories(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		fileName := filepath.Join(dir, name)
+		wzFile, err := NewWzFile(fileName)
+		if errors.Is(err, ErrBadSignature) {
+			// 旧客户端的 List.wz 不是 PKG1 格式
+			ws.logger().Debug("skipped file without a PKG1 header", "file", fileName)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		node := NewWzNode(strings.TrimSuffix(name, filepath.Ext(name)))
+		node.Value = wzFile
+		if err := ws.readFile(ctx, wzFile, node, true); err != nil {
+			wzFile.Close()
+			return err
+		}
+		root.AddChild(node)
+	}
+	return nil
+}
+
+// mountBase 读取 Base.wz 到 root，再按清单加载同目录的分类文件
+func (ws *WzStructure) mountBase(ctx context.Context, dir string, root *WzNode) error {
+	names, err := classicCategories(dir)
+	if err != nil {
+		return err
+	}
+	files := map[string]string{} // 小写分类名 -> 文件名
+	for _, name := range names {
+		files[strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))] = name
+	}
+
+	baseFile, err := NewWzFile(filepath.Join(dir, files["base"]))
+	if err != nil {
+		return err
+	}
+	if err := ws.readFile(ctx, baseFile, root, false); err != nil {
+		baseFile.Close()
+		return err
+	}
+	delete(files, "base")
+
+	err = ws.mountManifest(ctx, root, func(node *WzNode) (bool, error) {
+		name, ok := files[strings.ToLower(node.Text)]
+		if !ok {
+			return false, nil
+		}
+		delete(files, strings.ToLower(node.Text))
+		wzFile, err := NewWzFile(filepath.Join(dir, name))
+		if err != nil {
+			return false, err
+		}
+		if err := ws.readFile(ctx, wzFile, node, true); err != nil {
+			wzFile.Close()
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		ws.logger().Info("file not listed in Base.wz, skipped", "file", name)
+	}
+	return nil
+}
+
+// mountDataBase 与 mountBase 相同，清单是 Data/Base，分类来自 Data/<分类> 文件夹
+func (ws *WzStructure) mountDataBase(ctx context.Context, dir string, root *WzNode) error {
+	if err := ws.mountFolder(ctx, filepath.Join(dir, "Base"), root); err != nil {
+		return err
+	}
+	return ws.mountManifest(ctx, root, func(node *WzNode) (bool, error) {
+		folder := filepath.Join(dir, node.Text)
+		if !isFile(filepath.Join(folder, node.Text+".wz")) {
+			return false, nil
+		}
+		// LoadWzFolder 把节点的值换成入口文件，这里换回 Base.wz 的目录
+		value := node.Value
+		if err := ws.mountFolder(ctx, folder, node); err != nil {
+			return false, err
+		}
+		node.Value = value
+		return true, nil
+	})
+}
+
+// mountManifest 把 root 下 Base.wz 的每个空目录当作分类交给 fill 填充。
+// 分类节点的值仍是 Base.wz 的目录，Base.wz 的索引缓存因此保留完整的分类列表。
+// Mob2、Mob001 这样的分类已由 Mob 的扩展文件合并，从树中去掉
+func (ws *WzStructure) mountManifest(ctx context.Context, root *WzNode, fill func(node *WzNode) (bool, error)) error {
+	ws.HasBaseWz = true
+	var categories []*WzNode
+	listed := map[string]bool{}
+	for _, node := range root.Nodes {
+		if _, ok := node.Value.(*WzDirectory); !ok {
+			continue
+		}
+		if err := node.LoadChildrenContext(ctx); err != nil {
+			return err
+		}
+		if len(node.Nodes) == 0 {
+			categories = append(categories, node)
+			listed[strings.ToLower(node.Text)] = true
+		}
+	}
+
+	for _, node := range categories {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		name := strings.ToLower(node.Text)
+		if base := strings.TrimRight(name, "0123456789"); base != name && listed[base] {
+			root.RemoveChild(node)
+			continue
+		}
+		ok, err := fill(node)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			ws.logger().Debug("category listed in Base.wz has no file", "category", node.Text)
+		}
+	}
+	return nil
+}
+
+// mountData 用 LoadWzFolder 加载 dir 下的每个分类目录
+func (ws *WzStructure) mountData(ctx context.Context, dir string, root *WzNode) error {
+	for _, name := range dataCategories(dir) {
+		node := NewWzNode(name)
+		if err := ws.mountFolder(ctx, filepath.Join(dir, name), node); err != nil {
+			return err
+		}
+		root.AddChild(node)
+	}
+	return nil
+}
+
+// mountFolder 把 folder 加载到 node。Map/Map/Map0 这样的子目录在入口文件中
+// 是空目录，内容在同名子文件夹里，递归加载进来
+func (ws *WzStructure) mountFolder(ctx context.Context, folder string, node *WzNode) error {
+	if err := ws.LoadWzFolderContext(ctx, folder, node, false); err != nil {
+		return err
+	}
+	for _, child := range node.Nodes {
+		dir, ok := child.Value.(*WzDirectory)
+		if !ok {
+			continue
+		}
+		sub := filepath.Join(folder, child.Text)
+		if !isFile(filepath.Join(sub, child.Text+".wz")) {
+			continue
+		}
+		if err := child.LoadChildrenContext(ctx); err != nil {
+			return err
+		}
+		if len(child.Nodes) > 0 {
+			continue
+		}
+		if err := ws.mountFolder(ctx, sub, child); err != nil {
+			return err
+		}
+		// 节点的值换成了子文件夹的入口文件，记下原目录，入口文件的索引缓存仍需要它
+		if wf, ok := child.Value.(*WzFile); ok {
+			wf.mountedOn = dir
+		}
+	}
+	return nil
+}
+
+// classicCategories 列出 dir 下各分类的 .wz 文件名，按名称排序，不含扩展文件
+func classicCategories(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	bases := map[string]bool{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.EqualFold(filepath.Ext(e.Name()), ".wz") {
+			bases[strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))] = true
+		}
+	}
+	var names []string
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+		if e.IsDir() || !strings.EqualFold(filepath.Ext(e.Name()), ".wz") || !bases[name] {
+			continue // Mob.old、Mob.xml 等同名文件不是分类
+		}
+		if base := strings.TrimRight(name, "0123456789"); base != name && bases[base] {
+			continue // Mob2、Mob001 由 loadExtFiles 合并到 Mob
+		}
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// dataCategories 列出 dir 下含有 <名称>/<名称>.wz 的子目录，按名称排序
+func dataCategories(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && isFile(filepath.Join(dir, e.Name(), e.Name()+".wz")) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+func isFile(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.Mode().IsRegular()
+}
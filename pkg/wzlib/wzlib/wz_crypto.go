@@ -5,9 +5,9 @@ import (
 	"crypto/cipher"
 	"fmt"
 	"io"
-	"log"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 type WzCryptoKeyType int
@@ -25,8 +25,12 @@ var (
 	GmsCryptoKey = NewWzCryptoKey([]byte{0x4D, 0x23, 0xc7, 0x2b})
 )
 
+// WzCryptoKey is safe for concurrent use. The keystream only grows; a
+// generated prefix is never rewritten, so readers may keep using a slice
+// obtained earlier after releasing the lock.
 type WzCryptoKey struct {
 	iv        []byte
+	mu        sync.RWMutex // 保护 keys
 	keys      []byte
 	isEmptyIV bool
 }
@@ -46,12 +50,22 @@ func (k *WzCryptoKey) GetKey(index int) (byte, error) {
 	if k.isEmptyIV {
 		return 0, nil
 	}
-	if k.keys == nil || len(k.keys) <= index {
-		if err := k.EnsureKeySize(index + 1); err != nil {
-			return 0, err
-		}
+	return k.keystream(index + 1)[index], nil
+}
+
+// keystream returns at least size key bytes.
+func (k *WzCryptoKey) keystream(size int) []byte {
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+	if len(keys) >= size {
+		return keys
 	}
-	return k.keys[index], nil
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.ensureKeySize(size)
+	return k.keys
 }
 
 // EnsureKeySize ensures the keys array is large enough
@@ -59,29 +73,25 @@ func (k *WzCryptoKey) EnsureKeySize(size int) error {
 	if k.isEmptyIV {
 		return nil
 	}
+	k.keystream(size)
+	return nil
+}
+
+// ensureKeySize 扩展 keys，调用方需持有写锁
+func (k *WzCryptoKey) ensureKeySize(size int) {
 	if len(k.keys) >= size {
-		return nil
+		return
 	}
 
 	size = ((size + 63) / 64) * 64 // Round up to the nearest multiple of 64
-	startIndex := 0
-
-	if k.keys == nil {
-		k.keys = make([]byte, size)
-	} else {
-		startIndex = len(k.keys)
-		newKeys := make([]byte, size)
-		copy(newKeys, k.keys)
-		k.keys = newKeys
-	}
+	startIndex := len(k.keys)
 
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return err
-	}
+	// 总是分配新数组，之前返回给调用方的切片保持不变
+	newKeys := make([]byte, size)
+	copy(newKeys, k.keys)
 
-	blockSize := block.BlockSize()
-	aesEncryptor := ECBEncrypter(block)
+	blockSize := aesBlock.BlockSize()
+	aesEncryptor := ECBEncrypter(aesBlock)
 
 	for i := startIndex; i < size; i += blockSize {
 		blockData := make([]byte, blockSize)
@@ -90,12 +100,12 @@ func (k *WzCryptoKey) EnsureKeySize(size int) error {
 				blockData[j] = k.iv[j%len(k.iv)]
 			}
 		} else {
-			copy(blockData, k.keys[i-blockSize:i])
+			copy(blockData, newKeys[i-blockSize:i])
 		}
-		aesEncryptor.CryptBlocks(k.keys[i:i+blockSize], blockData)
+		aesEncryptor.CryptBlocks(newKeys[i:i+blockSize], blockData)
 	}
 
-	return nil
+	k.keys = newKeys
 }
 
 // ECBEncrypter wraps an AES cipher in ECB mode
@@ -132,13 +142,9 @@ func (k *WzCryptoKey) Decrypt(buffer []byte, startIndex, length int) {
 		return
 	}
 
-	if err := k.EnsureKeySize(length); err != nil {
-		log.Println(err)
-		return
-	}
-
+	keys := k.keystream(length)
 	for i := 0; i < length; i++ {
-		buffer[startIndex+i] ^= k.keys[i]
+		buffer[startIndex+i] ^= keys[i]
 	}
 }
 
@@ -154,6 +160,15 @@ var aesKey = []byte{
 	0x52, 0x00, 0x00, 0x00,
 }
 
+// aesBlock 由固定的 32 字节密钥创建，aes.NewCipher 不会失败
+var aesBlock = func() cipher.Block {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}()
+
 type WzCrypto struct {
 	Keys    *WzCryptoKey
 	ListWZ  bool
@@ -180,13 +195,13 @@ func (wc *WzCrypto) DetectEncryption(wzFile *WzFile) error {
 	// 保存文件流的当前位置
 	oldOff, err := wzFile.FileStream.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return fmt.Errorf("failed to get current file position: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, -1, "", err)
 	}
 
 	// 定位到加密数据的开始位置
 	_, err = wzFile.FileStream.Seek(wzFile.Header.DataStartPosition, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("failed to seek to data start position: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, wzFile.Header.DataStartPosition, "", err)
 	}
 
 	// 创建一个二进制读取器
@@ -194,29 +209,40 @@ func (wc *WzCrypto) DetectEncryption(wzFile *WzFile) error {
 
 	// 读取加密数据长度
 	dataLen, err := reader.ReadCompressedInt32()
-	if err != nil || dataLen <= 0 {
+	if err != nil {
+		return wrapError("detect encryption", wzFile.FileName, wzFile.Header.DataStartPosition, "", err)
+	}
+	if dataLen <= 0 {
 		// 如果数据长度无效，返回错误
-		return fmt.Errorf("invalid or missing compressed data length: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, wzFile.Header.DataStartPosition, "", fmt.Errorf("invalid entry count %d", dataLen))
 	}
 
 	// 跳过一个字节
 	_, err = wzFile.FileStream.Seek(1, io.SeekCurrent)
 	if err != nil {
-		return fmt.Errorf("failed to skip byte in file stream: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, reader.Pos(), "", err)
+	}
+	namePos := reader.Pos()
+	llen, err := reader.ReadSByte()
+	if err != nil {
+		return wrapError("detect encryption", wzFile.FileName, namePos, "", err)
 	}
-	llen, _ := reader.ReadSByte()
 	llen = -llen
+	if llen <= 0 {
+		return wrapError("detect encryption", wzFile.FileName, namePos, "", ErrNoKeyMatched)
+	}
 	// 读取加密数据
 	bytes := make([]byte, int32(llen))
 	_, err = io.ReadFull(wzFile.FileStream, bytes)
 	if err != nil {
-		return fmt.Errorf("failed to read encrypted data bytes: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, namePos, "", err)
 	}
 	for i := int8(0); i < llen; i++ {
 		bytes[i] ^= 0xAA + byte(i)
 	}
 
 	// 尝试每种加密键
+	matched := false
 	for _, keySet := range []struct {
 		encType WzCryptoKeyType
 		keys    *WzCryptoKey
@@ -228,11 +254,7 @@ func (wc *WzCrypto) DetectEncryption(wzFile *WzFile) error {
 		// 解密并转换为字符串
 		decrypted := make([]byte, 0)
 		for i := 0; i < len(bytes); i++ {
-			a, err := keySet.keys.GetKey(i)
-			if err != nil {
-				log.Println(err)
-				a = 0
-			}
+			a, _ := keySet.keys.GetKey(i)
 			decrypted = append(decrypted, bytes[i]^a)
 		}
 
@@ -240,14 +262,18 @@ func (wc *WzCrypto) DetectEncryption(wzFile *WzFile) error {
 		if wc.IsLegalNodeName(string(decrypted)) {
 			wc.EncType = keySet.encType
 			wc.Keys = keySet.keys
+			matched = true
 			break
 		}
 	}
+	if !matched {
+		return wrapError("detect encryption", wzFile.FileName, namePos, "", ErrNoKeyMatched)
+	}
 
 	// 恢复文件流的原始位置
 	_, err = wzFile.FileStream.Seek(oldOff, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("failed to restore file position: %v", err)
+		return wrapError("detect encryption", wzFile.FileName, oldOff, "", err)
 	}
 
 	return nil
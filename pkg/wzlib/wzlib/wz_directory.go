@@ -1,5 +1,13 @@
 package wzlib
 
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// WzDirectory is the Value of a directory node. Its children are read on
+// first access through WzNode.Children.
 type WzDirectory struct {
 	Name                 string  // 目录名称
 	WzFile               *WzFile // 所属 WzFile 对象
@@ -8,6 +16,11 @@ type WzDirectory struct {
 	Offset               int
 	HashedOffset         uint32 // 哈希偏移量
 	HashedOffsetPosition uint32 // 哈希偏移位置
+
+	load   func(ctx context.Context, n *WzNode) error // 读取子节点，nil 表示节点已完整
+	loadMu sync.Mutex
+	loaded atomic.Bool
+	index  atomic.Pointer[nodeIndex] // 子节点的名称索引
 }
 
 // NewWzDirectory 创建一个新的 WzDirectory 实例
@@ -21,3 +34,7 @@ func NewWzDirectory(name string, size int, checksum int, hashedOffset uint32, ha
 		HashedOffsetPosition: hashedOffsetPosition,
 	}
 }
+
+func (d *WzDirectory) String() string {
+	return d.Name
+}
@@ -0,0 +1,133 @@
+package wzlib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Sentinel errors reported by the library. Use errors.Is to test for them;
+// the concrete error is usually a *WzError carrying the location.
+var (
+	ErrChecksumMismatch = errors.New("wzlib: checksum mismatch")
+	ErrUnknownTag       = errors.New("wzlib: unknown tag")
+	ErrUnknownFlag      = errors.New("wzlib: unknown flag")
+	ErrBadSignature     = errors.New("wzlib: bad signature")
+	ErrNoKeyMatched     = errors.New("wzlib: no encryption key matched")
+	ErrTruncated        = errors.New("wzlib: truncated data")
+	ErrClosed           = errors.New("wzlib: file closed")
+	ErrNoVersionMatched = errors.New("wzlib: no version matched")
+	ErrLimitExceeded    = errors.New("wzlib: limit exceeded")
+	ErrAlreadyLoaded    = errors.New("wzlib: structure already holds a file")
+	ErrUnknownLayout    = errors.New("wzlib: no wz files found")
+	ErrTxActive         = errors.New("wzlib: structure already has an active transaction")
+	ErrTxDone           = errors.New("wzlib: transaction already committed or rolled back")
+	ErrNotEditable      = errors.New("wzlib: node cannot be edited this way")
+	ErrDuplicateName    = errors.New("wzlib: duplicate node name")
+	ErrBrokenLink       = errors.New("wzlib: canvas link target not found")
+)
+
+// WzError describes a failure at a known place in a WZ file.
+type WzError struct {
+	Op       string // 失败的操作，如 "extract"、"read directory"
+	FileName string // 所属 WZ 文件
+	Offset   int64  // 文件内的绝对偏移，未知时为 -1
+	Path     string // 出错节点的 WzNode 路径，未知时为空
+	Err      error  // 具体原因
+}
+
+func (e *WzError) Error() string {
+	msg := "wzlib: " + e.Op
+	if e.FileName != "" {
+		msg += " " + e.FileName
+	}
+	if e.Path != "" {
+		msg += " [" + e.Path + "]"
+	}
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(" at 0x%X", e.Offset)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *WzError) Unwrap() error {
+	return e.Err
+}
+
+// ChecksumError reports an image whose byte sum differs from its directory entry.
+type ChecksumError struct {
+	Expected int
+	Actual   int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %d, got %d", e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// UnknownTagError reports an object type name the parser does not understand.
+type UnknownTagError struct {
+	Tag string
+}
+
+func (e *UnknownTagError) Error() string {
+	return fmt.Sprintf("unknown tag %q", e.Tag)
+}
+
+func (e *UnknownTagError) Is(target error) bool {
+	return target == ErrUnknownTag
+}
+
+// UnknownFlagError reports an unexpected type byte. Context names what was
+// being read, e.g. "property", "string" or "directory entry".
+type UnknownFlagError struct {
+	Flag    byte
+	Context string
+}
+
+func (e *UnknownFlagError) Error() string {
+	return fmt.Sprintf("unknown %s flag 0x%02X", e.Context, e.Flag)
+}
+
+func (e *UnknownFlagError) Is(target error) bool {
+	return target == ErrUnknownFlag
+}
+
+// SignatureError reports a file that does not start with "PKG1".
+type SignatureError struct {
+	Signature []byte
+}
+
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("bad signature %q", e.Signature)
+}
+
+func (e *SignatureError) Is(target error) bool {
+	return target == ErrBadSignature
+}
+
+// wrapError attaches location information to err. Errors that already carry
+// a location are returned unchanged so the innermost position wins, and EOF
+// conditions are marked as ErrTruncated.
+func wrapError(op, fileName string, offset int64, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var we *WzError
+	if errors.As(err, &we) {
+		return err
+	}
+	if (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) && !errors.Is(err, ErrTruncated) {
+		err = fmt.Errorf("%w: %w", ErrTruncated, err)
+	}
+	return &WzError{
+		Op:       op,
+		FileName: fileName,
+		Offset:   offset,
+		Path:     path,
+		Err:      err,
+	}
+}
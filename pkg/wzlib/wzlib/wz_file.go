@@ -1,13 +1,14 @@
 package wzlib
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"regexp"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/text/encoding"
 )
@@ -19,6 +20,7 @@ import (
 
 type WzFile struct {
 	FileName      string
+	Source        WzSource // 底层存储
 	FileStream    *WzBinaryReader
 	Header        *WzHeader
 	Directories   []*WzDirectory
@@ -28,23 +30,41 @@ type WzFile struct {
 	Loaded        bool
 	WzStructure   *WzStructure
 	TextEncoding  encoding.Encoding // 文件的文本编码方式
+
+	closeMu   sync.RWMutex // 读取持有读锁，Close 持有写锁
+	closed    bool
+	dirMu     sync.Mutex // 保护 Directories，子目录可能在不同 goroutine 中延迟加载
+	index     atomic.Pointer[nodeIndex]
+	edited    atomic.Bool  // 目录树在加载或保存后被事务增删、改名或导入过，与磁盘不符
+	mountedOn *WzDirectory // 客户端挂载时本文件替换掉的另一文件中的空目录
 }
 
 func NewWzFile(fileName string) (*WzFile, error) {
-	file, err := os.Open(fileName)
+	src, err := OpenFileSource(fileName)
+	if err != nil {
+		return nil, err
+	}
+	wzFile, err := NewWzFileFromSource(fileName, src)
 	if err != nil {
+		src.Close()
 		return nil, err
 	}
+	return wzFile, nil
+}
+
+// NewWzFileFromSource reads the header of a WZ file stored in src. fileName
+// names the file in errors and node text and need not exist on disk.
+func NewWzFileFromSource(fileName string, src WzSource) (*WzFile, error) {
 	wzFile := &WzFile{
 		FileName:    fileName,
-		FileStream:  NewWzBinaryReader(file),
+		Source:      src,
 		Directories: []*WzDirectory{},
 	}
+	wzFile.FileStream = NewWzBinaryReader(io.NewSectionReader(wzFile, 0, src.Size()))
 
 	// Parse header
-	err = wzFile.GetHeader()
+	err := wzFile.GetHeader()
 	if err != nil {
-		file.Close()
 		return nil, err
 	}
 
@@ -53,16 +73,24 @@ func NewWzFile(fileName string) (*WzFile, error) {
 }
 
 func (wf *WzFile) GetHeader() error {
+	err := wf.readHeader()
+	if err != nil {
+		return wrapError("read header", wf.FileName, wf.FileStream.Pos(), "", err)
+	}
+	return nil
+}
+
+func (wf *WzFile) readHeader() error {
 	wf.FileStream.Seek(0, io.SeekStart)
 
 	// Read signature
 	signature := make([]byte, 4)
-	_, err := wf.FileStream.Read(signature)
+	_, err := io.ReadFull(wf.FileStream, signature)
 	if err != nil {
 		return err
 	}
 	if string(signature) != "PKG1" {
-		return errors.New("invalid file signature")
+		return &SignatureError{Signature: signature}
 	}
 
 	dataSize, err := wf.FileStream.ReadInt64()
@@ -73,9 +101,12 @@ func (wf *WzFile) GetHeader() error {
 	if err != nil {
 		return err
 	}
+	if int64(headerSize) < wf.FileStream.Pos() {
+		return fmt.Errorf("invalid header size %d", headerSize)
+	}
 	copyright := make([]byte, headerSize-int32(wf.FileStream.Pos()))
 
-	_, err = wf.FileStream.Read(copyright)
+	_, err = io.ReadFull(wf.FileStream, copyright)
 	if err != nil {
 		return err
 	}
@@ -114,6 +145,8 @@ func (wf *WzFile) GetHeader() error {
 
 	// Read additional header fields
 	header := &WzHeader{}
+	header.FileName = wf.FileName
+	header.FileSize = wf.Source.Size()
 	header.DataSize = dataSize
 	header.HeaderSize = headerSize
 	header.DataStartPosition = int64(dataStartPos)
@@ -126,190 +159,139 @@ func (wf *WzFile) GetHeader() error {
 	return nil
 }
 
-// GetDirTree parses the directory tree structure from the WZ file
-func (wf *WzFile) GetDirTree2(reader *WzBinaryReader, parent *WzNode, useBaseWz bool, loadWzAsFolder bool) error {
-	dirs := []string{}
-	count, err := reader.ReadCompressedInt32()
+func getStreamLength(stream io.ReadSeeker) (int64, error) {
+	current, err := stream.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return fmt.Errorf("failed to read directory count: %v", err)
+		return 0, err
 	}
-	cryptoKey := wf.WzStructure.Encryption.Keys
-
-	for i := 0; i < int(count); i++ {
-		nodeType, err := reader.ReadByte()
-		if err != nil {
-			return fmt.Errorf("failed to read node type: %v", err)
-		}
-
-		var name string
-		switch nodeType {
-		case 0x02:
-			stringOffAdd := -1
-			if wf.Header.HasCapabilities(WzCapabilitiesEncverMissing) {
-				stringOffAdd = 2
-			}
-			offset, err := reader.ReadInt32()
-			if err != nil {
-				return fmt.Errorf("failed to read string offset: %v", err)
-			}
-			name, err = reader.ReadStringAt(int64(int(offset)+stringOffAdd), cryptoKey)
-			if err != nil {
-				return fmt.Errorf("failed to read string at offset: %v", err)
-			}
-		case 0x04, 0x03:
-			name, err = reader.ReadString(cryptoKey)
-			if err != nil {
-				return fmt.Errorf("failed to read string: %v", err)
-			}
-		default:
-			return fmt.Errorf("unknown node type: %x", nodeType)
-		}
+	end, err := stream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = stream.Seek(current, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return end, nil
+}
 
-		size, err := reader.ReadCompressedInt32()
-		if err != nil {
-			return fmt.Errorf("failed to read size: %v", err)
-		}
+// GetDirTree reads the top-level directory into parent. Subdirectories are
+// read on first access through WzNode.Children.
+func (wf *WzFile) GetDirTree(parent *WzNode) error {
+	return wf.GetDirTreeContext(context.Background(), parent)
+}
 
-		cs32, err := reader.ReadCompressedInt32()
-		if err != nil {
-			return fmt.Errorf("failed to read checksum: %v", err)
-		}
+// GetDirTreeContext is like GetDirTree but stops when ctx is cancelled.
+func (wf *WzFile) GetDirTreeContext(ctx context.Context, parent *WzNode) error {
+	end, err := wf.readDirAt(ctx, wf.Header.DataStartPosition, parent)
+	if err != nil {
+		return err
+	}
+	wf.Header.DirEndPosition = end
+	return nil
+}
 
-		pos := reader.Pos()
-		hashOffset, err := reader.ReadUInt32()
-		if err != nil {
-			return fmt.Errorf("failed to read hash offset: %v", err)
+// readRoot 读取顶层目录。头部只有加密后的版本号，可能对应多个版本，
+// 按猜出的版本算出的偏移越界时换下一个候选版本重新读取
+func (wf *WzFile) readRoot(ctx context.Context, parent *WzNode) error {
+	for {
+		if err := wf.GetDirTreeContext(ctx, parent); err != nil {
+			return err
 		}
-
-		switch nodeType {
-		case 0x02, 0x04:
-			img := NewWzImage(name, int(size), int(cs32), uint32(hashOffset), uint32(pos), wf)
-			childNode := parent.AddChild(img.Node)
-			childNode.Value = img
-			//img.OwnerNode = childNode
-		case 0x03:
-			dir := NewWzDirectory(name, int(size), int(cs32), uint32(hashOffset), uint32(pos), wf)
-			wf.Directories = append(wf.Directories, dir)
-			dirs = append(dirs, name)
+		d := wf.Header.VersionDetector
+		if d == nil || wf.WzStructure.WzVersionVerifyMode == VersionVerifyFast || wf.offsetsValid(parent) {
+			return nil
 		}
-	}
-	dirCount := len(dirs)
-	willLoadBaseWz := useBaseWz && strings.EqualFold(parent.Text, "base.wz")
-
-	baseFolder := filepath.Dir(wf.Header.FileName)
-
-	if willLoadBaseWz && wf.WzStructure.AutoDetectExtFiles {
-		alphaRegex := regexp.MustCompile(`^[A-Za-z]+$`)
-		for i := 0; i < dirCount; i++ {
-			dir := dirs[i]
-			if alphaRegex.MatchString(dir) {
-				wzTypeName := dir
-
-				// Detect extended WZ files
-				for fileID := 2; ; fileID++ {
-					extDirName := fmt.Sprintf("%s%d", wzTypeName, fileID)
-					extWzFile := filepath.Join(baseFolder, extDirName+".wz")
-					if _, err := os.Stat(extWzFile); os.IsNotExist(err) {
-						break
-					}
-					if !containsIgnoreCase(dirs[:dirCount], extDirName) {
-						dirs = append(dirs, extDirName)
-					}
-				}
-
-				// Detect KMST1058-style WZ files
-				for fileID := 1; ; fileID++ {
-					extDirName := fmt.Sprintf("%s%03d", wzTypeName, fileID)
-					extWzFile := filepath.Join(baseFolder, extDirName+".wz")
-					if _, err := os.Stat(extWzFile); os.IsNotExist(err) {
-						break
-					}
-					if !containsIgnoreCase(dirs[:dirCount], extDirName) {
-						dirs = append(dirs, extDirName)
-					}
-				}
-			}
+		if _, fixed := d.(*FixedVersion); fixed || !d.TryGetNextVersion() {
+			return wf.dirError(wf.Header.DataStartPosition, parent, ErrNoVersionMatched)
 		}
+		wf.WzStructure.logger().Debug("offsets out of range, trying next version",
+			"file", wf.FileName, "version", d.GetWzVersion())
+		parent.Nodes = nil
+		wf.dirMu.Lock()
+		wf.Directories = nil
+		wf.dirMu.Unlock()
 	}
+}
 
-	for i, dir := range dirs {
-		node := parent.AddChild(NewWzNode(dir))
-		if i < dirCount {
-			if err := wf.GetDirTree(node); err != nil {
-				return fmt.Errorf("failed to get directory tree for %s: %v", dir, err)
-			}
+// offsetsValid 检查 parent 下的 img 与子目录是否都落在数据区内
+func (wf *WzFile) offsetsValid(parent *WzNode) bool {
+	start, end := wf.Header.DataStartPosition, wf.Source.Size()
+	for _, n := range parent.Nodes {
+		var off, size int64
+		switch v := n.Value.(type) {
+		case *WzImage:
+			off, size = v.Offset, int64(v.Size)
+		case *WzDirectory:
+			off = int64(wf.CalcOffset(v.HashedOffsetPosition, v.HashedOffset))
+		default:
+			continue
 		}
-
-		if len(node.Nodes) == 0 {
-			wf.WzStructure.HasBaseWz = wf.WzStructure.HasBaseWz || willLoadBaseWz
-			if loadWzAsFolder {
-				//todo
-				wzFolder := filepath.Join(baseFolder, dir)
-				if willLoadBaseWz {
-					wzFolder = filepath.Join(filepath.Dir(baseFolder), dir)
-				}
-				if _, err := os.Stat(wzFolder); err == nil {
-					if err := wf.WzStructure.LoadWzFolder(wzFolder, node, false); err != nil {
-						return fmt.Errorf("failed to load WZ folder: %v", err)
-					}
-				}
-			} else if willLoadBaseWz {
-				//todo
-				/*filePath := filepath.Join(baseFolder, dir+".wz")
-				if _, err := os.Stat(filePath); err == nil {
-					if err := wf.WzStructure.LoadFile(filePath, node, false, loadWzAsFolder); err != nil {
-						return fmt.Errorf("failed to load WZ file: %v", err)
-					}
-				}*/
-
-			}
+		if off < start || off+size > end {
+			return false
 		}
 	}
+	return true
+}
 
-	//parent.TrimChildren()
-	return nil
+// loadDirectory 读取子目录 dir 的内容到 node
+func (wf *WzFile) loadDirectory(ctx context.Context, dir *WzDirectory, node *WzNode) error {
+	_, err := wf.readDirAt(ctx, int64(wf.CalcOffset(dir.HashedOffsetPosition, dir.HashedOffset)), node)
+	return err
 }
 
-func getStreamLength(stream io.ReadSeeker) (int64, error) {
-	current, err := stream.Seek(0, io.SeekCurrent)
+// readDirAt 从绝对偏移 offset 读取一个目录，返回目录表结束的绝对位置。
+// 读取器从数据区开头开始，0x02 项的名称偏移相对于数据区
+func (wf *WzFile) readDirAt(ctx context.Context, offset int64, parent *WzNode) (int64, error) {
+	start := wf.Header.DataStartPosition
+	stream, err := NewPartialStream(wf, start, wf.Source.Size()-start)
 	if err != nil {
 		return 0, err
 	}
-	end, err := stream.Seek(0, io.SeekEnd)
-	if err != nil {
-		return 0, err
+	if _, err := stream.Seek(offset-start, io.SeekStart); err != nil {
+		return 0, wf.dirError(offset, parent, err)
 	}
-	_, err = stream.Seek(current, io.SeekStart)
-	if err != nil {
+	reader := wf.newReader(stream)
+	if err := wf.getDirTree(ctx, reader, parent); err != nil {
 		return 0, err
 	}
-	return end, nil
+	return reader.AbsPos(), nil
 }
 
-func (wf *WzFile) GetDirTree(parent *WzNode) error {
-	length, err := getStreamLength(wf.FileStream)
-	if err != nil {
-		return err
-	}
-	reader, err := NewPartialStream(wf.FileStream.File(), wf.Header.DataStartPosition, length-wf.Header.DataStartPosition)
-	if err != nil {
-		return err
+// newReader 创建按结构配置（文本编码、字符串长度上限）读取的读取器
+func (wf *WzFile) newReader(stream io.ReadSeeker) *WzBinaryReader {
+	r := NewWzBinaryReader(stream)
+	r.text = wf.TextEncoding
+	if ws := wf.WzStructure; ws != nil {
+		if r.text == nil {
+			r.text = ws.TextEncoding
+		}
+		r.maxString = ws.Limits.MaxStringLen
 	}
-	return wf.getDirTree(NewWzBinaryReader(reader), parent, false, false)
+	return r
 }
 
-func (wf *WzFile) getDirTree(reader *WzBinaryReader, parent *WzNode, useBaseWz bool, loadWzAsFolder bool) error {
+func (wf *WzFile) getDirTree(ctx context.Context, reader *WzBinaryReader, parent *WzNode) error {
 	dirs := []*WzDirectory{}
+	begin := reader.AbsPos()
+	start := begin
 	count, err := reader.ReadCompressedInt32()
 	if err != nil {
-		return fmt.Errorf("failed to read directory count: %v", err)
+		return wf.dirError(start, parent, fmt.Errorf("read directory count: %w", err))
+	}
+	if err := wf.WzStructure.Limits.checkEntries(count); err != nil {
+		return wf.dirError(start, parent, err)
 	}
 	cryptoKey := wf.WzStructure.Encryption.Keys
 
 	for i := 0; i < int(count); i++ {
+		start = reader.AbsPos()
+		if err := canceled(ctx); err != nil {
+			return wf.dirError(start, parent, err)
+		}
 		nodeType, err := reader.ReadByte()
 		if err != nil {
-			return fmt.Errorf("failed to read node type: %v", err)
+			return wf.dirError(start, parent, fmt.Errorf("read node type: %w", err))
 		}
 
 		var name string
@@ -321,36 +303,36 @@ func (wf *WzFile) getDirTree(reader *WzBinaryReader, parent *WzNode, useBaseWz b
 			}
 			offset, err := reader.ReadInt32()
 			if err != nil {
-				return fmt.Errorf("failed to read string offset: %v", err)
+				return wf.dirError(start, parent, fmt.Errorf("read string offset: %w", err))
 			}
 			name, err = reader.ReadStringAt(int64(offset)+int64(stringOffAdd), cryptoKey)
 			if err != nil {
-				return fmt.Errorf("failed to read string at offset: %v", err)
+				return wf.dirError(start, parent, fmt.Errorf("read string at offset: %w", err))
 			}
 		case 0x03, 0x04:
 			name, err = reader.ReadString(cryptoKey)
 			if err != nil {
-				return fmt.Errorf("failed to read string: %v", err)
+				return wf.dirError(start, parent, fmt.Errorf("read string: %w", err))
 			}
 		default:
-			return fmt.Errorf("unknown node type: %x", nodeType)
+			return wf.dirError(start, parent, &UnknownFlagError{Flag: nodeType, Context: "directory entry"})
 		}
 
 		size, err := reader.ReadCompressedInt32()
 		if err != nil {
-			return err
+			return wf.dirError(start, parent, fmt.Errorf("read size of %s: %w", name, err))
 		}
 
 		cs32, err := reader.ReadCompressedInt32()
 		if err != nil {
-			return err
+			return wf.dirError(start, parent, fmt.Errorf("read checksum of %s: %w", name, err))
 		}
 
-		offset := reader.Pos() + wf.FileStream.Pos()
+		offset := reader.AbsPos()
 
 		hashOffset, err := reader.ReadUInt32()
 		if err != nil {
-			return err
+			return wf.dirError(start, parent, fmt.Errorf("read hash offset of %s: %w", name, err))
 		}
 
 		switch nodeType {
@@ -362,37 +344,39 @@ func (wf *WzFile) getDirTree(reader *WzBinaryReader, parent *WzNode, useBaseWz b
 
 		case 0x03:
 			dir := &WzDirectory{
-				Name:         name,
-				Offset:       int(offset),
-				Size:         int(size),
-				Checksum:     int(cs32),
-				HashedOffset: hashOffset,
-				WzFile:       wf,
+				Name:                 name,
+				Offset:               int(offset),
+				Size:                 int(size),
+				Checksum:             int(cs32),
+				HashedOffset:         hashOffset,
+				HashedOffsetPosition: uint32(offset),
+				WzFile:               wf,
 			}
+			wf.dirMu.Lock()
 			wf.Directories = append(wf.Directories, dir)
+			wf.dirMu.Unlock()
 			dirs = append(dirs, dir)
 		}
 	}
 
+	// 子目录在首次访问时按哈希偏移定位读取，不再随父目录一起展开
 	for _, dir := range dirs {
 		child := parent.AddChild(NewWzNode(dir.Name))
-
-		// Seek 到子目录偏移位置，构造新 reader
-		/*_, err := wf.FileStream.Seek(int64(dir.Offset), io.SeekStart)
-		if err != nil {
-			return fmt.Errorf("seek to dir %s offset failed: %v", dir.Name, err)
-		}*/
-		//subReader := NewWzBinaryReader(wf.FileStream)
-
-		err = wf.getDirTree(reader, child, useBaseWz, loadWzAsFolder)
-		if err != nil {
-			return fmt.Errorf("read subdir %s failed: %v", dir.Name, err)
+		child.Value = dir
+		dir.load = func(ctx context.Context, n *WzNode) error {
+			return wf.loadDirectory(ctx, dir, n)
 		}
 	}
 
+	wf.WzStructure.report(int(count), reader.AbsPos()-begin)
 	return nil
 }
 
+// dirError wraps a directory parsing error with its location.
+func (wf *WzFile) dirError(offset int64, node *WzNode, err error) error {
+	return wrapError("read directory", wf.FileName, offset, node.GetFullPath(), err)
+}
+
 func (wf *WzFile) MergeWzFile(other *WzFile) {
 	// 将 other 的所有子节点移动到当前文件的根节点
 	children := make([]*WzNode, len(other.Node.Nodes))
@@ -416,97 +400,94 @@ func (wf *WzFile) MergeWzFile(other *WzFile) {
 	other.OwnerWzFile = wf
 }
 
-// containsIgnoreCase checks if a slice contains a string (case-insensitive)
-func containsIgnoreCase(slice []string, str string) bool {
-	for _, s := range slice {
-		if strings.EqualFold(s, str) {
-			return true
-		}
+// ReadAt reads from the underlying source. After Close it fails with
+// ErrClosed, so streams opened from the file stop cleanly.
+func (wf *WzFile) ReadAt(p []byte, off int64) (int, error) {
+	wf.closeMu.RLock()
+	defer wf.closeMu.RUnlock()
+	if wf.closed {
+		return 0, ErrClosed
 	}
-	return false
+	n, err := wf.Source.ReadAt(p, off)
+	wf.WzStructure.metrics().BytesRead(n)
+	return n, err
 }
 
-/*func (wf *WzFile) GetDirTree(reader *WzBinaryReader, parent *WzNode, useBaseWz bool, loadWzAsFolder bool) error {
-	var dirs []string
-	count, err := reader.ReadCompressedInt32()
+// viewAt 在持有读锁期间把 [off, off+n) 交给 fn。MmapSource 直接给出映射内存，
+// 其他数据源先读入缓冲区
+func (wf *WzFile) viewAt(off, n int64, fn func(b []byte) error) error {
+	wf.closeMu.RLock()
+	if wf.closed {
+		wf.closeMu.RUnlock()
+		return ErrClosed
+	}
+	if m, ok := wf.Source.(*MmapSource); ok {
+		defer wf.closeMu.RUnlock()
+		data := m.Bytes()
+		if off < 0 || n < 0 || off+n > int64(len(data)) {
+			return io.ErrUnexpectedEOF
+		}
+		wf.WzStructure.metrics().BytesRead(int(n))
+		return fn(data[off : off+n : off+n])
+	}
+	buf := make([]byte, n)
+	read, err := io.ReadFull(io.NewSectionReader(wf.Source, off, n), buf)
+	wf.closeMu.RUnlock()
+	wf.WzStructure.metrics().BytesRead(read)
 	if err != nil {
 		return err
 	}
+	return fn(buf)
+}
 
-	// Get the encryption key if needed
-	cryptoKey := wf.WzStructure.encryption.keys
-
-	for i := int32(0); i < count; i++ {
-		nodeType, err := reader.ReadByte()
-		if err != nil {
-			return err
-		}
-
-		var name string
-		switch nodeType {
-		case 0x02:
-			stringOffAdd := 0
-			if wf.Header.HasCapabilities(WzCapabilitiesEncverMissing) {
-				stringOffAdd = 2
-			} else {
-				stringOffAdd = -1
-			}
-			offset, err := reader.ReadInt32()
-			if err != nil {
-				return err
-			}
-			name, err = reader.ReadStringAt(int64(offset+int32(stringOffAdd)), cryptoKey)
-		case 0x04, 0x03:
-			name, err = reader.ReadString(cryptoKey)
-		default:
-			return fmt.Errorf("unknown type %x in WzDirTree", nodeType)
-		}
-
-		if err != nil {
-			return err
-		}
-
-		// Read size and checksum
-		size, err := reader.ReadCompressedInt32()
-		if err != nil {
-			return err
-		}
-		cs32, err := reader.ReadCompressedInt32()
-		if err != nil {
-			return err
-		}
-
-		pos := uint32(wf.FileStream.Position)
-		hashOffset, err := reader.ReadUInt32()
-		if err != nil {
-			return err
-		}
+// Close releases the source and the files merged into this one. Nodes that
+// are already extracted stay usable; reading anything else returns
+// ErrClosed. Closing twice is a no-op.
+func (wf *WzFile) Close() error {
+	wf.closeMu.Lock()
+	if wf.closed {
+		wf.closeMu.Unlock()
+		return nil
+	}
+	wf.closed = true
+	var errs []error
+	if wf.Source != nil {
+		errs = append(errs, wf.Source.Close())
+	}
+	wf.closeMu.Unlock()
 
-		// Handle based on node type
-		switch nodeType {
-		case 0x02, 0x04:
-			img := NewWzImage(name, size, cs32, hashOffset, pos, wf)
-			childNode := parent.Nodes.Add(name)
-			// Further logic for handling image or directory...
-		}
+	for _, merged := range wf.MergedWzFiles {
+		errs = append(errs, merged.Close())
 	}
-	return nil
+	if wf.WzStructure != nil && wf.WzStructure.ImageCache != nil {
+		wf.WzStructure.ImageCache.forget(wf)
+	}
+	return errors.Join(errs...)
 }
 
-func (wf *WzFile) ParseDirectory() error {
-	for _, dir := range wf.Directories {
-		err := dir.Parse()
-		if err != nil {
-			return err
-		}
+// Changed reports whether the file on disk was modified, replaced or
+// removed since it was opened, e.g. rebuilt by a packing tool while a
+// viewer has it loaded. It is always false for sources other than local
+// files.
+func (wf *WzFile) Changed() bool {
+	src, ok := wf.Source.(interface{ ModTime() time.Time })
+	if !ok {
+		return false
 	}
-	return nil
+	fi, err := os.Stat(wf.FileName)
+	return err != nil || fi.Size() != wf.Source.Size() || !fi.ModTime().Equal(src.ModTime())
 }
 
-func (wf *WzFile) Close() error {
-	if wf.FileStream != nil {
-		return wf.FileStream.Close()
-	}
-	return nil
+// Edited reports whether a transaction added, removed, renamed or imported
+// nodes in the file's tree since it was loaded or last saved, so the tree
+// no longer matches the file on disk.
+func (wf *WzFile) Edited() bool {
+	return wf.edited.Load()
+}
+
+// Closed reports whether Close has been called.
+func (wf *WzFile) Closed() bool {
+	wf.closeMu.RLock()
+	defer wf.closeMu.RUnlock()
+	return wf.closed
 }
-*/
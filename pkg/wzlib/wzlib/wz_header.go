@@ -1,6 +1,7 @@
 package wzlib
 
 import (
+	"fmt"
 	"math"
 	"strconv"
 )
@@ -79,17 +80,21 @@ func CalcHashVersion(wzVersion int) int {
 	return sum
 }
 
+// encryptVersion 计算版本号写在头部中的加密形式
+func encryptVersion(wzVersion int) int {
+	sum := CalcHashVersion(wzVersion)
+	return 0xff ^
+		((sum >> 24) & 0xFF) ^
+		((sum >> 16) & 0xFF) ^
+		((sum >> 8) & 0xFF) ^
+		(sum & 0xFF)
+}
+
 // TryGetNextVersion tries next wz version until match encrypted version
 func (d *OrdinalVersionDetector) TryGetNextVersion() bool {
 	for i := d.startVersion + 1; i < math.MaxInt16; i++ {
 		sum := CalcHashVersion(i)
-		enc := 0xff ^
-			((sum >> 24) & 0xFF) ^
-			((sum >> 16) & 0xFF) ^
-			((sum >> 8) & 0xFF) ^
-			(sum & 0xFF)
-
-		if enc == d.EncryptedVersion {
+		if encryptVersion(i) == d.EncryptedVersion {
 			d.versionTest = append(d.versionTest, i)
 			d.hashVersionTest = append(d.hashVersionTest, uint(sum))
 			d.startVersion = i
@@ -107,7 +112,7 @@ type WzHeader struct {
 	DataSize          int64
 	FileSize          int64
 	DataStartPosition int64
-	DirEndPosition    int64
+	DirEndPosition    int64 // 顶层目录表的结束位置，子目录表在其后
 	VersionChecked    bool
 	Capabilities      WzCapabilities
 	VersionDetector   IWzVersionDetector
@@ -134,6 +139,15 @@ func (h *WzHeader) SetWzVersion(wzVersion int) {
 	}
 }
 
+// fixVersion 固定使用 wzVersion。verify 为 true 且头部带有加密版本号时两者必须一致
+func (h *WzHeader) fixVersion(wzVersion int, verify bool) error {
+	if d, ok := h.VersionDetector.(*OrdinalVersionDetector); ok && verify && encryptVersion(wzVersion) != d.EncryptedVersion {
+		return fmt.Errorf("%w: version %d does not match the header", ErrNoVersionMatched, wzVersion)
+	}
+	h.VersionDetector = &FixedVersion{WzVersion: wzVersion, HashVersion: uint(CalcHashVersion(wzVersion))}
+	return nil
+}
+
 // SetOrdinalVersionDetector sets an ordinal version detector for encrypted versions
 func (h *WzHeader) SetOrdinalVersionDetector(encryptedVersion int) {
 	h.VersionDetector = NewOrdinalVersionDetector(encryptedVersion)
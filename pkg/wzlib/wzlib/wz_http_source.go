@@ -0,0 +1,253 @@
+package wzlib
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HTTPSourceOptions 配置 HTTPSource，零值字段使用默认值
+type HTTPSourceOptions struct {
+	Client      *http.Client // 默认 http.DefaultClient
+	BlockSize   int64        // 每次请求的最小单位，默认 64 KiB
+	ReadAhead   int          // 缺页时额外预取的块数，默认 4，负数表示不预取
+	CacheBlocks int          // 最多缓存的块数，默认 256
+}
+
+// HTTPSource reads a remote WZ file with HTTP range requests. Fetched blocks
+// are kept in an LRU cache and each miss also prefetches the following
+// blocks, so opening one image of a large file only downloads its bytes.
+type HTTPSource struct {
+	url       string
+	client    *http.Client
+	size      int64
+	blockSize int64
+	readAhead int
+	maxBlocks int
+
+	mu       sync.Mutex
+	blocks   map[int64]*list.Element // 块号 -> lru 元素
+	lru      *list.List              // 元素值为 *httpBlock，最近使用的在前
+	inflight map[int64]*httpFetch
+}
+
+type httpBlock struct {
+	index int64
+	data  []byte
+}
+
+type httpFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// OpenHTTPSource probes url for its size and range support. opts may be nil.
+func OpenHTTPSource(url string, opts *HTTPSourceOptions) (*HTTPSource, error) {
+	s := &HTTPSource{
+		url:       url,
+		client:    http.DefaultClient,
+		blockSize: 64 << 10,
+		readAhead: 4,
+		maxBlocks: 256,
+		blocks:    map[int64]*list.Element{},
+		lru:       list.New(),
+		inflight:  map[int64]*httpFetch{},
+	}
+	if opts != nil {
+		if opts.Client != nil {
+			s.client = opts.Client
+		}
+		if opts.BlockSize > 0 {
+			s.blockSize = opts.BlockSize
+		}
+		if opts.ReadAhead > 0 {
+			s.readAhead = opts.ReadAhead
+		} else if opts.ReadAhead < 0 {
+			s.readAhead = 0
+		}
+		if opts.CacheBlocks > 0 {
+			s.maxBlocks = opts.CacheBlocks
+		}
+	}
+	if s.maxBlocks <= s.readAhead {
+		s.maxBlocks = s.readAhead + 1
+	}
+
+	// 请求第一个字节，从 Content-Range 中得到文件总长度
+	resp, err := s.get(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	size, err := parseContentRangeSize(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	s.size = size
+	return s, nil
+}
+
+// URL returns the address the source reads from.
+func (s *HTTPSource) URL() string {
+	return s.url
+}
+
+func (s *HTTPSource) Size() int64 {
+	return s.size
+}
+
+// Close drops the block cache.
+func (s *HTTPSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = map[int64]*list.Element{}
+	s.lru.Init()
+	return nil
+}
+
+func (s *HTTPSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	want := len(p)
+	if int64(want) > s.size-off {
+		p = p[:s.size-off]
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		data, err := s.block(pos / s.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos%s.blockSize:])
+	}
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the content of block index, downloading it together with
+// the read-ahead window when it is not cached.
+func (s *HTTPSource) block(index int64) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if elem, ok := s.blocks[index]; ok {
+			s.lru.MoveToFront(elem)
+			data := elem.Value.(*httpBlock).data
+			s.mu.Unlock()
+			return data, nil
+		}
+		if f, ok := s.inflight[index]; ok {
+			s.mu.Unlock()
+			<-f.done
+			if f.err != nil {
+				return nil, f.err
+			}
+			continue
+		}
+
+		// 从 index 开始，连续预取未缓存且未在下载中的块
+		lastBlock := (s.size - 1) / s.blockSize
+		end := index
+		for end < lastBlock && end-index < int64(s.readAhead) {
+			if _, ok := s.blocks[end+1]; ok {
+				break
+			}
+			if _, ok := s.inflight[end+1]; ok {
+				break
+			}
+			end++
+		}
+		f := &httpFetch{done: make(chan struct{})}
+		for i := index; i <= end; i++ {
+			s.inflight[i] = f
+		}
+		s.mu.Unlock()
+
+		data, err := s.fetch(index, end)
+
+		s.mu.Lock()
+		for i := index; i <= end; i++ {
+			delete(s.inflight, i)
+			if err == nil {
+				start := (i - index) * s.blockSize
+				stop := min(start+s.blockSize, int64(len(data)))
+				s.addBlock(i, data[start:stop])
+			}
+		}
+		f.err = err
+		close(f.done)
+		s.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// addBlock 插入缓存并淘汰最久未使用的块，调用方需持有 mu
+func (s *HTTPSource) addBlock(index int64, data []byte) {
+	s.blocks[index] = s.lru.PushFront(&httpBlock{index: index, data: data})
+	for s.lru.Len() > s.maxBlocks {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.blocks, oldest.Value.(*httpBlock).index)
+	}
+}
+
+func (s *HTTPSource) fetch(first, last int64) ([]byte, error) {
+	start := first * s.blockSize
+	end := min((last+1)*s.blockSize, s.size) - 1
+	resp, err := s.get(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("%s: read range %d-%d: %w", s.url, start, end, err)
+	}
+	return data, nil
+}
+
+func (s *HTTPSource) get(start, end int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("%s: server does not support range requests", s.url)
+		}
+		return nil, fmt.Errorf("%s: unexpected status %s", s.url, resp.Status)
+	}
+	return resp, nil
+}
+
+// parseContentRangeSize 解析 "bytes 0-0/12345" 中的总长度
+func parseContentRangeSize(header string) (int64, error) {
+	i := strings.LastIndexByte(header, '/')
+	if !strings.HasPrefix(header, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return size, nil
+}
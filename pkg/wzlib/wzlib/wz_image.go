@@ -1,12 +1,14 @@
 package wzlib
 
 import (
-	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"image"
 	"io"
 	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type WzImage struct {
@@ -22,8 +24,16 @@ type WzImage struct {
 	ChecksumChecked   bool
 	EncryptionChecked bool
 	EncryptionType    WzCryptoKeyType
-	Stream            io.ReadSeeker
+	Stream            io.ReadSeeker // Deprecated: 不再预先创建，读取数据请用 OpenRead
 	Type              string
+
+	mu       sync.Mutex // 串行化提取与卸载，保护 Extracted、ChecksumChecked 与 Node.Nodes
+	memBytes int64      // 已提取内容的估算内存
+	modified bool       // 属性被修改过，不再卸载，保存时需要重新编码
+
+	index       atomic.Pointer[nodeIndex] // 顶层属性的名称索引
+	indexMu     sync.Mutex
+	propIndexes map[*WzNode]*atomic.Pointer[nodeIndex] // 子节点较多的属性节点的索引
 }
 
 // NewWzImage creates a new WzImage instance
@@ -38,17 +48,6 @@ func NewWzImage(name string, size, checksum int, hashOffset, hashPos uint32, wzF
 		Node:            NewWzNode(name),
 	}
 	wz.Offset = int64(wz.WzFile.CalcOffset(hashPos, hashOffset))
-
-	stream, err := NewPartialStream(wzFile.FileStream.File(), wz.Offset, int64(wz.Size))
-	if err != nil {
-		// fallback: 将数据读入内存，使用 bytes.Reader（确保线程安全）
-		buf := make([]byte, wz.Size)
-		_, _ = wzFile.FileStream.BaseStream.Seek(wz.Offset, io.SeekStart)
-		_, _ = io.ReadFull(wzFile.FileStream.BaseStream, buf)
-		stream = bytes.NewReader(buf)
-	}
-
-	wz.Stream = stream
 	return wz
 }
 
@@ -60,21 +59,27 @@ func NewImageStream(r *WzBinaryReader, offset int64, size int64) (io.ReadSeeker,
 }
 
 func (wf *WzFile) CalcOffset(filePos uint32, hashedOffset uint32) uint32 {
-	offset := (filePos - 0x3C) ^ 0xFFFFFFFF
-	offset *= uint32(wf.Header.VersionDetector.GetHashVersion())
-	offset -= 0x581C3F6D
-
-	distance := offset & 0x1F
-	offset = bits.RotateLeft32(offset, int(distance))
-
-	offset ^= hashedOffset
+	offset := wf.offsetKey(filePos) ^ hashedOffset
 	offset += 0x78
 	return offset
 }
 
+// hashOffset 是 CalcOffset 的逆运算，返回存放在 filePos 处、指向 offset 的哈希偏移
+func (wf *WzFile) hashOffset(filePos uint32, offset uint32) uint32 {
+	return wf.offsetKey(filePos) ^ (offset - 0x78)
+}
+
+// offsetKey 返回与 filePos 处的哈希偏移异或的值
+func (wf *WzFile) offsetKey(filePos uint32) uint32 {
+	key := (filePos - 0x3C) ^ 0xFFFFFFFF
+	key *= uint32(wf.Header.VersionDetector.GetHashVersion())
+	key -= 0x581C3F6D
+	return bits.RotateLeft32(key, int(key&0x1F))
+}
+
 // CalcChecksum calculates the checksum of the image
 func (img *WzImage) CalcChecksum() (int, error) {
-	stream := img.Stream
+	stream := img.OpenRead()
 	buf := make([]byte, 4096)
 	checksum := 0
 	size := img.Size
@@ -100,35 +105,193 @@ func (img *WzImage) CalcChecksum() (int, error) {
 	return checksum, nil
 }
 
-// TryExtract extracts the image data
+// TryExtract extracts the image data. It is safe to call from several
+// goroutines: the first caller extracts and the others wait for it.
+// When the structure has an ImageCache the image is registered with it,
+// which may unload other images.
 func (img *WzImage) TryExtract() error {
+	return img.TryExtractContext(context.Background())
+}
+
+// TryExtractContext is like TryExtract but stops when ctx is cancelled.
+// A cancelled extraction leaves the image unextracted.
+func (img *WzImage) TryExtractContext(ctx context.Context) error {
+	_, err := img.extract(ctx)
+	return err
+}
+
+// extract 提取并返回顶层子节点的快照，快照不受之后的卸载影响
+func (img *WzImage) extract(ctx context.Context) ([]*WzNode, error) {
+	nodes, memBytes, err := img.tryExtract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c := img.cache(); c != nil {
+		c.touch(img, memBytes)
+	}
+	return nodes, nil
+}
+
+func (img *WzImage) tryExtract(ctx context.Context) ([]*WzNode, int64, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	var ws *WzStructure
+	if img.WzFile != nil {
+		ws = img.WzFile.WzStructure // 重新打包、尚未保存的 img 不属于任何文件
+	}
 	if img.Extracted {
-		return nil
+		ws.metrics().CacheLookup(CacheImage, true)
+		return img.Node.Nodes, img.memBytes, nil
+	}
+	if err := canceled(ctx); err != nil {
+		return nil, 0, err
 	}
+	ws.metrics().CacheLookup(CacheImage, false)
+	start := time.Now()
 
-	stream := img.Stream
 	if !img.ChecksumChecked {
-		calculatedChecksum, err := img.CalcChecksum()
-		if err != nil {
-			return err
-		}
-		if calculatedChecksum != img.Checksum {
-			return errors.New("checksum mismatch")
+		if err := img.verifyChecksum(); err != nil {
+			return nil, 0, err
 		}
 		img.ChecksumChecked = true
 	}
-	stream.Seek(0, io.SeekStart)
 
-	reader := NewWzBinaryReader(stream)
+	reader := img.WzFile.newReader(img.OpenRead())
+	if ws != nil {
+		reader.names = &ws.names
+	}
+	reader.ctx = ctx
 	err := img.ExtractImg(reader, img.Node)
 	if err != nil {
-		return err
+		// 丢弃不完整的结果，下次调用重新提取
+		img.Node.Nodes = []*WzNode{}
+		return nil, 0, err
 	}
 	img.Extracted = true
+	img.memBytes = estimateNodeBytes(img.Node)
+	ws.report(reader.entries, int64(img.Size))
+	ws.metrics().ImageExtracted(reader.entries, int64(img.Size), time.Since(start))
+	return img.Node.Nodes, img.memBytes, nil
+}
+
+// verifyChecksum 按结构的 ChecksumPolicy 检查校验和
+func (img *WzImage) verifyChecksum() error {
+	ws := img.WzFile.WzStructure
+	policy := ws.checksumPolicy()
+	if policy == ChecksumSkip {
+		return nil
+	}
+	calculatedChecksum, err := img.CalcChecksum()
+	if err != nil {
+		return img.wrapError("checksum", img.Offset, img.Node, err)
+	}
+	if calculatedChecksum != img.Checksum {
+		err := img.wrapError("checksum", img.Offset, img.Node, &ChecksumError{Expected: img.Checksum, Actual: calculatedChecksum})
+		if policy != ChecksumWarn {
+			return err
+		}
+		ws.logger().Warn("checksum mismatch, extracting anyway", "path", img.Node.GetFullPath(), "err", err)
+	}
 	return nil
 }
 
+// Unload drops the extracted property tree so it can be garbage collected.
+// The next TryExtract or GetNode extracts the image again. Nodes obtained
+// before Unload are detached but remain valid. A modified image is kept,
+// since its edits exist only in memory.
+func (img *WzImage) Unload() {
+	img.unload()
+	if c := img.cache(); c != nil {
+		c.remove(img)
+	}
+}
+
+func (img *WzImage) unload() {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if !img.Extracted || img.modified {
+		return
+	}
+	// 换成新的切片而不是截断，已交出的节点和正在遍历的切片不受影响
+	img.Node.Nodes = []*WzNode{}
+	img.index.Store(nil)
+	img.indexMu.Lock()
+	img.propIndexes = nil
+	img.indexMu.Unlock()
+	img.Extracted = false
+	img.memBytes = 0
+}
+
+// propIndexSlot 返回属性节点 n 的索引位置，create 为 false 且尚无位置时返回 nil
+func (img *WzImage) propIndexSlot(n *WzNode, create bool) *atomic.Pointer[nodeIndex] {
+	img.indexMu.Lock()
+	defer img.indexMu.Unlock()
+	slot := img.propIndexes[n]
+	if slot == nil && create {
+		if img.propIndexes == nil {
+			img.propIndexes = make(map[*WzNode]*atomic.Pointer[nodeIndex])
+		}
+		slot = new(atomic.Pointer[nodeIndex])
+		img.propIndexes[n] = slot
+	}
+	return slot
+}
+
+func (img *WzImage) cache() *ImageCache {
+	if img.WzFile == nil || img.WzFile.WzStructure == nil {
+		return nil
+	}
+	return img.WzFile.WzStructure.ImageCache
+}
+
+// IsExtracted reports whether TryExtract has completed successfully.
+func (img *WzImage) IsExtracted() bool {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	return img.Extracted
+}
+
+// Modified reports whether the image's properties were edited since it
+// was read, e.g. by a Transaction.
+func (img *WzImage) Modified() bool {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	return img.modified
+}
+
+// MarkModified records that the image's properties were edited in place.
+// Call it after changing an extracted image without a Transaction so the
+// edits are neither unloaded nor skipped when saving.
+func (img *WzImage) MarkModified() {
+	img.setModified(true)
+}
+
+func (img *WzImage) setModified(modified bool) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	img.modified = modified
+}
+
+// extractedNodes 返回已提取时顶层子节点的快照，未提取时返回 nil
+func (img *WzImage) extractedNodes() []*WzNode {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if !img.Extracted {
+		return nil
+	}
+	return img.Node.Nodes
+}
+
 func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
+	start := reader.AbsPos()
+	err := img.extractImg(reader, parent)
+	if err != nil {
+		return img.wrapError("extract", start, parent, err)
+	}
+	return nil
+}
+
+func (img *WzImage) extractImg(reader *WzBinaryReader, parent *WzNode) error {
 	tag, err := reader.ReadImageObjectTypeName(img.WzFile.WzStructure.Encryption.Keys)
 	if err != nil {
 		return err
@@ -142,6 +305,10 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 		if err != nil {
 			return err
 		}
+		if err := img.limits().checkEntries(entries); err != nil {
+			return err
+		}
+		reserveNodes(parent, entries)
 		for i := 0; i < int(entries); i++ {
 			err = img.ExtractValue(reader, parent)
 			if err != nil {
@@ -163,6 +330,10 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 			if err != nil {
 				return err
 			}
+			if err := img.limits().checkEntries(entries); err != nil {
+				return err
+			}
+			reserveNodes(parent, entries)
 			for i := 0; i < int(entries); i++ {
 				err = img.ExtractValue(reader, parent)
 				if err != nil {
@@ -176,7 +347,10 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 		b, _ := reader.ReadByte()
 		form += int32(b)
 		reader.SkipBytes(4)
-		dataLen, _ := reader.ReadInt32()
+		dataLen, err := reader.ReadInt32()
+		if err != nil {
+			return err
+		}
 		//ps := pp
 		pos := reader.Pos()
 		/*if ps != nil {
@@ -192,17 +366,24 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 		}
 		parent.Value = wz_png
 		parent.Type = "Canvas"
-		reader.SkipBytes(int64(dataLen))
+		if err := reader.SkipBytes(int64(dataLen)); err != nil {
+			return err
+		}
 	case "Shape2D#Convex2D":
 		entries, err := reader.ReadCompressedInt32()
 		if err != nil {
 			return err
 		}
+		if err := img.limits().checkEntries(entries); err != nil {
+			return err
+		}
 		var points = make([]image.Point, entries)
 		var virtualNode = NewWzNode("")
 
 		for i := 0; i < int(entries); i++ {
-			img.ExtractImg(reader, virtualNode)
+			if err := img.extractImg(reader, virtualNode); err != nil {
+				return err
+			}
 			if point, ok := virtualNode.Value.(image.Point); ok {
 				points[i] = point
 			}
@@ -210,6 +391,13 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 		parent.Value = points
 		parent.Type = "Shape2D#Convex2D"
 
+	case "Sound_DX8":
+		sound, err := img.readSound(reader)
+		if err != nil {
+			return err
+		}
+		parent.Value = sound
+		parent.Type = "Sound_DX8"
 	case "UOL":
 		// 跳过1字节（通常为0x00）
 		reader.SkipBytes(1)
@@ -221,19 +409,48 @@ func (img *WzImage) ExtractImg(reader *WzBinaryReader, parent *WzNode) error {
 		parent.Value = NewWzUol(uolStr)
 		parent.Type = "UOL"
 	default:
-		return fmt.Errorf("unsupported tag type: %s", tag)
+		return &UnknownTagError{Tag: tag}
 	}
 	return nil
 }
 
+func (img *WzImage) limits() Limits {
+	if img.WzFile == nil || img.WzFile.WzStructure == nil {
+		return Limits{}
+	}
+	return img.WzFile.WzStructure.Limits
+}
+
+// reserveNodes 按已知的条目数预分配子节点切片，避免 append 反复扩容。
+// 条目数来自文件，上限防止损坏的数据造成巨大的分配
+func reserveNodes(parent *WzNode, entries int32) {
+	if entries <= 0 || len(parent.Nodes) > 0 {
+		return
+	}
+	parent.Nodes = make([]*WzNode, 0, min(int(entries), 1<<16))
+}
+
 // ExtractValue extracts a single value from the reader
 func (img *WzImage) ExtractValue(reader *WzBinaryReader, parent *WzNode) error {
-	key, err := reader.ReadImageString(img.WzFile.WzStructure.Encryption.Keys)
+	start := reader.AbsPos()
+	if err := canceled(reader.ctx); err != nil {
+		return img.wrapError("extract", start, parent, err)
+	}
+	reader.entries++
+	key, err := reader.readImageName(img.WzFile.WzStructure.Encryption.Keys)
 	if err != nil {
-		return err
+		return img.wrapError("extract", start, parent, err)
 	}
 
 	child := parent.AddChild(NewWzNode(key))
+	err = img.extractValue(reader, child)
+	if err != nil {
+		return img.wrapError("extract", start, child, err)
+	}
+	return nil
+}
+
+func (img *WzImage) extractValue(reader *WzBinaryReader, child *WzNode) error {
 	// 打印parent和child的路径，便于调试树结构
 	flag, err := reader.ReadByte()
 	if err != nil {
@@ -248,13 +465,13 @@ func (img *WzImage) ExtractValue(reader *WzBinaryReader, parent *WzNode) error {
 		if err != nil {
 			return err
 		}
-		child.Value = val
+		child.Value = boxInt16(val)
 	case 0x03, 0x13:
 		val, err := reader.ReadCompressedInt32()
 		if err != nil {
 			return err
 		}
-		child.Value = val
+		child.Value = boxInt32(val)
 	case 0x14:
 		val, err := reader.ReadCompressedInt64()
 		if err != nil {
@@ -283,7 +500,7 @@ func (img *WzImage) ExtractValue(reader *WzBinaryReader, parent *WzNode) error {
 		// 1. 读取结构块长度
 		objDataLen, err := reader.ReadInt32()
 		if err != nil {
-			return fmt.Errorf("读取结构体长度失败: %v", err)
+			return fmt.Errorf("read object length: %w", err)
 		}
 
 		// 2. 计算结构体的结束位置
@@ -292,37 +509,33 @@ func (img *WzImage) ExtractValue(reader *WzBinaryReader, parent *WzNode) error {
 
 		// 3. 提取结构体内容
 		if err := img.ExtractImg(reader, child); err != nil {
-			return fmt.Errorf("提取结构体内容失败: %v", err)
+			return err
 		}
 
 		// 4. 检查是否完全读完结构体
 		newPos := reader.Pos()
 		if newPos != endPos {
-			return fmt.Errorf("结构体未完整读取 (%d != %d)", newPos, endPos)
+			return fmt.Errorf("object not fully read (%d != %d)", newPos, endPos)
 		}
 	default:
-		return fmt.Errorf("unknown flag: %x", flag)
+		return &UnknownFlagError{Flag: flag, Context: "property"}
 	}
 
 	return nil
 }
 
-// OpenRead 返回一个指向当前 WzImage 数据的 io.ReadSeeker
-func (img *WzImage) OpenRead() io.ReadSeeker {
-	// 如果 Stream 已经存在且指向正确位置，直接返回
-	if img.Stream != nil {
-		img.Stream.Seek(0, io.SeekStart)
-		return img.Stream
-	}
-	// 否则重新创建一个新的 PartialStream 或 bytes.Reader
-	stream, err := NewPartialStream(img.WzFile.FileStream.File(), img.Offset, int64(img.Size))
-	if err != nil {
-		// fallback: 读入内存
-		buf := make([]byte, img.Size)
-		_, _ = img.WzFile.FileStream.BaseStream.Seek(img.Offset, io.SeekStart)
-		_, _ = io.ReadFull(img.WzFile.FileStream.BaseStream, buf)
-		return bytes.NewReader(buf)
+// wrapError attaches the image file name and node path to err.
+func (img *WzImage) wrapError(op string, offset int64, node *WzNode, err error) error {
+	fileName := ""
+	if img.WzFile != nil {
+		fileName = img.WzFile.FileName
 	}
-	img.Stream = stream
+	return wrapError(op, fileName, offset, node.GetFullPath(), err)
+}
+
+// OpenRead 返回一个指向当前 WzImage 数据的 io.ReadSeeker。
+// 每次调用都返回独立的流，各自维护读取位置，可以在多个 goroutine 中同时使用。
+func (img *WzImage) OpenRead() io.ReadSeeker {
+	stream, _ := NewPartialStream(img.WzFile, img.Offset, int64(img.Size))
 	return stream
 }
@@ -0,0 +1,191 @@
+package wzlib
+
+import (
+	"container/list"
+	"sync"
+)
+
+// ImageCache bounds the memory held by extracted images. Images register
+// themselves when TryExtract succeeds; once the cache exceeds MaxImages or
+// MaxBytes, the least recently used unpinned images are unloaded and will be
+// extracted again on their next access. One cache may be shared by several
+// structures. The zero value is a cache without limits; the limits may be set
+// before first use.
+type ImageCache struct {
+	MaxImages int   // 最多保留的 img 数量，0 表示不限
+	MaxBytes  int64 // 估算内存上限，0 表示不限
+
+	mu      sync.Mutex
+	entries map[*WzImage]*list.Element
+	lru     *list.List // 元素值为 *imageCacheEntry，最近使用的在前
+	bytes   int64
+	pins    map[*WzImage]int
+}
+
+type imageCacheEntry struct {
+	img   *WzImage
+	bytes int64
+}
+
+// NewImageCache returns a cache limited to maxImages images and maxBytes
+// estimated bytes. A zero limit is not enforced.
+func NewImageCache(maxImages int, maxBytes int64) *ImageCache {
+	return &ImageCache{MaxImages: maxImages, MaxBytes: maxBytes}
+}
+
+// initLocked 在首次使用时创建内部结构，使零值可用，调用方需持有 mu
+func (c *ImageCache) initLocked() {
+	if c.lru == nil {
+		c.entries = map[*WzImage]*list.Element{}
+		c.lru = list.New()
+		c.pins = map[*WzImage]int{}
+	}
+}
+
+// Len returns the number of cached images.
+func (c *ImageCache) Len() int {
+	c.mu.Lock()
+	c.initLocked()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Bytes returns the estimated memory used by cached images.
+func (c *ImageCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// Pin keeps img from being evicted until a matching Unpin. Pins nest.
+func (c *ImageCache) Pin(img *WzImage) {
+	c.mu.Lock()
+	c.initLocked()
+	defer c.mu.Unlock()
+	c.pins[img]++
+}
+
+// Unpin releases one Pin and evicts images if the cache is over its limits.
+func (c *ImageCache) Unpin(img *WzImage) {
+	c.mu.Lock()
+	c.initLocked()
+	if c.pins[img] <= 1 {
+		delete(c.pins, img)
+	} else {
+		c.pins[img]--
+	}
+	victims := c.evictLocked()
+	c.mu.Unlock()
+	unloadAll(victims)
+}
+
+// Clear unloads every unpinned image.
+func (c *ImageCache) Clear() {
+	c.mu.Lock()
+	c.initLocked()
+	var victims []*WzImage
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		e := elem.Value.(*imageCacheEntry)
+		if c.pins[e.img] == 0 {
+			c.removeLocked(elem)
+			victims = append(victims, e.img)
+		}
+		elem = next
+	}
+	c.mu.Unlock()
+	unloadAll(victims)
+}
+
+// touch 记录 img 被访问，bytes 为其估算大小
+func (c *ImageCache) touch(img *WzImage, bytes int64) {
+	c.mu.Lock()
+	c.initLocked()
+	if elem, ok := c.entries[img]; ok {
+		e := elem.Value.(*imageCacheEntry)
+		c.bytes += bytes - e.bytes
+		e.bytes = bytes
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[img] = c.lru.PushFront(&imageCacheEntry{img: img, bytes: bytes})
+		c.bytes += bytes
+	}
+	victims := c.evictLocked()
+	c.mu.Unlock()
+	unloadAll(victims)
+}
+
+// remove 在 img 被手动卸载后移除其记录
+func (c *ImageCache) remove(img *WzImage) {
+	c.mu.Lock()
+	c.initLocked()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[img]; ok {
+		c.removeLocked(elem)
+	}
+}
+
+// forget 移除属于已关闭文件的记录，不卸载其内容
+func (c *ImageCache) forget(wf *WzFile) {
+	c.mu.Lock()
+	c.initLocked()
+	defer c.mu.Unlock()
+	for img, elem := range c.entries {
+		if img.WzFile == wf {
+			c.removeLocked(elem)
+			delete(c.pins, img)
+		}
+	}
+}
+
+func (c *ImageCache) removeLocked(elem *list.Element) {
+	e := c.lru.Remove(elem).(*imageCacheEntry)
+	delete(c.entries, e.img)
+	c.bytes -= e.bytes
+}
+
+// evictLocked 从最久未使用的一端挑出需要卸载的 img，调用方需持有 mu。
+// 卸载本身在释放 mu 之后进行，避免与正在提取的 img 互相等待。
+func (c *ImageCache) evictLocked() []*WzImage {
+	var victims []*WzImage
+	elem := c.lru.Back()
+	// 最近访问的 img 总是保留，即使它本身就超过上限
+	for elem != nil && elem != c.lru.Front() && c.overLimit() {
+		prev := elem.Prev()
+		e := elem.Value.(*imageCacheEntry)
+		if c.pins[e.img] == 0 {
+			c.removeLocked(elem)
+			victims = append(victims, e.img)
+		}
+		elem = prev
+	}
+	return victims
+}
+
+func (c *ImageCache) overLimit() bool {
+	return (c.MaxImages > 0 && c.lru.Len() > c.MaxImages) ||
+		(c.MaxBytes > 0 && c.bytes > c.MaxBytes)
+}
+
+func unloadAll(images []*WzImage) {
+	for _, img := range images {
+		img.unload()
+	}
+}
+
+// estimateNodeBytes 粗略估算节点树占用的内存
+func estimateNodeBytes(n *WzNode) int64 {
+	size := int64(96 + len(n.Text) + 8*cap(n.Nodes))
+	switch v := n.Value.(type) {
+	case string:
+		size += int64(len(v))
+	case *WzPng:
+		size += 64
+	case *WzSound:
+		size += 64
+	}
+	for _, child := range n.Nodes {
+		size += estimateNodeBytes(child)
+	}
+	return size
+}
@@ -0,0 +1,267 @@
+package wzlib
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"slices"
+	"strings"
+)
+
+// maxLinkDepth 限制画布链接的跳转次数，防止链接成环
+const maxLinkDepth = 8
+
+// ImportOptions controls Transaction.Import.
+type ImportOptions struct {
+	Name string // 目标中的 img 名称，空时沿用源 img 的名称
+
+	// RewriteOutlink maps the _outlink path of a source canvas to the path
+	// stored in the target; _inlink paths are kept. When nil, links are
+	// inlined for clients that predate them: a linked canvas takes the data
+	// of the canvas it points to and its _outlink or _inlink property is
+	// dropped.
+	RewriteOutlink func(path string) string
+
+	// CanvasForms lists the canvas formats the target client can read. A
+	// canvas in another format is decoded and re-encoded in the first
+	// listed format that holds its pixels losslessly, only 1, 2, 257 and
+	// 513 can be encoded; Import fails when none can. When nil, canvases
+	// keep their format.
+	CanvasForms []int
+}
+
+// Import copies the image src, typically from a structure of another
+// client, into the directory dir of the transaction's structure and
+// returns the new image node. The copy is marked modified; it is encoded
+// with the target's key when its file is saved, so strings are
+// re-encrypted. Canvas payloads are copied raw when their format is in
+// opts.CanvasForms (or CanvasForms is nil) and re-encoded otherwise;
+// block-encrypted canvases are re-encrypted for the target key. Sound
+// payloads are always copied raw: their format header travels with them
+// and its encrypted part is re-encrypted. The source file must stay open
+// until the target is saved.
+func (tx *Transaction) Import(dir, src *WzNode, opts ImportOptions) (*WzNode, error) {
+	srcImg, ok := src.Value.(*WzImage)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an image", ErrNotEditable, src.GetFullPath())
+	}
+	nodes, err := srcImg.extract(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	name := opts.Name
+	if name == "" {
+		name = src.Text
+	}
+
+	node := NewWzNode(name)
+	node.Type = "Property"
+	im := &importer{root: rootOf(src), img: src, rewrite: opts.RewriteOutlink, forms: opts.CanvasForms}
+	if err := im.copyNodes(nodes, node); err != nil {
+		return nil, err
+	}
+
+	err = tx.apply(func() (func(), error) {
+		if err := tx.checkNode(dir); err != nil {
+			return nil, err
+		}
+		if !isDirectory(dir) {
+			return nil, fmt.Errorf("%w: %s is not a directory", ErrNotEditable, dir.GetFullPath())
+		}
+		wf := tx.ws.fileOf(dir)
+		if wf == nil {
+			return nil, fmt.Errorf("%w: %s does not belong to a file", ErrNotEditable, dir.GetFullPath())
+		}
+		if err := checkUnique(dir, name, nil); err != nil {
+			return nil, err
+		}
+		node.Value = &WzImage{
+			Name:            name,
+			WzFile:          wf,
+			Node:            node,
+			Extracted:       true,
+			ChecksumChecked: true,
+			modified:        true,
+		}
+		unedit := tx.markEdited(dir)
+		dir.AddChild(node)
+		return func() {
+			dir.RemoveChild(node)
+			unedit()
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// fileOf 返回目录节点 dir 所属的文件。Base.wz 布局下分类节点的值是 Base.wz 的目录，
+// 内容却属于分类文件，所以先按文件的根节点匹配
+func (ws *WzStructure) fileOf(dir *WzNode) *WzFile {
+	for n := dir; n != nil; n = n.ParentNode {
+		for _, wf := range ws.WzFiles {
+			if wf.Node == n {
+				return wf
+			}
+		}
+		switch v := n.Value.(type) {
+		case *WzFile:
+			return v
+		case *WzDirectory:
+			if v.WzFile != nil {
+				return v.WzFile
+			}
+		}
+	}
+	return nil
+}
+
+func rootOf(n *WzNode) *WzNode {
+	for n.ParentNode != nil {
+		n = n.ParentNode
+	}
+	return n
+}
+
+// importer 复制源 img 的属性树
+type importer struct {
+	root    *WzNode // 源结构的根，解析 _outlink
+	img     *WzNode // 源 img，解析 _inlink
+	rewrite func(string) string
+	forms   []int // 目标支持的画布格式，nil 表示不转换
+}
+
+func (im *importer) copyNodes(nodes []*WzNode, parent *WzNode) error {
+	for _, n := range nodes {
+		c := NewWzNode(n.Text)
+		c.Type = n.Type
+		c.Value = copyValue(n.Value)
+		children := n.Nodes
+		if _, ok := n.Value.(*WzPng); ok {
+			var err error
+			if children, err = im.link(n, c); err != nil {
+				return err
+			}
+			if err := im.convert(n, c); err != nil {
+				return err
+			}
+		}
+		if err := im.copyNodes(children, c); err != nil {
+			return err
+		}
+		parent.AddChild(c)
+	}
+	return nil
+}
+
+// link 处理画布 n 的链接，返回要复制的子节点。内联时 c 换成链接目标的数据，
+// 链接属性不再复制
+func (im *importer) link(n, c *WzNode) ([]*WzNode, error) {
+	if im.rewrite != nil {
+		children := make([]*WzNode, 0, len(n.Nodes))
+		for _, child := range n.Nodes {
+			if path, ok := child.Value.(string); ok && child.Text == "_outlink" {
+				child = &WzNode{Text: child.Text, Value: im.rewrite(path)}
+			}
+			children = append(children, child)
+		}
+		return children, nil
+	}
+
+	target, err := im.resolve(n)
+	if err != nil {
+		return nil, err
+	}
+	if target == n {
+		return n.Nodes, nil
+	}
+	c.Value = copyValue(target.Value)
+	children := make([]*WzNode, 0, len(n.Nodes))
+	for _, child := range n.Nodes {
+		if child.Text != "_outlink" && child.Text != "_inlink" {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+// convert 在目标不支持画布 c 的格式时解码并按目标支持的格式重新编码，n 是源节点
+func (im *importer) convert(n, c *WzNode) error {
+	png := c.Value.(*WzPng)
+	if im.forms == nil || slices.Contains(im.forms, png.Form) {
+		return nil
+	}
+	img, err := png.ExtractImageInto(nil)
+	if err != nil {
+		return err
+	}
+	for _, form := range im.forms {
+		raw, ok := encodePixels(form, img.Pix)
+		if !ok {
+			continue
+		}
+		data, err := deflateCanvas(raw)
+		if err != nil {
+			return err
+		}
+		png.Form, png.DataLength, png.data = form, len(data), data
+		return nil
+	}
+	return fmt.Errorf("wzlib: %s has form %d, which cannot be converted to any of %v", n.GetFullPath(), png.Form, im.forms)
+}
+
+// resolve 沿 _outlink 与 _inlink 找到真正带数据的画布，没有链接时返回 n
+func (im *importer) resolve(n *WzNode) (*WzNode, error) {
+	for range maxLinkDepth {
+		var target *WzNode
+		if path, ok := linkPath(n, "_outlink"); ok {
+			target = im.root.GetNode(path)
+			if target == nil {
+				// 路径以 wz 文件名开头，单独加载的文件中根节点就是该文件
+				if _, rest, ok := strings.Cut(path, "/"); ok {
+					target = im.root.GetNode(rest)
+				}
+			}
+		} else if path, ok := linkPath(n, "_inlink"); ok {
+			target = im.img.GetNode(path)
+		} else {
+			return n, nil
+		}
+		if target == nil {
+			return nil, fmt.Errorf("%w: %s", ErrBrokenLink, n.GetFullPath())
+		}
+		if _, ok := target.Value.(*WzPng); !ok {
+			return nil, fmt.Errorf("%w: %s points to %s, which is not a canvas", ErrBrokenLink, n.GetFullPath(), target.GetFullPath())
+		}
+		n = target
+	}
+	return nil, fmt.Errorf("%w: %s: too many links", ErrBrokenLink, n.GetFullPath())
+}
+
+func linkPath(n *WzNode, name string) (string, bool) {
+	for _, c := range n.Nodes {
+		if c.Text == name {
+			path, ok := c.Value.(string)
+			return path, ok
+		}
+	}
+	return "", false
+}
+
+// copyValue 复制节点的值。画布与音频复制描述而不复制数据，保存时从源文件读取
+func copyValue(v any) any {
+	switch v := v.(type) {
+	case []image.Point:
+		return append([]image.Point(nil), v...)
+	case *WzUol:
+		return NewWzUol(v.Uol)
+	case *WzPng:
+		png := *v
+		return &png
+	case *WzSound:
+		sound := *v
+		return &sound
+	}
+	return v
+}
@@ -0,0 +1,492 @@
+package wzlib
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// indexCacheVersion 在缓存格式变化时递增，旧版本的缓存文件会被忽略
+const indexCacheVersion = 5
+
+// indexHeaderBytes 参与头部哈希的字节数，覆盖文件头和目录开头
+const indexHeaderBytes = 4096
+
+// IndexCache stores the parsed directory tree of WZ files on disk so that
+// reopening an unchanged file skips directory parsing and key detection.
+// A cache entry is keyed by the file's absolute path and is only used when
+// the size, modification time and a hash of the file header still match.
+//
+// The cache is written by SaveIndexCache. Only files loaded from a path on
+// disk are cached.
+type IndexCache struct {
+	Dir string // 缓存文件所在目录
+
+	// SaveProperties 为 true 时 SaveIndexCache 同时保存已提取 img 的属性骨架，
+	// 下次打开时这些 img 不必再读取和解析
+	SaveProperties bool
+}
+
+// NewIndexCache returns a cache that keeps its files in dir.
+func NewIndexCache(dir string) *IndexCache {
+	return &IndexCache{Dir: dir}
+}
+
+// indexFile 是一个缓存文件的内容
+type indexFile struct {
+	Version     int
+	Path        string
+	Size        int64
+	ModTime     int64 // UnixNano
+	HeaderHash  [sha256.Size]byte
+	EncType     WzCryptoKeyType
+	HasVersion  bool
+	WzVersion   int
+	HashVersion uint
+	DirEnd      int64 // WzHeader.DirEndPosition
+	Root        []indexEntry
+}
+
+// indexEntry 是目录或 img，目录的 HashedOffsetPos 对应 WzDirectory.HashedOffsetPosition
+type indexEntry struct {
+	Name            string
+	IsDir           bool
+	Size            int
+	Checksum        int
+	HashedOffset    uint32
+	HashedOffsetPos uint32
+	Offset          int64        // img 数据的偏移；目录为 WzDirectory.Offset
+	Children        []indexEntry // 目录的子项
+	Props           []indexProp  // 已提取 img 的属性骨架，nil 表示未保存
+}
+
+// indexProp 是 img 内的一个属性节点；值按 Kind 存放在对应字段中
+type indexProp struct {
+	Name     string
+	Type     string
+	Kind     byte
+	Int      int64
+	Float    float64
+	Str      string
+	Points   []image.Point
+	Png      *indexPng
+	Sound    *indexSound
+	Children []indexProp
+}
+
+type indexPng struct {
+	Width, Height, DataLength, Form int
+	Offset                          uint32
+}
+
+// indexSound 保存 WzSound 除音频数据外的全部字段
+type indexSound struct {
+	Offset          uint32
+	DataLength, Ms  int
+	Header, Format  []byte
+	FormatEncrypted bool
+}
+
+const (
+	propNil byte = iota
+	propInt16
+	propInt32
+	propInt64
+	propFloat32
+	propFloat64
+	propString
+	propPoint
+	propConvex
+	propCanvas
+	propUol
+	propSound
+)
+
+// indexKey 描述文件的当前状态，用于判断缓存是否过期
+type indexKey struct {
+	path       string
+	size       int64
+	modTime    int64
+	headerHash [sha256.Size]byte
+}
+
+// statIndexKey 只对磁盘上的文件有效，其他来源返回 false
+func statIndexKey(wf *WzFile) (indexKey, bool) {
+	path, err := filepath.Abs(wf.FileName)
+	if err != nil {
+		return indexKey{}, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || fi.Size() != wf.Source.Size() {
+		return indexKey{}, false
+	}
+	buf := make([]byte, min(int64(indexHeaderBytes), fi.Size()))
+	if _, err := wf.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return indexKey{}, false
+	}
+	return indexKey{
+		path:       path,
+		size:       fi.Size(),
+		modTime:    fi.ModTime().UnixNano(),
+		headerHash: sha256.Sum256(buf),
+	}, true
+}
+
+func (c *IndexCache) fileName(path string) string {
+	sum := sha1.Sum([]byte(path))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".idx")
+}
+
+// load 读取与 key 匹配的缓存，缺失、损坏或过期时返回 nil
+func (c *IndexCache) load(key indexKey) *indexFile {
+	f, err := os.Open(c.fileName(key.path))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var idx indexFile
+	if err := gob.NewDecoder(f).Decode(&idx); err != nil {
+		return nil
+	}
+	if idx.Version != indexCacheVersion || idx.Path != key.path || idx.Size != key.size ||
+		idx.ModTime != key.modTime || idx.HeaderHash != key.headerHash {
+		return nil
+	}
+	return &idx
+}
+
+// save 先写临时文件再改名，其他进程不会读到写了一半的缓存
+func (c *IndexCache) save(idx *indexFile) error {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.Dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(idx); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.fileName(idx.Path)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func cryptoKeyOf(t WzCryptoKeyType) *WzCryptoKey {
+	switch t {
+	case BMS:
+		return BmsCryptoKey
+	case KMS:
+		return KmsCryptoKey
+	case GMS:
+		return GmsCryptoKey
+	}
+	return nil
+}
+
+// loadFromIndex 用缓存恢复密钥、版本与目录树到 node，成功时不再读取目录
+func (ws *WzStructure) loadFromIndex(wzFile *WzFile, idx *indexFile, node *WzNode) bool {
+	if ws.Encryption == nil {
+		keys := cryptoKeyOf(idx.EncType)
+		if keys == nil {
+			return false
+		}
+		ws.Encryption = NewWzCrypto()
+		ws.Encryption.EncType = idx.EncType
+		ws.Encryption.Keys = keys
+	} else if ws.Encryption.EncType != idx.EncType {
+		return false
+	}
+	if ws.WzVersion > 0 && (!idx.HasVersion || idx.WzVersion != ws.WzVersion) {
+		return false
+	}
+	if idx.HasVersion {
+		wzFile.Header.VersionDetector = &FixedVersion{WzVersion: idx.WzVersion, HashVersion: idx.HashVersion}
+	}
+
+	wzFile.WzStructure = ws
+	wzFile.Header.DirEndPosition = idx.DirEnd
+	wzFile.restoreEntries(node, idx.Root)
+	return true
+}
+
+func (wf *WzFile) restoreEntries(parent *WzNode, entries []indexEntry) {
+	for i := range entries {
+		e := &entries[i]
+		if e.IsDir {
+			dir := &WzDirectory{
+				Name:                 e.Name,
+				Offset:               int(e.Offset),
+				Size:                 e.Size,
+				Checksum:             e.Checksum,
+				HashedOffset:         e.HashedOffset,
+				HashedOffsetPosition: e.HashedOffsetPos,
+				WzFile:               wf,
+			}
+			// 与直接解析时一样，子目录首次访问时才创建节点
+			dir.load = func(_ context.Context, n *WzNode) error {
+				wf.restoreEntries(n, e.Children)
+				return nil
+			}
+			wf.dirMu.Lock()
+			wf.Directories = append(wf.Directories, dir)
+			wf.dirMu.Unlock()
+			parent.AddChild(NewWzNode(e.Name)).Value = dir
+			continue
+		}
+		img := &WzImage{
+			Name:            e.Name,
+			Size:            e.Size,
+			Checksum:        e.Checksum,
+			HashedOffset:    e.HashedOffset,
+			HashedOffsetPos: e.HashedOffsetPos,
+			Offset:          e.Offset,
+			WzFile:          wf,
+			Node:            NewWzNode(e.Name),
+		}
+		if e.Props != nil {
+			restoreProps(img, img.Node, e.Props)
+			img.Extracted = true
+			img.ChecksumChecked = true
+			img.memBytes = estimateNodeBytes(img.Node)
+		}
+		parent.AddChild(img.Node).Value = img
+	}
+}
+
+func restoreProps(img *WzImage, parent *WzNode, props []indexProp) {
+	for i := range props {
+		p := &props[i]
+		child := parent.AddChild(NewWzNode(p.Name))
+		child.Type = p.Type
+		switch p.Kind {
+		case propInt16:
+			child.Value = int16(p.Int)
+		case propInt32:
+			child.Value = int32(p.Int)
+		case propInt64:
+			child.Value = p.Int
+		case propFloat32:
+			child.Value = float32(p.Float)
+		case propFloat64:
+			child.Value = p.Float
+		case propString:
+			child.Value = p.Str
+		case propPoint:
+			child.Value = p.Points[0]
+		case propConvex:
+			child.Value = append([]image.Point{}, p.Points...)
+		case propCanvas:
+			child.Value = &WzPng{
+				Width:      p.Png.Width,
+				Height:     p.Png.Height,
+				DataLength: p.Png.DataLength,
+				Form:       p.Png.Form,
+				Offset:     p.Png.Offset,
+				Image:      img,
+			}
+		case propUol:
+			child.Value = NewWzUol(p.Str)
+		case propSound:
+			sound := &WzSound{
+				Offset:          p.Sound.Offset,
+				DataLength:      p.Sound.DataLength,
+				Ms:              p.Sound.Ms,
+				WzImage:         img,
+				header:          p.Sound.Header,
+				formatEncrypted: p.Sound.FormatEncrypted,
+			}
+			sound.setFormat(p.Sound.Format)
+			child.Value = sound
+		}
+		restoreProps(img, child, p.Children)
+	}
+}
+
+// SaveIndexCache writes the directory tree of every file loaded from disk
+// to the structure's IndexCache. With SaveProperties set, the property
+// trees of images extracted so far are saved as well. It does nothing when
+// IndexCache is nil.
+func (ws *WzStructure) SaveIndexCache() error {
+	c := ws.IndexCache
+	if c == nil {
+		return nil
+	}
+	for _, wf := range ws.WzFiles {
+		if err := c.saveFiles(wf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveFiles 保存 wf 及合并进它的扩展文件。扩展文件的条目挂在主文件的节点下，
+// 对扩展文件的修改记在主文件上
+func (c *IndexCache) saveFiles(wf *WzFile) error {
+	// 打开后被改写的文件，或树被修改而尚未保存的文件，内存中的目录已与磁盘不符
+	if wf.Node == nil || wf.OwnerWzFile != nil || wf.Edited() {
+		return nil
+	}
+	for _, f := range append([]*WzFile{wf}, wf.MergedWzFiles...) {
+		if f.Closed() || f.Changed() {
+			continue
+		}
+		if err := c.saveFile(f); err != nil {
+			return fmt.Errorf("save index cache of %s: %w", f.FileName, err)
+		}
+	}
+	return nil
+}
+
+func (c *IndexCache) saveFile(wf *WzFile) error {
+	key, ok := statIndexKey(wf)
+	if !ok {
+		return nil
+	}
+	idx := &indexFile{
+		Version:    indexCacheVersion,
+		Path:       key.path,
+		Size:       key.size,
+		ModTime:    key.modTime,
+		HeaderHash: key.headerHash,
+		EncType:    wf.WzStructure.Encryption.EncType,
+		DirEnd:     wf.Header.DirEndPosition,
+	}
+	if d := wf.Header.VersionDetector; d != nil {
+		idx.HasVersion = true
+		idx.WzVersion = d.GetWzVersion()
+		idx.HashVersion = d.GetHashVersion()
+	}
+	// 尚未展开的子目录在这里读取
+	root, err := c.collectEntries(wf, wf.saveRoot())
+	if err != nil {
+		return err
+	}
+	idx.Root = root
+	return c.save(idx)
+}
+
+func (c *IndexCache) collectEntries(wf *WzFile, parent *WzNode) ([]indexEntry, error) {
+	if err := parent.LoadChildren(); err != nil {
+		return nil, err
+	}
+	entries := make([]indexEntry, 0, len(parent.Nodes))
+	for _, n := range parent.Nodes {
+		switch v := n.Value.(type) {
+		case *WzImage:
+			if v.WzFile != wf {
+				continue
+			}
+			e := indexEntry{
+				Name:            v.Name,
+				Size:            v.Size,
+				Checksum:        v.Checksum,
+				HashedOffset:    v.HashedOffset,
+				HashedOffsetPos: v.HashedOffsetPos,
+				Offset:          v.Offset,
+			}
+			if c.SaveProperties {
+				e.Props = v.snapshotProps()
+			}
+			entries = append(entries, e)
+		case *WzDirectory:
+			if v.WzFile != wf {
+				continue
+			}
+			children, err := c.collectEntries(wf, n)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, dirEntry(v, children))
+		case *WzFile:
+			// 挂载在本文件空目录上的子文件，只记下原来的空目录
+			if d := v.mountedOn; d != nil && d.WzFile == wf {
+				entries = append(entries, dirEntry(d, nil))
+			}
+		}
+		// 其他值属于别的文件，不写入本文件的缓存
+	}
+	return entries, nil
+}
+
+func dirEntry(d *WzDirectory, children []indexEntry) indexEntry {
+	return indexEntry{
+		Name:            d.Name,
+		IsDir:           true,
+		Size:            d.Size,
+		Checksum:        d.Checksum,
+		HashedOffset:    d.HashedOffset,
+		HashedOffsetPos: d.HashedOffsetPosition,
+		Offset:          int64(d.Offset),
+		Children:        children,
+	}
+}
+
+// snapshotProps 在 img 已提取且未修改时返回属性骨架，否则返回 nil
+func (img *WzImage) snapshotProps() []indexProp {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	// 修改过的属性与文件内容不符，不能记入缓存
+	if !img.Extracted || img.modified {
+		return nil
+	}
+	return collectProps(img.Node.Nodes)
+}
+
+func collectProps(nodes []*WzNode) []indexProp {
+	props := make([]indexProp, len(nodes))
+	for i, n := range nodes {
+		p := &props[i]
+		p.Name, p.Type = n.Text, n.Type
+		switch v := n.Value.(type) {
+		case int16:
+			p.Kind, p.Int = propInt16, int64(v)
+		case int32:
+			p.Kind, p.Int = propInt32, int64(v)
+		case int64:
+			p.Kind, p.Int = propInt64, v
+		case float32:
+			p.Kind, p.Float = propFloat32, float64(v)
+		case float64:
+			p.Kind, p.Float = propFloat64, v
+		case string:
+			p.Kind, p.Str = propString, v
+		case image.Point:
+			p.Kind, p.Points = propPoint, []image.Point{v}
+		case []image.Point:
+			p.Kind, p.Points = propConvex, v
+		case *WzPng:
+			p.Kind = propCanvas
+			p.Png = &indexPng{Width: v.Width, Height: v.Height, DataLength: v.DataLength, Form: v.Form, Offset: v.Offset}
+		case *WzUol:
+			p.Kind, p.Str = propUol, v.Uol
+		case *WzSound:
+			p.Kind = propSound
+			p.Sound = &indexSound{
+				Offset:          v.Offset,
+				DataLength:      v.DataLength,
+				Ms:              v.Ms,
+				Header:          v.header,
+				Format:          v.format,
+				FormatEncrypted: v.formatEncrypted,
+			}
+		}
+		p.Children = collectProps(n.Nodes)
+	}
+	return props
+}
@@ -0,0 +1,65 @@
+package wzlib
+
+import "sync"
+
+// stringTable 驻留属性名。同一结构中的 origin、delay、z 等键名只保留一份，
+// 表随结构存在，大小受键名种类限制。零值可用
+type stringTable struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+// intern 返回与 b 内容相同的驻留字符串，命中时不分配内存
+func (t *stringTable) intern(b []byte) string {
+	t.mu.RLock()
+	s, ok := t.m[string(b)]
+	t.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.m[string(b)]; ok {
+		return s
+	}
+	if t.m == nil {
+		t.m = make(map[string]string)
+	}
+	s = string(b)
+	t.m[s] = s
+	return s
+}
+
+// 预先装箱的小整数。delay、z、坐标之类的值大多落在这个范围内，
+// 直接复用这些 interface 值，不必为每个节点单独分配
+const (
+	boxedMin = -1024
+	boxedMax = 4096
+)
+
+var (
+	boxedInt16 [boxedMax - boxedMin]any
+	boxedInt32 [boxedMax - boxedMin]any
+)
+
+func init() {
+	for i := range boxedInt32 {
+		boxedInt16[i] = int16(i + boxedMin)
+		boxedInt32[i] = int32(i + boxedMin)
+	}
+}
+
+func boxInt16(v int16) any {
+	if v >= boxedMin && v < boxedMax {
+		return boxedInt16[int(v)-boxedMin]
+	}
+	return v
+}
+
+func boxInt32(v int32) any {
+	if v >= boxedMin && v < boxedMax {
+		return boxedInt32[int(v)-boxedMin]
+	}
+	return v
+}
@@ -0,0 +1,83 @@
+package wzlib
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+)
+
+// Logger receives diagnostic messages. The methods match those of
+// *slog.Logger, which can be passed directly; args are alternating keys
+// and values.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// NewSlogLogger returns a Logger writing to h, or to the handler of
+// slog.Default when h is nil. Every record carries component=wzlib so the
+// library's messages can be told apart from the application's.
+func NewSlogLogger(h slog.Handler) Logger {
+	if h == nil {
+		h = slog.Default().Handler()
+	}
+	return slog.New(h).With("component", "wzlib")
+}
+
+// NewStdLogger returns a Logger printing to l, or to the standard logger
+// when l is nil. Debug messages are dropped unless debug is true.
+func NewStdLogger(l *log.Logger, debug bool) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, debug: debug}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	debug bool
+}
+
+func (s *stdLogger) Debug(msg string, args ...any) {
+	if s.debug {
+		s.print("DEBUG", msg, args)
+	}
+}
+
+func (s *stdLogger) Info(msg string, args ...any)  { s.print("INFO", msg, args) }
+func (s *stdLogger) Warn(msg string, args ...any)  { s.print("WARN", msg, args) }
+func (s *stdLogger) Error(msg string, args ...any) { s.print("ERROR", msg, args) }
+
+// print 输出 "LEVEL msg key=value ..."，落单的参数记为 !BADKEY，与 slog 一致
+func (s *stdLogger) print(level, msg string, args []any) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	s.l.Output(3, b.String())
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// logger 返回结构的 Logger，未设置时丢弃所有消息
+func (ws *WzStructure) logger() Logger {
+	if ws == nil || ws.Logger == nil {
+		return nopLogger{}
+	}
+	return ws.Logger
+}
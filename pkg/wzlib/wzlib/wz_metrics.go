@@ -0,0 +1,133 @@
+package wzlib
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics receives instrumentation events. Methods may be called from
+// several goroutines at once and should return quickly.
+type Metrics interface {
+	// ImageExtracted 报告一个 img 提取完成：属性条目数、img 数据大小与耗时
+	ImageExtracted(entries int, bytes int64, d time.Duration)
+	// BytesRead 报告从数据源读取的字节数
+	BytesRead(n int)
+	// CanvasDecoded 报告一次按 form 格式解码画布的耗时
+	CanvasDecoded(form int, d time.Duration)
+	// CacheLookup 报告一次缓存查找，cache 为 CacheImage 或 CacheIndex
+	CacheLookup(cache string, hit bool)
+}
+
+// 传给 Metrics.CacheLookup 的缓存名
+const (
+	CacheImage = "image" // 访问 img 时已提取的为命中
+	CacheIndex = "index" // 打开文件时 IndexCache 可用的为命中
+)
+
+type nopMetrics struct{}
+
+func (nopMetrics) ImageExtracted(int, int64, time.Duration) {}
+func (nopMetrics) BytesRead(int)                            {}
+func (nopMetrics) CanvasDecoded(int, time.Duration)         {}
+func (nopMetrics) CacheLookup(string, bool)                 {}
+
+// metrics 返回结构的 Metrics，未设置时丢弃所有事件
+func (ws *WzStructure) metrics() Metrics {
+	if ws == nil || ws.Metrics == nil {
+		return nopMetrics{}
+	}
+	return ws.Metrics
+}
+
+// ExpvarMetrics publishes the events as an expvar map, so a process that
+// serves expvar.Handler (or imports net/http/pprof's default mux) shows
+// them under /debug/vars:
+//
+//	"wzlib": {
+//		"images_extracted": 120, "image_entries": 5300, "image_bytes": 812000,
+//		"extract_ns": 95000000, "bytes_read": 830000,
+//		"canvas_decoded": {"1": 40, "2": 12}, "canvas_decode_ns": {"1": 3100000, "2": 900000},
+//		"cache_hits": {"image": 310}, "cache_misses": {"image": 120, "index": 1}
+//	}
+//
+// Durations are totals in nanoseconds.
+type ExpvarMetrics struct {
+	vars *expvar.Map
+
+	images, entries, imageBytes, extractNs, bytesRead *expvar.Int
+
+	canvasCount, canvasNs, cacheHits, cacheMisses *expvar.Map
+}
+
+var (
+	expvarMu      sync.Mutex
+	expvarMetrics = map[string]*ExpvarMetrics{}
+)
+
+// NewExpvarMetrics returns the metrics published under name, creating them
+// on first use so several structures can share one set of counters. Like
+// expvar.NewMap it panics if name is already used by another variable.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if m, ok := expvarMetrics[name]; ok {
+		return m
+	}
+
+	m := &ExpvarMetrics{
+		vars:        new(expvar.Map),
+		images:      new(expvar.Int),
+		entries:     new(expvar.Int),
+		imageBytes:  new(expvar.Int),
+		extractNs:   new(expvar.Int),
+		bytesRead:   new(expvar.Int),
+		canvasCount: new(expvar.Map),
+		canvasNs:    new(expvar.Map),
+		cacheHits:   new(expvar.Map),
+		cacheMisses: new(expvar.Map),
+	}
+	m.vars.Set("images_extracted", m.images)
+	m.vars.Set("image_entries", m.entries)
+	m.vars.Set("image_bytes", m.imageBytes)
+	m.vars.Set("extract_ns", m.extractNs)
+	m.vars.Set("bytes_read", m.bytesRead)
+	m.vars.Set("canvas_decoded", m.canvasCount)
+	m.vars.Set("canvas_decode_ns", m.canvasNs)
+	m.vars.Set("cache_hits", m.cacheHits)
+	m.vars.Set("cache_misses", m.cacheMisses)
+	expvar.Publish(name, m.vars)
+	expvarMetrics[name] = m
+	return m
+}
+
+// Map returns the published map.
+func (m *ExpvarMetrics) Map() *expvar.Map {
+	return m.vars
+}
+
+func (m *ExpvarMetrics) ImageExtracted(entries int, bytes int64, d time.Duration) {
+	m.images.Add(1)
+	m.entries.Add(int64(entries))
+	m.imageBytes.Add(bytes)
+	m.extractNs.Add(int64(d))
+}
+
+func (m *ExpvarMetrics) BytesRead(n int) {
+	m.bytesRead.Add(int64(n))
+}
+
+func (m *ExpvarMetrics) CanvasDecoded(form int, d time.Duration) {
+	key := strconv.Itoa(form)
+	m.canvasCount.Add(key, 1)
+	m.canvasNs.Add(key, int64(d))
+}
+
+func (m *ExpvarMetrics) CacheLookup(cache string, hit bool) {
+	if hit {
+		m.cacheHits.Add(cache, 1)
+	} else {
+		m.cacheMisses.Add(cache, 1)
+	}
+}
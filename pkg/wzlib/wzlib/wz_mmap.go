@@ -0,0 +1,46 @@
+package wzlib
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// MmapSource serves a WZ file mapped into memory. Reads are plain memory
+// copies instead of syscalls, and the decoder reads strings and canvas
+// payloads straight from the mapping. On platforms without mmap support the
+// whole file is read into memory instead.
+type MmapSource struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func (s *MmapSource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MmapSource) Size() int64 {
+	return int64(len(s.data))
+}
+
+// ModTime returns the modification time of the file when it was opened.
+func (s *MmapSource) ModTime() time.Time {
+	return s.modTime
+}
+
+// Bytes returns the mapped file. The slice is read-only and must not be used
+// after Close.
+func (s *MmapSource) Bytes() []byte {
+	return s.data
+}
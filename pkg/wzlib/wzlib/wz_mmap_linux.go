@@ -0,0 +1,48 @@
+//go:build linux
+
+package wzlib
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// OpenMmapSource maps fileName read-only into memory.
+func OpenMmapSource(fileName string) (*MmapSource, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	// 映射建立后即可关闭文件描述符
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return &MmapSource{name: fileName, modTime: info.ModTime()}, nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("%s: file too large to map", fileName)
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, &os.PathError{Op: "mmap", Path: fileName, Err: err}
+	}
+	return &MmapSource{name: fileName, data: data, modTime: info.ModTime()}, nil
+}
+
+// Close unmaps the file.
+func (s *MmapSource) Close() error {
+	if s.data == nil {
+		return nil
+	}
+	data := s.data
+	s.data = nil
+	if err := syscall.Munmap(data); err != nil {
+		return &os.PathError{Op: "munmap", Path: s.name, Err: err}
+	}
+	return nil
+}
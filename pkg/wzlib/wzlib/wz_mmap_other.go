@@ -0,0 +1,23 @@
+//go:build !linux
+
+package wzlib
+
+import "os"
+
+// OpenMmapSource reads fileName into memory; mmap is only used on Linux.
+func OpenMmapSource(fileName string) (*MmapSource, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &MmapSource{name: fileName, data: data, modTime: info.ModTime()}, nil
+}
+
+func (s *MmapSource) Close() error {
+	s.data = nil
+	return nil
+}
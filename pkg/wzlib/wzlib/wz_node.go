@@ -1,15 +1,24 @@
 package wzlib
 
-import "strings"
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
 
 type WzNode struct {
 	Value      any       // 节点的值
 	Text       string    // 节点的名称
 	ParentNode *WzNode   // 父节点
-	Nodes      []*WzNode // 子节点集合
+	Nodes      []*WzNode // 子节点集合，延迟加载的目录在首次访问前为空，请用 Children 读取
 	Type       string    // 节点类型
 }
 
+// WzNode 的数量可达数百万，不要再加字段：延迟加载的状态放在目录的 *WzDirectory 中，
+// 名称索引放在 indexSlot 给出的位置
+
 // NewWzNode 创建一个新的 WzNode
 func NewWzNode(text string) *WzNode {
 	return &WzNode{
@@ -18,37 +27,289 @@ func NewWzNode(text string) *WzNode {
 	}
 }
 
-// GetFullPath 返回节点的完整路径
+// GetFullPath 返回节点的完整路径，只分配一次内存
 func (n *WzNode) GetFullPath() string {
-	if n.ParentNode == nil {
-		return n.Text
+	size := -1
+	for p := n; p != nil; p = p.ParentNode {
+		size += len(p.Text) + 1
+	}
+	if size <= 0 {
+		return ""
+	}
+	buf := make([]byte, size)
+	i := size
+	for p := n; p != nil; p = p.ParentNode {
+		i -= len(p.Text)
+		copy(buf[i:], p.Text)
+		if i > 0 {
+			i--
+			buf[i] = '/'
+		}
 	}
-	return n.ParentNode.GetFullPath() + "/" + n.Text
+	return unsafe.String(&buf[0], len(buf))
 }
 
 // AddChild 添加子节点
 func (n *WzNode) AddChild(child *WzNode) *WzNode {
 	child.ParentNode = n
 	n.Nodes = append(n.Nodes, child)
+	// 子节点不够多时不可能已有索引，提取 img 时绝大多数调用走不到这里
+	if count := len(n.Nodes); count > nodeIndexThreshold {
+		if slot := n.indexSlot(false); slot != nil {
+			if idx := slot.Load(); idx != nil {
+				if idx.validFor(n.Nodes[:count-1]) {
+					idx.add(child, count-1)
+				} else {
+					slot.Store(nil)
+				}
+			}
+		}
+	}
 	return child
 }
 
-// FindChild 根据名称查找子节点
+// RemoveChild removes child from n and reports whether it was a child of
+// n. Nodes is replaced by a new slice, so slices obtained earlier are not
+// modified.
+func (n *WzNode) RemoveChild(child *WzNode) bool {
+	for i, c := range n.Nodes {
+		if c == child {
+			nodes := make([]*WzNode, 0, len(n.Nodes)-1)
+			nodes = append(nodes, n.Nodes[:i]...)
+			n.Nodes = append(nodes, n.Nodes[i+1:]...)
+			child.ParentNode = nil
+			// 之后的下标都变了，索引在下次查找时重建
+			n.dropIndex()
+			return true
+		}
+	}
+	return false
+}
+
+// insertChild 把 child 插入到下标 i，i 越界时追加到末尾
+func (n *WzNode) insertChild(i int, child *WzNode) {
+	if i < 0 || i > len(n.Nodes) {
+		i = len(n.Nodes)
+	}
+	nodes := make([]*WzNode, 0, len(n.Nodes)+1)
+	nodes = append(nodes, n.Nodes[:i]...)
+	nodes = append(nodes, child)
+	n.Nodes = append(nodes, n.Nodes[i:]...)
+	child.ParentNode = n
+	n.dropIndex()
+}
+
+// Rename changes the node's name and keeps the parent's index in sync.
+func (n *WzNode) Rename(name string) {
+	n.Text = name
+	if n.ParentNode != nil {
+		n.ParentNode.dropIndex()
+	}
+}
+
+// LoadChildren reads the children of a lazily loaded directory and reports
+// any read error. It does nothing once the children are loaded. A failed
+// load leaves Nodes empty and is retried on the next call.
+func (n *WzNode) LoadChildren() error {
+	return n.LoadChildrenContext(context.Background())
+}
+
+// LoadChildrenContext is like LoadChildren but stops reading when ctx is
+// cancelled; the directory is then read again on the next access.
+func (n *WzNode) LoadChildrenContext(ctx context.Context) error {
+	dir, ok := n.Value.(*WzDirectory)
+	if !ok || dir.load == nil || dir.loaded.Load() {
+		return nil
+	}
+	dir.loadMu.Lock()
+	defer dir.loadMu.Unlock()
+	if dir.loaded.Load() {
+		return nil
+	}
+	if err := dir.load(ctx, n); err != nil {
+		n.Nodes = []*WzNode{}
+		return err
+	}
+	dir.loaded.Store(true)
+	return nil
+}
+
+// Children returns the child nodes, loading a lazy directory on first
+// access. Use LoadChildren to see the error when loading fails.
+func (n *WzNode) Children() []*WzNode {
+	n.LoadChildren()
+	return n.Nodes
+}
+
+// ExtractAll reads every directory and extracts every image below n,
+// stopping at the first error or when ctx is cancelled. Progress is
+// reported to the structure's Progress. With an ImageCache, images
+// extracted early may be unloaded again before ExtractAll returns.
+func (n *WzNode) ExtractAll(ctx context.Context) error {
+	return n.WalkContext(ctx, WalkOptions{Extract: true}, func(*WzNode, int) error {
+		return nil
+	})
+}
+
+// HasChildren reports whether the node has children without loading a lazy
+// directory; a directory that has not been read yet counts as non-empty.
+func (n *WzNode) HasChildren() bool {
+	if dir, ok := n.Value.(*WzDirectory); ok && dir.load != nil && !dir.loaded.Load() {
+		return true
+	}
+	return len(n.Nodes) > 0
+}
+
+// FindChild 根据名称查找子节点，重名时返回第一个
 func (n *WzNode) FindChild(name string) *WzNode {
-	for _, child := range n.Nodes {
-		if child.Text == name {
+	return n.findIn(n.Children(), name, false)
+}
+
+// FindChildFold is like FindChild but compares names case-insensitively.
+func (n *WzNode) FindChildFold(name string) *WzNode {
+	return n.findIn(n.Children(), name, true)
+}
+
+// nodeIndexThreshold 以下的子节点直接线性查找，建立索引不划算
+const nodeIndexThreshold = 16
+
+// nodeIndex 是子节点名称到下标的映射。Nodes 可能被直接替换（如 img 卸载），
+// 所以每次使用前用子节点数和第一个子节点检查索引是否仍然对应当前的切片
+type nodeIndex struct {
+	count int
+	first *WzNode
+	names map[string]int // 重名时保留第一个
+
+	mu   sync.Mutex
+	fold map[string]int // 小写名称，首次大小写无关查找时建立
+}
+
+func buildNodeIndex(nodes []*WzNode) *nodeIndex {
+	idx := &nodeIndex{
+		count: len(nodes),
+		first: nodes[0],
+		names: make(map[string]int, len(nodes)),
+	}
+	for i, child := range nodes {
+		if _, ok := idx.names[child.Text]; !ok {
+			idx.names[child.Text] = i
+		}
+	}
+	return idx
+}
+
+func (idx *nodeIndex) validFor(nodes []*WzNode) bool {
+	return idx.count == len(nodes) && (len(nodes) == 0 || nodes[0] == idx.first)
+}
+
+func (idx *nodeIndex) add(child *WzNode, i int) {
+	if idx.count == 0 {
+		idx.first = child
+	}
+	idx.count++
+	if _, ok := idx.names[child.Text]; !ok {
+		idx.names[child.Text] = i
+	}
+	idx.mu.Lock()
+	if idx.fold != nil {
+		key := strings.ToLower(child.Text)
+		if _, ok := idx.fold[key]; !ok {
+			idx.fold[key] = i
+		}
+	}
+	idx.mu.Unlock()
+}
+
+func (idx *nodeIndex) lookupFold(nodes []*WzNode, name string) (int, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.fold == nil {
+		idx.fold = make(map[string]int, len(nodes))
+		for i, child := range nodes {
+			key := strings.ToLower(child.Text)
+			if _, ok := idx.fold[key]; !ok {
+				idx.fold[key] = i
+			}
+		}
+	}
+	i, ok := idx.fold[strings.ToLower(name)]
+	return i, ok
+}
+
+// findIn 在 nodes 中查找 name；nodes 是 n 的子节点或其快照
+func (n *WzNode) findIn(nodes []*WzNode, name string, fold bool) *WzNode {
+	if len(nodes) < nodeIndexThreshold {
+		return findLinear(nodes, name, fold)
+	}
+
+	slot := n.indexSlot(true)
+	if slot == nil {
+		return findLinear(nodes, name, fold)
+	}
+	idx := slot.Load()
+	if idx == nil || !idx.validFor(nodes) {
+		idx = buildNodeIndex(nodes)
+		slot.Store(idx)
+	}
+	var i int
+	var ok bool
+	if fold {
+		i, ok = idx.lookupFold(nodes, name)
+	} else {
+		i, ok = idx.names[name]
+	}
+	if !ok {
+		return nil
+	}
+	if child := nodes[i]; child.Text == name || fold && strings.EqualFold(child.Text, name) {
+		return child
+	}
+	// 子节点被直接改了名而没有经过 Rename，丢弃索引后线性查找
+	slot.Store(nil)
+	return findLinear(nodes, name, fold)
+}
+
+func findLinear(nodes []*WzNode, name string, fold bool) *WzNode {
+	for _, child := range nodes {
+		if child.Text == name || fold && strings.EqualFold(child.Text, name) {
 			return child
 		}
 	}
 	return nil
 }
 
+// indexSlot 返回存放 n 的子节点索引的位置：目录、img 与文件节点放在各自的值中，
+// img 内的属性节点放在所属 img 的表里，随 img 卸载一起释放。
+// 不属于任何 img 或文件的节点返回 nil，只做线性查找
+func (n *WzNode) indexSlot(create bool) *atomic.Pointer[nodeIndex] {
+	switch v := n.Value.(type) {
+	case *WzDirectory:
+		return &v.index
+	case *WzImage:
+		return &v.index
+	case *WzFile:
+		return &v.index
+	}
+	for p := n.ParentNode; p != nil; p = p.ParentNode {
+		if img, ok := p.Value.(*WzImage); ok {
+			return img.propIndexSlot(n, create)
+		}
+	}
+	return nil
+}
+
+func (n *WzNode) dropIndex() {
+	if slot := n.indexSlot(false); slot != nil {
+		slot.Store(nil)
+	}
+}
+
 // Clone 克隆当前节点
 func (n *WzNode) Clone() *WzNode {
 	newNode := NewWzNode(n.Text)
 	newNode.Value = n.Value
 	newNode.Type = n.Type
-	for _, child := range n.Nodes {
+	for _, child := range n.Children() {
 		newNode.AddChild(child.Clone())
 	}
 	return newNode
@@ -72,20 +333,42 @@ func (n *WzNode) ToString() string {
 
 // GetNode 根据路径查找子节点，路径用'/'分隔
 func (n *WzNode) GetNode(path string) *WzNode {
+	return n.getNode(path, false)
+}
+
+// GetNodeFold is like GetNode but matches every path segment
+// case-insensitively.
+func (n *WzNode) GetNodeFold(path string) *WzNode {
+	return n.getNode(path, true)
+}
+
+func (n *WzNode) getNode(path string, fold bool) *WzNode {
 	if path == "" {
 		return n
 	}
-	parts := strings.SplitN(path, "/", 2)
-	child := n.FindChild(parts[0])
+	name, rest, more := strings.Cut(path, "/")
+	child := n.findIn(n.Children(), name, fold)
 	if child == nil {
 		return nil
 	}
-	// 如果child是*WzImage类型，尝试解压img文件
-	if img, ok := child.Value.(*WzImage); ok {
-		img.TryExtract() // 假设有TryExtract方法
-	}
-	if len(parts) == 1 {
+	if !more {
+		// 如果child是*WzImage类型，尝试解压img文件
+		if img, ok := child.Value.(*WzImage); ok {
+			img.TryExtract()
+		}
 		return child
 	}
-	return child.GetNode(parts[1])
+	if img, ok := child.Value.(*WzImage); ok {
+		// img 可能随时被缓存卸载，在提取时取得的子节点快照中继续查找
+		nodes, err := img.extract(context.Background())
+		if err != nil {
+			return nil
+		}
+		name, rest, _ := strings.Cut(rest, "/")
+		if child = child.findIn(nodes, name, fold); child == nil {
+			return nil
+		}
+		return child.getNode(rest, fold)
+	}
+	return child.getNode(rest, fold)
 }
@@ -0,0 +1,224 @@
+package wzlib
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"golang.org/x/text/encoding"
+)
+
+// Option configures a WzStructure created by NewWzStructure.
+type Option func(ws *WzStructure) error
+
+// NewWzStructure creates a structure configured by opts. Options are
+// applied in order, so a later option overrides an earlier one of the same
+// kind; invalid values and conflicting combinations are reported as errors.
+//
+//	ws, err := wzlib.NewWzStructure(
+//		wzlib.WithKey(wzlib.GMS),
+//		wzlib.WithVersion(83),
+//		wzlib.WithImageCache(wzlib.NewImageCache(0, 256<<20)),
+//	)
+func NewWzStructure(opts ...Option) (*WzStructure, error) {
+	ws := &WzStructure{}
+	for _, opt := range opts {
+		if err := opt(ws); err != nil {
+			return nil, err
+		}
+	}
+	if err := ws.validate(); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// WithKey uses the given key instead of detecting it from the first entry
+// name, e.g. when that name happens to decrypt under several keys.
+func WithKey(t WzCryptoKeyType) Option {
+	return func(ws *WzStructure) error {
+		keys := cryptoKeyOf(t)
+		if keys == nil {
+			return fmt.Errorf("wzlib: unknown key type %d", t)
+		}
+		ws.Encryption = &WzCrypto{Keys: keys, EncType: t}
+		return nil
+	}
+}
+
+// WithVersion fixes the client version instead of guessing it from the
+// encrypted version in the header.
+func WithVersion(version int) Option {
+	return func(ws *WzStructure) error {
+		if version <= 0 || version >= math.MaxInt16 {
+			return fmt.Errorf("wzlib: invalid version %d", version)
+		}
+		ws.WzVersion = version
+		return nil
+	}
+}
+
+// WithVersionVerify sets how the guessed version is checked, see
+// VersionVerifyDefault and VersionVerifyFast.
+func WithVersionVerify(mode int) Option {
+	return func(ws *WzStructure) error {
+		ws.WzVersionVerifyMode = mode
+		return nil
+	}
+}
+
+// WithTextEncoding decodes non-Unicode names and strings with enc, e.g.
+// simplifiedchinese.GBK for CMS or korean.EUCKR for KMS.
+func WithTextEncoding(enc encoding.Encoding) Option {
+	return func(ws *WzStructure) error {
+		if enc == nil {
+			return errors.New("wzlib: nil text encoding")
+		}
+		ws.TextEncoding = enc
+		return nil
+	}
+}
+
+// WithChecksum sets what happens when an image checksum does not match.
+func WithChecksum(policy ChecksumPolicy) Option {
+	return func(ws *WzStructure) error {
+		ws.Checksum = policy
+		return nil
+	}
+}
+
+// WithImageCache limits the memory held by extracted images.
+func WithImageCache(c *ImageCache) Option {
+	return func(ws *WzStructure) error {
+		if c == nil {
+			return errors.New("wzlib: nil image cache")
+		}
+		ws.ImageCache = c
+		return nil
+	}
+}
+
+// WithIndexCache reuses directory trees saved by SaveIndexCache.
+func WithIndexCache(c *IndexCache) Option {
+	return func(ws *WzStructure) error {
+		if c == nil {
+			return errors.New("wzlib: nil index cache")
+		}
+		ws.IndexCache = c
+		return nil
+	}
+}
+
+// WithLogger sends diagnostic messages to l.
+func WithLogger(l Logger) Option {
+	return func(ws *WzStructure) error {
+		if l == nil {
+			return errors.New("wzlib: nil logger")
+		}
+		ws.Logger = l
+		return nil
+	}
+}
+
+// WithLimits rejects files whose entry counts or string lengths exceed l.
+func WithLimits(l Limits) Option {
+	return func(ws *WzStructure) error {
+		ws.Limits = l
+		return nil
+	}
+}
+
+// WithExtFiles merges extension files such as Mob2.wz or Skill001.wz
+// found next to the loaded file into its root.
+func WithExtFiles(enabled bool) Option {
+	return func(ws *WzStructure) error {
+		ws.AutoDetectExtFiles = enabled
+		return nil
+	}
+}
+
+// WithProgress reports directory reads and image extraction to p.
+func WithProgress(p Progress) Option {
+	return func(ws *WzStructure) error {
+		ws.Progress = p
+		return nil
+	}
+}
+
+// WithMetrics reports extraction, reads, canvas decoding and cache lookups
+// to m, e.g. NewExpvarMetrics("wzlib").
+func WithMetrics(m Metrics) Option {
+	return func(ws *WzStructure) error {
+		if m == nil {
+			return errors.New("wzlib: nil metrics")
+		}
+		ws.Metrics = m
+		return nil
+	}
+}
+
+// validate 检查单个选项无法发现的取值与组合问题
+func (ws *WzStructure) validate() error {
+	switch ws.WzVersionVerifyMode {
+	case VersionVerifyDefault, VersionVerifyFast:
+	default:
+		return fmt.Errorf("wzlib: unknown version verify mode %d", ws.WzVersionVerifyMode)
+	}
+	switch ws.Checksum {
+	case ChecksumVerify, ChecksumSkip:
+	case ChecksumWarn:
+		if ws.Logger == nil {
+			return errors.New("wzlib: ChecksumWarn needs a logger to report mismatches")
+		}
+	default:
+		return fmt.Errorf("wzlib: unknown checksum policy %d", ws.Checksum)
+	}
+	if ws.ImgCheckDisabled && ws.Checksum == ChecksumWarn {
+		return errors.New("wzlib: ImgCheckDisabled conflicts with ChecksumWarn")
+	}
+	if ws.Limits.MaxEntries < 0 || ws.Limits.MaxStringLen < 0 {
+		return fmt.Errorf("wzlib: negative limits %+v", ws.Limits)
+	}
+	return nil
+}
+
+// 版本校验模式，用于 WzVersionVerifyMode
+const (
+	VersionVerifyDefault = iota // 按版本计算出的 img 偏移越界时尝试下一个候选版本
+	VersionVerifyFast           // 直接采用第一个与头部匹配的版本，不做检查
+)
+
+// ChecksumPolicy 决定 img 校验和不匹配时的处理方式
+type ChecksumPolicy int
+
+const (
+	ChecksumVerify ChecksumPolicy = iota // 提取失败并返回 ErrChecksumMismatch
+	ChecksumWarn                         // 通过 Logger 记录警告后继续提取
+	ChecksumSkip                         // 不计算校验和
+)
+
+// Limits 限制从文件中读出的数量，防止损坏的数据造成巨大的分配。
+// 字段为 0 表示不限
+type Limits struct {
+	MaxEntries   int // 单个目录或属性的最大子项数
+	MaxStringLen int // 单个名称或字符串的最大长度（字节）
+}
+
+// checkEntries 在数量超出限制时返回错误
+func (l Limits) checkEntries(n int32) error {
+	if l.MaxEntries > 0 && int(n) > l.MaxEntries {
+		return fmt.Errorf("%w: %d entries, max %d", ErrLimitExceeded, n, l.MaxEntries)
+	}
+	return nil
+}
+
+// checksumPolicy 返回生效的校验策略，ImgCheckDisabled 等同于 ChecksumSkip
+func (ws *WzStructure) checksumPolicy() ChecksumPolicy {
+	if ws == nil {
+		return ChecksumVerify
+	}
+	if ws.ImgCheckDisabled {
+		return ChecksumSkip
+	}
+	return ws.Checksum
+}
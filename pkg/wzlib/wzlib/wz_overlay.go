@@ -0,0 +1,312 @@
+package wzlib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Overlay stacks the trees of several sources, e.g. the base client, a
+// hotfix Data.wz and a mod file, into one virtual tree. Directories present
+// in several layers are merged, and so are images and the property
+// containers inside them: a higher priority layer shadows only the leaf
+// properties (values, canvases, sounds, ...) it provides itself, the other
+// properties of a lower layer's image stay visible. A node shadows nodes of
+// another kind at the same path, e.g. a value shadows a lower property
+// container of the same name.
+//
+// Layers are never modified: merged directories, images and properties are
+// new nodes whose value is a *WzDirectory, while nodes supplied by a single
+// layer are the layer's own nodes, so their ParentNode and GetFullPath still
+// point into that layer. Use LayerOf to find the layer that supplied a node.
+type Overlay struct {
+	name string
+
+	mu     sync.Mutex      // 保护 layers 与重建
+	layers []*OverlayLayer // 优先级从高到低，同优先级时后加入的在前
+	seq    int
+	build  atomic.Pointer[overlayBuild]
+}
+
+// OverlayLayer is one source of an Overlay.
+type OverlayLayer struct {
+	Name      string
+	Priority  int     // 数值大的层遮盖数值小的层
+	Root      *WzNode // 层的根节点，如 WzStructure.WzNode
+	MountPath string  // Root 的子节点出现在叠加树中的位置，如 "Mob"；空表示根
+
+	seq     int // 加入顺序，同优先级时后加入的优先
+	enabled atomic.Bool
+}
+
+// Enabled reports whether the layer takes part in the overlay.
+func (l *OverlayLayer) Enabled() bool {
+	return l.enabled.Load()
+}
+
+// overlayBuild 是某一组启用层对应的虚拟树，切换层时整体替换
+type overlayBuild struct {
+	root     *WzNode
+	supplier sync.Map // 合并出的虚拟目录节点 -> 优先级最高的来源层
+}
+
+// overlaySource 是虚拟目录的一个来源。rest 非空时层的根还在更深处，
+// 本目录只含一个名为 rest[0] 的子目录
+type overlaySource struct {
+	layer *OverlayLayer
+	node  *WzNode
+	rest  []string
+}
+
+// NewOverlay returns an empty overlay whose root node is named name.
+func NewOverlay(name string) *Overlay {
+	o := &Overlay{name: name}
+	o.rebuild()
+	return o
+}
+
+// AddLayer adds an enabled layer showing the children of root under
+// mountPath ("" for the overlay root). Nodes obtained from Root before the
+// call keep showing the old layers.
+func (o *Overlay) AddLayer(name string, priority int, root *WzNode, mountPath string) (*OverlayLayer, error) {
+	if root == nil {
+		return nil, fmt.Errorf("wzlib: overlay layer %q has no root", name)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, l := range o.layers {
+		if l.Name == name {
+			return nil, fmt.Errorf("wzlib: duplicate overlay layer %q", name)
+		}
+	}
+	o.seq++
+	l := &OverlayLayer{
+		Name:      name,
+		Priority:  priority,
+		Root:      root,
+		MountPath: strings.Trim(mountPath, "/"),
+		seq:       o.seq,
+	}
+	l.enabled.Store(true)
+	o.layers = append(o.layers, l)
+	sort.SliceStable(o.layers, func(i, j int) bool {
+		a, b := o.layers[i], o.layers[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.seq > b.seq
+	})
+	o.rebuild()
+	return l, nil
+}
+
+// SetEnabled turns the named layer on or off and rebuilds the tree.
+func (o *Overlay) SetEnabled(name string, enabled bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, l := range o.layers {
+		if l.Name == name {
+			if l.enabled.Swap(enabled) != enabled {
+				o.rebuild()
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("wzlib: no overlay layer %q", name)
+}
+
+// Layers returns the layers from highest to lowest priority.
+func (o *Overlay) Layers() []*OverlayLayer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]*OverlayLayer(nil), o.layers...)
+}
+
+// Root returns the root of the merged tree. The tree is rebuilt whenever a
+// layer is added or toggled; nodes of an earlier tree stay usable but do
+// not reflect the change.
+func (o *Overlay) Root() *WzNode {
+	return o.build.Load().root
+}
+
+// LayerOf returns the layer that supplied n, or nil if n does not belong
+// to the current tree of o. For a merged directory it is the highest
+// priority layer containing that directory.
+func (o *Overlay) LayerOf(n *WzNode) *OverlayLayer {
+	b := o.build.Load()
+	layers := o.Layers()
+	for p := n; p != nil; p = p.ParentNode {
+		if l, ok := b.supplier.Load(p); ok {
+			return l.(*OverlayLayer)
+		}
+		for _, l := range layers {
+			if l.Root == p {
+				return l
+			}
+		}
+	}
+	return nil
+}
+
+// LayersAt returns the enabled layers that contain path, relative to the
+// overlay root, from highest to lowest priority. The first one supplies
+// the node that Root().GetNode(path) returns unless a layer in between
+// shadows it with a node of another kind.
+func (o *Overlay) LayersAt(path string) []*OverlayLayer {
+	path = strings.Trim(path, "/")
+	var found []*OverlayLayer
+	for _, l := range o.Layers() {
+		if !l.Enabled() {
+			continue
+		}
+		rel := path
+		switch {
+		case l.MountPath == "":
+		case path == l.MountPath:
+			rel = ""
+		case strings.HasPrefix(path, l.MountPath+"/"):
+			rel = path[len(l.MountPath)+1:]
+		case path == "" || strings.HasPrefix(l.MountPath, path+"/"):
+			// path 是挂载点的上级目录
+			found = append(found, l)
+			continue
+		default:
+			continue
+		}
+		if l.Root.GetNode(rel) != nil {
+			found = append(found, l)
+		}
+	}
+	return found
+}
+
+// rebuild 按当前启用的层建立新的虚拟根，调用方需持有 o.mu
+func (o *Overlay) rebuild() {
+	b := &overlayBuild{}
+	var srcs []overlaySource
+	for _, l := range o.layers {
+		if !l.Enabled() {
+			continue
+		}
+		var rest []string
+		if l.MountPath != "" {
+			rest = strings.Split(l.MountPath, "/")
+		}
+		srcs = append(srcs, overlaySource{layer: l, node: l.Root, rest: rest})
+	}
+	b.root = b.newDir(o.name, srcs)
+	o.build.Store(b)
+}
+
+// newDir 创建合并 srcs 的虚拟目录，子节点在首次访问时才计算
+func (b *overlayBuild) newDir(name string, srcs []overlaySource) *WzNode {
+	n := NewWzNode(name)
+	if len(srcs) > 0 && overlayKind(srcs[0]) == overlayProperty {
+		n.Type = "Property"
+	}
+	n.Value = &WzDirectory{
+		Name: name,
+		load: func(ctx context.Context, n *WzNode) error {
+			return b.fill(ctx, n, srcs)
+		},
+	}
+	if len(srcs) > 0 {
+		b.supplier.Store(n, srcs[0].layer)
+	}
+	return n
+}
+
+// fill 计算虚拟目录 n 的子节点。子节点按低优先级层中的顺序排列，
+// 只在高优先级层中出现的排在后面
+func (b *overlayBuild) fill(ctx context.Context, n *WzNode, srcs []overlaySource) error {
+	var order []string
+	byName := map[string][]overlaySource{} // 每个名称的来源，优先级从高到低
+	add := func(name string, s overlaySource) {
+		if _, ok := byName[name]; !ok {
+			order = append(order, name)
+		}
+		byName[name] = append([]overlaySource{s}, byName[name]...)
+	}
+	for i := len(srcs) - 1; i >= 0; i-- {
+		s := srcs[i]
+		if len(s.rest) > 0 {
+			add(s.rest[0], overlaySource{layer: s.layer, node: s.node, rest: s.rest[1:]})
+			continue
+		}
+		children, err := s.children(ctx)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			add(child.Text, overlaySource{layer: s.layer, node: child})
+		}
+	}
+
+	n.Nodes = make([]*WzNode, 0, len(order))
+	for _, name := range order {
+		candidates := byName[name]
+		// 目录、img 与属性容器和下层同类的节点合并，直到遇到别的类型；
+		// 其他节点遮盖它下面的一切
+		kind := overlayKind(candidates[0])
+		var dirs []overlaySource
+		for _, s := range candidates {
+			if kind == overlayLeaf || overlayKind(s) != kind {
+				break
+			}
+			dirs = append(dirs, s)
+		}
+		switch {
+		case len(dirs) == 0:
+			// 层自己的节点，不修改其 ParentNode
+			n.Nodes = append(n.Nodes, candidates[0].node)
+		case len(dirs) == 1 && len(dirs[0].rest) == 0 && dirs[0].node != dirs[0].layer.Root:
+			n.Nodes = append(n.Nodes, dirs[0].node)
+		default:
+			// 多层合并，或层的根挂在 MountPath 下（根的名称与挂载点不同）
+			n.AddChild(b.newDir(name, dirs))
+		}
+	}
+	return nil
+}
+
+// children 返回来源节点的子节点，img 在这里提取
+func (s overlaySource) children(ctx context.Context) ([]*WzNode, error) {
+	if img, ok := s.node.Value.(*WzImage); ok {
+		return img.extract(ctx)
+	}
+	if err := s.node.LoadChildrenContext(ctx); err != nil {
+		return nil, err
+	}
+	return s.node.Nodes, nil
+}
+
+// 叠加时节点的类别，同类的节点合并
+const (
+	overlayLeaf = iota
+	overlayDir
+	overlayImage
+	overlayProperty
+)
+
+func overlayKind(s overlaySource) int {
+	if len(s.rest) > 0 {
+		return overlayDir
+	}
+	switch s.node.Value.(type) {
+	case *WzDirectory, *WzFile:
+		return overlayDir
+	case *WzImage:
+		return overlayImage
+	case nil:
+		if s.node.Type == "Property" {
+			return overlayProperty
+		}
+		if len(s.node.Nodes) > 0 {
+			return overlayDir
+		}
+	}
+	return overlayLeaf
+}
@@ -1,9 +1,6 @@
 package wzlib
 
 import (
-	"bufio"
-	"bytes"
-	"compress/zlib"
 	"encoding/binary"
 	"fmt"
 	"image"
@@ -18,147 +15,65 @@ type WzPng struct {
 	Form       int
 	Offset     uint32
 	Image      *WzImage
+
+	data []byte // 重新打包、尚未保存的画布数据：一个 0 字节加 zlib 数据流
 }
 
 func (p *WzPng) GetRawData() ([]byte, error) {
-	stream := p.Image.OpenRead()
-	endPos := int64(p.Offset) + int64(p.DataLength)
-
-	_, err := stream.Seek(int64(p.Offset)+1, io.SeekStart) // 跳过第一个字节
-	if err != nil {
-		return nil, fmt.Errorf("seek failed: %v", err)
-	}
-
-	// 检查是否为 zlib 压缩数据 (0x78 0x9C)
-	reader := NewWzBinaryReader(stream)
-	header, err := reader.ReadUInt16()
+	data, err := p.getRawData()
 	if err != nil {
-		return nil, err
+		return nil, p.Image.wrapError("decode canvas", p.Image.Offset+int64(p.Offset), p.Image.Node, err)
 	}
-	var zlibStream io.ReadCloser
-	if int(header) == 0x9C78 {
-		// 是标准 zlib 数据流
-		dataLen := endPos - reader.Pos()
-		_, _ = stream.Seek(int64(p.Offset)+1, io.SeekStart)
-		limitReader := io.LimitReader(stream, dataLen)
-		payload, err := io.ReadAll(limitReader)
-		if err != nil {
-			return nil, fmt.Errorf("create zlib reader: %v", err)
-		}
-		zlibStream, err = zlib.NewReader(bytes.NewBuffer(payload))
-		if err != nil {
-			return nil, fmt.Errorf("create zlib reader: %v", err)
-		}
-	} else {
-		// 不是 zlib，说明是分块加密
-		_, _ = stream.Seek(int64(p.Offset), io.SeekStart)
-
-		buffer := make([]byte, p.DataLength)
-		total := 0
-		b := bufio.NewReader(stream)
-
-		for pos := int64(p.Offset); pos < endPos; {
-			blockSizeBytes := make([]byte, 4)
-			if _, err := io.ReadFull(b, blockSizeBytes); err != nil {
-				return nil, err
-			}
-			blockSize := int(binary.LittleEndian.Uint32(blockSizeBytes))
-
-			if pos+4+int64(blockSize) > endPos {
-				return nil, fmt.Errorf("block exceeds declared data size")
-			}
-			n, err := io.ReadFull(b, buffer[total:total+blockSize])
-			if err != nil {
-				return nil, err
-			}
+	return data, nil
+}
 
-			// 解密块
-			p.Image.WzFile.WzStructure.Encryption.Keys.Decrypt(buffer, total, blockSize)
-			total += n
-			pos += int64(n + 4)
+func (p *WzPng) getRawData() ([]byte, error) {
+	var output []byte
+	err := p.withInflated(func(r io.Reader) error {
+		rawLen := p.rawLen()
+		if rawLen < 0 {
+			// 未知格式，直接读取全部解压后数据
+			data, err := io.ReadAll(r)
+			output = data
+			return err
 		}
-
-		dataStream := bytes.NewReader(buffer[:total])
-		_, _ = dataStream.Seek(2, io.SeekStart)
-		zlibStream, err = zlib.NewReader(dataStream)
-		if err != nil {
-			return nil, fmt.Errorf("zlib decode after decryption failed: %v", err)
+		output = make([]byte, rawLen)
+		if _, err := io.ReadFull(r, output); err != nil {
+			return fmt.Errorf("read decompressed data: %w", err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return output, nil
+}
 
-	defer zlibStream.Close()
-
-	var rawLen int
+// rawLen 返回解压后原始像素的长度，未知格式返回 -1
+func (p *WzPng) rawLen() int {
 	switch p.Form {
 	case 1, 257, 513:
-		rawLen = p.Width * p.Height * 2
+		return p.Width * p.Height * 2
 	case 2:
-		rawLen = p.Width * p.Height * 4
+		return p.Width * p.Height * 4
 	case 3:
-		rawLen = int(math.Ceil(float64(p.Width)/4)) * 4 * int(math.Ceil(float64(p.Height)/4)) * 4 / 8
+		return int(math.Ceil(float64(p.Width)/4)) * 4 * int(math.Ceil(float64(p.Height)/4)) * 4 / 8
 	case 517:
-		rawLen = p.Width * p.Height / 128
+		return p.Width * p.Height / 128
 	case 1026, 2050:
-		rawLen = p.Width * p.Height
+		return p.Width * p.Height
 	default:
-		// 未知格式，直接读取全部解压后数据
-		return io.ReadAll(zlibStream)
+		return -1
 	}
-
-	output := make([]byte, rawLen)
-	if _, err := io.ReadFull(zlibStream, output); err != nil {
-		return nil, fmt.Errorf("read decompressed data: %v", err)
-	}
-	return output, nil
 }
 
+// ExtractImage decodes the canvas into a new image. Use ExtractImageInto or
+// an ImagePool to reuse pixel buffers.
 func (p *WzPng) ExtractImage() (image.Image, error) {
-	raw, err := p.GetRawData()
+	img, err := p.ExtractImageInto(nil)
 	if err != nil {
 		return nil, err
 	}
-	if raw == nil {
-		return nil, nil
-	}
-
-	img := image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
-	img.Stride = 4 * p.Width
-	var pixel []byte
-
-	switch p.Form {
-	case 1: // ARGB4444
-		pixel = GetPixelDataBGRA4444(raw, p.Width, p.Height)
-	case 2: // ARGB8888 (no conversion needed)
-		pixel = BGRAtoRGBA(raw)
-
-	case 3: // 黑白缩略图（暂略，待实现 GetPixelDataForm3）
-		pixel = GetPixelDataForm3(raw, p.Width, p.Height)
-
-	case 257: // ARGB1555
-		pixel = GetPixelDataARGB1555(raw, p.Width, p.Height)
-
-	case 513: // RGB565
-		pixel = ConvertRGB565ToRGBA(raw, p.Width, p.Height)
-
-	case 517: // RGB565 缩略图
-		pixel = GetPixelDataForm517(raw, p.Width, p.Height)
-
-	case 1026: // DXT3
-		pixel = GetPixelDataDXT3(raw, p.Width, p.Height)
-
-	case 2050: // DXT5
-		pixel = GetPixelDataDXT5(raw, p.Width, p.Height)
-
-	default:
-		return nil, fmt.Errorf("unsupported image form: %d", p.Form)
-	}
-
-	if len(pixel) != p.Width*p.Height*4 {
-		return nil, fmt.Errorf("pixel data size mismatch: got %d, expected %d", len(pixel), p.Width*p.Height*4)
-	}
-
-	// 写入 RGBA 图像
-	copy(img.Pix, pixel)
 	return img, nil
 }
 
@@ -195,22 +110,7 @@ func GetPixelDataForm517(rawData []byte, width, height int) []byte {
 // ConvertRGB565ToRGBA 将 RGB565 像素转换为 RGBA 图像
 func ConvertRGB565ToRGBA(rgb565 []byte, width, height int) []byte {
 	out := make([]byte, width*height*4)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			i := y*width*2 + x*2
-			val := binary.LittleEndian.Uint16(rgb565[i:])
-
-			rgba := RGB565ToRGBA(val)
-
-			j := (y*width + x) * 4
-			out[j+0] = rgba[2] // B
-			out[j+1] = rgba[1] // G
-			out[j+2] = rgba[0] // R
-			out[j+3] = rgba[3] // A
-		}
-	}
-
+	decodeRGB565(out, rgb565, width*height)
 	return out
 }
 
@@ -265,14 +165,7 @@ func GetPixelDataForm3(rawData []byte, width, height int) []byte {
 
 func GetPixelDataBGRA4444(rawData []byte, width, height int) []byte {
 	pixelBuffer := make([]byte, width*height*4)
-	for i := 0; i < width*height; i++ {
-		lo := rawData[i*2]
-		hi := rawData[i*2+1]
-		pixelBuffer[i*4+0] = (hi&0x0F)<<4 | (hi & 0x0F) // R
-		pixelBuffer[i*4+1] = (lo & 0xF0) | (lo&0xF0)>>4 // G
-		pixelBuffer[i*4+2] = (lo&0x0F)<<4 | (lo & 0x0F) // B
-		pixelBuffer[i*4+3] = (hi & 0xF0) | (hi&0xF0)>>4 // A
-	}
+	decodeBGRA4444(pixelBuffer, rawData, width*height)
 	return pixelBuffer
 }
 
@@ -323,73 +216,13 @@ func ExpandAlphaIndexTableDXT5(alphaIndex []int, raw []byte, offset int) {
 
 func GetPixelDataDXT3(raw []byte, width, height int) []byte {
 	pixel := make([]byte, width*height*4)
-	var colorTable [4][4]byte // RGBA
-	var colorIdx [16]int
-	var alphaTable [16]byte
-
-	for y := 0; y < height; y += 4 {
-		for x := 0; x < width; x += 4 {
-			offset := x*4 + y*width
-
-			ExpandAlphaTableDXT3(alphaTable[:], raw, offset)
-
-			c0 := binary.LittleEndian.Uint16(raw[offset+8:])
-			c1 := binary.LittleEndian.Uint16(raw[offset+10:])
-			ExpandColorTable(&colorTable, c0, c1)
-
-			ExpandColorIndexTable(colorIdx[:], raw, offset+12)
-
-			for j := 0; j < 4; j++ {
-				for i := 0; i < 4; i++ {
-					idx := j*4 + i
-					SetPixel(
-						pixel,
-						x+i, y+j, width,
-						colorTable[colorIdx[idx]],
-						alphaTable[idx],
-					)
-				}
-			}
-		}
-	}
+	decodeDXT3(pixel, raw, width, height)
 	return pixel
 }
 
 func GetPixelDataDXT5(raw []byte, width, height int) []byte {
 	pixel := make([]byte, width*height*4)
-	var colorTable [4][4]byte
-	var colorIdx [16]int
-	var alphaTable [8]byte
-	var alphaIdx [16]int
-
-	for y := 0; y < height; y += 4 {
-		for x := 0; x < width; x += 4 {
-			offset := x*4 + y*width
-
-			a0 := raw[offset]
-			a1 := raw[offset+1]
-			ExpandAlphaTableDXT5(alphaTable[:], a0, a1)
-			ExpandAlphaIndexTableDXT5(alphaIdx[:], raw, offset+2)
-
-			c0 := binary.LittleEndian.Uint16(raw[offset+8:])
-			c1 := binary.LittleEndian.Uint16(raw[offset+10:])
-			ExpandColorTable(&colorTable, c0, c1)
-
-			ExpandColorIndexTable(colorIdx[:], raw, offset+12)
-
-			for j := 0; j < 4; j++ {
-				for i := 0; i < 4; i++ {
-					idx := j*4 + i
-					SetPixel(
-						pixel,
-						x+i, y+j, width,
-						colorTable[colorIdx[idx]],
-						alphaTable[alphaIdx[idx]],
-					)
-				}
-			}
-		}
-	}
+	decodeDXT5(pixel, raw, width, height)
 	return pixel
 }
 
@@ -476,10 +309,6 @@ func BGRAtoRGBA(bgra []byte) []byte {
 
 func GetPixelDataARGB1555(raw []byte, width, height int) []byte {
 	out := make([]byte, width*height*4)
-	for i := 0; i < width*height; i++ {
-		val := binary.LittleEndian.Uint16(raw[i*2:])
-		rgba := ARGB1555ToRGBA(val)
-		copy(out[i*4:], rgba[:])
-	}
+	decodeARGB1555(out, raw, width*height)
 	return out
 }
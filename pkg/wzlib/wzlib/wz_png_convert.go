@@ -0,0 +1,222 @@
+package wzlib
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sync"
+)
+
+// 位宽扩展表：n 位分量扩展为 8 位时把高位复制到低位，与逐像素计算结果一致
+var (
+	expand4 [16]byte
+	expand5 [32]byte
+	expand6 [64]byte
+)
+
+func init() {
+	for i := range expand4 {
+		expand4[i] = byte(i<<4 | i)
+	}
+	for i := range expand5 {
+		expand5[i] = byte(i<<3 | i>>2)
+	}
+	for i := range expand6 {
+		expand6[i] = byte(i<<2 | i>>4)
+	}
+}
+
+// parallelMinPixels 以下的画布单线程解码，避免协程开销超过收益
+const parallelMinPixels = 256 * 256
+
+// parallelRows 将 [0, rows) 切成若干段交给 fn 并发处理，段数不超过 GOMAXPROCS
+func parallelRows(rows, pixels int, fn func(start, end int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if pixels < parallelMinPixels || workers < 2 || rows < 2 {
+		fn(0, rows)
+		return
+	}
+	workers = min(workers, rows)
+	band := (rows + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < rows; start += band {
+		end := min(start+band, rows)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(start, end)
+		}()
+	}
+	wg.Wait()
+}
+
+func decodeBGRA4444(pix, raw []byte, count int) {
+	for i := 0; i < count; i++ {
+		lo, hi := raw[i*2], raw[i*2+1]
+		o := pix[i*4 : i*4+4 : i*4+4]
+		o[0] = expand4[hi&0x0F] // R
+		o[1] = expand4[lo>>4]   // G
+		o[2] = expand4[lo&0x0F] // B
+		o[3] = expand4[hi>>4]   // A
+	}
+}
+
+func decodeARGB1555(pix, raw []byte, count int) {
+	for i := 0; i < count; i++ {
+		v := binary.LittleEndian.Uint16(raw[i*2:])
+		o := pix[i*4 : i*4+4 : i*4+4]
+		o[0] = expand5[v>>10&0x1F]
+		o[1] = expand5[v>>5&0x1F]
+		o[2] = expand5[v&0x1F]
+		o[3] = byte(int8(v>>8) >> 7) // 最高位为 1 时 0xFF，否则 0
+	}
+}
+
+// decodeRGB565 按 B、G、R、A 顺序写出，与 DXT 解码一致
+func decodeRGB565(pix, raw []byte, count int) {
+	for i := 0; i < count; i++ {
+		v := binary.LittleEndian.Uint16(raw[i*2:])
+		o := pix[i*4 : i*4+4 : i*4+4]
+		o[0] = expand5[v&0x1F]
+		o[1] = expand6[v>>5&0x3F]
+		o[2] = expand5[v>>11]
+		o[3] = 0xFF
+	}
+}
+
+// dxtColors 解码 DXT 块的 4 色调色板，每项为小端 B、G、R 三字节（alpha 另行填入）
+func dxtColors(out *[4]uint32, c0, c1 uint16) {
+	r0, g0, b0 := uint32(expand5[c0>>11]), uint32(expand6[c0>>5&0x3F]), uint32(expand5[c0&0x1F])
+	r1, g1, b1 := uint32(expand5[c1>>11]), uint32(expand6[c1>>5&0x3F]), uint32(expand5[c1&0x1F])
+	bgr := func(b, g, r uint32) uint32 { return b | g<<8 | r<<16 }
+	out[0] = bgr(b0, g0, r0)
+	out[1] = bgr(b1, g1, r1)
+	if c0 > c1 {
+		out[2] = bgr((2*b0+b1+1)/3, (2*g0+g1+1)/3, (2*r0+r1+1)/3)
+		out[3] = bgr((b0+2*b1+1)/3, (g0+2*g1+1)/3, (r0+2*r1+1)/3)
+	} else {
+		out[2] = bgr((b0+b1)/2, (g0+g1)/2, (r0+r1)/2)
+		out[3] = 0
+	}
+}
+
+// decodeDXT 按块行并发解码 DXT3 (dxt5 为 false) 或 DXT5，输出 B、G、R、A
+func decodeDXT(pix, raw []byte, width, height int, dxt5 bool) {
+	blocksX := (width + 3) / 4
+	blocksY := (height + 3) / 4
+	parallelRows(blocksY, width*height, func(start, end int) {
+		var colors [4]uint32
+		var alphas [16]byte
+		var table [8]byte
+		for by := start; by < end; by++ {
+			for bx := 0; bx < blocksX; bx++ {
+				offset := (by*blocksX + bx) * 16
+				if offset+16 > len(raw) {
+					return
+				}
+				block := raw[offset : offset+16 : offset+16]
+				if dxt5 {
+					dxt5Alpha(&alphas, &table, block)
+				} else {
+					for i := 0; i < 8; i++ {
+						b := block[i]
+						alphas[i*2] = expand4[b&0x0F]
+						alphas[i*2+1] = expand4[b>>4]
+					}
+				}
+				dxtColors(&colors, binary.LittleEndian.Uint16(block[8:]), binary.LittleEndian.Uint16(block[10:]))
+				indices := binary.LittleEndian.Uint32(block[12:])
+
+				x0, y0 := bx*4, by*4
+				w, h := min(4, width-x0), min(4, height-y0)
+				for j := 0; j < h; j++ {
+					row := pix[((y0+j)*width+x0)*4:]
+					for i := 0; i < w; i++ {
+						k := j*4 + i
+						px := colors[indices>>(2*k)&0x03] | uint32(alphas[k])<<24
+						binary.LittleEndian.PutUint32(row[i*4:], px)
+					}
+				}
+			}
+		}
+	})
+}
+
+// dxt5Alpha 解码 DXT5 块的 alpha：两个端点插值出 8 级，再由 16 个 3 位索引选取
+func dxt5Alpha(out *[16]byte, table *[8]byte, block []byte) {
+	a0, a1 := int(block[0]), int(block[1])
+	table[0], table[1] = byte(a0), byte(a1)
+	if a0 > a1 {
+		for i := 2; i < 8; i++ {
+			table[i] = byte(((8-i)*a0 + (i-1)*a1 + 3) / 7)
+		}
+	} else {
+		for i := 2; i < 6; i++ {
+			table[i] = byte(((6-i)*a0 + (i-1)*a1 + 2) / 5)
+		}
+		table[6], table[7] = 0, 255
+	}
+	// 16 个 3 位索引，共 48 位
+	bits := uint64(block[2]) | uint64(block[3])<<8 | uint64(block[4])<<16 |
+		uint64(block[5])<<24 | uint64(block[6])<<32 | uint64(block[7])<<40
+	for i := 0; i < 16; i++ {
+		out[i] = table[bits>>(3*i)&0x07]
+	}
+}
+
+func decodeDXT3(pix, raw []byte, width, height int) {
+	decodeDXT(pix, raw, width, height, false)
+}
+
+func decodeDXT5(pix, raw []byte, width, height int) {
+	decodeDXT(pix, raw, width, height, true)
+}
+
+// encodePixels 是 decodePixels 的逆过程：把解码结果 pix 编码为 form 格式的原始像素。
+// 只支持 1、2、257、513，像素无法用该格式无损表示时返回 false
+func encodePixels(form int, pix []byte) ([]byte, bool) {
+	count := len(pix) / 4
+	switch form {
+	case 2:
+		raw := make([]byte, len(pix))
+		for i := 0; i+3 < len(pix); i += 4 {
+			raw[i], raw[i+1], raw[i+2], raw[i+3] = pix[i+2], pix[i+1], pix[i], pix[i+3]
+		}
+		return raw, true
+	case 1, 257, 513:
+	default:
+		return nil, false
+	}
+
+	raw := make([]byte, count*2)
+	for i := 0; i < count; i++ {
+		p := pix[i*4 : i*4+4 : i*4+4]
+		var v uint16
+		switch form {
+		case 1:
+			if !fits4(p[0]) || !fits4(p[1]) || !fits4(p[2]) || !fits4(p[3]) {
+				return nil, false
+			}
+			v = uint16(p[3]>>4)<<12 | uint16(p[0]>>4)<<8 | uint16(p[1]>>4)<<4 | uint16(p[2]>>4)
+		case 257:
+			if !fits5(p[0]) || !fits5(p[1]) || !fits5(p[2]) || p[3] != 0 && p[3] != 0xFF {
+				return nil, false
+			}
+			v = uint16(p[0]>>3)<<10 | uint16(p[1]>>3)<<5 | uint16(p[2]>>3)
+			if p[3] == 0xFF {
+				v |= 0x8000
+			}
+		case 513:
+			// 与 decodeRGB565 一致，pix 依次为 B、G、R
+			if !fits5(p[0]) || expand6[p[1]>>2] != p[1] || !fits5(p[2]) || p[3] != 0xFF {
+				return nil, false
+			}
+			v = uint16(p[2]>>3)<<11 | uint16(p[1]>>2)<<5 | uint16(p[0]>>3)
+		}
+		binary.LittleEndian.PutUint16(raw[i*2:], v)
+	}
+	return raw, true
+}
+
+func fits4(c byte) bool { return expand4[c>>4] == c }
+
+func fits5(c byte) bool { return expand5[c>>3] == c }
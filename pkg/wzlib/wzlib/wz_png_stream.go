@@ -0,0 +1,252 @@
+package wzlib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+	"time"
+)
+
+// 画布解码过程中复用的对象，批量导出时避免每张图都重新分配
+var (
+	zlibReaderPool sync.Pool // io.ReadCloser，实现 zlib.Resetter
+	bufioPool      = sync.Pool{New: func() any { return bufio.NewReaderSize(nil, 32<<10) }}
+	rawBufPool     sync.Pool // *[]byte，存放解压后的原始像素
+)
+
+// openZlib 从池中取出 zlib 读取器并重置到 r
+func openZlib(r io.Reader) (io.ReadCloser, error) {
+	if zr, ok := zlibReaderPool.Get().(io.ReadCloser); ok {
+		if err := zr.(zlib.Resetter).Reset(r, nil); err != nil {
+			zlibReaderPool.Put(zr)
+			return nil, err
+		}
+		return zr, nil
+	}
+	return zlib.NewReader(r)
+}
+
+func closeZlib(zr io.ReadCloser) {
+	zr.Close()
+	zlibReaderPool.Put(zr)
+}
+
+func getRawBuf(n int) *[]byte {
+	if buf, ok := rawBufPool.Get().(*[]byte); ok && cap(*buf) >= n {
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n)
+	return &buf
+}
+
+// blockDecryptReader 读取分块加密的画布数据：每块为 int32 长度加密文，
+// 每块都从密钥流开头解密
+type blockDecryptReader struct {
+	r      *bufio.Reader
+	key    *WzCryptoKey
+	remain int64 // 尚未读取的字节数，包括块长度
+	buf    []byte
+	block  []byte // 已解密、尚未返回的数据
+}
+
+func (d *blockDecryptReader) Read(p []byte) (int, error) {
+	for len(d.block) == 0 {
+		if d.remain <= 0 {
+			return 0, io.EOF
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(d.r, size[:]); err != nil {
+			return 0, err
+		}
+		n := int64(binary.LittleEndian.Uint32(size[:]))
+		d.remain -= 4
+		if n > d.remain {
+			return 0, fmt.Errorf("%w: block exceeds declared data size", ErrTruncated)
+		}
+		if int64(cap(d.buf)) < n {
+			d.buf = make([]byte, n)
+		}
+		d.block = d.buf[:n]
+		if _, err := io.ReadFull(d.r, d.block); err != nil {
+			return 0, err
+		}
+		d.remain -= n
+		d.key.Decrypt(d.block, 0, int(n))
+	}
+	n := copy(p, d.block)
+	d.block = d.block[n:]
+	return n, nil
+}
+
+// withInflated 打开画布的压缩数据并把解压流交给 fn。
+// 未加密的数据在 MmapSource 上直接从映射内存解压，否则经由池化的 bufio 流式读取；
+// 分块加密的数据边读边解密。整个过程不缓冲完整的压缩数据。
+func (p *WzPng) withInflated(fn func(r io.Reader) error) error {
+	if p.data != nil {
+		zr, err := openZlib(bytes.NewReader(p.data[1:]))
+		if err != nil {
+			return fmt.Errorf("create zlib reader: %w", err)
+		}
+		defer closeZlib(zr)
+		return fn(zr)
+	}
+	stream := p.Image.OpenRead()
+	start := int64(p.Offset) + 1 // 跳过第一个字节
+	end := int64(p.Offset) + int64(p.DataLength)
+	if _, err := stream.Seek(start, io.SeekStart); err != nil {
+		return fmt.Errorf("seek failed: %w", err)
+	}
+
+	reader := NewWzBinaryReader(stream)
+	header, err := reader.ReadUInt16()
+	if err != nil {
+		return err
+	}
+	stream.Seek(start, io.SeekStart)
+
+	inflate := func(src io.Reader) error {
+		zr, err := openZlib(src)
+		if err != nil {
+			return fmt.Errorf("create zlib reader: %w", err)
+		}
+		defer closeZlib(zr)
+		return fn(zr)
+	}
+
+	br := bufioPool.Get().(*bufio.Reader)
+	defer func() {
+		br.Reset(nil)
+		bufioPool.Put(br)
+	}()
+
+	if header == 0x9C78 {
+		// 是标准 zlib 数据流
+		dataLen := end - start - 2
+		if _, ok := p.Image.WzFile.Source.(*MmapSource); ok {
+			return reader.view(int(dataLen), func(payload []byte) error {
+				return inflate(bytes.NewReader(payload))
+			})
+		}
+		br.Reset(io.LimitReader(stream, dataLen))
+		return inflate(br)
+	}
+
+	// 不是 zlib，说明是分块加密，解密后为完整的 zlib 数据流
+	br.Reset(stream)
+	return inflate(&blockDecryptReader{
+		r:      br,
+		key:    p.Image.WzFile.WzStructure.Encryption.Keys,
+		remain: end - start,
+	})
+}
+
+// ExtractImageInto decodes the canvas into dst and returns it. dst is reused
+// when its Pix slice is large enough and reallocated otherwise, so it may be
+// nil. The result always has bounds (0, 0, Width, Height).
+func (p *WzPng) ExtractImageInto(dst *image.NRGBA) (*image.NRGBA, error) {
+	start := time.Now()
+	dst, err := p.extractImageInto(dst)
+	if err != nil {
+		return nil, p.Image.wrapError("decode canvas", p.Image.Offset+int64(p.Offset), p.Image.Node, err)
+	}
+	if p.Image != nil && p.Image.WzFile != nil {
+		p.Image.WzFile.WzStructure.metrics().CanvasDecoded(p.Form, time.Since(start))
+	}
+	return dst, nil
+}
+
+func (p *WzPng) extractImageInto(dst *image.NRGBA) (*image.NRGBA, error) {
+	rawLen := p.rawLen()
+	if rawLen < 0 {
+		return nil, fmt.Errorf("unsupported image form: %d", p.Form)
+	}
+
+	n := p.Width * p.Height * 4
+	if dst == nil || cap(dst.Pix) < n {
+		dst = image.NewNRGBA(image.Rect(0, 0, p.Width, p.Height))
+	} else {
+		dst.Pix = dst.Pix[:n]
+		dst.Stride = 4 * p.Width
+		dst.Rect = image.Rect(0, 0, p.Width, p.Height)
+	}
+
+	err := p.withInflated(func(r io.Reader) error {
+		if p.Form == 2 {
+			// ARGB8888 直接解压到目标图像，再原地交换 R 与 B
+			if _, err := io.ReadFull(r, dst.Pix); err != nil {
+				return fmt.Errorf("read decompressed data: %w", err)
+			}
+			for i := 0; i+3 < len(dst.Pix); i += 4 {
+				dst.Pix[i], dst.Pix[i+2] = dst.Pix[i+2], dst.Pix[i]
+			}
+			return nil
+		}
+
+		buf := getRawBuf(rawLen)
+		defer rawBufPool.Put(buf)
+		raw := *buf
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return fmt.Errorf("read decompressed data: %w", err)
+		}
+		return p.decodePixels(dst.Pix, raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// decodePixels 将原始像素转换到 pix（Width*Height*4 字节）
+func (p *WzPng) decodePixels(pix, raw []byte) error {
+	w, h := p.Width, p.Height
+	switch p.Form {
+	case 1: // ARGB4444
+		decodeBGRA4444(pix, raw, w*h)
+	case 3: // 黑白缩略图
+		copy(pix, GetPixelDataForm3(raw, w, h))
+	case 257: // ARGB1555
+		decodeARGB1555(pix, raw, w*h)
+	case 513: // RGB565
+		decodeRGB565(pix, raw, w*h)
+	case 517: // RGB565 缩略图
+		decodeRGB565(pix, GetPixelDataForm517(raw, w, h), w*h)
+	case 1026: // DXT3
+		decodeDXT3(pix, raw, w, h)
+	case 2050: // DXT5
+		decodeDXT5(pix, raw, w, h)
+	default:
+		return fmt.Errorf("unsupported image form: %d", p.Form)
+	}
+	return nil
+}
+
+// ImagePool recycles decoded canvases between ExtractImage calls so batch
+// exports do not allocate a new pixel buffer per sprite. The zero value is
+// ready to use.
+type ImagePool struct {
+	pool sync.Pool
+}
+
+// Extract decodes p into an image taken from the pool. Call Put once the
+// image is no longer needed.
+func (ip *ImagePool) Extract(p *WzPng) (*image.NRGBA, error) {
+	dst, _ := ip.pool.Get().(*image.NRGBA)
+	img, err := p.ExtractImageInto(dst)
+	if err != nil && dst != nil {
+		ip.pool.Put(dst)
+	}
+	return img, err
+}
+
+// Put returns img to the pool.
+func (ip *ImagePool) Put(img *image.NRGBA) {
+	if img != nil {
+		ip.pool.Put(img)
+	}
+}
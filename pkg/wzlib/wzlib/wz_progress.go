@@ -0,0 +1,63 @@
+package wzlib
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Progress receives progress reports from long running operations such as
+// LoadWzFolderContext and ExtractAll. Add may be called from several
+// goroutines at once and should return quickly.
+type Progress interface {
+	// Add 报告新处理了 entries 个条目（目录项或属性）和 bytes 字节
+	Add(entries int, bytes int64)
+}
+
+// ProgressFunc adapts a function to the Progress interface.
+type ProgressFunc func(entries int, bytes int64)
+
+func (f ProgressFunc) Add(entries int, bytes int64) {
+	f(entries, bytes)
+}
+
+// ProgressCounter 累计进度，界面可以定时读取而不必在回调中刷新
+type ProgressCounter struct {
+	entries atomic.Int64
+	bytes   atomic.Int64
+}
+
+func (c *ProgressCounter) Add(entries int, bytes int64) {
+	c.entries.Add(int64(entries))
+	c.bytes.Add(bytes)
+}
+
+// Entries returns the number of entries reported so far.
+func (c *ProgressCounter) Entries() int64 {
+	return c.entries.Load()
+}
+
+// Bytes returns the number of bytes reported so far.
+func (c *ProgressCounter) Bytes() int64 {
+	return c.bytes.Load()
+}
+
+// report 转发到结构的 Progress，未设置时什么也不做
+func (ws *WzStructure) report(entries int, bytes int64) {
+	if ws != nil && ws.Progress != nil {
+		ws.Progress.Add(entries, bytes)
+	}
+}
+
+// canceled 在 ctx 已取消时返回其错误。用 Done 而不是 Err，
+// 未取消时不必加锁，可以在逐条读取的循环中调用
+func canceled(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
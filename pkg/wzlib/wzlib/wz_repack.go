@@ -0,0 +1,521 @@
+package wzlib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding"
+)
+
+// RepackOptions controls Repack.
+type RepackOptions struct {
+	// TextEncoding writes non-ASCII strings in a single-byte encoding, e.g.
+	// simplifiedchinese.GBK for older CMS clients. When nil they are
+	// written as UTF-16.
+	TextEncoding encoding.Encoding
+}
+
+// Repack builds the .wz file fileName from a folder written by
+// WzFile.Unpack, using the version and key recorded there. Entries are
+// written in the order of each dir.txt; folders not listed there, such as
+// newly added images, follow in name order. Canvases are re-encoded from
+// their PNG files in the recorded form when the pixels allow it and as
+// BGRA8888 (form 2) otherwise, so DXT canvases change form. The file is
+// replaced only once it has been written completely.
+func Repack(dir, fileName string, opts RepackOptions) error {
+	return RepackContext(context.Background(), dir, fileName, opts)
+}
+
+// RepackContext is like Repack but stops when ctx is cancelled.
+func RepackContext(ctx context.Context, dir, fileName string, opts RepackOptions) error {
+	m, err := readDirText(dir, true)
+	if err != nil {
+		return err
+	}
+	if m.version <= 0 || m.keys == nil {
+		return fmt.Errorf("wzlib: %s does not record the version and key", filepath.Join(dir, dirTextName))
+	}
+	root, err := repackEntries(ctx, dir, m)
+	if err != nil {
+		return err
+	}
+
+	ws := &WzStructure{
+		Encryption:   &WzCrypto{Keys: m.keys, EncType: m.encType},
+		TextEncoding: opts.TextEncoding,
+	}
+	header := newFileHeader(m.version, m.encver)
+	wf := &WzFile{
+		FileName:    fileName,
+		WzStructure: ws,
+		Header: &WzHeader{
+			HeaderSize:        fileHeaderSize,
+			DataStartPosition: int64(len(header)),
+			VersionDetector:   &FixedVersion{WzVersion: m.version, HashVersion: uint(CalcHashVersion(m.version))},
+		},
+	}
+	dirArea, err := wf.layout(ctx, root)
+	if err != nil {
+		return err
+	}
+	tmp, err := wf.writeTemp(ctx, header, dirArea, root)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fileName); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// fileHeaderSize 是新文件的头部长度，即版权信息结束的位置
+const fileHeaderSize = 0x3C
+
+// newFileHeader 生成新文件的头部，数据长度由 writeTemp 填入
+func newFileHeader(version int, encver bool) []byte {
+	h := make([]byte, fileHeaderSize, fileHeaderSize+2)
+	copy(h, "PKG1")
+	binary.LittleEndian.PutUint32(h[12:], fileHeaderSize)
+	copy(h[16:], "Package file v1.0 Copyright 2002 Wizet, ZMS")
+	if encver {
+		h = binary.LittleEndian.AppendUint16(h, uint16(encryptVersion(version)))
+	}
+	return h
+}
+
+// dirText 是 dir.txt 的内容
+type dirText struct {
+	version int
+	keys    *WzCryptoKey
+	encType WzCryptoKeyType
+	encver  bool
+	entries []dirTextEntry
+}
+
+type dirTextEntry struct {
+	image  bool
+	name   string
+	folder string
+}
+
+// readDirText 读取 dir 中的 dir.txt，top 为 true 时允许记录版本与密钥
+func readDirText(dir string, top bool) (*dirText, error) {
+	name := filepath.Join(dir, dirTextName)
+	m := &dirText{encver: true}
+	err := readTextLines(name, func(line string) error {
+		kind, rest, _ := strings.Cut(line, " ")
+		if top {
+			switch kind {
+			case "version":
+				v, err := strconv.Atoi(rest)
+				if err != nil || v <= 0 {
+					return fmt.Errorf("invalid version %q", rest)
+				}
+				m.version = v
+				return nil
+			case "key":
+				for t, s := range keyNames {
+					if s == rest {
+						m.keys, m.encType = cryptoKeyOf(t), t
+						return nil
+					}
+				}
+				return fmt.Errorf("unknown key %q", rest)
+			case "encver":
+				if rest != "missing" {
+					return fmt.Errorf("unknown encver %q", rest)
+				}
+				m.encver = false
+				return nil
+			}
+		}
+		if kind != "image" && kind != "dir" {
+			return fmt.Errorf("unknown entry %q", kind)
+		}
+		name, rest, err := cutName(rest)
+		if err != nil {
+			return err
+		}
+		e := dirTextEntry{image: kind == "image", name: name, folder: escapeName(name)}
+		if rest != "" {
+			if e.folder, err = strconv.Unquote(rest); err != nil {
+				return fmt.Errorf("invalid folder %s", rest)
+			}
+		}
+		m.entries = append(m.entries, e)
+		return nil
+	})
+	return m, err
+}
+
+// repackEntries 按 dir.txt 读出目录中的 img 与子目录，未列出的文件夹按名称排在后面
+func repackEntries(ctx context.Context, dir string, m *dirText) ([]*saveEntry, error) {
+	listed := make(map[string]bool)
+	for _, e := range m.entries {
+		listed[e.folder] = true
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := slices.Clone(m.entries)
+	for _, f := range files {
+		if !f.IsDir() || listed[f.Name()] {
+			continue
+		}
+		name, err := url.PathUnescape(f.Name())
+		if err != nil {
+			name = f.Name()
+		}
+		_, err = os.Stat(filepath.Join(dir, f.Name(), imageTextName))
+		entries = append(entries, dirTextEntry{image: err == nil, name: name, folder: f.Name()})
+	}
+
+	var out []*saveEntry
+	for _, e := range entries {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		sub := filepath.Join(dir, e.folder)
+		if e.image {
+			node, err := repackImage(sub, e.name)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, &saveEntry{node: node, img: node.Value.(*WzImage)})
+			continue
+		}
+		sm, err := readDirText(sub, false)
+		if err != nil {
+			return nil, err
+		}
+		children, err := repackEntries(ctx, sub, sm)
+		if err != nil {
+			return nil, err
+		}
+		node := NewWzNode(e.name)
+		node.Value = &WzDirectory{Name: e.name}
+		out = append(out, &saveEntry{node: node, dir: node.Value.(*WzDirectory), entries: children})
+	}
+	return out, nil
+}
+
+// RepackImage reads an image folder written by UnpackImage and returns a
+// new image node named after the folder. The node is not attached to any
+// file; add it to a directory with Transaction.Add and save the file to
+// write it. Until then its canvases and sounds are held in memory.
+func RepackImage(dir string) (*WzNode, error) {
+	name, err := url.PathUnescape(filepath.Base(dir))
+	if err != nil {
+		name = filepath.Base(dir)
+	}
+	return repackImage(dir, name)
+}
+
+func repackImage(dir, name string) (*WzNode, error) {
+	node := NewWzNode(name)
+	node.Type = "Property"
+	img := &WzImage{Name: name, Node: node, Extracted: true, ChecksumChecked: true, modified: true}
+	node.Value = img
+
+	r := &imageRepacker{dir: dir, img: img, stack: []*WzNode{node}, names: make(map[childName]bool)}
+	if err := readTextLines(filepath.Join(dir, imageTextName), r.line); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// imageRepacker 按 image.txt 逐行重建属性树
+type imageRepacker struct {
+	dir   string
+	img   *WzImage
+	stack []*WzNode // stack[d] 是深度 d 的行的父节点
+	names map[childName]bool
+}
+
+type childName struct {
+	parent *WzNode
+	name   string
+}
+
+func (r *imageRepacker) line(line string) error {
+	text := strings.TrimLeft(line, " ")
+	indent := len(line) - len(text)
+	depth := indent / 2
+	if indent%2 != 0 || depth >= len(r.stack) {
+		return errors.New("bad indentation")
+	}
+	parent := r.stack[depth]
+	if parent.Type != "Property" && parent.Type != "Canvas" {
+		return fmt.Errorf("%s cannot have properties", parent.Text)
+	}
+	name, rest, err := cutName(text)
+	if err != nil {
+		return err
+	}
+	if r.names[childName{parent, name}] {
+		return fmt.Errorf("%w: %q", ErrDuplicateName, name)
+	}
+	r.names[childName{parent, name}] = true
+	kind, args, _ := strings.Cut(rest, " ")
+
+	n := NewWzNode(name)
+	if err := r.value(n, kind, args); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	parent.AddChild(n)
+	r.stack = append(r.stack[:depth+1], n)
+	return nil
+}
+
+// value 按类型名 kind 与参数 args 设置 n 的类型与值，是 imageUnpacker.value 的逆过程
+func (r *imageRepacker) value(n *WzNode, kind, args string) error {
+	var err error
+	switch kind {
+	case "property":
+		n.Type = "Property"
+	case "canvas":
+		n.Type = "Canvas"
+		n.Value, err = r.canvas(args)
+	case "sound":
+		n.Type = "Sound_DX8"
+		n.Value, err = r.sound(args)
+	case "vector":
+		n.Type = "Shape2D#Vector2D"
+		n.Value, err = parsePoint(args)
+	case "convex":
+		n.Type = "Shape2D#Convex2D"
+		points := []image.Point{}
+		for _, f := range strings.Fields(args) {
+			p, err := parsePoint(f)
+			if err != nil {
+				return err
+			}
+			points = append(points, p)
+		}
+		n.Value = points
+	case "uol":
+		n.Type = "UOL"
+		var s string
+		s, err = strconv.Unquote(args)
+		n.Value = NewWzUol(s)
+	case "null":
+		n.Value = nil
+	case "short":
+		var v int64
+		v, err = strconv.ParseInt(args, 10, 16)
+		n.Value = int16(v)
+	case "int":
+		var v int64
+		v, err = strconv.ParseInt(args, 10, 32)
+		n.Value = int32(v)
+	case "long":
+		n.Value, err = strconv.ParseInt(args, 10, 64)
+	case "float":
+		var v float64
+		v, err = strconv.ParseFloat(args, 32)
+		n.Value = float32(v)
+	case "double":
+		n.Value, err = strconv.ParseFloat(args, 64)
+	case "string":
+		n.Value, err = strconv.Unquote(args)
+	default:
+		return fmt.Errorf("unknown type %q", kind)
+	}
+	return err
+}
+
+// canvas 读取 PNG 文件，按记录的格式编码并压缩
+func (r *imageRepacker) canvas(args string) (*WzPng, error) {
+	file, opts, err := cutFile(args)
+	if err != nil {
+		return nil, err
+	}
+	form, err := strconv.Atoi(opts["form"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid form %q", opts["form"])
+	}
+	f, err := os.Open(filepath.Join(r.dir, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	b := src.Bounds()
+	pix := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(pix, pix.Rect, src, b.Min, draw.Src)
+
+	raw, ok := encodePixels(form, pix.Pix)
+	if !ok {
+		form = 2
+		raw, _ = encodePixels(form, pix.Pix)
+	}
+	data, err := deflateCanvas(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &WzPng{
+		Width:      b.Dx(),
+		Height:     b.Dy(),
+		Form:       form,
+		DataLength: len(data),
+		Image:      r.img,
+		data:       data,
+	}, nil
+}
+
+// deflateCanvas 把原始像素压缩为画布数据：一个 0 字节后跟 zlib 流
+func deflateCanvas(raw []byte) ([]byte, error) {
+	// 读取时以 78 9C 判断是否为 zlib 明文，所以只能用默认压缩级别
+	var data bytes.Buffer
+	data.WriteByte(0)
+	zw := zlib.NewWriter(&data)
+	zw.Write(raw)
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// sound 读取音频文件，WAV 文件只取 data 块
+func (r *imageRepacker) sound(args string) (*WzSound, error) {
+	file, opts, err := cutFile(args)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := strconv.Atoi(opts["ms"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ms %q", opts["ms"])
+	}
+	format, err := hex.DecodeString(opts["format"])
+	if err != nil || !validWaveFormat(format) {
+		return nil, fmt.Errorf("invalid format %q", opts["format"])
+	}
+	header := defaultSoundHeader()
+	if h, ok := opts["header"]; ok {
+		if header, err = hex.DecodeString(h); err != nil || len(header) != soundHeaderLen {
+			return nil, fmt.Errorf("invalid header %q", h)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(r.dir, filepath.FromSlash(file)))
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(filepath.Ext(file), ".wav") {
+		if data, err = waveData(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	_, encrypted := opts["encrypted"]
+	s := &WzSound{
+		DataLength:      len(data),
+		Ms:              ms,
+		WzImage:         r.img,
+		header:          header,
+		formatEncrypted: encrypted,
+		data:            data,
+	}
+	s.setFormat(format)
+	return s, nil
+}
+
+// waveData 返回 WAV 文件 data 块的内容
+func waveData(b []byte) ([]byte, error) {
+	if len(b) < 12 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	for b = b[12:]; len(b) >= 8; {
+		id, size := string(b[0:4]), int(binary.LittleEndian.Uint32(b[4:8]))
+		b = b[8:]
+		if size > len(b) {
+			break
+		}
+		if id == "data" {
+			return b[:size], nil
+		}
+		b = b[size+size&1:]
+	}
+	return nil, errors.New("WAV file has no data chunk")
+}
+
+// readTextLines 逐行读取文本文件，跳过空行；fn 返回的错误带上文件名与行号
+func readTextLines(name string, fn func(line string) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for i := 1; sc.Scan(); i++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", name, i, err)
+		}
+	}
+	return sc.Err()
+}
+
+// cutName 取出行首的名称，名称可能带引号
+func cutName(s string) (name, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid name %s", s)
+		}
+		name, _ = strconv.Unquote(q)
+		return name, strings.TrimPrefix(s[len(q):], " "), nil
+	}
+	name, rest, _ = strings.Cut(s, " ")
+	return name, rest, nil
+}
+
+// cutFile 解析画布与音频的参数：带引号的文件名，之后是 key=value 或单独的标记
+func cutFile(args string) (string, map[string]string, error) {
+	q, err := strconv.QuotedPrefix(args)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid file name in %q", args)
+	}
+	file, _ := strconv.Unquote(q)
+	if filepath.IsAbs(file) || !filepath.IsLocal(filepath.FromSlash(file)) {
+		return "", nil, fmt.Errorf("file %q is outside the image folder", file)
+	}
+	opts := make(map[string]string)
+	for _, f := range strings.Fields(args[len(q):]) {
+		k, v, _ := strings.Cut(f, "=")
+		opts[k] = v
+	}
+	return file, opts, nil
+}
+
+func parsePoint(s string) (image.Point, error) {
+	xs, ys, ok := strings.Cut(s, ",")
+	x, err1 := strconv.Atoi(xs)
+	y, err2 := strconv.Atoi(ys)
+	if !ok || err1 != nil || err2 != nil {
+		return image.Point{}, fmt.Errorf("invalid point %q", s)
+	}
+	return image.Pt(x, y), nil
+}
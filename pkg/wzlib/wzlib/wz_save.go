@@ -0,0 +1,450 @@
+package wzlib
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/text/encoding"
+)
+
+// SaveOptions controls WzFile.Save.
+type SaveOptions struct {
+	Backup bool // 保留原文件为 <文件名>.bak
+}
+
+// saveEntry 是要写出的一个目录项
+type saveEntry struct {
+	node    *WzNode
+	dir     *WzDirectory
+	entries []*saveEntry // 子目录的内容
+	img     *WzImage
+	data    *wzWriter // 重新编码的 img，nil 表示原样复制
+	size    int
+	sum     int
+	hashPos int64 // 哈希偏移在新文件中的位置
+	offset  int64 // 子目录表或 img 数据在新文件中的位置
+}
+
+// Save writes the file's current tree back to FileName. Images that are
+// not modified are copied byte for byte from their old offsets; modified
+// images (see WzImage.Modified) and images moved in from files with other
+// keys are re-encoded. Directory entries, hashed offsets and checksums are
+// recomputed for the new layout.
+//
+// The new file is written to a temporary file next to FileName and renamed
+// over it, so a failed save leaves the original untouched. With Backup the
+// original is kept as FileName + ".bak". Afterwards the WzFile reads from
+// the new file, its images point at their new offsets and are no longer
+// marked modified; extracted nodes stay valid.
+//
+// Only files opened from disk can be saved, and not while the structure
+// has an active transaction. Don't edit the tree while Save runs.
+func (wf *WzFile) Save(opts SaveOptions) error {
+	return wf.SaveContext(context.Background(), opts)
+}
+
+// SaveContext is like Save but stops when ctx is cancelled, leaving the
+// original file untouched.
+func (wf *WzFile) SaveContext(ctx context.Context, opts SaveOptions) error {
+	if err := wf.checkSave(); err != nil {
+		return err
+	}
+	root, err := wf.collect(ctx, wf.saveRoot(), true)
+	if err != nil {
+		return err
+	}
+	dirArea, err := wf.layout(ctx, root)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, wf.Header.DataStartPosition)
+	if _, err := wf.ReadAt(header, 0); err != nil {
+		return wrapError("read header", wf.FileName, 0, "", err)
+	}
+	tmp, err := wf.writeTemp(ctx, header, dirArea, root)
+	if err != nil {
+		return err
+	}
+	if err := wf.replace(tmp, opts.Backup); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	wf.applyLayout(root)
+	wf.edited.Store(false)
+	return nil
+}
+
+func (wf *WzFile) checkSave() error {
+	if wf.Closed() {
+		return ErrClosed
+	}
+	if _, ok := wf.Source.(interface{ ModTime() time.Time }); !ok {
+		return fmt.Errorf("wzlib: %s was not opened from disk and cannot be saved", wf.FileName)
+	}
+	ws := wf.WzStructure
+	if ws == nil || ws.Encryption == nil || ws.Encryption.Keys == nil || wf.Header.VersionDetector == nil || wf.Node == nil {
+		return fmt.Errorf("wzlib: %s is not loaded into a structure", wf.FileName)
+	}
+	ws.txMu.Lock()
+	defer ws.txMu.Unlock()
+	if ws.tx != nil {
+		return ErrTxActive
+	}
+	return nil
+}
+
+// saveRoot 返回文件内容所在的节点。扩展文件的内容已合并到主文件的根节点下
+func (wf *WzFile) saveRoot() *WzNode {
+	if wf.OwnerWzFile != nil {
+		return wf.OwnerWzFile.Node
+	}
+	return wf.Node
+}
+
+// owns 判断属于 other 的目录项是否写入 wf。结构中其他已打开的文件各自保存，
+// 新建的或从别的结构移来的目录项归所在的目录；扩展文件只取自己的顶层项
+func (wf *WzFile) owns(other *WzFile, top bool) bool {
+	if other == wf {
+		return true
+	}
+	if top && wf.OwnerWzFile != nil {
+		return false
+	}
+	return other == nil || !wf.WzStructure.holds(other)
+}
+
+// holds 判断 wf 是否是结构打开的文件或合并进来的扩展文件
+func (ws *WzStructure) holds(wf *WzFile) bool {
+	for _, f := range ws.WzFiles {
+		if f == wf || f == wf.OwnerWzFile {
+			return true
+		}
+	}
+	return false
+}
+
+// collect 读出 node 下要写入 wf 的目录与 img，需要时读取延迟加载的目录
+func (wf *WzFile) collect(ctx context.Context, node *WzNode, top bool) ([]*saveEntry, error) {
+	if err := node.LoadChildrenContext(ctx); err != nil {
+		return nil, err
+	}
+	var entries []*saveEntry
+	for _, n := range node.Nodes {
+		switch v := n.Value.(type) {
+		case *WzImage:
+			if wf.owns(v.WzFile, top) {
+				entries = append(entries, &saveEntry{node: n, img: v})
+			}
+		case *WzDirectory:
+			if !wf.owns(v.WzFile, top) {
+				continue
+			}
+			sub, err := wf.collect(ctx, n, false)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, &saveEntry{node: n, dir: v, entries: sub})
+		case *WzFile:
+			// 挂在树上的其他文件（如客户端的分类）各自保存
+		default:
+			return nil, fmt.Errorf("wzlib: %s is neither a directory nor an image and cannot be saved", n.GetFullPath())
+		}
+	}
+	return entries, nil
+}
+
+// canCopy 判断 img 的原始数据能否原样写入 wf
+func (wf *WzFile) canCopy(img *WzImage) bool {
+	if img.WzFile == nil || img.Modified() {
+		return false
+	}
+	if img.WzFile == wf || img.WzFile.WzStructure == wf.WzStructure {
+		return true
+	}
+	// 不同结构的 img 只有密钥相同才能直接复制
+	a, b := img.WzFile.WzStructure, wf.WzStructure
+	return a != nil && a.Encryption != nil && a.Encryption.EncType == b.Encryption.EncType
+}
+
+// layout 编码需要重新编码的 img，排定目录表与 img 数据的位置，返回写好哈希偏移的目录区
+func (wf *WzFile) layout(ctx context.Context, root []*saveEntry) (*wzWriter, error) {
+	text := wf.TextEncoding
+	if text == nil {
+		text = wf.WzStructure.TextEncoding
+	}
+	key := wf.WzStructure.Encryption.Keys
+	start := wf.Header.DataStartPosition
+
+	// 目录区：每个目录的表紧跟在父目录的表之后
+	dirArea := newWzWriter(key, text)
+	var images []*saveEntry
+	var writeDir func(entries []*saveEntry) error
+	writeDir = func(entries []*saveEntry) error {
+		dirArea.compressedInt(int32(len(entries)))
+		var subdirs []*saveEntry
+		for _, e := range entries {
+			if e.img != nil {
+				if err := wf.encode(ctx, e, key, text); err != nil {
+					return err
+				}
+				dirArea.WriteByte(0x04)
+				images = append(images, e)
+			} else {
+				dirArea.WriteByte(0x03)
+				e.size, e.sum = e.dir.Size, e.dir.Checksum
+				subdirs = append(subdirs, e)
+			}
+			dirArea.str(e.node.Text)
+			dirArea.compressedInt(int32(e.size))
+			dirArea.compressedInt(int32(e.sum))
+			e.hashPos = start + int64(dirArea.Len())
+			dirArea.int32(0)
+		}
+		for _, e := range subdirs {
+			e.offset = start + int64(dirArea.Len())
+			if err := writeDir(e.entries); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := writeDir(root); err != nil {
+		return nil, err
+	}
+
+	pos := start + int64(dirArea.Len())
+	for _, e := range images {
+		e.offset = pos
+		pos += int64(e.size)
+	}
+	if pos > math.MaxUint32 {
+		return nil, fmt.Errorf("wzlib: %s would be %d bytes, larger than the format allows", wf.FileName, pos)
+	}
+
+	var patch func(entries []*saveEntry)
+	patch = func(entries []*saveEntry) {
+		for _, e := range entries {
+			binary.LittleEndian.PutUint32(dirArea.Bytes()[e.hashPos-start:], wf.hashOffset(uint32(e.hashPos), uint32(e.offset)))
+			patch(e.entries)
+		}
+	}
+	patch(root)
+	return dirArea, nil
+}
+
+// encode 确定 img 的大小与校验和，不能原样复制的 img 重新编码
+func (wf *WzFile) encode(ctx context.Context, e *saveEntry, key Decrypter, text encoding.Encoding) error {
+	img := e.img
+	if wf.canCopy(img) {
+		e.size, e.sum = img.Size, img.Checksum
+		return nil
+	}
+	nodes := e.node.Nodes
+	if img.WzFile != nil {
+		var err error
+		if nodes, err = img.extract(ctx); err != nil {
+			return err
+		}
+	}
+	e.data = newWzWriter(key, text)
+	if err := e.data.image(nodes); err != nil {
+		return err
+	}
+	e.size = e.data.Len()
+	e.sum = 0
+	for _, b := range e.data.Bytes() {
+		e.sum += int(b)
+	}
+	return nil
+}
+
+// writeTemp 把新文件写到 FileName 旁边的临时文件，返回其路径。header 中的数据长度按新文件改写
+func (wf *WzFile) writeTemp(ctx context.Context, header []byte, dirArea *wzWriter, root []*saveEntry) (name string, err error) {
+	size := wf.Header.DataStartPosition + int64(dirArea.Len())
+	forEachImage(root, func(e *saveEntry) { size += int64(e.size) })
+	binary.LittleEndian.PutUint64(header[4:], uint64(size-int64(wf.Header.HeaderSize)))
+
+	f, err := os.CreateTemp(filepath.Dir(wf.FileName), filepath.Base(wf.FileName)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriterSize(f, 1<<20)
+	bw.Write(header)
+	bw.Write(dirArea.Bytes())
+	var werr error
+	forEachImage(root, func(e *saveEntry) {
+		if werr != nil {
+			return
+		}
+		if werr = canceled(ctx); werr != nil {
+			return
+		}
+		if e.data != nil {
+			_, werr = bw.Write(e.data.Bytes())
+			return
+		}
+		img := e.img
+		if _, werr = io.Copy(bw, io.NewSectionReader(img.WzFile, img.Offset, int64(img.Size))); werr != nil {
+			werr = img.wrapError("copy", img.Offset, e.node, werr)
+		}
+	})
+	if werr != nil {
+		return "", werr
+	}
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// forEachImage 按写出的顺序遍历 img，与 layout 排定的顺序一致
+func forEachImage(entries []*saveEntry, fn func(e *saveEntry)) {
+	var dirs []*saveEntry
+	for _, e := range entries {
+		if e.img != nil {
+			fn(e)
+		} else {
+			dirs = append(dirs, e)
+		}
+	}
+	for _, e := range dirs {
+		forEachImage(e.entries, fn)
+	}
+}
+
+// replace 用 tmp 替换 FileName 并改为从新文件读取。Windows 上不能替换打开的文件，
+// 所以先关闭数据源，替换失败时重新打开原文件
+func (wf *WzFile) replace(tmp string, backup bool) error {
+	wf.closeMu.Lock()
+	defer wf.closeMu.Unlock()
+	_, mmap := wf.Source.(*MmapSource)
+	wf.Source.Close()
+
+	err := func() error {
+		if backup {
+			if err := backupFile(wf.FileName); err != nil {
+				return err
+			}
+		}
+		return os.Rename(tmp, wf.FileName)
+	}()
+
+	src, openErr := openSaved(wf.FileName, mmap)
+	if openErr != nil {
+		wf.closed = true
+		return errors.Join(err, openErr)
+	}
+	wf.Source = src
+	wf.FileStream = NewWzBinaryReader(io.NewSectionReader(wf, 0, src.Size()))
+	if err != nil {
+		return err
+	}
+	wf.Header.FileSize = src.Size()
+	wf.Header.DataSize = src.Size() - int64(wf.Header.HeaderSize)
+	return nil
+}
+
+func openSaved(fileName string, mmap bool) (WzSource, error) {
+	if mmap {
+		return OpenMmapSource(fileName)
+	}
+	return OpenFileSource(fileName)
+}
+
+// backupFile 把 fileName 保留为 fileName.bak，能建硬链接时不复制数据
+func backupFile(fileName string) error {
+	bak := fileName + ".bak"
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(fileName, bak) == nil {
+		return nil
+	}
+	src, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(bak)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// applyLayout 让目录与 img 记录指向新文件中的位置
+func (wf *WzFile) applyLayout(root []*saveEntry) {
+	var dirs []*WzDirectory
+	var apply func(entries []*saveEntry)
+	apply = func(entries []*saveEntry) {
+		for _, e := range entries {
+			hashed := wf.hashOffset(uint32(e.hashPos), uint32(e.offset))
+			if e.dir != nil {
+				e.dir.WzFile = wf
+				e.dir.Offset = int(e.hashPos)
+				e.dir.HashedOffset = hashed
+				e.dir.HashedOffsetPosition = uint32(e.hashPos)
+				dirs = append(dirs, e.dir)
+				apply(e.entries)
+				continue
+			}
+			img := e.img
+			img.mu.Lock()
+			created := img.WzFile == nil
+			img.WzFile = wf
+			img.Offset = e.offset
+			img.HashedOffset = hashed
+			img.HashedOffsetPos = uint32(e.hashPos)
+			img.Size = e.size
+			img.Checksum = e.sum
+			if e.data != nil {
+				// 重新编码的 img 内画布与音频数据的位置变了，重新打包的数据此后从文件读取
+				for v, off := range e.data.payloads {
+					switch v := v.(type) {
+					case *WzPng:
+						v.Image, v.Offset, v.data = img, off, nil
+					case *WzSound:
+						v.WzImage, v.Offset, v.data = img, off, nil
+					}
+				}
+				img.ChecksumChecked = true
+			}
+			if created {
+				// 新建的 img 的内容只在树中，不再从文件提取
+				img.Node = e.node
+				img.Extracted = true
+			}
+			img.modified = false
+			img.mu.Unlock()
+		}
+	}
+	apply(root)
+	wf.dirMu.Lock()
+	wf.Directories = dirs
+	wf.dirMu.Unlock()
+}
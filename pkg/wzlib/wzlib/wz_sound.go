@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
-	"sync"
 )
 
 // WzSoundType 表示音频类型
@@ -25,6 +24,117 @@ type WzSound struct {
 	Ms         int
 	MediaType  *AMMediaType
 	WzImage    *WzImage
+
+	header          []byte // 格式 GUID 部分，原样写回
+	format          []byte // 解密后的 WAVEFORMATEX
+	formatEncrypted bool   // 文件中的 WAVEFORMATEX 用密钥加密
+	data            []byte // 重新打包、尚未保存的音频数据
+}
+
+// soundHeaderLen 是 Sound_DX8 中格式 GUID 部分的长度：
+// 1 字节、major type、subtype、2 字节、format type
+const soundHeaderLen = 51
+
+var (
+	guidStream     = [16]byte{0x83, 0xEB, 0x36, 0xE4, 0x4F, 0x52, 0xCE, 0x11, 0x9F, 0x53, 0x00, 0x20, 0xAF, 0x0B, 0xA7, 0x70}
+	guidWave       = [16]byte{0x8B, 0xEB, 0x36, 0xE4, 0x4F, 0x52, 0xCE, 0x11, 0x9F, 0x53, 0x00, 0x20, 0xAF, 0x0B, 0xA7, 0x70}
+	guidMpeg1Audio = [16]byte{0x87, 0xEB, 0x36, 0xE4, 0x4F, 0x52, 0xCE, 0x11, 0x9F, 0x53, 0x00, 0x20, 0xAF, 0x0B, 0xA7, 0x70}
+	guidWaveFormat = [16]byte{0x81, 0x9F, 0x58, 0x05, 0x56, 0xC3, 0xCE, 0x11, 0xBF, 0x01, 0x00, 0xAA, 0x00, 0x55, 0x59, 0x5A}
+)
+
+// defaultSoundHeader 返回客户端文件中常见的格式 GUID 部分：Stream、WAVE 与 WAVEFORMATEX
+func defaultSoundHeader() []byte {
+	h := make([]byte, 0, soundHeaderLen)
+	h = append(h, 0x02)
+	h = append(h, guidStream[:]...)
+	h = append(h, guidWave[:]...)
+	h = append(h, 0x00, 0x01)
+	return append(h, guidWaveFormat[:]...)
+}
+
+// readSound 读取 Sound_DX8 对象，音频数据留在文件中
+func (img *WzImage) readSound(reader *WzBinaryReader) (*WzSound, error) {
+	if err := reader.SkipBytes(1); err != nil {
+		return nil, err
+	}
+	dataLen, err := reader.ReadCompressedInt32()
+	if err != nil {
+		return nil, err
+	}
+	ms, err := reader.ReadCompressedInt32()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, soundHeaderLen+1)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	format := make([]byte, header[soundHeaderLen])
+	if _, err := io.ReadFull(reader, format); err != nil {
+		return nil, err
+	}
+	sound := &WzSound{
+		DataLength: int(dataLen),
+		Ms:         int(ms),
+		WzImage:    img,
+		header:     header[:soundHeaderLen],
+	}
+	sound.parseFormat(format, img.WzFile.WzStructure.Encryption.Keys)
+	sound.Offset = uint32(reader.Pos())
+	if err := reader.SkipBytes(int64(dataLen)); err != nil {
+		return nil, err
+	}
+	return sound, nil
+}
+
+// parseFormat 解析 WAVEFORMATEX。有的文件用密钥加密了这部分，
+// 按明文解析不合法时再解密一次
+func (ws *WzSound) parseFormat(format []byte, key Decrypter) {
+	if !validWaveFormat(format) && len(format) > 0 {
+		plain := append([]byte(nil), format...)
+		key.Decrypt(plain, 0, len(plain))
+		if validWaveFormat(plain) {
+			format = plain
+			ws.formatEncrypted = true
+		}
+	}
+	ws.setFormat(format)
+}
+
+// setFormat 按格式 GUID 与明文 WAVEFORMATEX 设置 MediaType
+func (ws *WzSound) setFormat(format []byte) {
+	ws.format = format
+	media := &AMMediaType{}
+	if [16]byte(ws.header[1:17]) == guidStream {
+		media.MajorType = "Stream"
+	}
+	switch [16]byte(ws.header[17:33]) {
+	case guidWave:
+		media.SubType = "WAVE"
+	case guidMpeg1Audio:
+		media.SubType = "MPEG1Audio"
+	}
+	if validWaveFormat(format) {
+		wfx := WAVEFORMATEX{
+			FormatTag:      binary.LittleEndian.Uint16(format[0:]),
+			Channels:       binary.LittleEndian.Uint16(format[2:]),
+			SamplesPerSec:  binary.LittleEndian.Uint32(format[4:]),
+			AvgBytesPerSec: binary.LittleEndian.Uint32(format[8:]),
+			BlockAlign:     binary.LittleEndian.Uint16(format[12:]),
+			BitsPerSample:  binary.LittleEndian.Uint16(format[14:]),
+		}
+		if wfx.FormatTag == 0x55 { // MPEG Layer-3
+			media.PbFormat = &MPEGLAYER3WAVEFORMAT{Wfx: wfx}
+		} else {
+			media.PbFormat = &wfx
+		}
+	}
+	ws.MediaType = media
+}
+
+// validWaveFormat 检查 b 的长度是否与其中的 cbSize 一致
+func validWaveFormat(b []byte) bool {
+	return len(b) >= 18 && 18+int(binary.LittleEndian.Uint16(b[16:])) == len(b)
 }
 
 // AMMediaType、WAVEFORMATEX、MPEGLAYER3WAVEFORMAT 结构体需根据实际情况定义
@@ -140,10 +250,11 @@ func (ws *WzSound) CopyTo(buffer []byte, offset int) error {
 	if len(buffer)-offset < ws.DataLength {
 		return errors.New("insufficient buffer size")
 	}
-	// 假设WzImage有OpenRead()方法返回io.ReadSeeker
-	var mu sync.Mutex
-	mu.Lock()
-	defer mu.Unlock()
+	if ws.data != nil {
+		copy(buffer[offset:], ws.data)
+		return nil
+	}
+	// OpenRead 返回独立的流，无需加锁
 	s := ws.WzImage.OpenRead()
 	s.Seek(int64(ws.Offset), io.SeekStart)
 	_, err := io.ReadFull(s, buffer[offset:offset+ws.DataLength])
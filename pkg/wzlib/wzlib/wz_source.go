@@ -0,0 +1,171 @@
+package wzlib
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// WzSource is the random-access storage a WzFile is read from.
+type WzSource interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64 // 数据总长度
+}
+
+// fileSource 基于本地文件
+type fileSource struct {
+	file    *os.File
+	size    int64
+	modTime time.Time
+}
+
+// OpenFileSource opens a WZ file on disk.
+func OpenFileSource(fileName string) (WzSource, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &fileSource{file: file, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (s *fileSource) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+func (s *fileSource) Size() int64 {
+	return s.size
+}
+
+// ModTime 返回打开时文件的修改时间
+func (s *fileSource) ModTime() time.Time {
+	return s.modTime
+}
+
+func (s *fileSource) Close() error {
+	return s.file.Close()
+}
+
+// readerAtSource 包装任意 io.ReaderAt，closer 可为空
+type readerAtSource struct {
+	io.ReaderAt
+	size   int64
+	closer io.Closer
+}
+
+// NewReaderAtSource wraps r, whose content is size bytes long. Closing the
+// source does not close r.
+func NewReaderAtSource(r io.ReaderAt, size int64) WzSource {
+	return &readerAtSource{ReaderAt: r, size: size}
+}
+
+// NewBytesSource serves a WZ file that is already in memory.
+func NewBytesSource(data []byte) WzSource {
+	return &readerAtSource{ReaderAt: bytes.NewReader(data), size: int64(len(data))}
+}
+
+func (s *readerAtSource) Size() int64 {
+	return s.size
+}
+
+func (s *readerAtSource) Close() error {
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// OpenFSSource opens name in fsys, e.g. an embed.FS. Files that support
+// io.ReaderAt are read in place; others are loaded into memory.
+func OpenFSSource(fsys fs.FS, name string) (WzSource, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if ra, ok := file.(io.ReaderAt); ok {
+		return &readerAtSource{ReaderAt: ra, size: info.Size(), closer: file}, nil
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return NewBytesSource(data), nil
+}
+
+// OpenZipSource opens the archive member name from the zip archive in r.
+// Stored members are read directly from r; compressed members are inflated
+// into memory since deflate streams cannot be read at random offsets.
+func OpenZipSource(r io.ReaderAt, size int64, name string) (WzSource, error) {
+	src, _, err := openZipMember(r, size, name)
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// OpenZipFileSource opens the member name of the zip archive at zipPath.
+// For stored members the archive stays open until the source is closed.
+func OpenZipFileSource(zipPath, name string) (WzSource, error) {
+	archive, err := OpenFileSource(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	src, stored, err := openZipMember(archive, archive.Size(), name)
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	if !stored {
+		// 已解压到内存，归档文件不再需要
+		archive.Close()
+		return src, nil
+	}
+	src.closer = archive
+	return src, nil
+}
+
+func openZipMember(r io.ReaderAt, size int64, name string) (*readerAtSource, bool, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		if f.Method == zip.Store {
+			offset, err := f.DataOffset()
+			if err != nil {
+				return nil, false, err
+			}
+			length := int64(f.UncompressedSize64)
+			return &readerAtSource{ReaderAt: io.NewSectionReader(r, offset, length), size: length}, true, nil
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, false, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, false, err
+		}
+		return &readerAtSource{ReaderAt: bytes.NewReader(data), size: int64(len(data))}, false, nil
+	}
+	return nil, false, fmt.Errorf("zip member %s: %w", name, fs.ErrNotExist)
+}
@@ -3,17 +3,16 @@ package wzlib
 import (
 	"fmt"
 	"io"
-	"os"
 )
 
 type PartialStream struct {
-	Base     *os.File
+	Base     io.ReaderAt
 	Offset   int64
 	Length   int64
 	position int64
 }
 
-func NewPartialStream(base *os.File, offset, length int64) (io.ReadSeeker, error) {
+func NewPartialStream(base io.ReaderAt, offset, length int64) (io.ReadSeeker, error) {
 	p := &PartialStream{
 		Base:     base,
 		Offset:   offset,
@@ -54,3 +53,31 @@ func (ps *PartialStream) Seek(offset int64, whence int) (int64, error) {
 	ps.position = abs
 	return abs, nil
 }
+
+// viewerAt 由能直接暴露底层数据的 ReaderAt 实现（如基于 MmapSource 的 WzFile），
+// fn 返回前 b 一直有效，b 为只读
+type viewerAt interface {
+	viewAt(off, n int64, fn func(b []byte) error) error
+}
+
+// view 将接下来的 n 字节交给 fn，底层支持时不复制数据
+func (ps *PartialStream) view(n int64, fn func(b []byte) error) error {
+	if n < 0 || ps.position+n > ps.Length {
+		return io.ErrUnexpectedEOF
+	}
+	off := ps.Offset + ps.position
+	var err error
+	if v, ok := ps.Base.(viewerAt); ok {
+		err = v.viewAt(off, n, fn)
+	} else {
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(io.NewSectionReader(ps.Base, off, n), buf); err == nil {
+			err = fn(buf)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ps.position += n
+	return nil
+}
@@ -1,14 +1,16 @@
 package wzlib
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/text/encoding"
-	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type WzStructure struct {
@@ -19,48 +21,247 @@ type WzStructure struct {
 	HasBaseWz           bool              // 是否存在基础 Wz 文件
 	TextEncoding        encoding.Encoding // 文件的文本编码方式
 	AutoDetectExtFiles  bool              // 是否自动检测扩展文件
-	ImgCheckDisabled    bool              // 是否禁用图像校验
-	WzVersionVerifyMode int               // 版本验证模式
+	ImgCheckDisabled    bool              // 是否禁用图像校验，等同于 Checksum 为 ChecksumSkip
+	WzVersionVerifyMode int               // 版本验证模式，VersionVerifyDefault 或 VersionVerifyFast
+	WzVersion           int               // 固定的客户端版本，0 表示根据头部检测
+	Checksum            ChecksumPolicy    // img 校验和不匹配时的处理方式
+	Limits              Limits            // 读取数量的上限，零值表示不限
+	Logger              Logger            // 诊断消息，nil 表示丢弃
+	ImageCache          *ImageCache       // 限制已提取 img 的内存，nil 表示不限
+	IndexCache          *IndexCache       // 目录树的磁盘缓存，nil 表示不使用
+	Progress            Progress          // 接收读取目录与提取 img 的进度，nil 表示不报告
+	Metrics             Metrics           // 接收提取、读取、解码与缓存命中的统计，nil 表示不统计
+
+	names stringTable // 所有 img 共用的属性名驻留表
+
+	txMu sync.Mutex   // 保护 tx
+	tx   *Transaction // 当前进行中的事务
 }
 
 // LoadWzFile loads a WZ file into the structure
 func (ws *WzStructure) LoadWzFile(fileName string) error {
+	return ws.LoadWzFileContext(context.Background(), fileName)
+}
+
+// LoadWzFileContext is like LoadWzFile but stops when ctx is cancelled.
+func (ws *WzStructure) LoadWzFileContext(ctx context.Context, fileName string) error {
 	if fileName == "" {
 		return fmt.Errorf("fileName cannot be empty")
 	}
 
 	wzFile, err := NewWzFile(fileName)
 	if err != nil {
-		return fmt.Errorf("failed to create WzFile: %v", err)
+		return fmt.Errorf("failed to create WzFile: %w", err)
 	}
+	if err := ws.loadWzFile(ctx, wzFile); err != nil {
+		wzFile.Close()
+		return err
+	}
+	return nil
+}
+
+// LoadWzSource loads a WZ file from src, e.g. an embedded or in-memory
+// file. name is used as the root node text. On success src is owned by the
+// structure and closed by Close.
+func (ws *WzStructure) LoadWzSource(name string, src WzSource) error {
+	if src == nil {
+		return fmt.Errorf("src cannot be nil")
+	}
+
+	wzFile, err := NewWzFileFromSource(name, src)
+	if err != nil {
+		return fmt.Errorf("failed to create WzFile: %w", err)
+	}
+	return ws.loadWzFile(context.Background(), wzFile)
+}
+
+// LoadWzURL loads a WZ file served over HTTP. Only the byte ranges that are
+// actually parsed are downloaded.
+func (ws *WzStructure) LoadWzURL(url string) error {
+	src, err := OpenHTTPSource(url, nil)
+	if err != nil {
+		return err
+	}
+	name := path.Base(strings.SplitN(url, "?", 2)[0])
+	if err := ws.LoadWzSource(name, src); err != nil {
+		src.Close()
+		return err
+	}
+	return nil
+}
+
+// LoadWzFileMmap is like LoadWzFile but maps the file into memory, which
+// is much faster for large files such as String.wz or Map.wz.
+func (ws *WzStructure) LoadWzFileMmap(fileName string) error {
+	src, err := OpenMmapSource(fileName)
+	if err != nil {
+		return err
+	}
+	if err := ws.LoadWzSource(fileName, src); err != nil {
+		src.Close()
+		return err
+	}
+	return nil
+}
 
-	if wzFile.Loaded {
-		ws.WzFiles = append(ws.WzFiles, wzFile)
-	} else {
+func (ws *WzStructure) loadWzFile(ctx context.Context, wzFile *WzFile) error {
+	if !wzFile.Loaded {
 		return errors.New("not a wz file")
 	}
+	if ws.WzNode != nil {
+		// 一个结构只有一个根节点，多个文件请用 LoadWzFolder
+		return ErrAlreadyLoaded
+	}
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	// 读完才设置根节点，失败时结构可以重新加载
+	node := NewWzNode(filepath.Base(wzFile.FileName))
+	if err := ws.readFile(ctx, wzFile, node, ws.AutoDetectExtFiles); err != nil {
+		return err
+	}
+	ws.WzNode = node
+	return nil
+}
 
-	if ws.Encryption == nil {
-		ws.Encryption = NewWzCrypto()
-		err = ws.Encryption.DetectEncryption(wzFile)
-		if err != nil {
+// readFile 把 wzFile 的根目录读到 node 下，可用时先查 IndexCache；
+// withExt 为 true 时同时合并扩展文件。成功后 wzFile 归结构所有
+func (ws *WzStructure) readFile(ctx context.Context, wzFile *WzFile, node *WzNode, withExt bool) error {
+	if err := ws.prepareFile(wzFile); err != nil {
+		return err
+	}
+	if err := ws.readTree(ctx, wzFile, node); err != nil {
+		return err
+	}
+	wzFile.Node = node
+
+	if withExt {
+		if err := ws.loadExtFiles(ctx, wzFile); err != nil {
 			return err
 		}
 	}
+	ws.WzFiles = append(ws.WzFiles, wzFile)
+	return nil
+}
 
-	ws.WzNode = NewWzNode(filepath.Base(fileName))
-	_, err = wzFile.FileStream.Seek(wzFile.Header.DataStartPosition, io.SeekStart)
-	if err != nil {
-		return err
+// readTree 把 wzFile 的根目录读到 node 下，缓存可用时不再解析目录
+func (ws *WzStructure) readTree(ctx context.Context, wzFile *WzFile, node *WzNode) error {
+	cached := false
+	if ws.IndexCache != nil {
+		if key, ok := statIndexKey(wzFile); ok {
+			if idx := ws.IndexCache.load(key); idx != nil && ws.loadFromIndex(wzFile, idx, node) {
+				cached = true
+			}
+			ws.metrics().CacheLookup(CacheIndex, cached)
+		}
+	}
+
+	if !cached {
+		if err := ws.ensureEncryption(wzFile); err != nil {
+			return err
+		}
+		if err := wzFile.readRoot(ctx, node); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// prepareFile 把结构的配置应用到刚打开的文件
+func (ws *WzStructure) prepareFile(wzFile *WzFile) error {
 	wzFile.WzStructure = ws
-	err = wzFile.GetDirTree(ws.WzNode)
-	if err != nil {
+	if wzFile.TextEncoding == nil {
+		wzFile.TextEncoding = ws.TextEncoding
+	}
+	if ws.WzVersion > 0 {
+		if err := wzFile.Header.fixVersion(ws.WzVersion, ws.WzVersionVerifyMode != VersionVerifyFast); err != nil {
+			return wrapError("read header", wzFile.FileName, -1, "", err)
+		}
+	}
+	return nil
+}
+
+// ensureEncryption 在结构还没有密钥时根据 wzFile 检测，之后的文件沿用同一密钥
+func (ws *WzStructure) ensureEncryption(wzFile *WzFile) error {
+	if ws.Encryption != nil && ws.Encryption.Keys != nil {
+		return nil
+	}
+	crypto := NewWzCrypto()
+	if err := crypto.DetectEncryption(wzFile); err != nil {
 		return err
 	}
+	ws.Encryption = crypto
 	return nil
 }
 
+// loadExtFiles 把同目录下的扩展文件（Mob2.wz、Skill001.wz 等）合并到 wzFile 的根节点
+func (ws *WzStructure) loadExtFiles(ctx context.Context, wzFile *WzFile) error {
+	if _, err := os.Stat(wzFile.FileName); err != nil {
+		return nil // 不是磁盘上的文件
+	}
+	for _, name := range extFileNames(wzFile.FileName) {
+		ext, err := NewWzFile(name)
+		if err != nil {
+			return fmt.Errorf("open extension file: %w", err)
+		}
+		if err := ws.loadExtFile(ctx, ext); err != nil {
+			ext.Close()
+			return err
+		}
+		wzFile.MergeWzFile(ext)
+		ws.logger().Info("merged extension file", "file", name, "into", wzFile.FileName)
+	}
+	return nil
+}
+
+func (ws *WzStructure) loadExtFile(ctx context.Context, ext *WzFile) error {
+	if !ext.Loaded {
+		return fmt.Errorf("%s is not a wz file", ext.FileName)
+	}
+	if err := ws.prepareFile(ext); err != nil {
+		return err
+	}
+	ext.Node = NewWzNode(filepath.Base(ext.FileName))
+	ext.Node.Value = ext
+	return ws.readTree(ctx, ext, ext.Node)
+}
+
+// extFileNames 按命名约定列出 fileName 旁边存在的扩展文件：
+// Mob2.wz、Mob3.wz……，以及 KMST1058 起的 Mob001.wz、Mob002.wz……
+func extFileNames(fileName string) []string {
+	dir := filepath.Dir(fileName)
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	if base == "" || strings.IndexFunc(base, func(r rune) bool {
+		return !('A' <= r && r <= 'Z' || 'a' <= r && r <= 'z')
+	}) >= 0 {
+		return nil
+	}
+	var names []string
+	for _, layout := range []struct {
+		format string
+		first  int
+	}{{"%s%d.wz", 2}, {"%s%03d.wz", 1}} {
+		for id := layout.first; ; id++ {
+			name := filepath.Join(dir, fmt.Sprintf(layout.format, base, id))
+			if _, err := os.Stat(name); err != nil {
+				break
+			}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Close closes every file loaded into the structure, including extension
+// files merged by LoadWzFolder.
+func (ws *WzStructure) Close() error {
+	var errs []error
+	for _, wzFile := range ws.WzFiles {
+		errs = append(errs, wzFile.Close())
+	}
+	return errors.Join(errs...)
+}
+
 // ResetEncryption resets the encryption state
 func (ws *WzStructure) ResetEncryption() {
 	ws.Encryption.Reset()
@@ -80,7 +281,17 @@ func (ws *WzStructure) ToString() string {
 	return fmt.Sprintf("WzStructure with %d WzFile(s).", len(ws.WzFiles))
 }
 
+// LoadWzFolder loads a data folder: folder/<name>.wz and the extension
+// files folder/<name>_NNN.wz, counted by <name>.ini when present, which are
+// merged into node. useBaseWz is ignored and kept for compatibility; use
+// MountClient to mount a client whose categories are listed in Base.wz.
 func (ws *WzStructure) LoadWzFolder(folder string, node *WzNode, useBaseWz bool) error {
+	return ws.LoadWzFolderContext(context.Background(), folder, node, useBaseWz)
+}
+
+// LoadWzFolderContext is like LoadWzFolder but stops when ctx is
+// cancelled, including between extension files.
+func (ws *WzStructure) LoadWzFolderContext(ctx context.Context, folder string, node *WzNode, useBaseWz bool) error {
 	baseName := filepath.Join(folder, filepath.Base(folder))
 	entryWzFileName := baseName + ".wz"
 	iniFileName := baseName + ".ini"
@@ -116,17 +327,20 @@ func (ws *WzStructure) LoadWzFolder(folder string, node *WzNode, useBaseWz bool)
 		node = NewWzNode(filepath.Base(entryWzFileName))
 	}
 
-	entryWzf, err := ws.LoadFile(entryWzFileName, node, useBaseWz, true)
+	entryWzf, err := ws.LoadFileContext(ctx, entryWzFileName, node, false, true)
 	if err != nil {
-		return fmt.Errorf("LoadFile entry failed: %v", err)
+		return fmt.Errorf("LoadFile entry failed: %w", err)
 	}
 
 	if lastWzIndex != nil {
 		for i := 0; i <= *lastWzIndex; i++ {
 			extraFile := extraWzFileName(i)
 			tempNode := NewWzNode(filepath.Base(extraFile))
-			extraWzf, err := ws.LoadFile(extraFile, tempNode, false, true)
+			extraWzf, err := ws.LoadFileContext(ctx, extraFile, tempNode, false, true)
 			if err != nil {
+				if ctxErr := canceled(ctx); ctxErr != nil {
+					return ctxErr
+				}
 				continue
 			}
 			entryWzf.MergeWzFile(extraWzf)
@@ -136,42 +350,31 @@ func (ws *WzStructure) LoadWzFolder(folder string, node *WzNode, useBaseWz bool)
 	return nil
 }
 
+// LoadFile reads fileName into node and adds it to the structure.
+// useBaseWz and loadWzAsFolder are ignored and kept for compatibility.
 func (ws *WzStructure) LoadFile(fileName string, node *WzNode, useBaseWz, loadWzAsFolder bool) (*WzFile, error) {
+	return ws.LoadFileContext(context.Background(), fileName, node, useBaseWz, loadWzAsFolder)
+}
+
+// LoadFileContext is like LoadFile but stops when ctx is cancelled.
+func (ws *WzStructure) LoadFileContext(ctx context.Context, fileName string, node *WzNode, useBaseWz, loadWzAsFolder bool) (*WzFile, error) {
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
 	wzFile, err := NewWzFile(fileName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create WzFile: %v", err)
+		return nil, fmt.Errorf("failed to create WzFile: %w", err)
 	}
 	if !wzFile.Loaded {
+		wzFile.Close()
 		return nil, fmt.Errorf("the file is not a valid wz file")
 	}
 
-	ws.WzFiles = append(ws.WzFiles, wzFile)
-	wzFile.TextEncoding = ws.TextEncoding
-
-	err = ws.Encryption.DetectEncryption(wzFile)
-	if err != nil {
-		return nil, err
+	// 读完才加入结构，失败时关闭文件，结构中不留下半初始化的文件
+	if err := ws.readFile(ctx, wzFile, node, false); err != nil {
+		wzFile.Close()
+		return nil, fmt.Errorf("failed to read directory tree: %w", err)
 	}
-
 	node.Value = wzFile
-	wzFile.Node = node
-
-	if _, err := wzFile.FileStream.Seek(wzFile.Header.DataStartPosition, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to data start: %v", err)
-	}
-
-	err = wzFile.GetDirTree(node)
-	if err != nil {
-		//wzFile.FileStream.Close()
-		return nil, fmt.Errorf("failed to read directory tree: %v", err)
-	}
-
-	if pos, err := wzFile.FileStream.Seek(0, io.SeekCurrent); err == nil {
-		wzFile.Header.DirEndPosition = pos
-	}
-
-	//wzFile.DetectWzType()
-	//wzFile.DetectWzVersion()
-
 	return wzFile, nil
 }
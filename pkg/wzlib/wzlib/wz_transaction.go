@@ -1,73 +1,454 @@
 package wzlib
 
 import (
-	"errors"
-	"io"
+	"fmt"
+	"image"
 	"sync"
 )
 
-// Transaction represents a single transactional operation.
+// Transaction groups edits of a structure's node tree so that they are
+// kept or undone together. Edits are applied to the tree as they are made,
+// so later edits and lookups in the same transaction see them; Rollback
+// undoes them in reverse order and Commit keeps them. Each edit is checked
+// before anything is changed, so a failed call leaves the tree as it was.
+//
+// A structure has at most one active transaction. Readers on other
+// goroutines may observe edits before Commit; hold off reading while a
+// transaction is active if that matters.
+//
+// Images whose properties are edited are marked modified (see
+// WzImage.Modified) and are no longer unloaded by Unload or an ImageCache.
 type Transaction struct {
-	reader    *WzBinaryReader
-	isActive  bool
-	lock      sync.Mutex
-	backupPos int64 // Backup of the stream position for rollback
+	ws *WzStructure
+
+	mu   sync.Mutex
+	undo []func() // 每次修改的逆操作，回滚时倒序执行
+	done bool
 }
 
-// BeginTransaction starts a new transaction.
-func BeginTransaction(reader *WzBinaryReader) *Transaction {
-	return &Transaction{
-		reader:   reader,
-		isActive: true,
+// Savepoint marks a point in a transaction that RollbackTo can return to.
+type Savepoint int
+
+// Begin starts a transaction on the structure's tree. It fails with
+// ErrTxActive while another transaction is active.
+func (ws *WzStructure) Begin() (*Transaction, error) {
+	ws.txMu.Lock()
+	defer ws.txMu.Unlock()
+	if ws.tx != nil {
+		return nil, ErrTxActive
 	}
+	ws.tx = &Transaction{ws: ws}
+	return ws.tx, nil
 }
 
-// Commit ends the transaction and confirms all operations.
-func (t *Transaction) Commit() error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
+// Commit keeps every edit and ends the transaction.
+func (tx *Transaction) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.finish()
+	return nil
+}
 
-	if !t.isActive {
-		return errors.New("transaction is not active")
+// Rollback undoes every edit and ends the transaction.
+func (tx *Transaction) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
 	}
+	tx.undoTo(0)
+	tx.finish()
+	return nil
+}
 
-	t.isActive = false
+// Savepoint returns a savepoint at the current state of the transaction.
+func (tx *Transaction) Savepoint() Savepoint {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return Savepoint(len(tx.undo))
+}
+
+// RollbackTo undoes the edits made after sp. The transaction stays
+// active; savepoints taken after sp become invalid.
+func (tx *Transaction) RollbackTo(sp Savepoint) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if sp < 0 || int(sp) > len(tx.undo) {
+		return fmt.Errorf("wzlib: invalid savepoint %d", sp)
+	}
+	tx.undoTo(int(sp))
 	return nil
 }
 
-// Rollback reverts all changes made during the transaction.
-func (t *Transaction) Rollback() error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
+// Do runs fn in a nested savepoint: if fn returns an error, the edits it
+// made are undone and the error is returned, while earlier edits of the
+// transaction are kept.
+func (tx *Transaction) Do(fn func(tx *Transaction) error) error {
+	sp := tx.Savepoint()
+	if err := fn(tx); err != nil {
+		if rbErr := tx.RollbackTo(sp); rbErr != nil {
+			return rbErr
+		}
+		return err
+	}
+	return nil
+}
 
-	if !t.isActive {
-		return errors.New("transaction is not active")
+// Set changes the value of a property inside an image. value must be one
+// of the types the extractor produces for plain properties: nil, int16,
+// int32, int64, float32, float64, string, image.Point, []image.Point or
+// *WzUol. Containers (images, sub properties, canvases, sounds) cannot be
+// set; edit their children instead.
+func (tx *Transaction) Set(n *WzNode, value any) error {
+	typ, err := propType(value)
+	if err != nil {
+		return err
 	}
+	return tx.apply(func() (func(), error) {
+		if err := tx.checkNode(n); err != nil {
+			return nil, err
+		}
+		img := imageOf(n.ParentNode)
+		if img == nil || isContainer(n) {
+			return nil, fmt.Errorf("%w: %s is not a plain property", ErrNotEditable, n.GetFullPath())
+		}
+		oldValue, oldType := n.Value, n.Type
+		restore, err := tx.markModified(img, n)
+		if err != nil {
+			return nil, err
+		}
+		n.Value, n.Type = value, typ
+		return func() {
+			n.Value, n.Type = oldValue, oldType
+			restore()
+		}, nil
+	})
+}
+
+// Add appends child, a node not attached to any tree, to parent. Below a
+// directory child must be an image or directory node; inside an image it
+// is a property, possibly with sub properties, and parent must be the
+// image or a property container. Names must be unique among siblings.
+func (tx *Transaction) Add(parent, child *WzNode) error {
+	return tx.apply(func() (func(), error) {
+		if err := tx.checkNode(parent); err != nil {
+			return nil, err
+		}
+		if child == nil || child.ParentNode != nil {
+			return nil, fmt.Errorf("%w: child is nil or already attached", ErrNotEditable)
+		}
+		img, err := editableImage(parent)
+		if err != nil {
+			return nil, err
+		}
+		if img == nil {
+			if _, dir := child.Value.(*WzDirectory); !isDirectory(parent) || !dir && !isImage(child) {
+				return nil, fmt.Errorf("%w: only images and directories can be added to %s", ErrNotEditable, parent.GetFullPath())
+			}
+		} else {
+			if !isContainer(parent) {
+				return nil, fmt.Errorf("%w: %s cannot have properties", ErrNotEditable, parent.GetFullPath())
+			}
+			if err := checkProps(child); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkUnique(parent, child.Text, nil); err != nil {
+			return nil, err
+		}
+		restore, err := tx.markModified(img, parent)
+		if err != nil {
+			return nil, err
+		}
+		unedit := tx.markEdited(parent)
+		parent.AddChild(child)
+		return func() {
+			parent.RemoveChild(child)
+			unedit()
+			restore()
+		}, nil
+	})
+}
+
+// Remove detaches n from its parent. The root cannot be removed.
+func (tx *Transaction) Remove(n *WzNode) error {
+	return tx.apply(func() (func(), error) {
+		if err := tx.checkNode(n); err != nil {
+			return nil, err
+		}
+		parent := n.ParentNode
+		if parent == nil {
+			return nil, fmt.Errorf("%w: cannot remove the root", ErrNotEditable)
+		}
+		img, err := editableImage(parent)
+		if err != nil {
+			return nil, err
+		}
+		restore, err := tx.markModified(img, n)
+		if err != nil {
+			return nil, err
+		}
+		i := indexOf(parent.Nodes, n)
+		unedit := tx.markEdited(parent)
+		parent.RemoveChild(n)
+		return func() {
+			parent.insertChild(i, n)
+			unedit()
+			restore()
+		}, nil
+	})
+}
 
-	// Revert the position of the stream
-	_, err := t.reader.BaseStream.Seek(t.backupPos, io.SeekStart)
-	t.isActive = false
-	return err
+// Rename changes the name of n, keeping the name of an image or directory
+// in sync. The new name must be unique among n's siblings.
+func (tx *Transaction) Rename(n *WzNode, name string) error {
+	return tx.apply(func() (func(), error) {
+		if err := tx.checkNode(n); err != nil {
+			return nil, err
+		}
+		if n.ParentNode == nil || name == "" {
+			return nil, fmt.Errorf("%w: cannot rename %q to %q", ErrNotEditable, n.Text, name)
+		}
+		img, err := editableImage(n.ParentNode)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUnique(n.ParentNode, name, n); err != nil {
+			return nil, err
+		}
+		oldName := n.Text
+		restore, err := tx.markModified(img, n)
+		if err != nil {
+			return nil, err
+		}
+		unedit := tx.markEdited(n.ParentNode)
+		renameNode(n, name)
+		return func() {
+			renameNode(n, oldName)
+			unedit()
+			restore()
+		}, nil
+	})
 }
 
-// Do performs an operation within the transaction.
-func (t *Transaction) Do(action func(*WzBinaryReader) error) error {
-	t.lock.Lock()
-	defer t.lock.Unlock()
+// apply 在事务仍有效时执行一次修改并记下逆操作
+func (tx *Transaction) apply(edit func() (func(), error)) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	undo, err := edit()
+	if err != nil {
+		return err
+	}
+	tx.undo = append(tx.undo, undo)
+	return nil
+}
 
-	if !t.isActive {
-		return errors.New("transaction is not active")
+func (tx *Transaction) undoTo(n int) {
+	for i := len(tx.undo) - 1; i >= n; i-- {
+		tx.undo[i]()
 	}
+	tx.undo = tx.undo[:n]
+}
+
+func (tx *Transaction) finish() {
+	tx.done = true
+	tx.undo = nil
+	tx.ws.txMu.Lock()
+	tx.ws.tx = nil
+	tx.ws.txMu.Unlock()
+}
 
-	// Save the initial position for rollback
-	if t.backupPos == 0 {
-		pos, err := t.reader.BaseStream.Seek(0, io.SeekCurrent)
+// checkNode 确认 n 在结构的树中
+func (tx *Transaction) checkNode(n *WzNode) error {
+	if n == nil {
+		return fmt.Errorf("%w: nil node", ErrNotEditable)
+	}
+	root := n
+	for root.ParentNode != nil {
+		root = root.ParentNode
+	}
+	if root != tx.ws.WzNode {
+		return fmt.Errorf("%w: %s is not in the structure", ErrNotEditable, n.GetFullPath())
+	}
+	if !attached(n) {
+		return detachedError(n)
+	}
+	return nil
+}
+
+// attached 确认从 n 到根的每个节点都还在上级的 Nodes 中。img 被卸载后，
+// 之前取得的属性节点仍指向原来的上级，却已不在树中
+func attached(n *WzNode) bool {
+	for p := n; p.ParentNode != nil; p = p.ParentNode {
+		if indexOf(p.ParentNode.Nodes, p) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func detachedError(n *WzNode) error {
+	return fmt.Errorf("%w: %s was unloaded or removed from the tree", ErrNotEditable, n.GetFullPath())
+}
+
+// markModified 把 n 所在的 img 标记为已修改，返回恢复原标记的函数；img 为 nil 时什么都不做。
+// 标记后 img 不会再被卸载，此时再确认 n 仍在树中，检查之后才卸载的情况也能发现
+func (tx *Transaction) markModified(img *WzImage, n *WzNode) (func(), error) {
+	if img == nil {
+		return func() {}, nil
+	}
+	was := img.Modified()
+	img.MarkModified()
+	restore := func() { img.setModified(was) }
+	if !attached(n) {
+		restore()
+		return nil, detachedError(n)
+	}
+	return restore, nil
+}
+
+// markEdited 记下 n 所属文件的目录树已被修改，返回恢复原标记的函数
+func (tx *Transaction) markEdited(n *WzNode) func() {
+	wf := tx.ws.fileOf(n)
+	if wf == nil {
+		return func() {}
+	}
+	was := wf.edited.Swap(true)
+	return func() { wf.edited.Store(was) }
+}
+
+// editableImage 返回 n 所在的 img，需要时先提取；n 在目录层时返回 nil
+func editableImage(n *WzNode) (*WzImage, error) {
+	img := imageOf(n)
+	if img == nil {
+		return nil, nil
+	}
+	if err := img.TryExtract(); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// imageOf 返回 n 或其最近的上级中的 img，n 在目录层时返回 nil
+func imageOf(n *WzNode) *WzImage {
+	for p := n; p != nil; p = p.ParentNode {
+		if img, ok := p.Value.(*WzImage); ok {
+			return img
+		}
+	}
+	return nil
+}
+
+func isImage(n *WzNode) bool {
+	_, ok := n.Value.(*WzImage)
+	return ok
+}
+
+// isDirectory 判断 n 是否在目录层，文件的根节点也算
+func isDirectory(n *WzNode) bool {
+	switch n.Value.(type) {
+	case *WzDirectory, *WzFile:
+		return true
+	case nil:
+		return n.ParentNode == nil
+	}
+	return false
+}
+
+// isContainer 判断 n 是否可以在 img 中包含子属性
+func isContainer(n *WzNode) bool {
+	if _, ok := n.Value.(*WzImage); ok {
+		return true
+	}
+	return n.Type == "Property" || n.Type == "Canvas"
+}
+
+// checkProps 确认要加入 img 的属性子树只含提取器能产生的值
+func checkProps(n *WzNode) error {
+	switch n.Value.(type) {
+	case *WzPng:
+		if n.Type != "Canvas" {
+			return fmt.Errorf("%w: canvas %s must have type Canvas", ErrNotEditable, n.Text)
+		}
+	case *WzSound:
+		if n.Type != "Sound_DX8" {
+			return fmt.Errorf("%w: sound %s must have type Sound_DX8", ErrNotEditable, n.Text)
+		}
+	default:
+		typ, err := propType(n.Value)
 		if err != nil {
+			return fmt.Errorf("%s: %w", n.Text, err)
+		}
+		if n.Type != typ && !(n.Value == nil && n.Type == "Property") {
+			return fmt.Errorf("%w: %s has type %q, want %q", ErrNotEditable, n.Text, n.Type, typ)
+		}
+	}
+	if len(n.Nodes) > 0 && !isContainer(n) {
+		return fmt.Errorf("%w: %s has children but is not a container", ErrNotEditable, n.Text)
+	}
+	seen := make(map[string]bool, len(n.Nodes))
+	for _, c := range n.Nodes {
+		if seen[c.Text] {
+			return fmt.Errorf("%w: %s/%s", ErrDuplicateName, n.Text, c.Text)
+		}
+		seen[c.Text] = true
+		if err := checkProps(c); err != nil {
 			return err
 		}
-		t.backupPos = pos
 	}
+	return nil
+}
 
-	// Execute the transactional action
-	return action(t.reader)
+// propType 返回普通属性值对应的节点类型
+func propType(v any) (string, error) {
+	switch v.(type) {
+	case nil, int16, int32, int64, float32, float64, string:
+		return "", nil
+	case image.Point:
+		return "Shape2D#Vector2D", nil
+	case []image.Point:
+		return "Shape2D#Convex2D", nil
+	case *WzUol:
+		return "UOL", nil
+	}
+	return "", fmt.Errorf("%w: unsupported value type %T", ErrNotEditable, v)
+}
+
+// checkUnique 确认 parent 下除 self 外没有名为 name 的子节点
+func checkUnique(parent *WzNode, name string, self *WzNode) error {
+	for _, c := range parent.Children() {
+		if c != self && c.Text == name {
+			return fmt.Errorf("%w: %s/%s", ErrDuplicateName, parent.GetFullPath(), name)
+		}
+	}
+	return nil
+}
+
+func indexOf(nodes []*WzNode, n *WzNode) int {
+	for i, c := range nodes {
+		if c == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// renameNode 同时更新 img 与目录记录的名称
+func renameNode(n *WzNode, name string) {
+	switch v := n.Value.(type) {
+	case *WzImage:
+		v.Name = name
+	case *WzDirectory:
+		v.Name = name
+	}
+	n.Rename(name)
 }
@@ -0,0 +1,361 @@
+package wzlib
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 解包目录中由 wzlib 维护的文本文件
+const (
+	imageTextName = "image.txt" // img 目录中的属性树
+	dirTextName   = "dir.txt"   // 目录中子项的顺序，顶层的还记录版本与密钥
+)
+
+var keyNames = map[WzCryptoKeyType]string{BMS: "BMS", KMS: "KMS", GMS: "GMS"}
+
+// Unpack writes the file's directories and images below the folder dir,
+// which must be empty or not exist, so the data can be kept under version
+// control and rebuilt with Repack. Every directory becomes a folder with a
+// dir.txt listing its entries in file order; the top one also records the
+// version and key. Every image becomes a folder written by UnpackImage.
+// The output depends only on the data, unpacking the same file twice gives
+// identical folders.
+func (wf *WzFile) Unpack(dir string) error {
+	return wf.UnpackContext(context.Background(), dir)
+}
+
+// UnpackContext is like Unpack but stops when ctx is cancelled, leaving a
+// partial folder behind.
+func (wf *WzFile) UnpackContext(ctx context.Context, dir string) error {
+	if wf.Closed() {
+		return ErrClosed
+	}
+	ws := wf.WzStructure
+	if ws == nil || ws.Encryption == nil || wf.Header.VersionDetector == nil || wf.Node == nil {
+		return fmt.Errorf("wzlib: %s is not loaded into a structure", wf.FileName)
+	}
+	key, ok := keyNames[ws.Encryption.EncType]
+	if !ok {
+		return fmt.Errorf("wzlib: %s uses a key that cannot be recorded", wf.FileName)
+	}
+	entries, err := wf.collect(ctx, wf.saveRoot(), true)
+	if err != nil {
+		return err
+	}
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	head := []string{
+		"version " + strconv.Itoa(wf.Header.VersionDetector.GetWzVersion()),
+		"key " + key,
+	}
+	if wf.Header.DataStartPosition == int64(wf.Header.HeaderSize) {
+		head = append(head, "encver missing")
+	}
+	return unpackDir(ctx, dir, head, entries)
+}
+
+// unpackDir 写出一个目录的文件夹，head 为 dir.txt 开头的行
+func unpackDir(ctx context.Context, dir string, head []string, entries []*saveEntry) error {
+	text := strings.Join(head, "\n")
+	if text != "" {
+		text += "\n"
+	}
+	folders := newPathSet(dirTextName)
+	for _, e := range entries {
+		if err := canceled(ctx); err != nil {
+			return err
+		}
+		kind := "dir"
+		if e.img != nil {
+			kind = "image"
+		}
+		name := e.node.Text
+		folder := folders.claim(escapeName(name))
+		text += kind + " " + quoteName(name)
+		if folder != escapeName(name) {
+			text += " " + strconv.Quote(folder)
+		}
+		text += "\n"
+
+		sub := filepath.Join(dir, folder)
+		var err error
+		if e.img != nil {
+			err = unpackImage(ctx, e.node, sub)
+		} else {
+			err = unpackDir(ctx, sub, nil, e.entries)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, dirTextName), []byte(text), 0o644)
+}
+
+// UnpackImage writes the image node n to the folder dir, which must be
+// empty or not exist. The properties go to image.txt, one per line and
+// indented two spaces per level:
+//
+//	info property
+//	  name string "snail"
+//	  level int 1
+//	stand property
+//	  0 canvas "stand/0.png" form=2
+//	    origin vector 2,4
+//	die sound "die.mp3" ms=500 format=5500...
+//
+// Canvases are saved as PNG files and sounds as MP3, WAV or, for other
+// formats, raw .bin files, named after the node path. RepackImage reads
+// the folder back.
+func UnpackImage(n *WzNode, dir string) error {
+	if err := emptyDir(dir); err != nil {
+		return err
+	}
+	return unpackImage(context.Background(), n, dir)
+}
+
+func unpackImage(ctx context.Context, n *WzNode, dir string) error {
+	img, ok := n.Value.(*WzImage)
+	if !ok {
+		return fmt.Errorf("wzlib: %s is not an image", n.GetFullPath())
+	}
+	nodes, err := img.extract(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	u := &imageUnpacker{dir: dir, files: newPathSet(imageTextName)}
+	if err := u.nodes(nodes, 0, ""); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, imageTextName), u.text.Bytes(), 0o644)
+}
+
+// imageUnpacker 把一个 img 的属性写成文本，画布与音频写成文件
+type imageUnpacker struct {
+	dir   string
+	text  bytes.Buffer
+	files pathSet
+}
+
+func (u *imageUnpacker) nodes(nodes []*WzNode, depth int, dir string) error {
+	for _, n := range nodes {
+		for range depth {
+			u.text.WriteString("  ")
+		}
+		u.text.WriteString(quoteName(n.Text))
+		u.text.WriteByte(' ')
+		p := path.Join(dir, escapeName(n.Text))
+		if err := u.value(n, p); err != nil {
+			return fmt.Errorf("unpack %s: %w", n.GetFullPath(), err)
+		}
+		u.text.WriteByte('\n')
+		if n.Type == "Property" || n.Type == "Canvas" {
+			if err := u.nodes(n.Nodes, depth+1, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value 写出 n 的类型与值，p 是按节点路径生成的文件名（不含扩展名）
+func (u *imageUnpacker) value(n *WzNode, p string) error {
+	t := &u.text
+	switch n.Type {
+	case "Property":
+		t.WriteString("property")
+	case "Canvas":
+		v, ok := n.Value.(*WzPng)
+		if !ok {
+			return fmt.Errorf("canvas has value %T", n.Value)
+		}
+		file := u.files.claim(p + ".png")
+		if err := u.writePNG(file, v); err != nil {
+			return err
+		}
+		fmt.Fprintf(t, "canvas %s form=%d", strconv.Quote(file), v.Form)
+	case "Sound_DX8":
+		v, ok := n.Value.(*WzSound)
+		if !ok {
+			return fmt.Errorf("sound has value %T", n.Value)
+		}
+		ext, data, err := soundFile(v)
+		if err != nil {
+			return err
+		}
+		file := u.files.claim(p + ext)
+		if err := u.writeFile(file, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(t, "sound %s ms=%d format=%s", strconv.Quote(file), v.Ms, hex.EncodeToString(v.format))
+		if v.formatEncrypted {
+			t.WriteString(" encrypted")
+		}
+		if !bytes.Equal(v.header, defaultSoundHeader()) {
+			t.WriteString(" header=" + hex.EncodeToString(v.header))
+		}
+	case "Shape2D#Vector2D":
+		v, ok := n.Value.(image.Point)
+		if !ok {
+			return fmt.Errorf("vector has value %T", n.Value)
+		}
+		fmt.Fprintf(t, "vector %d,%d", v.X, v.Y)
+	case "Shape2D#Convex2D":
+		v, ok := n.Value.([]image.Point)
+		if !ok {
+			return fmt.Errorf("convex has value %T", n.Value)
+		}
+		t.WriteString("convex")
+		for _, p := range v {
+			fmt.Fprintf(t, " %d,%d", p.X, p.Y)
+		}
+	case "UOL":
+		v, ok := n.Value.(*WzUol)
+		if !ok {
+			return fmt.Errorf("uol has value %T", n.Value)
+		}
+		t.WriteString("uol " + strconv.Quote(v.Uol))
+	case "":
+		switch v := n.Value.(type) {
+		case nil:
+			t.WriteString("null")
+		case int16:
+			t.WriteString("short " + strconv.FormatInt(int64(v), 10))
+		case int32:
+			t.WriteString("int " + strconv.FormatInt(int64(v), 10))
+		case int64:
+			t.WriteString("long " + strconv.FormatInt(v, 10))
+		case float32:
+			t.WriteString("float " + strconv.FormatFloat(float64(v), 'g', -1, 32))
+		case float64:
+			t.WriteString("double " + strconv.FormatFloat(v, 'g', -1, 64))
+		case string:
+			t.WriteString("string " + strconv.Quote(v))
+		default:
+			return fmt.Errorf("unsupported value %T", n.Value)
+		}
+	default:
+		return fmt.Errorf("unsupported type %q", n.Type)
+	}
+	return nil
+}
+
+func (u *imageUnpacker) writePNG(file string, p *WzPng) error {
+	img, err := p.ExtractImage()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return u.writeFile(file, buf.Bytes())
+}
+
+func (u *imageUnpacker) writeFile(file string, data []byte) error {
+	name := filepath.Join(u.dir, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o644)
+}
+
+// soundFile 返回音频文件的扩展名与内容：MP3 原样，PCM 加上 WAV 头，其他格式原样存为 .bin
+func soundFile(s *WzSound) (string, []byte, error) {
+	switch s.SoundType() {
+	case WzSoundTypeMp3:
+		data, err := s.ExtractSound()
+		return ".mp3", data, err
+	case WzSoundTypePcm:
+		data, err := s.ExtractSound()
+		return ".wav", data, err
+	}
+	data := make([]byte, s.DataLength)
+	return ".bin", data, s.CopyTo(data, 0)
+}
+
+// emptyDir 确认 dir 不存在或为空，解包不覆盖已有的文件
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("wzlib: %s is not empty", dir)
+	}
+	return nil
+}
+
+// pathSet 记录一个文件夹中已用的相对路径。大小写不敏感的文件系统上
+// 只差大小写的名称也会冲突，所以按小写比较
+type pathSet map[string]bool
+
+func newPathSet(reserved ...string) pathSet {
+	s := pathSet{}
+	for _, p := range reserved {
+		s[strings.ToLower(p)] = true
+	}
+	return s
+}
+
+// claim 返回不与已用路径冲突的 p，冲突时在扩展名前加 ~2、~3……
+func (s pathSet) claim(p string) string {
+	ext := path.Ext(p)
+	stem := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		c := p
+		if i > 1 {
+			c = stem + "~" + strconv.Itoa(i) + ext
+		}
+		if !s[strings.ToLower(c)] {
+			s[strings.ToLower(c)] = true
+			return c
+		}
+	}
+}
+
+// escapeName 把节点名转为可用作文件名的形式：路径分隔符、Windows 不允许的字符、
+// 控制字符与 % 写成 %XX，末尾的点与空格也转义，空名称写成 _
+func escapeName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		last := i == len(name)-1
+		if c < 0x20 || c == 0x7F || strings.IndexByte(`/\:*?"<>|%`, c) >= 0 || last && (c == '.' || c == ' ') {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// quoteName 在名称含空白、引号或为空时加引号，使每行第一个词总是名称
+func quoteName(name string) string {
+	if name == "" || strings.ContainsAny(name, " \t\r\n\"\\") || !strconv.CanBackquote(name) {
+		return strconv.Quote(name)
+	}
+	return name
+}
@@ -0,0 +1,147 @@
+package wzlib
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// WalkFunc is called for every node visited by Walk; depth is 0 for the
+// node Walk was called on. Returning SkipSubtree skips the node's
+// children, StopWalk ends the walk without an error, and any other error
+// ends the walk and is returned by Walk.
+type WalkFunc func(n *WzNode, depth int) error
+
+var (
+	SkipSubtree = errors.New("wzlib: skip subtree")
+	StopWalk    = errors.New("wzlib: stop walk")
+)
+
+// WalkOptions 控制遍历的范围
+type WalkOptions struct {
+	Extract  bool // 自动提取遇到的 img；为 false 时只进入已提取的 img
+	MaxDepth int  // 只访问深度不超过 MaxDepth 的节点，0 表示不限
+}
+
+// Walk visits n and its descendants depth-first in child order, calling
+// fn before the children of each node. Lazy directories are read as they
+// are reached.
+func (n *WzNode) Walk(opts WalkOptions, fn WalkFunc) error {
+	return n.WalkContext(context.Background(), opts, fn)
+}
+
+// WalkContext is like Walk but stops when ctx is cancelled.
+func (n *WzNode) WalkContext(ctx context.Context, opts WalkOptions, fn WalkFunc) error {
+	err := n.walk(ctx, opts, fn, 0)
+	if err == StopWalk || err == SkipSubtree {
+		return nil
+	}
+	return err
+}
+
+func (n *WzNode) walk(ctx context.Context, opts WalkOptions, fn WalkFunc, depth int) error {
+	if err := canceled(ctx); err != nil {
+		return err
+	}
+	if err := fn(n, depth); err != nil {
+		if err == SkipSubtree {
+			return nil
+		}
+		return err
+	}
+	if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+		return nil
+	}
+	nodes, err := n.walkChildren(ctx, opts.Extract)
+	if err != nil {
+		return err
+	}
+	for _, child := range nodes {
+		if err := child.walk(ctx, opts, fn, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkChildren 返回遍历用的子节点快照，img 在遍历期间被卸载也不受影响
+func (n *WzNode) walkChildren(ctx context.Context, extract bool) ([]*WzNode, error) {
+	switch v := n.Value.(type) {
+	case *WzImage:
+		if extract {
+			return v.extract(ctx)
+		}
+		return v.extractedNodes(), nil
+	case *WzDirectory:
+		if err := n.LoadChildrenContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return n.Nodes, nil
+}
+
+// WalkImages extracts every image below root on a pool of workers
+// goroutines (GOMAXPROCS when workers <= 0) and calls fn with each image
+// node. fn may be called concurrently. The result for the i-th image in
+// Walk order is stored at index i, so the results do not depend on
+// scheduling. The first error in that order is returned; if fn returns
+// StopWalk no further images are started and the results of images that
+// were not processed are left as zero values.
+func WalkImages[T any](ctx context.Context, root *WzNode, workers int, fn func(n *WzNode) (T, error)) ([]T, error) {
+	var images []*WzNode
+	err := root.WalkContext(ctx, WalkOptions{}, func(n *WzNode, _ int) error {
+		if _, ok := n.Value.(*WzImage); ok {
+			images = append(images, n)
+			return SkipSubtree
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// 出错后只停止领取新的 img，已开始的照常完成。下标按顺序领取，
+	// 所以出错位置之前的 img 都会处理完，返回的错误与调度无关
+	results := make([]T, len(images))
+	errs := make([]error, len(images))
+	var next atomic.Int64
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	for range min(workers, len(images)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stop.Load() && canceled(ctx) == nil {
+				i := int(next.Add(1) - 1)
+				if i >= len(images) {
+					return
+				}
+				n := images[i]
+				if err := n.Value.(*WzImage).TryExtractContext(ctx); err != nil {
+					errs[i] = err
+				} else {
+					results[i], errs[i] = fn(n)
+				}
+				if errs[i] != nil {
+					stop.Store(true)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err == StopWalk {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, canceled(ctx)
+}
@@ -0,0 +1,347 @@
+package wzlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+)
+
+// wzWriter 按 WZ 格式编码目录与 img，是读取器的逆过程
+type wzWriter struct {
+	bytes.Buffer
+	key  Decrypter         // 字符串的密钥流，异或加密与解密相同
+	text encoding.Encoding // 非 ASCII 字符串优先按此编码写成单字节形式，nil 时写成 UTF-16
+
+	refs     map[string]int32 // img 内已写出的字符串位置，重复的字符串写成引用
+	payloads map[any]uint32   // 画布（*WzPng）与音频（*WzSound）数据在 img 内的新位置
+}
+
+func newWzWriter(key Decrypter, text encoding.Encoding) *wzWriter {
+	return &wzWriter{key: key, text: text}
+}
+
+func (w *wzWriter) int16(v int16) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *wzWriter) int32(v int32) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *wzWriter) compressedInt(v int32) {
+	if v > math.MinInt8 && v <= math.MaxInt8 {
+		w.WriteByte(byte(int8(v)))
+		return
+	}
+	w.WriteByte(0x80)
+	w.int32(v)
+}
+
+func (w *wzWriter) compressedLong(v int64) {
+	if v > math.MinInt8 && v <= math.MaxInt8 {
+		w.WriteByte(byte(int8(v)))
+		return
+	}
+	w.WriteByte(0x80)
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+func (w *wzWriter) compressedSingle(v float32) {
+	if v == float32(int8(v)) && v != math.MinInt8 && !(v == 0 && math.Signbit(float64(v))) {
+		w.WriteByte(byte(int8(v)))
+		return
+	}
+	w.WriteByte(0x80)
+	binary.Write(w, binary.LittleEndian, math.Float32bits(v))
+}
+
+// str 写入加密的字符串。能写成单字节的按 ASCII 形式写，其余写成 UTF-16
+func (w *wzWriter) str(s string) {
+	if s == "" {
+		w.WriteByte(0)
+		return
+	}
+	if b, ok := w.narrow(s); ok {
+		if len(b) < 128 {
+			w.WriteByte(byte(int8(-len(b))))
+		} else {
+			w.WriteByte(0x80)
+			w.int32(int32(len(b)))
+		}
+		buf := make([]byte, len(b))
+		mask := byte(0xAA)
+		for i, c := range b {
+			buf[i] = c ^ mask
+			mask++
+		}
+		w.key.Decrypt(buf, 0, len(buf))
+		w.Write(buf)
+		return
+	}
+
+	chars := utf16.Encode([]rune(s))
+	if len(chars) < 127 {
+		w.WriteByte(byte(len(chars)))
+	} else {
+		w.WriteByte(127)
+		w.int32(int32(len(chars)))
+	}
+	buf := make([]byte, len(chars)*2)
+	mask := uint16(0xAAAA)
+	for i, c := range chars {
+		binary.LittleEndian.PutUint16(buf[i*2:], c^mask)
+		mask++
+	}
+	w.key.Decrypt(buf, 0, len(buf))
+	w.Write(buf)
+}
+
+// narrow 返回 s 的单字节形式。读取时没有文本编码的字符串原样是字节，
+// 不是合法 UTF-8 的也原样写回
+func (w *wzWriter) narrow(s string) ([]byte, bool) {
+	if isASCII([]byte(s)) {
+		return []byte(s), true
+	}
+	if w.text != nil {
+		if b, err := w.text.NewEncoder().Bytes([]byte(s)); err == nil {
+			return b, true
+		}
+	}
+	if !utf8.ValidString(s) {
+		return []byte(s), true
+	}
+	return nil, false
+}
+
+// imageString 写入 img 内的字符串：首次出现时以 inline 标记内联，
+// 之后以 ref 标记写成到首次位置的偏移
+func (w *wzWriter) imageString(s string, inline, ref byte) {
+	if off, ok := w.refs[s]; ok {
+		w.WriteByte(ref)
+		w.int32(off)
+		return
+	}
+	w.WriteByte(inline)
+	// 引用本身占 4 字节，更短的字符串不值得记录
+	if len(s) > 4 {
+		if w.refs == nil {
+			w.refs = make(map[string]int32)
+		}
+		w.refs[s] = int32(w.Len())
+	}
+	w.str(s)
+}
+
+// image 把 img 的顶层属性编码为 img 数据，w 须为空
+func (w *wzWriter) image(nodes []*WzNode) error {
+	w.imageString("Property", 0x73, 0x1B)
+	return w.properties(nodes)
+}
+
+func (w *wzWriter) properties(nodes []*WzNode) error {
+	w.Write([]byte{0, 0})
+	w.compressedInt(int32(len(nodes)))
+	for _, n := range nodes {
+		w.imageString(n.Text, 0x00, 0x01)
+		if err := w.property(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wzWriter) property(n *WzNode) error {
+	switch n.Type {
+	case "Property", "Canvas", "Shape2D#Vector2D", "Shape2D#Convex2D", "UOL", "Sound_DX8":
+		w.WriteByte(0x09)
+		lenPos := w.Len()
+		w.int32(0)
+		if err := w.object(n); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(w.Bytes()[lenPos:], uint32(w.Len()-lenPos-4))
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("encode %s: unsupported type %q", n.GetFullPath(), n.Type)
+	}
+
+	switch v := n.Value.(type) {
+	case nil:
+		w.WriteByte(0x00)
+	case int16:
+		w.WriteByte(0x02)
+		w.int16(v)
+	case int32:
+		w.WriteByte(0x03)
+		w.compressedInt(v)
+	case int64:
+		w.WriteByte(0x14)
+		w.compressedLong(v)
+	case float32:
+		w.WriteByte(0x04)
+		w.compressedSingle(v)
+	case float64:
+		w.WriteByte(0x05)
+		binary.Write(w, binary.LittleEndian, v)
+	case string:
+		w.WriteByte(0x08)
+		w.imageString(v, 0x00, 0x01)
+	default:
+		return fmt.Errorf("encode %s: unsupported value %T", n.GetFullPath(), n.Value)
+	}
+	return nil
+}
+
+// object 写入带类型名的对象，即 0x09 属性的内容
+func (w *wzWriter) object(n *WzNode) error {
+	w.imageString(n.Type, 0x73, 0x1B)
+	switch n.Type {
+	case "Property":
+		return w.properties(n.Nodes)
+	case "Shape2D#Vector2D":
+		p, ok := n.Value.(image.Point)
+		if !ok {
+			return fmt.Errorf("encode %s: vector has value %T", n.GetFullPath(), n.Value)
+		}
+		w.compressedInt(int32(p.X))
+		w.compressedInt(int32(p.Y))
+	case "Shape2D#Convex2D":
+		points, ok := n.Value.([]image.Point)
+		if !ok {
+			return fmt.Errorf("encode %s: convex has value %T", n.GetFullPath(), n.Value)
+		}
+		w.compressedInt(int32(len(points)))
+		for _, p := range points {
+			w.imageString("Shape2D#Vector2D", 0x73, 0x1B)
+			w.compressedInt(int32(p.X))
+			w.compressedInt(int32(p.Y))
+		}
+	case "UOL":
+		uol, ok := n.Value.(*WzUol)
+		if !ok {
+			return fmt.Errorf("encode %s: uol has value %T", n.GetFullPath(), n.Value)
+		}
+		w.WriteByte(0)
+		w.imageString(uol.Uol, 0x00, 0x01)
+	case "Canvas":
+		return w.canvas(n)
+	case "Sound_DX8":
+		return w.sound(n)
+	}
+	return nil
+}
+
+// canvas 写入画布的属性与原样复制的压缩数据
+func (w *wzWriter) canvas(n *WzNode) error {
+	png, ok := n.Value.(*WzPng)
+	if !ok || png.data == nil && (png.Image == nil || png.Image.WzFile == nil) {
+		return fmt.Errorf("encode %s: canvas has no data", n.GetFullPath())
+	}
+	w.WriteByte(0)
+	if len(n.Nodes) > 0 {
+		w.WriteByte(1)
+		if err := w.properties(n.Nodes); err != nil {
+			return err
+		}
+	} else {
+		w.WriteByte(0)
+	}
+	w.compressedInt(int32(png.Width))
+	w.compressedInt(int32(png.Height))
+	// 读取时格式为压缩整数与一个字节之和
+	w.compressedInt(int32(png.Form))
+	w.WriteByte(0)
+	w.int32(0)
+	w.int32(int32(png.DataLength))
+
+	if png.data != nil {
+		// 重新打包的数据是 zlib 明文，与密钥无关
+		w.payload(png, png.data)
+		return nil
+	}
+	data, err := readPayload(png.Image, png.Offset, png.DataLength, n)
+	if err != nil {
+		return err
+	}
+	// 分块加密的数据按目标密钥重新加密，zlib 明文原样复制
+	if src := png.Image.WzFile.WzStructure.Encryption.Keys; Decrypter(src) != w.key &&
+		len(data) >= 3 && !(data[1] == 0x78 && data[2] == 0x9C) {
+		if err := w.reencryptBlocks(data[1:], src); err != nil {
+			return fmt.Errorf("encode %s: %w", n.GetFullPath(), err)
+		}
+	}
+	w.payload(png, data)
+	return nil
+}
+
+// reencryptBlocks 就地把分块加密的画布数据从 src 密钥转为 w 的密钥，块结构不变
+func (w *wzWriter) reencryptBlocks(data []byte, src Decrypter) error {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return io.ErrUnexpectedEOF
+		}
+		n := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if n < 0 || n > len(data) {
+			return io.ErrUnexpectedEOF
+		}
+		src.Decrypt(data, 0, n)
+		w.key.Decrypt(data, 0, n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// sound 写入音频的格式头与原样复制的音频数据
+func (w *wzWriter) sound(n *WzNode) error {
+	sound, ok := n.Value.(*WzSound)
+	if !ok || sound.data == nil && (sound.WzImage == nil || sound.WzImage.WzFile == nil) || len(sound.header) != soundHeaderLen {
+		return fmt.Errorf("encode %s: sound has no data", n.GetFullPath())
+	}
+	w.WriteByte(0)
+	w.compressedInt(int32(sound.DataLength))
+	w.compressedInt(int32(sound.Ms))
+	w.Write(sound.header)
+	format := append([]byte(nil), sound.format...)
+	if sound.formatEncrypted {
+		w.key.Decrypt(format, 0, len(format))
+	}
+	w.WriteByte(byte(len(format)))
+	w.Write(format)
+
+	data := sound.data
+	if data == nil {
+		var err error
+		if data, err = readPayload(sound.WzImage, sound.Offset, sound.DataLength, n); err != nil {
+			return err
+		}
+	}
+	w.payload(sound, data)
+	return nil
+}
+
+// payload 写入画布或音频数据并记下其在 img 内的位置
+func (w *wzWriter) payload(v any, data []byte) {
+	if w.payloads == nil {
+		w.payloads = make(map[any]uint32)
+	}
+	w.payloads[v] = uint32(w.Len())
+	w.Write(data)
+}
+
+// readPayload 读取 img 中 offset 处的 n 字节数据
+func readPayload(img *WzImage, offset uint32, n int, node *WzNode) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := img.WzFile.ReadAt(data, img.Offset+int64(offset)); err != nil {
+		return nil, img.wrapError("read", img.Offset+int64(offset), node, err)
+	}
+	return data, nil
+}
@@ -20,6 +20,7 @@ type ContentViewer struct {
 	dataTab     *container.TabItem
 	hexTab      *container.TabItem
 	currentNode *wzlib.WzNode
+	pinnedImage *wzlib.WzImage // 正在查看的 img，固定在缓存中不被卸载
 }
 
 // NewContentViewer 创建新的内容查看器
@@ -52,6 +53,7 @@ func (cv *ContentViewer) createContent() {
 // ShowNodeContent 显示节点内容
 func (cv *ContentViewer) ShowNodeContent(nodeType string, nodeValue interface{}, node *wzlib.WzNode) {
 	cv.currentNode = node
+	cv.pinImage(node)
 
 	// 更新信息选项卡
 	cv.updateInfoTab(nodeType, nodeValue, node)
@@ -63,6 +65,34 @@ func (cv *ContentViewer) ShowNodeContent(nodeType string, nodeValue interface{},
 	cv.updateHexTab(nodeType, nodeValue, node)
 }
 
+// pinImage 固定 node 所属的 img，并释放之前固定的 img
+func (cv *ContentViewer) pinImage(node *wzlib.WzNode) {
+	var img *wzlib.WzImage
+	for n := node; n != nil; n = n.ParentNode {
+		if v, ok := n.Value.(*wzlib.WzImage); ok {
+			img = v
+			break
+		}
+	}
+	if img == cv.pinnedImage {
+		return
+	}
+	if cache := imageCacheOf(cv.pinnedImage); cache != nil {
+		cache.Unpin(cv.pinnedImage)
+	}
+	if cache := imageCacheOf(img); cache != nil {
+		cache.Pin(img)
+	}
+	cv.pinnedImage = img
+}
+
+func imageCacheOf(img *wzlib.WzImage) *wzlib.ImageCache {
+	if img == nil || img.WzFile == nil || img.WzFile.WzStructure == nil {
+		return nil
+	}
+	return img.WzFile.WzStructure.ImageCache
+}
+
 // updateInfoTab 更新信息选项卡
 func (cv *ContentViewer) updateInfoTab(nodeType string, nodeValue interface{}, node *wzlib.WzNode) {
 	var infoText strings.Builder
@@ -71,7 +101,7 @@ func (cv *ContentViewer) updateInfoTab(nodeType string, nodeValue interface{}, n
 	infoText.WriteString(fmt.Sprintf("节点名称: %s\n", node.Text))
 	infoText.WriteString(fmt.Sprintf("节点类型: %s\n", nodeType))
 	infoText.WriteString(fmt.Sprintf("完整路径: %s\n", node.GetFullPath()))
-	infoText.WriteString(fmt.Sprintf("子节点数量: %d\n", len(node.Nodes)))
+	infoText.WriteString(fmt.Sprintf("子节点数量: %d\n", len(node.Children())))
 
 	// 父节点信息
 	if node.ParentNode != nil {
@@ -88,7 +118,9 @@ func (cv *ContentViewer) updateInfoTab(nodeType string, nodeValue interface{}, n
 		// 根据类型显示特定信息
 		switch v := nodeValue.(type) {
 		case *wzlib.WzImage:
-			infoText.WriteString(fmt.Sprintf("图像是否已提取: %t\n", v.Extracted))
+			infoText.WriteString(fmt.Sprintf("图像是否已提取: %t\n", v.IsExtracted()))
+		case *wzlib.WzDirectory:
+			infoText.WriteString(fmt.Sprintf("目录大小: %d\n", v.Size))
 		case *wzlib.WzSound:
 			infoText.WriteString("音频文件\n")
 		case string:
@@ -148,15 +180,10 @@ func (cv *ContentViewer) createImageContent(nodeValue interface{}) fyne.CanvasOb
 	if img, ok := nodeValue.(*wzlib.WzImage); ok {
 		var infoText strings.Builder
 		infoText.WriteString("图像信息:\n")
-		infoText.WriteString(fmt.Sprintf("是否已提取: %t\n", img.Extracted))
-
-		// 尝试提取图像
-		if !img.Extracted {
-			img.TryExtract()
-		}
+		infoText.WriteString(fmt.Sprintf("是否已提取: %t\n", img.IsExtracted()))
 
-		// 显示图像属性
-		if img.Extracted {
+		// 尝试提取图像，显示图像属性
+		if img.TryExtract() == nil {
 			infoText.WriteString("图像已提取，可在图像查看选项卡中查看\n")
 		} else {
 			infoText.WriteString("图像提取失败\n")
@@ -271,13 +298,13 @@ func (cv *ContentViewer) createGenericContent(nodeValue interface{}, node *wzlib
 	}
 
 	// 如果有子节点，显示子节点列表
-	if len(node.Nodes) > 0 {
-		infoText.WriteString(fmt.Sprintf("\n子节点列表 (%d个):\n", len(node.Nodes)))
-		for i, child := range node.Nodes {
+	if children := node.Children(); len(children) > 0 {
+		infoText.WriteString(fmt.Sprintf("\n子节点列表 (%d个):\n", len(children)))
+		for i, child := range children {
 			if i < 20 { // 只显示前20个子节点
 				infoText.WriteString(fmt.Sprintf("- %s [%s]\n", child.Text, child.Type))
 			} else {
-				infoText.WriteString(fmt.Sprintf("... 还有 %d 个子节点\n", len(node.Nodes)-20))
+				infoText.WriteString(fmt.Sprintf("... 还有 %d 个子节点\n", len(children)-20))
 				break
 			}
 		}
@@ -227,43 +227,52 @@ func (de *DataExporter) exportSounds(exportPath, filter string) error {
 	return fmt.Errorf("音频导出功能尚未实现")
 }
 
-// collectNodeData 收集节点数据
-func (de *DataExporter) collectNodeData(node *wzlib.WzNode, filter string) map[string]interface{} {
-	if node == nil {
+// collectNodeData 收集节点数据，不匹配过滤条件的节点连同子节点一起跳过
+func (de *DataExporter) collectNodeData(root *wzlib.WzNode, filter string) map[string]interface{} {
+	if root == nil {
 		return nil
 	}
 
-	// 简单的过滤逻辑
-	if filter != "" && !de.matchFilter(node, filter) {
-		return nil
-	}
+	var result map[string]interface{}
+	collected := make(map[*wzlib.WzNode]map[string]interface{})
+	root.Walk(wzlib.WalkOptions{}, func(node *wzlib.WzNode, depth int) error {
+		// 简单的过滤逻辑
+		if filter != "" && !de.matchFilter(node, filter) {
+			return wzlib.SkipSubtree
+		}
 
-	data := map[string]interface{}{
-		"name": node.Text,
-		"type": node.Type,
-		"path": node.GetFullPath(),
-	}
+		data := map[string]interface{}{
+			"name": node.Text,
+			"type": node.Type,
+			"path": node.GetFullPath(),
+		}
 
-	// 添加值信息
-	if node.Value != nil {
-		data["value_type"] = fmt.Sprintf("%T", node.Value)
-	}
+		// 添加值信息
+		if node.Value != nil {
+			data["value_type"] = fmt.Sprintf("%T", node.Value)
+		}
 
-	// 递归处理子节点
-	if len(node.Nodes) > 0 {
-		children := make(map[string]interface{})
-		for _, child := range node.Nodes {
-			childData := de.collectNodeData(child, filter)
-			if childData != nil {
-				children[child.Text] = childData
-			}
+		collected[node] = data
+		if depth == 0 {
+			result = data
+			return nil
 		}
-		if len(children) > 0 {
-			data["children"] = children
+
+		// 父节点先于子节点访问，直接挂到父节点的 children 下
+		parent := collected[node.ParentNode]
+		if parent == nil {
+			return nil
 		}
-	}
+		children, _ := parent["children"].(map[string]interface{})
+		if children == nil {
+			children = make(map[string]interface{})
+			parent["children"] = children
+		}
+		children[node.Text] = data
+		return nil
+	})
 
-	return data
+	return result
 }
 
 // matchFilter 匹配过滤条件
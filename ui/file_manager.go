@@ -1,11 +1,15 @@
 package ui
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
@@ -18,27 +22,52 @@ import (
 
 // FileManager 文件管理器
 type FileManager struct {
-	content         *fyne.Container
-	fileList        *widget.List
-	loadedFiles     []string
-	wzStructures    map[string]*wzlib.WzStructure
-	mergedStructure *wzlib.WzStructure
-	OnWzFileLoaded  func(wzStructure interface{})
-	statusLabel     *widget.Label
+	content        *fyne.Container
+	fileList       *widget.List
+	mu             sync.Mutex // 保护 loadedFiles、wzStructures 与 watcher，后台加载与文件监视也会访问它们
+	loadedFiles    []string
+	wzStructures   map[string]*wzlib.WzStructure // data 目录挂载为一个结构，单独打开的文件各一个
+	OnWzFileLoaded func(wzStructure interface{})
+	statusLabel    *widget.Label
+	imageCache     *wzlib.ImageCache // 所有已加载文件共用，限制已提取 img 的内存
+	indexCache     *wzlib.IndexCache // 目录树与已浏览 img 的磁盘缓存，重新打开时免去解析
+	cancelButton   *widget.Button    // 加载默认数据时显示
+	cancelLoad     context.CancelFunc
+	loading        sync.WaitGroup // 等待后台加载结束后再关闭文件
+	watcher        *fileWatcher   // 勾选“监视文件变化”时不为 nil
+
+	// OnWzFileReloaded 在监视到文件变化并重新加载后调用，old 已被 ws 取代，
+	// 回调返回后关闭；changed 是变化的文件名
+	OnWzFileReloaded func(old, ws *wzlib.WzStructure, changed []string)
 }
 
+// imageCacheBytes 是已提取 img 的估算内存上限，超出后卸载最久未浏览的 img
+const imageCacheBytes = 256 << 20
+
 // NewFileManager 创建新的文件管理器
 func NewFileManager() *FileManager {
 	fm := &FileManager{
 		loadedFiles:  make([]string, 0),
 		wzStructures: make(map[string]*wzlib.WzStructure),
 		statusLabel:  widget.NewLabel("正在加载默认数据..."),
+		imageCache:   wzlib.NewImageCache(0, imageCacheBytes),
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		fm.indexCache = wzlib.NewIndexCache(filepath.Join(dir, "wzviewer", "index"))
+		fm.indexCache.SaveProperties = true
 	}
 
 	fm.createContent()
 
-	// 自动加载 ./data 目录下的 WZ 文件
-	go fm.loadDefaultDataFiles()
+	// 自动加载 ./data 目录下的 WZ 文件，关闭窗口或点击取消时停止
+	ctx, cancel := context.WithCancel(context.Background())
+	fm.cancelLoad = cancel
+	fm.loading.Add(1)
+	go func() {
+		defer fm.loading.Done()
+		defer fm.cancelButton.Hide()
+		fm.loadDefaultDataFiles(ctx)
+	}()
 
 	return fm
 }
@@ -48,6 +77,8 @@ func (fm *FileManager) createContent() {
 	// 文件列表
 	fm.fileList = widget.NewList(
 		func() int {
+			fm.mu.Lock()
+			defer fm.mu.Unlock()
 			return len(fm.loadedFiles)
 		},
 		func() fyne.CanvasObject {
@@ -58,24 +89,19 @@ func (fm *FileManager) createContent() {
 		},
 		func(id widget.ListItemID, obj fyne.CanvasObject) {
 			label := obj.(*widget.Label)
-			if id < len(fm.loadedFiles) {
-				fileName := filepath.Base(fm.loadedFiles[id])
-				label.SetText(fileName)
+			if filePath, _, ok := fm.fileAt(id); ok {
+				label.SetText(filepath.Base(filePath))
 			}
 		},
 	)
 
 	// 文件列表选择事件
 	fm.fileList.OnSelected = func(id widget.ListItemID) {
-		if id < len(fm.loadedFiles) {
-			filePath := fm.loadedFiles[id]
-			if _, exists := fm.wzStructures[filePath]; exists {
-				// 总是传递合并后的结构，而不是单个文件的结构
-				if fm.mergedStructure != nil && fm.OnWzFileLoaded != nil {
-					fm.OnWzFileLoaded(fm.mergedStructure)
-				}
-				fm.statusLabel.SetText(fmt.Sprintf("Selected: %s", filepath.Base(filePath)))
+		if filePath, ws, ok := fm.fileAt(id); ok && ws != nil {
+			if fm.OnWzFileLoaded != nil {
+				fm.OnWzFileLoaded(ws)
 			}
+			fm.statusLabel.SetText(fmt.Sprintf("Selected: %s", filepath.Base(filePath)))
 		}
 	}
 
@@ -89,10 +115,21 @@ func (fm *FileManager) createContent() {
 	clearButton := widget.NewButtonWithIcon("清空", theme.ContentClearIcon(), fm.clearFileList)
 	clearButton.Importance = widget.LowImportance
 
+	fm.cancelButton = widget.NewButtonWithIcon("取消", theme.CancelIcon(), func() {
+		if fm.cancelLoad != nil {
+			fm.cancelLoad()
+		}
+	})
+	fm.cancelButton.Importance = widget.LowImportance
+
+	// 打包工具重建已加载的文件后自动重新加载
+	watchCheck := widget.NewCheck("监视文件变化", fm.setWatching)
+
 	// 使用垂直布局让按钮更紧凑
 	buttonContainer := container.NewVBox(
 		container.NewHBox(loadButton, removeButton),
 		clearButton,
+		watchCheck,
 	)
 
 	// 创建标题标签
@@ -105,7 +142,7 @@ func (fm *FileManager) createContent() {
 		widget.NewSeparator(),
 		buttonContainer,
 		widget.NewSeparator(),
-		fm.statusLabel,
+		container.NewBorder(nil, nil, nil, fm.cancelButton, fm.statusLabel),
 	)
 
 	fm.content = container.NewBorder(
@@ -117,6 +154,36 @@ func (fm *FileManager) createContent() {
 	)
 }
 
+// fileAt 返回列表第 id 项的路径与结构
+func (fm *FileManager) fileAt(id int) (string, *wzlib.WzStructure, bool) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if id < 0 || id >= len(fm.loadedFiles) {
+		return "", nil, false
+	}
+	filePath := fm.loadedFiles[id]
+	return filePath, fm.wzStructures[filePath], true
+}
+
+// addFile 把已加载的结构加入列表，返回它在列表中的位置
+func (fm *FileManager) addFile(filePath string, ws *wzlib.WzStructure) int {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.loadedFiles = append(fm.loadedFiles, filePath)
+	fm.wzStructures[filePath] = ws
+	return len(fm.loadedFiles) - 1
+}
+
+// takeAll 清空列表，返回原来的结构，由调用方在锁外关闭
+func (fm *FileManager) takeAll() map[string]*wzlib.WzStructure {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	all := fm.wzStructures
+	fm.loadedFiles = make([]string, 0)
+	fm.wzStructures = make(map[string]*wzlib.WzStructure)
+	return all
+}
+
 // loadWzFile 加载WZ文件
 func (fm *FileManager) loadWzFile() {
 	// 创建文件选择对话框
@@ -128,46 +195,44 @@ func (fm *FileManager) loadWzFile() {
 
 		filePath := reader.URI().Path()
 
-		log.Printf("Attempting to load WZ file: %s", filePath)
+		slog.Debug("loading WZ file", "path", filePath)
 
 		// 检查文件是否已经加载
-		for _, loadedFile := range fm.loadedFiles {
-			if loadedFile == filePath {
-				fm.statusLabel.SetText("File already loaded")
-				return
-			}
+		fm.mu.Lock()
+		_, loaded := fm.wzStructures[filePath]
+		fm.mu.Unlock()
+		if loaded {
+			fm.statusLabel.SetText("File already loaded")
+			return
 		}
 
 		// 加载WZ文件
-		wzStructure := &wzlib.WzStructure{}
-		log.Printf("Created WzStructure, calling LoadWzFile...")
-		loadErr := wzStructure.LoadWzFile(filePath)
+		wzStructure, loadErr := fm.openStructure(context.Background(), filePath)
 		if loadErr != nil {
-			log.Printf("LoadWzFile failed: %v", loadErr)
+			slog.Error("load WZ file failed", "path", filePath, "err", loadErr)
 			dialog.ShowError(fmt.Errorf("Failed to load WZ file: %v", loadErr), fyne.CurrentApp().Driver().AllWindows()[0])
 			fm.statusLabel.SetText("Load failed")
 			return
 		}
 
-		log.Printf("LoadWzFile succeeded")
-
 		// 检查是否成功加载
 		if wzStructure.WzNode == nil {
-			log.Printf("WzNode is nil")
+			slog.Warn("WZ file has no root node", "path", filePath)
+			wzStructure.Close()
 			dialog.ShowError(fmt.Errorf("WZ file loaded but no data found"), fyne.CurrentApp().Driver().AllWindows()[0])
 			fm.statusLabel.SetText("No data found")
 			return
 		}
 
-		log.Printf("WzNode loaded successfully, has %d child nodes", len(wzStructure.WzNode.Nodes))
+		slog.Info("loaded WZ file", "path", filePath, "children", len(wzStructure.WzNode.Nodes))
 
 		// 添加到列表
-		fm.loadedFiles = append(fm.loadedFiles, filePath)
-		fm.wzStructures[filePath] = wzStructure
+		id := fm.addFile(filePath, wzStructure)
+		fm.watchStructure(wzStructure)
 		fm.fileList.Refresh()
 
 		// 自动选择新加载的文件
-		fm.fileList.Select(len(fm.loadedFiles) - 1)
+		fm.fileList.Select(id)
 
 		fm.statusLabel.SetText(fmt.Sprintf("Successfully loaded: %s", filepath.Base(filePath)))
 
@@ -180,6 +245,7 @@ func (fm *FileManager) loadWzFile() {
 
 // removeSelectedFile 移除选中的文件
 func (fm *FileManager) removeSelectedFile() {
+	fm.mu.Lock()
 	// 获取当前选中的项目
 	selectedID := -1
 	if len(fm.loadedFiles) > 0 {
@@ -188,11 +254,13 @@ func (fm *FileManager) removeSelectedFile() {
 	}
 
 	if selectedID < 0 || selectedID >= len(fm.loadedFiles) {
+		fm.mu.Unlock()
 		return
 	}
 
 	// 移除选中的文件
 	filePath := fm.loadedFiles[selectedID]
+	ws, ok := fm.wzStructures[filePath]
 	delete(fm.wzStructures, filePath)
 
 	// 重建文件列表
@@ -204,159 +272,237 @@ func (fm *FileManager) removeSelectedFile() {
 	}
 
 	fm.loadedFiles = newFiles
+	fm.mu.Unlock()
+
+	if ok {
+		closeStructure(filePath, ws)
+	}
 	fm.fileList.UnselectAll()
 	fm.fileList.Refresh()
 	fm.statusLabel.SetText("Removed selected file")
 }
 
-// clearFileList 清空文件列表
-func (fm *FileManager) clearFileList() {
-	fm.loadedFiles = make([]string, 0)
-	fm.wzStructures = make(map[string]*wzlib.WzStructure)
-	fm.fileList.UnselectAll()
-	fm.fileList.Refresh()
-	fm.statusLabel.SetText("File list cleared")
+// newStructure 创建使用共享缓存的 WzStructure，库的诊断消息写入 slog
+func (fm *FileManager) newStructure(opts ...wzlib.Option) (*wzlib.WzStructure, error) {
+	opts = append(opts, wzlib.WithLogger(wzlib.NewSlogLogger(nil)), wzlib.WithImageCache(fm.imageCache))
+	if fm.indexCache != nil {
+		opts = append(opts, wzlib.WithIndexCache(fm.indexCache))
+	}
+	return wzlib.NewWzStructure(opts...)
 }
 
-// loadDefaultDataFiles 自动加载 ./data 目录下的 WZ 文件
-func (fm *FileManager) loadDefaultDataFiles() {
-	dataDir := "./data"
-
-	// 检查 data 目录是否存在
-	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
-		fm.statusLabel.SetText("data 目录不存在")
-		return
+// openStructure 打开 path：目录作为客户端整体挂载，文件连同旁边的扩展文件
+// （Mob2.wz 等）一起加载，与 data 目录的挂载一致。失败时已打开的文件都会关闭
+func (fm *FileManager) openStructure(ctx context.Context, path string, opts ...wzlib.Option) (*wzlib.WzStructure, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
 	}
-
-	// 读取 data 目录中的文件
-	files, err := os.ReadDir(dataDir)
+	if !fi.IsDir() {
+		opts = append(opts, wzlib.WithExtFiles(true))
+	}
+	ws, err := fm.newStructure(opts...)
 	if err != nil {
-		log.Printf("读取 data 目录失败: %v", err)
-		fm.statusLabel.SetText("读取 data 目录失败")
-		return
+		return nil, err
 	}
+	if fi.IsDir() {
+		err = ws.MountClientContext(ctx, path)
+	} else {
+		err = ws.LoadWzFileContext(ctx, path)
+	}
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return ws, nil
+}
 
-	loadedCount := 0
-	totalWzFiles := 0
-
-	// 统计 .wz 文件数量
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".wz") {
-			totalWzFiles++
+// setWatching 开始或停止监视已加载文件的变化
+func (fm *FileManager) setWatching(on bool) {
+	fm.mu.Lock()
+	watcher := fm.watcher
+	if !on {
+		fm.watcher = nil
+	}
+	fm.mu.Unlock()
+	if !on {
+		// Close 等待正在进行的重新加载返回，不能持有 mu
+		if watcher != nil {
+			watcher.Close()
+			fm.statusLabel.SetText("已停止监视文件变化")
 		}
+		return
 	}
-
-	if totalWzFiles == 0 {
-		fm.statusLabel.SetText("data 目录中没有找到 .wz 文件")
+	if watcher != nil {
 		return
 	}
+	watcher, err := newFileWatcher(fm.reloadChanged)
+	if err != nil {
+		slog.Error("创建文件监视失败", "err", err)
+		fm.statusLabel.SetText("无法监视文件变化")
+		return
+	}
+	fm.mu.Lock()
+	fm.watcher = watcher
+	for _, ws := range fm.wzStructures {
+		watcher.watch(ws)
+	}
+	fm.mu.Unlock()
+	fm.statusLabel.SetText("正在监视文件变化")
+}
 
-	// 加载每个 .wz 文件
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(strings.ToLower(file.Name()), ".wz") {
-			filePath := filepath.Join(dataDir, file.Name())
-
-			log.Printf("正在加载 WZ 文件: %s", filePath)
-			fm.statusLabel.SetText(fmt.Sprintf("正在加载: %s (%d/%d)", file.Name(), loadedCount+1, totalWzFiles))
-
-			// 检查文件是否已经加载
-			alreadyLoaded := false
-			for _, loadedFile := range fm.loadedFiles {
-				if loadedFile == filePath {
-					alreadyLoaded = true
-					break
-				}
-			}
-
-			if alreadyLoaded {
-				continue
-			}
+// watchStructure 在开启监视时把 ws 的文件加入监视
+func (fm *FileManager) watchStructure(ws *wzlib.WzStructure) {
+	fm.mu.Lock()
+	watcher := fm.watcher
+	fm.mu.Unlock()
+	if watcher != nil {
+		watcher.watch(ws)
+	}
+}
 
-			// 加载 WZ 文件
-			wzStructure := &wzlib.WzStructure{}
-			loadErr := wzStructure.LoadWzFile(filePath)
-			if loadErr != nil {
-				log.Printf("加载 WZ 文件失败 %s: %v", filePath, loadErr)
-				continue
-			}
+// reloadChanged 重新加载含有已变化文件的结构，由监视器在后台调用。
+// 文件可能还没写完，加载失败时保留旧结构，等下一次写入事件再试
+func (fm *FileManager) reloadChanged() {
+	fm.mu.Lock()
+	files := append([]string(nil), fm.loadedFiles...)
+	olds := make([]*wzlib.WzStructure, len(files))
+	for i, filePath := range files {
+		olds[i] = fm.wzStructures[filePath]
+	}
+	fm.mu.Unlock()
 
-			// 检查是否成功加载
-			if wzStructure.WzNode == nil {
-				log.Printf("WZ 文件加载成功但没有数据: %s", filePath)
-				continue
+	for i, filePath := range files {
+		old := olds[i]
+		if old == nil {
+			continue
+		}
+		changed := changedFiles(old)
+		if len(changed) == 0 {
+			continue
+		}
+		names := strings.Join(changed, ", ")
+		slog.Info("文件已变化，重新加载", "path", filePath, "files", names)
+		fm.statusLabel.SetText(fmt.Sprintf("%s 已变化，正在重新加载...", names))
+
+		ws, err := fm.openStructure(context.Background(), filePath)
+		if err != nil {
+			slog.Warn("重新加载失败", "path", filePath, "err", err)
+			fm.statusLabel.SetText(fmt.Sprintf("重新加载 %s 失败", filepath.Base(filePath)))
+			continue
+		}
+		// 加载期间文件可能已被移除或清空，这时丢弃新结构
+		fm.mu.Lock()
+		current := fm.wzStructures[filePath] == old
+		if current {
+			fm.wzStructures[filePath] = ws
+		}
+		fm.mu.Unlock()
+		if !current {
+			if err := ws.Close(); err != nil {
+				slog.Warn("关闭 WZ 文件失败", "path", filePath, "err", err)
 			}
-
-			log.Printf("成功加载 WZ 文件: %s，包含 %d 个子节点", filePath, len(wzStructure.WzNode.Nodes))
-
-			// 添加到列表
-			fm.loadedFiles = append(fm.loadedFiles, filePath)
-			fm.wzStructures[filePath] = wzStructure
-			loadedCount++
-
-			// 刷新界面
-			fm.fileList.Refresh()
+			continue
 		}
+		fm.watchStructure(ws)
+		if fm.OnWzFileReloaded != nil {
+			fm.OnWzFileReloaded(old, ws, changed)
+		}
+		// 旧结构的文件已与磁盘不符，不保存索引缓存
+		if err := old.Close(); err != nil {
+			slog.Warn("关闭 WZ 文件失败", "path", filePath, "err", err)
+		}
+		fm.statusLabel.SetText(fmt.Sprintf("已重新加载: %s", names))
 	}
+}
 
-	// 更新状态
-	if loadedCount > 0 {
-		fm.statusLabel.SetText(fmt.Sprintf("成功加载 %d 个 WZ 文件", loadedCount))
-
-		// 创建合并的WZ结构
-		fm.createMergedStructure()
+// closeStructure 保存索引缓存后关闭文件，已浏览的 img 下次打开时无需重新解析
+func closeStructure(filePath string, ws *wzlib.WzStructure) {
+	if err := ws.SaveIndexCache(); err != nil {
+		slog.Warn("保存索引缓存失败", "path", filePath, "err", err)
+	}
+	if err := ws.Close(); err != nil {
+		slog.Warn("关闭 WZ 文件失败", "path", filePath, "err", err)
+	}
+}
 
-		// 自动选择第一个文件
-		if len(fm.loadedFiles) > 0 {
-			fm.fileList.Select(0)
-		}
-	} else {
-		fm.statusLabel.SetText("没有成功加载任何 WZ 文件")
+// Close 停止监视与后台加载，保存索引缓存并关闭所有已加载的文件
+func (fm *FileManager) Close() {
+	fm.setWatching(false)
+	fm.cancelLoad()
+	fm.loading.Wait()
+	for filePath, ws := range fm.takeAll() {
+		closeStructure(filePath, ws)
 	}
 }
 
-// createMergedStructure 创建合并的WZ结构
-func (fm *FileManager) createMergedStructure() {
-	if len(fm.wzStructures) == 0 {
-		return
+// clearFileList 清空文件列表
+func (fm *FileManager) clearFileList() {
+	for filePath, ws := range fm.takeAll() {
+		closeStructure(filePath, ws)
 	}
+	fm.fileList.UnselectAll()
+	fm.fileList.Refresh()
+	fm.statusLabel.SetText("File list cleared")
+}
 
-	// 创建根节点
-	rootNode := &wzlib.WzNode{
-		Text:  "所有WZ文件",
-		Type:  "Directory",
-		Nodes: make([]*wzlib.WzNode, 0),
+// loadDefaultDataFiles 把 ./data 目录作为客户端整体挂载到一棵树下
+func (fm *FileManager) loadDefaultDataFiles(ctx context.Context) {
+	dataDir := "./data"
+
+	// 检查 data 目录是否存在
+	if _, err := os.Stat(dataDir); os.IsNotExist(err) {
+		fm.statusLabel.SetText("data 目录不存在")
+		return
 	}
 
-	// 将所有WZ文件的根节点添加到合并结构中
-	for filePath, wzStructure := range fm.wzStructures {
-		if wzStructure.WzNode != nil {
-			// 创建文件节点
-			fileName := filepath.Base(filePath)
-			fileNode := &wzlib.WzNode{
-				Text:       fileName,
-				Type:       "WzFile",
-				Nodes:      wzStructure.WzNode.Nodes,
-				ParentNode: rootNode,
+	// 定时显示已读取的目录项与字节数，文件较大时标签不会长时间不动
+	var progress wzlib.ProgressCounter
+	fm.statusLabel.SetText("正在加载 data 目录...")
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopProgress:
+				return
+			case <-ticker.C:
+				fm.statusLabel.SetText(fmt.Sprintf("正在加载 data 目录，已读取 %d 项 / %.1f MB", progress.Entries(), float64(progress.Bytes())/(1<<20)))
 			}
+		}
+	}()
 
-			// 更新子节点的父节点引用
-			for _, child := range fileNode.Nodes {
-				child.ParentNode = fileNode
-			}
+	wzStructure, loadErr := fm.openStructure(ctx, dataDir, wzlib.WithProgress(&progress))
 
-			rootNode.Nodes = append(rootNode.Nodes, fileNode)
-		}
-	}
+	// 先停止定时刷新，避免覆盖下面的最终状态
+	close(stopProgress)
+	<-progressDone
 
-	// 创建合并的WZ结构
-	fm.mergedStructure = &wzlib.WzStructure{
-		WzNode: rootNode,
+	switch {
+	case errors.Is(loadErr, context.Canceled):
+		slog.Info("已取消加载 data 目录")
+		fm.statusLabel.SetText("已取消加载")
+		return
+	case errors.Is(loadErr, wzlib.ErrUnknownLayout):
+		fm.statusLabel.SetText("data 目录中没有找到 .wz 文件")
+		return
+	case loadErr != nil:
+		slog.Error("加载 data 目录失败", "err", loadErr)
+		fm.statusLabel.SetText("加载 data 目录失败")
+		return
 	}
 
-	// 通知界面更新
-	if fm.OnWzFileLoaded != nil {
-		fm.OnWzFileLoaded(fm.mergedStructure)
-	}
+	slog.Info("成功加载 data 目录", "files", len(wzStructure.WzFiles), "categories", len(wzStructure.WzNode.Nodes))
+	id := fm.addFile(dataDir, wzStructure)
+	fm.watchStructure(wzStructure)
+	fm.fileList.Refresh()
+	fm.statusLabel.SetText(fmt.Sprintf("成功加载 %d 个 WZ 文件", len(wzStructure.WzFiles)))
+
+	// 自动选择 data 目录
+	fm.fileList.Select(id)
 }
 
 // GetContent 获取文件管理器内容
@@ -0,0 +1,138 @@
+package ui
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/luoxk/wzlib"
+)
+
+// watchDelay 是最后一次文件事件之后等待的时间，打包工具一次重建会产生大量写事件
+const watchDelay = 500 * time.Millisecond
+
+// fileWatcher 监视已加载文件所在的目录。打包工具常先写临时文件再改名替换，
+// 所以监视目录而不是文件本身；一批事件合并后调用一次 onChange
+type fileWatcher struct {
+	watcher  *fsnotify.Watcher
+	onChange func()
+
+	mu   sync.Mutex // 保护 dirs
+	dirs map[string]bool
+	done chan struct{}
+}
+
+func newFileWatcher(onChange func()) (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWatcher{
+		watcher:  w,
+		onChange: onChange,
+		dirs:     make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+	go fw.run()
+	return fw, nil
+}
+
+// watch 开始监视 ws 打开的所有文件所在的目录
+func (fw *fileWatcher) watch(ws *wzlib.WzStructure) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for _, wf := range structureFiles(ws) {
+		dir, err := filepath.Abs(filepath.Dir(wf.FileName))
+		if err != nil || fw.dirs[dir] {
+			continue
+		}
+		if err := fw.watcher.Add(dir); err != nil {
+			slog.Warn("监视目录失败", "dir", dir, "err", err)
+			continue
+		}
+		fw.dirs[dir] = true
+	}
+}
+
+func (fw *fileWatcher) run() {
+	defer close(fw.done)
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			if !isWzEvent(ev) {
+				continue
+			}
+			if timer == nil {
+				timer = time.NewTimer(watchDelay)
+			} else {
+				timer.Reset(watchDelay)
+			}
+			fire = timer.C
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Warn("文件监视出错", "err", err)
+		case <-fire:
+			fire = nil
+			fw.onChange()
+		}
+	}
+}
+
+// Close 停止监视，等待正在进行的 onChange 返回
+func (fw *fileWatcher) Close() error {
+	err := fw.watcher.Close()
+	<-fw.done
+	return err
+}
+
+// isWzEvent 只关心 .wz 与 .ini 文件的内容变化、创建、改名和删除
+func isWzEvent(ev fsnotify.Event) bool {
+	if !ev.Has(fsnotify.Write) && !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Rename) && !ev.Has(fsnotify.Remove) {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(ev.Name))
+	return ext == ".wz" || ext == ".ini"
+}
+
+// structureFiles 列出 ws 打开的所有文件，包括合并进主文件的扩展文件。
+// LoadWzFolder 加载的扩展文件同时在 WzFiles 中，只列一次
+func structureFiles(ws *wzlib.WzStructure) []*wzlib.WzFile {
+	var files []*wzlib.WzFile
+	seen := make(map[*wzlib.WzFile]bool)
+	var add func(wf *wzlib.WzFile)
+	add = func(wf *wzlib.WzFile) {
+		if seen[wf] {
+			return
+		}
+		seen[wf] = true
+		files = append(files, wf)
+		for _, merged := range wf.MergedWzFiles {
+			add(merged)
+		}
+	}
+	for _, wf := range ws.WzFiles {
+		add(wf)
+	}
+	return files
+}
+
+// changedFiles 返回 ws 中打开后在磁盘上被改写、替换或删除的文件名
+func changedFiles(ws *wzlib.WzStructure) []string {
+	var names []string
+	for _, wf := range structureFiles(ws) {
+		if wf.Changed() {
+			names = append(names, filepath.Base(wf.FileName))
+		}
+	}
+	return names
+}
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"strings"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
@@ -35,6 +36,8 @@ func NewMainWindow(window fyne.Window) *MainWindow {
 	mw.soundPlayer = NewSoundPlayer()
 	mw.dataExporter = NewDataExporter()
 	mw.contentViewer = NewContentViewer()
+	// 退出时保存索引缓存并关闭已加载的文件
+	window.SetOnClosed(mw.fileManager.Close)
 
 	// 创建现代风格状态栏
 	mw.statusBar = widget.NewLabel("🚀 WZ文件管理器已启动 - 准备就绪")
@@ -59,6 +62,15 @@ func (mw *MainWindow) setupConnections() {
 		}
 	}
 
+	// 监视到文件变化并重新加载后，正在显示的结构换成新的，展开与选中的路径保持不变
+	mw.fileManager.OnWzFileReloaded = func(old, ws *wzlib.WzStructure, changed []string) {
+		if mw.treeViewer.wzStructure == old {
+			mw.treeViewer.ReloadWzStructure(ws)
+			mw.dataExporter.SetWzStructure(ws)
+		}
+		mw.UpdateStatusBar(fmt.Sprintf("🔄 已重新加载: %s", strings.Join(changed, ", ")))
+	}
+
 	// 设置树视图的文件加载回调和文件管理器引用
 	mw.treeViewer.OnWzFileLoaded = mw.fileManager.OnWzFileLoaded
 	mw.treeViewer.fileManager = mw.fileManager
@@ -2,6 +2,8 @@ package ui
 
 import (
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 
 	"fyne.io/fyne/v2"
@@ -26,6 +28,8 @@ type TreeViewer struct {
 	// 文件管理功能
 	fileManager *FileManager
 
+	selected widget.TreeNodeID // 当前选中的节点，重新加载后按路径恢复
+
 	// 性能优化缓存
 	nodeCache   map[string]*wzlib.WzNode
 	childCache  map[string][]widget.TreeNodeID
@@ -128,6 +132,7 @@ func (tv *TreeViewer) LoadWzStructure(wzStructure interface{}) {
 
 		// 清除所有选择和展开状态
 		tv.tree.UnselectAll()
+		tv.selected = ""
 		// 刷新树视图
 		tv.tree.Refresh()
 
@@ -142,6 +147,39 @@ func (tv *TreeViewer) LoadWzStructure(wzStructure interface{}) {
 	}
 }
 
+// ReloadWzStructure 换成文件变化后重新加载的结构。节点按路径查找，
+// 新结构中仍然存在的分支保持展开，选中的节点重新选中以刷新查看器
+func (tv *TreeViewer) ReloadWzStructure(ws *wzlib.WzStructure) {
+	// 只有展开过的分支才会有子节点缓存
+	var open []widget.TreeNodeID
+	for uid := range tv.childCache {
+		if uid != "" && tv.tree.IsBranchOpen(uid) {
+			open = append(open, uid)
+		}
+	}
+	// 父节点的路径更短，先展开
+	sort.Slice(open, func(i, j int) bool { return len(open[i]) < len(open[j]) })
+
+	tv.wzStructure = ws
+	tv.clearCache()
+	for _, uid := range open {
+		if tv.findNodeByPath(uid) != nil && tv.isBranch(uid) {
+			tv.tree.OpenBranch(uid)
+		} else {
+			tv.tree.CloseBranch(uid)
+		}
+	}
+	tv.tree.Refresh()
+
+	if tv.selected != "" && tv.findNodeByPath(tv.selected) != nil {
+		// 树仍认为该节点已选中，Select 不会触发回调，直接通知查看器
+		tv.onNodeSelected(tv.selected)
+	} else {
+		tv.tree.UnselectAll()
+		tv.selected = ""
+	}
+}
+
 // childUIDs 获取子节点ID列表
 func (tv *TreeViewer) childUIDs(uid widget.TreeNodeID) []widget.TreeNodeID {
 	if tv.wzStructure == nil {
@@ -158,10 +196,7 @@ func (tv *TreeViewer) childUIDs(uid widget.TreeNodeID) []widget.TreeNodeID {
 	if uid == "" {
 		// 根节点 - 返回WZ文件的直接子节点
 		if tv.wzStructure.WzNode != nil {
-			for _, child := range tv.wzStructure.WzNode.Nodes {
-				childPath := tv.getNodePath(child)
-				childIDs = append(childIDs, childPath)
-			}
+			childIDs = tv.addChildUIDs(childIDs, tv.wzStructure.WzNode.Text, tv.wzStructure.WzNode.Nodes)
 		}
 	} else {
 		// 查找节点
@@ -177,11 +212,11 @@ func (tv *TreeViewer) childUIDs(uid widget.TreeNodeID) []widget.TreeNodeID {
 			img.TryExtract()
 		}
 
-		// 返回子节点ID
-		for _, child := range node.Nodes {
-			childPath := tv.getNodePath(child)
-			childIDs = append(childIDs, childPath)
+		// 返回子节点ID，目录在首次展开时才读取
+		if err := node.LoadChildren(); err != nil {
+			slog.Warn("读取目录失败", "path", node.GetFullPath(), "err", err)
 		}
+		childIDs = tv.addChildUIDs(childIDs, string(uid), node.Nodes)
 	}
 
 	// 缓存结果
@@ -189,6 +224,17 @@ func (tv *TreeViewer) childUIDs(uid widget.TreeNodeID) []widget.TreeNodeID {
 	return childIDs
 }
 
+// addChildUIDs 由父路径拼出子节点路径并预先填入节点缓存，
+// 避免对每个子节点调用 GetFullPath 和从根查找
+func (tv *TreeViewer) addChildUIDs(ids []widget.TreeNodeID, parentPath string, children []*wzlib.WzNode) []widget.TreeNodeID {
+	for _, child := range children {
+		childPath := parentPath + "/" + child.Text
+		tv.nodeCache[childPath] = child
+		ids = append(ids, childPath)
+	}
+	return ids
+}
+
 // clearCache 清除所有缓存
 func (tv *TreeViewer) clearCache() {
 	tv.nodeCache = make(map[string]*wzlib.WzNode)
@@ -217,7 +263,7 @@ func (tv *TreeViewer) isBranch(uid widget.TreeNodeID) bool {
 		if node == nil {
 			result = false
 		} else {
-			result = len(node.Nodes) > 0
+			result = node.HasChildren()
 		}
 	}
 
@@ -269,6 +315,7 @@ func (tv *TreeViewer) onNodeSelected(uid widget.TreeNodeID) {
 		return
 	}
 
+	tv.selected = uid
 	node := tv.findNodeByPath(uid)
 	if node == nil {
 		return
@@ -364,14 +411,30 @@ func (tv *TreeViewer) expandNodeRecursiveWithDepth(uid widget.TreeNodeID, curren
 		return
 	}
 
-	tv.tree.OpenBranch(uid)
+	root := tv.wzStructure.WzNode
+	if uid != "" {
+		root = tv.findNodeByPath(uid)
+	}
+	if root == nil {
+		return
+	}
 
-	childIDs := tv.childUIDs(uid)
-	for _, childID := range childIDs {
-		if tv.isBranch(childID) {
-			tv.expandNodeRecursiveWithDepth(childID, currentDepth+1, maxDepth)
+	// 只遍历到要展开的最深一层，子节点的 UID 由父节点的 UID 拼接
+	uids := map[*wzlib.WzNode]widget.TreeNodeID{root: uid}
+	root.Walk(wzlib.WalkOptions{MaxDepth: maxDepth - currentDepth - 1}, func(node *wzlib.WzNode, depth int) error {
+		if depth > 0 {
+			parentUID := uids[node.ParentNode]
+			if parentUID == "" {
+				parentUID = tv.wzStructure.WzNode.Text
+			}
+			uids[node] = parentUID + "/" + node.Text
 		}
-	}
+		if depth > 0 && !tv.isBranch(uids[node]) {
+			return wzlib.SkipSubtree
+		}
+		tv.tree.OpenBranch(uids[node])
+		return nil
+	})
 }
 
 // collapseNodeRecursive 递归折叠节点